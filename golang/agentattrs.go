@@ -0,0 +1,601 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/antchfx/xmlquery"
+)
+
+// Agents carry typed attributes in AgentAttributes of agents.db, one row per attribute, so that
+// they can be searched (attr= of /aac/agents/search) and shown structurally. A branch may declare
+// a schema for the attributes of its agents in universe.xml:
+//
+//	<agentattrs strict="no">
+//	    <attr name="serial" type="string" required="yes"/>
+//	</agentattrs>
+//
+// The schema of a branch is that of its ancestors with its own declarations over them; the nearest
+// agentattrs decides strict, which refuses attributes not declared. The free-form extra XML of
+// the agents is turned into attributes by /aac/agents/attributes/migrate.
+
+var agentAttrTypes = []string{"string", "int", "float", "bool"}
+
+var agentAttrNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+func checkAgentAttrDecl(name, typ string) error {
+	if !agentAttrNameRe.MatchString(name) {
+		return fmt.Errorf("attribute name %q is not valid", name)
+	}
+	if !hasKey(mapSet(agentAttrTypes...), typ) {
+		return fmt.Errorf("attribute %v has unknown type %q, expected one of %v", name, typ, agentAttrTypes)
+	}
+	return nil
+}
+
+// canonicalAttrValue gives the text form of the value as the type stores it; the value is a string
+// or what encoding/json decodes with UseNumber.
+func canonicalAttrValue(typ string, value interface{}) (string, error) {
+	text := ""
+	switch v := value.(type) {
+	case string:
+		text = strings.TrimSpace(v)
+		if typ == "string" {
+			return v, nil
+		}
+	case json.Number:
+		text = v.String()
+	case bool:
+		text = strconv.FormatBool(v)
+	default:
+		return "", fmt.Errorf("value %v is neither a string, a number nor a boolean", value)
+	}
+	switch typ {
+	case "string":
+		return text, nil
+	case "int":
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("value %q is not an int", text)
+		}
+		return strconv.FormatInt(n, 10), nil
+	case "float":
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return "", fmt.Errorf("value %q is not a float", text)
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), nil
+	case "bool":
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return "", fmt.Errorf("value %q is not a bool", text)
+		}
+		return strconv.FormatBool(b), nil
+	}
+	return "", fmt.Errorf("unknown type %q", typ)
+}
+
+// checkAgentAttr validates a stored attribute, which must already be in its canonical form.
+func checkAgentAttr(name, typ, value string) error {
+	if err := checkAgentAttrDecl(name, typ); err != nil {
+		return err
+	}
+	canon, err := canonicalAttrValue(typ, value)
+	if err != nil {
+		return fmt.Errorf("attribute %v: %v", name, err)
+	}
+	if canon != value {
+		return fmt.Errorf("attribute %v: value %q is not in the canonical form %q", name, value, canon)
+	}
+	return nil
+}
+
+// jsonAttrType is the type an undeclared attribute gets from its JSON value.
+func jsonAttrType(value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		return "bool"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "int"
+		}
+		return "float"
+	}
+	return "string"
+}
+
+var inferIntRe = regexp.MustCompile(`^-?(0|[1-9][0-9]*)$`)
+var inferFloatRe = regexp.MustCompile(`^-?(0|[1-9][0-9]*)\.[0-9]+$`)
+
+// inferAttrType is the type of a text migrated from extra XML; texts that would not keep their form
+// as a number, like "007", stay strings.
+func inferAttrType(text string) string {
+	switch {
+	case text == "true" || text == "false":
+		return "bool"
+	case inferIntRe.MatchString(text):
+		if _, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return "int"
+		}
+	case inferFloatRe.MatchString(text):
+		if canon, err := canonicalAttrValue("float", text); err == nil && canon == text {
+			return "float"
+		}
+	}
+	return "string"
+}
+
+func typedAttrValue(a agentAttr) interface{} {
+	switch a.typ {
+	case "int":
+		if n, err := strconv.ParseInt(a.value, 10, 64); err == nil {
+			return n
+		}
+	case "float":
+		if f, err := strconv.ParseFloat(a.value, 64); err == nil {
+			return f
+		}
+	case "bool":
+		return a.value == "true"
+	}
+	return a.value
+}
+
+func typedAttrMap(attrs []agentAttr) map[string]interface{} {
+	ret := map[string]interface{}{}
+	for _, a := range attrs {
+		ret[a.name] = typedAttrValue(a)
+	}
+	return ret
+}
+
+type agentAttrSchema struct {
+	strict bool
+	decls  map[string]jsonAgentAttrDecl
+	names  []string // in the order of declaration
+}
+
+// agentSchemaOf gives the schema in force for the agents of the branch: the schemas from the
+// root down, a lower one adding declarations and overriding those of the same name.
+func (dk *configDataKeeper) agentSchemaOf(branchID string) agentAttrSchema {
+	view := dk.data()
+	chain := view.lineage(branchID)
+	sch := agentAttrSchema{decls: map[string]jsonAgentAttrDecl{}}
+	for i := len(chain) - 1; i >= 0; i-- {
+		own := view.schemaOf[chain[i]]
+		if own == nil {
+			continue
+		}
+		sch.strict = own.Strict
+		for _, d := range own.Attrs {
+			if _, ok := sch.decls[d.Name]; !ok {
+				sch.names = append(sch.names, d.Name)
+			}
+			sch.decls[d.Name] = d
+		}
+	}
+	return sch
+}
+
+func (sch agentAttrSchema) dict() map[string]interface{} {
+	decls := make([]interface{}, 0, len(sch.names))
+	for _, n := range sch.names {
+		d := sch.decls[n]
+		decls = append(decls, map[string]interface{}{"name": d.Name, "type": d.Type, "required": d.Required})
+	}
+	return map[string]interface{}{"strict": sch.strict, "attributes": decls}
+}
+
+// problems lists how the attributes break the schema.
+func (sch agentAttrSchema) problems(attrs []agentAttr) []string {
+	ret := sch.violations(attrs)
+	have := map[string]struct{}{}
+	for _, a := range attrs {
+		have[a.name] = struct{}{}
+	}
+	for _, n := range sch.names {
+		if sch.decls[n].Required && !hasKey(have, n) {
+			ret = append(ret, fmt.Sprintf("required attribute %v is missing", n))
+		}
+	}
+	return ret
+}
+
+// violations lists the attributes of a wrong type or not declared by a strict schema, which an agent
+// cannot have in the branch; a missing required attribute is only a problem, as it can be set later.
+func (sch agentAttrSchema) violations(attrs []agentAttr) []string {
+	ret := []string{}
+	for _, a := range attrs {
+		d, declared := sch.decls[a.name]
+		switch {
+		case declared && d.Type != a.typ:
+			ret = append(ret, fmt.Sprintf("attribute %v is %v, the schema declares %v", a.name, a.typ, d.Type))
+		case !declared && sch.strict:
+			ret = append(ret, fmt.Sprintf("attribute %v is not declared by the strict schema", a.name))
+		}
+	}
+	return ret
+}
+
+// attrOfSchema makes the attribute of a value given for it, typed as the schema declares or as the value is.
+func (sch agentAttrSchema) attrOfSchema(name string, value interface{}) (agentAttr, error) {
+	typ := jsonAttrType(value)
+	if d, ok := sch.decls[name]; ok {
+		typ = d.Type
+	} else if sch.strict {
+		return agentAttr{}, fmt.Errorf("attribute %v is not declared by the strict schema", name)
+	}
+	if err := checkAgentAttrDecl(name, typ); err != nil {
+		return agentAttr{}, err
+	}
+	canon, err := canonicalAttrValue(typ, value)
+	if err != nil {
+		return agentAttr{}, fmt.Errorf("attribute %v: %v", name, err)
+	}
+	return agentAttr{name: name, typ: typ, value: canon}, nil
+}
+
+// agentBranch gives the branch of the agent, which must still exist.
+func (dk *configDataKeeper) agentBranch(agentID string) (string, *internError) {
+	current := dk.agentsKeeper.getAgentDict(agentID, false)
+	if current == nil {
+		return "", newInternError("AGENT-UNKNOWN", fmt.Sprintf("Agent %v is never registered", agentID), map[string]interface{}{"bad_value": agentID})
+	}
+	branch := fmt.Sprintf("%v", current["branch"])
+	if dk.data().branch(branch) == nil {
+		return "", newInternError("DATABASE-ERROR", fmt.Sprintf("Branch %v referenced from agent %v does not longer exist", branch, agentID), nil)
+	}
+	return branch, nil
+}
+
+// setAgentAttributes sets the attributes of the JSON object attrsJSON (null removes one) and removes
+// the comma separated names of remove, as the schema of the agent's branch allows.
+func (dk *configDataKeeper) setAgentAttributes(agentID, attrsJSON, remove string) map[string]interface{} {
+	if agentID == "" {
+		return newInternError("WRONG-FORMAT", "Required argument not given: agent", nil).dict4api
+	}
+	br, ex := dk.agentBranch(agentID)
+	if ex != nil {
+		return ex.dict4api
+	}
+	given := map[string]interface{}{}
+	if strings.TrimSpace(attrsJSON) != "" {
+		dec := json.NewDecoder(strings.NewReader(attrsJSON))
+		dec.UseNumber()
+		if err := dec.Decode(&given); err != nil {
+			return newInternError("WRONG-FORMAT", fmt.Sprintf("attributes is not a JSON object: %v", err), nil).dict4api
+		}
+	}
+
+	sch := dk.agentSchemaOf(br)
+	patch := agentPatch{removeAttrs: splitTags(remove)}
+	names := make([]string, 0, len(given))
+	for name := range given {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if given[name] == nil {
+			patch.removeAttrs = append(patch.removeAttrs, name)
+			continue
+		}
+		a, err := sch.attrOfSchema(name, given[name])
+		if err != nil {
+			return newInternError("WRONG-FORMAT", err.Error(), map[string]interface{}{"bad_value": name}).dict4api
+		}
+		patch.attrs = append(patch.attrs, a)
+	}
+	for _, name := range patch.removeAttrs {
+		if sch.decls[name].Required {
+			return newInternError("NOT-ALLOWED", fmt.Sprintf("Attribute %v is required by the schema of the branch", name), map[string]interface{}{"bad_value": name}).dict4api
+		}
+	}
+
+	changes, err := dk.agentsKeeper.updateAgent(agentID, patch)
+	if err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Attributes of agent %v not set: %v", agentID, err), nil).dict4api
+	}
+	attrs := dk.agentsKeeper.attributes([]string{agentID})[agentID]
+	return map[string]interface{}{"result": true, "agent": agentID, "changes": agentChangesDict(changes), "attributes": typedAttrMap(attrs), "schema_problems": sch.problems(attrs)}
+}
+
+// agentSchemaViolations lists the agents of the branch and its subtree whose attributes break the schema in force for them.
+func (dk *configDataKeeper) agentSchemaViolations(branchID string) []interface{} {
+	ret := []interface{}{}
+	rows := dk.agentsKeeper.getAgentsByBranches(dk.data().subtree(branchID))
+	sort.Slice(rows, func(i, j int) bool { return rows[i][0] < rows[j][0] })
+	ids := make([]string, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row[0])
+	}
+	attrs := dk.agentsKeeper.attributes(ids)
+	for _, row := range rows {
+		if problems := dk.agentSchemaOf(row[1]).problems(attrs[row[0]]); len(problems) > 0 {
+			ret = append(ret, map[string]interface{}{"agent": row[0], "branch": row[1], "problems": problems})
+		}
+	}
+	return ret
+}
+
+func (dk *configDataKeeper) getBranchAgentSchema(branchID string) map[string]interface{} {
+	view := dk.data()
+	if view.branch(branchID) == nil {
+		return newInternError("BRANCH-UNKNOWN", fmt.Sprintf("Branch %v is unknown", branchID), map[string]interface{}{"bad_value": branchID}).dict4api
+	}
+	own := agentAttrSchema{decls: map[string]jsonAgentAttrDecl{}}
+	if sch := view.schemaOf[branchID]; sch != nil {
+		own.strict = sch.Strict
+		for _, d := range sch.Attrs {
+			own.decls[d.Name], own.names = d, append(own.names, d.Name)
+		}
+	}
+	return map[string]interface{}{"result": true, "branch": branchID, "own": own.dict(), "effective": dk.agentSchemaOf(branchID).dict()}
+}
+
+// setBranchAgentSchema replaces the declarations of the branch with those of the JSON list
+// schemaJSON; an empty list removes the schema of the branch. Agents breaking the new schema are
+// reported, not refused: their attributes are checked when they are set.
+func (dk *configDataKeeper) setBranchAgentSchema(branchID, schemaJSON string, strict bool) map[string]interface{} {
+	view := dk.data()
+	if view.branch(branchID) == nil {
+		return newInternError("BRANCH-UNKNOWN", fmt.Sprintf("Branch %v is unknown", branchID), map[string]interface{}{"bad_value": branchID}).dict4api
+	}
+	decls := []jsonAgentAttrDecl{}
+	if strings.TrimSpace(schemaJSON) != "" {
+		if err := json.Unmarshal([]byte(schemaJSON), &decls); err != nil {
+			return newInternError("WRONG-FORMAT", fmt.Sprintf("schema is not a JSON list of declarations: %v", err), nil).dict4api
+		}
+	}
+	names := map[string]struct{}{}
+	for _, d := range decls {
+		if err := checkAgentAttrDecl(d.Name, d.Type); err != nil {
+			return newInternError("WRONG-FORMAT", err.Error(), map[string]interface{}{"bad_value": d.Name}).dict4api
+		}
+		if hasKey(names, d.Name) {
+			return newInternError("WRONG-FORMAT", fmt.Sprintf("Attribute %v is declared twice", d.Name), map[string]interface{}{"bad_value": d.Name}).dict4api
+		}
+		names[d.Name] = struct{}{}
+	}
+
+	var err error
+	if len(decls) == 0 && !strict {
+		if view.schemaOf[branchID] != nil {
+			err = dk.store.deleteAgentSchema(branchID)
+		}
+	} else {
+		err = dk.store.putAgentSchema(agentSchemaRecord{Branch: branchID, Strict: strict, Attrs: decls})
+	}
+	if ex := dk._stored(err, false); ex != nil {
+		return ex.dict4api
+	}
+	logDataKeeper.Info("agent attribute schema set", "branch", branchID, "attributes", len(decls), "strict", strict)
+
+	ret := dk.getBranchAgentSchema(branchID)
+	ret["violations"] = dk.agentSchemaViolations(branchID)
+	return ret
+}
+
+// flattenExtraXML turns the extra XML of an agent into attributes: a leaf element gives the
+// attribute named by its path (a.b for <a><b>), an XML attribute that of the path and its name.
+func flattenExtraXML(extra string) ([]agentAttr, error) {
+	doc, err := xmlquery.Parse(strings.NewReader("<extra>" + extra + "</extra>"))
+	if err != nil {
+		return nil, fmt.Errorf("extra is not XML: %v", err)
+	}
+	root := queryOne(doc, "/extra")
+	if root == nil {
+		return nil, fmt.Errorf("extra is not XML")
+	}
+	out := []agentAttr{}
+	seen := map[string]struct{}{}
+	add := func(name, text string) error {
+		if !agentAttrNameRe.MatchString(name) {
+			return fmt.Errorf("%q cannot be an attribute name", name)
+		}
+		if hasKey(seen, name) {
+			return fmt.Errorf("%v is repeated", name)
+		}
+		seen[name] = struct{}{}
+		typ := inferAttrType(text)
+		if typ != "string" {
+			text = strings.TrimSpace(text)
+		}
+		out = append(out, agentAttr{name: name, typ: typ, value: text})
+		return nil
+	}
+	var walk func(n *xmlquery.Node, path string) error
+	walk = func(n *xmlquery.Node, path string) error {
+		for _, a := range n.Attr {
+			if err := add(strings.TrimPrefix(path+"."+a.Name.Local, "."), a.Value); err != nil {
+				return err
+			}
+		}
+		hasElements, text := false, ""
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch c.Type {
+			case xmlquery.ElementNode:
+				hasElements = true
+				if err := walk(c, strings.TrimPrefix(path+"."+c.Data, ".")); err != nil {
+					return err
+				}
+			case xmlquery.TextNode, xmlquery.CharDataNode:
+				text += c.Data
+			}
+		}
+		switch {
+		case path == "" && strings.TrimSpace(text) != "":
+			return fmt.Errorf("extra holds text outside of elements")
+		case hasElements && strings.TrimSpace(text) != "":
+			return fmt.Errorf("%v mixes text and elements", path)
+		case !hasElements && path != "" && (len(n.Attr) == 0 || strings.TrimSpace(text) != ""):
+			return add(path, strings.TrimSpace(text))
+		}
+		return nil
+	}
+	if err := walk(root, ""); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// migrateAgentExtra moves the extra XML of the agent, or of every agent when agentID is empty,
+// into attributes and clears it. An agent is skipped when its extra does not flatten, an attribute
+// would change one it has, or the schema of its branch refuses the result.
+func (dk *configDataKeeper) migrateAgentExtra(agentID string, dryRun bool) map[string]interface{} {
+	ids := []string{agentID}
+	if agentID == "" {
+		ids = dk.agentsKeeper.getAllAgentIds()
+	}
+	current := dk.agentsKeeper.attributes(ids)
+	migrated, skipped := []interface{}{}, []interface{}{}
+	for _, id := range ids {
+		ag := dk.agentsKeeper.getAgentDict(id, false)
+		if ag == nil {
+			return newInternError("AGENT-UNKNOWN", fmt.Sprintf("Agent %v is never registered", id), map[string]interface{}{"bad_value": id}).dict4api
+		}
+		extra, _ := ag["extra"].(string)
+		if strings.TrimSpace(extra) == "" {
+			continue
+		}
+		skip := func(reason string) {
+			skipped = append(skipped, map[string]interface{}{"agent": id, "reason": reason})
+		}
+		attrs, err := flattenExtraXML(extra)
+		if err != nil {
+			skip(err.Error())
+			continue
+		}
+		br := fmt.Sprintf("%v", ag["branch"])
+		if dk.data().branch(br) == nil {
+			skip(fmt.Sprintf("branch %v does not longer exist", ag["branch"]))
+			continue
+		}
+		sch := dk.agentSchemaOf(br)
+		have := map[string]agentAttr{}
+		for _, a := range current[id] {
+			have[a.name] = a
+		}
+		problem := ""
+		for i, a := range attrs {
+			if d, ok := sch.decls[a.name]; ok && d.Type != a.typ {
+				canon, err := canonicalAttrValue(d.Type, a.value)
+				if err != nil {
+					problem = fmt.Sprintf("attribute %v: %v", a.name, err)
+					break
+				}
+				attrs[i] = agentAttr{name: a.name, typ: d.Type, value: canon}
+			}
+			if old, ok := have[a.name]; ok && old != attrs[i] {
+				problem = fmt.Sprintf("attribute %v is already %q", a.name, old.value)
+				break
+			}
+			have[a.name] = attrs[i]
+		}
+		if problem == "" {
+			all := make([]agentAttr, 0, len(have))
+			for _, a := range have {
+				all = append(all, a)
+			}
+			for _, p := range sch.problems(all) {
+				if !strings.HasPrefix(p, "required") {
+					problem = p
+					break
+				}
+			}
+		}
+		if problem != "" {
+			skip(problem)
+			continue
+		}
+		if !dryRun {
+			empty := ""
+			if _, err := dk.agentsKeeper.updateAgent(id, agentPatch{extra: &empty, attrs: attrs}); err != nil {
+				return newInternError("DATABASE-ERROR", fmt.Sprintf("Extra of agent %v not migrated: %v", id, err), map[string]interface{}{"migrated": migrated}).dict4api
+			}
+		}
+		migrated = append(migrated, map[string]interface{}{"agent": id, "attributes": typedAttrMap(attrs)})
+	}
+	if !dryRun && len(migrated) > 0 {
+		logDataKeeper.Info("agent extra migrated to attributes", "agents", len(migrated), "skipped", len(skipped))
+	}
+	ret := map[string]interface{}{"result": true, "migrated": migrated, "skipped": skipped}
+	if dryRun {
+		ret["dry_run"] = true
+	}
+	return ret
+}
+
+func handleAgentAttributesSet(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	if r.Method == http.MethodGet {
+		writeJSON(w, map[string]interface{}{
+			"result":     true,
+			"formMethod": "post",
+			"agentsList": storage.getAgents(),
+			"extratxtinputs": [][3]string{
+				{"attributes", "Attributes as a JSON object, null removes one", ""},
+				{"remove", "Attributes to remove (comma separated)", ""},
+			},
+		})
+		return
+	}
+	writeJSON(w, storage.setAgentAttributes(strings.TrimSpace(r.FormValue("agent")), r.FormValue("attributes"), r.FormValue("remove")))
+}
+
+func handleBranchAgentSchemaGet(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet) {
+		return
+	}
+	parseRequestForm(r)
+	branch := strings.TrimSpace(r.FormValue("branch"))
+	if branch == "" {
+		writeJSON(w, map[string]interface{}{"result": true, "branchList": storageBranches()})
+		return
+	}
+	writeJSON(w, storage.getBranchAgentSchema(branch))
+}
+
+func handleBranchAgentSchemaSet(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	if r.Method == http.MethodGet {
+		writeJSON(w, map[string]interface{}{
+			"result":     true,
+			"formMethod": "post",
+			"branchList": storageBranches(),
+			"extratxtinputs": [][3]string{
+				{"schema", `Declarations as JSON, e.g. [{"name":"serial","type":"string","required":true}]`, ""},
+			},
+			"cboxes": [][2]string{{"strict", "Refuse undeclared attributes"}},
+		})
+		return
+	}
+	writeJSON(w, storage.setBranchAgentSchema(strings.TrimSpace(r.FormValue("branch")), r.FormValue("schema"), boolFromParam(r.FormValue("strict"), false)))
+}
+
+func handleAgentsAttributesMigrate(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	if r.Method == http.MethodGet {
+		writeJSON(w, map[string]interface{}{
+			"result":     true,
+			"formMethod": "post",
+			"agentsList": storage.getAgents(),
+			"cboxes":     [][2]string{{"dry_run", "Only report, do not migrate"}},
+		})
+		return
+	}
+	writeJSON(w, storage.migrateAgentExtra(strings.TrimSpace(r.FormValue("agent")), boolFromParam(r.FormValue("dry_run"), false)))
+}
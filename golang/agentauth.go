@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Agents prove their identity with a credential kept in agents.db: a shared secret, stored as a
+// salted hash, or a registered public key (Ed25519, ECDSA or RSA in PEM). With a key the agent
+// asks /aac/agent/challenge for a nonce and signs "aac-agent:<agent id>:<nonce>". A successful
+// /aac/agent/authenticate gives a short-lived token that services check with /aac/agent/token/verify;
+// only its hash is stored. Setting a new credential rotates: the old ones are dropped at once,
+// or stay valid for a grace period so that agents can be switched over one by one.
+
+var agentCredentialKinds = []string{"secret", "pubkey"}
+
+const (
+	defaultAgentTokenTTL = 15 // minutes
+	agentChallengeTTL    = 60 // seconds
+	agentTokenPrefix     = "agt_"
+)
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("no randomness available: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+func hashAgentSecret(salt, secret string) string {
+	sum := sha256.Sum256([]byte(salt + secret))
+	return "sha256:" + salt + ":" + hex.EncodeToString(sum[:])
+}
+
+func agentSecretMatches(stored, secret string) bool {
+	parts := strings.SplitN(stored, ":", 3)
+	if len(parts) != 3 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashAgentSecret(parts[1], secret)), []byte(stored)) == 1
+}
+
+func hashAgentToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseAgentPublicKey accepts a PEM "PUBLIC KEY" block or a bare base64 Ed25519 key.
+func parseAgentPublicKey(text string) (crypto.PublicKey, []byte, error) {
+	text = strings.TrimSpace(text)
+	if block, _ := pem.Decode([]byte(text)); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch key.(type) {
+		case ed25519.PublicKey, *ecdsa.PublicKey, *rsa.PublicKey:
+			return key, block.Bytes, nil
+		}
+		return nil, nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+	raw, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, nil, fmt.Errorf("public key is neither PEM nor a base64 Ed25519 key")
+	}
+	der, _ := x509.MarshalPKIXPublicKey(ed25519.PublicKey(raw))
+	return ed25519.PublicKey(raw), der, nil
+}
+
+func verifyAgentSignature(key crypto.PublicKey, message, signature []byte) bool {
+	digest := sha256.Sum256(message)
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, message, signature)
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
+
+func decodeSignature(sig string) ([]byte, error) {
+	sig = strings.TrimSpace(sig)
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(sig); err == nil {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("signature is not base64")
+}
+
+func agentChallengeMessage(agentID, nonce string) []byte {
+	return []byte("aac-agent:" + agentID + ":" + nonce)
+}
+
+// agentOperatorCheck refuses the operator not accountable for the branch of the agent.
+func (dk *configDataKeeper) agentOperatorCheck(agentID, operator string) *internError {
+	if agentID == "" || operator == "" {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Not all required parameters are given: agent is %v, operator is %v", agentID, operator), nil)
+	}
+	branch, ok := dk.agentsKeeper.getBranchName(agentID)
+	if !ok {
+		return newInternError("AGENT-UNKNOWN", fmt.Sprintf("Agent %v is never registered", agentID), map[string]interface{}{"bad_value": agentID})
+	}
+	_, ex := dk._get_branch_relOp(operator, branch)
+	return ex
+}
+
+// setAgentCredential gives the agent a new secret (generated when not given) or public key;
+// its previous credentials stay valid for grace minutes.
+func (dk *configDataKeeper) setAgentCredential(agentID, operator, kind, secret, publicKey string, grace int) map[string]interface{} {
+	if ex := dk.agentOperatorCheck(agentID, operator); ex != nil {
+		return ex.dict4api
+	}
+	if grace < 0 {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Grace period %d is negative", grace), map[string]interface{}{"bad_value": grace}).dict4api
+	}
+
+	ret := map[string]interface{}{"result": true, "agent": agentID, "kind": kind}
+	var data, fingerprint string
+	switch kind {
+	case "secret":
+		generated := secret == ""
+		if generated {
+			secret = randomHex(24)
+			ret["secret"] = secret
+		}
+		data = hashAgentSecret(randomHex(8), secret)
+	case "pubkey":
+		_, der, err := parseAgentPublicKey(publicKey)
+		if err != nil {
+			return newInternError("WRONG-FORMAT", fmt.Sprintf("Public key not accepted: %v", err), nil).dict4api
+		}
+		sum := sha256.Sum256(der)
+		fingerprint = "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+		data = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		ret["fingerprint"] = fingerprint
+	default:
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Unknown credential kind %v, expected one of %v", kind, agentCredentialKinds), map[string]interface{}{"bad_value": kind}).dict4api
+	}
+
+	id, err := dk.agentsKeeper.addCredential(agentID, kind, data, fingerprint, int64(grace)*60)
+	if err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Credential not stored: %v", err), nil).dict4api
+	}
+	ret["credential"] = id
+	logAgentsKeeper.Info("agent credential set", "agent", agentID, "kind", kind, "credential", id, "grace_minutes", grace, "operator", operator)
+	return ret
+}
+
+func (dk *configDataKeeper) listAgentCredentials(agentID, operator string) map[string]interface{} {
+	if ex := dk.agentOperatorCheck(agentID, operator); ex != nil {
+		return ex.dict4api
+	}
+	creds := make([]interface{}, 0)
+	for _, c := range dk.agentsKeeper.credentials(agentID, false) {
+		cred := map[string]interface{}{"credential": c.id, "kind": c.kind, "created": c.createdAt, "expires": c.expiresAt}
+		if c.fingerprint != "" {
+			cred["fingerprint"] = c.fingerprint
+		}
+		creds = append(creds, cred)
+	}
+	return map[string]interface{}{"result": true, "agent": agentID, "credentials": creds}
+}
+
+// revokeAgentCredential removes one credential, or all for "all", and the tokens issued on them.
+func (dk *configDataKeeper) revokeAgentCredential(agentID, operator, credential string) map[string]interface{} {
+	if ex := dk.agentOperatorCheck(agentID, operator); ex != nil {
+		return ex.dict4api
+	}
+	var credID int64
+	if credential != "all" {
+		var err error
+		if credID, err = strconv.ParseInt(credential, 10, 64); err != nil || credID <= 0 {
+			return newInternError("WRONG-FORMAT", fmt.Sprintf("Credential %q is neither an id nor all", credential), map[string]interface{}{"bad_value": credential}).dict4api
+		}
+	}
+	removed, err := dk.agentsKeeper.removeCredential(agentID, credID)
+	if err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Credential not revoked: %v", err), nil).dict4api
+	}
+	if removed == 0 && credID != 0 {
+		return newInternError("NOT-IN-SET", fmt.Sprintf("Agent %v has no credential %v", agentID, credential), map[string]interface{}{"bad_value": credential}).dict4api
+	}
+	logAgentsKeeper.Info("agent credential revoked", "agent", agentID, "credential", credential, "removed", removed, "operator", operator)
+	return map[string]interface{}{"result": true, "removed": removed}
+}
+
+func (dk *configDataKeeper) agentChallenge(agentID string) map[string]interface{} {
+	if dk.agentsKeeper.getAgentDict(agentID, false) == nil {
+		return newInternError("AGENT-UNKNOWN", fmt.Sprintf("Agent %v is never registered", agentID), map[string]interface{}{"bad_value": agentID}).dict4api
+	}
+	ak := dk.agentsKeeper
+	nonce := randomHex(16)
+	now := time.Now().Unix()
+	ak.authMu.Lock()
+	if ak.challenges == nil {
+		ak.challenges = map[string]int64{}
+	}
+	for k, exp := range ak.challenges {
+		if exp <= now {
+			delete(ak.challenges, k)
+		}
+	}
+	ak.challenges[agentID+":"+nonce] = now + agentChallengeTTL
+	ak.authMu.Unlock()
+	return map[string]interface{}{"result": true, "agent": agentID, "nonce": nonce, "expires": now + agentChallengeTTL, "sign": string(agentChallengeMessage(agentID, nonce))}
+}
+
+// takeChallenge uses up the nonce; it is valid once and only until it expires.
+func (ak *agentsKeeper) takeChallenge(agentID, nonce string) bool {
+	ak.authMu.Lock()
+	defer ak.authMu.Unlock()
+	key := agentID + ":" + nonce
+	exp, ok := ak.challenges[key]
+	delete(ak.challenges, key)
+	return ok && exp > time.Now().Unix()
+}
+
+// authenticateAgent checks the secret, or the signature of a challenge, against the valid credentials and issues a token.
+func (dk *configDataKeeper) authenticateAgent(agentID, secret, nonce, signature string) map[string]interface{} {
+	if agentID == "" || (secret == "" && (nonce == "" || signature == "")) {
+		return newInternError("WRONG-FORMAT", "Required arguments not given: agent and either secret or nonce with signature", nil).dict4api
+	}
+	if dk.agentsKeeper.getAgentDict(agentID, false) == nil {
+		return newInternError("AGENT-UNKNOWN", fmt.Sprintf("Agent %v is never registered", agentID), map[string]interface{}{"bad_value": agentID}).dict4api
+	}
+
+	var matched int64
+	if secret != "" {
+		for _, c := range dk.agentsKeeper.credentials(agentID, false) {
+			if c.kind == "secret" && agentSecretMatches(c.data, secret) {
+				matched = c.id
+				break
+			}
+		}
+	} else if dk.agentsKeeper.takeChallenge(agentID, nonce) {
+		sig, err := decodeSignature(signature)
+		if err != nil {
+			return newInternError("WRONG-FORMAT", err.Error(), nil).dict4api
+		}
+		for _, c := range dk.agentsKeeper.credentials(agentID, false) {
+			if c.kind != "pubkey" {
+				continue
+			}
+			if key, _, err := parseAgentPublicKey(c.data); err == nil && verifyAgentSignature(key, agentChallengeMessage(agentID, nonce), sig) {
+				matched = c.id
+				break
+			}
+		}
+	}
+	if matched == 0 {
+		logAgentsKeeper.Warn("agent authentication failed", "agent", agentID)
+		return newInternError("WRONG-SECRET", fmt.Sprintf("Agent %v is not authenticated", agentID), nil).dict4api
+	}
+
+	ttl := dk.agentsKeeper.tokenTTL
+	if ttl <= 0 {
+		ttl = defaultAgentTokenTTL
+	}
+	token := agentTokenPrefix + randomHex(32)
+	now := time.Now().Unix()
+	if err := dk.agentsKeeper.storeToken(hashAgentToken(token), agentID, matched, now, now+ttl*60); err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Token not issued: %v", err), nil).dict4api
+	}
+	logAgentsKeeper.Info("agent authenticated", "agent", agentID, "credential", matched)
+	return map[string]interface{}{"result": true, "agent": agentID, "token": token, "expires": now + ttl*60}
+}
+
+func (dk *configDataKeeper) verifyAgentToken(token string) map[string]interface{} {
+	if token == "" {
+		return newInternError("WRONG-FORMAT", "Required argument not given: token", nil).dict4api
+	}
+	agentID, expires, ok := dk.agentsKeeper.tokenOwner(hashAgentToken(token))
+	if !ok {
+		return newInternError("WRONG-SECRET", "Token is unknown or expired", nil).dict4api
+	}
+	ret := map[string]interface{}{"result": true, "agent": agentID, "expires": expires}
+	if branch, ok := dk.agentsKeeper.getBranchName(agentID); ok {
+		ret["branch"] = branch
+	}
+	return ret
+}
+
+func handleAgentCredentialSet(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	if r.Method == http.MethodGet {
+		writeJSON(w, map[string]interface{}{
+			"result":         true,
+			"formMethod":     "post",
+			"operatorDriven": true,
+			"agentsList":     storage.getAgents(),
+			"kindList":       agentCredentialKinds,
+			"extratxtinputs": [][3]string{
+				{"secret", "Secret, generated when empty", ""},
+				{"public_key", "Public key (PEM)", ""},
+				{"grace", "Minutes the previous credentials stay valid", "0"},
+			},
+		})
+		return
+	}
+	writeJSON(w, storage.setAgentCredential(
+		strings.TrimSpace(r.FormValue("agent")),
+		strings.TrimSpace(r.FormValue("operator")),
+		strings.TrimSpace(r.FormValue("kind")),
+		strings.TrimSpace(r.FormValue("secret")),
+		r.FormValue("public_key"),
+		toInt(r.FormValue("grace"), 0),
+	))
+}
+
+func handleAgentCredentialsList(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	writeJSON(w, storage.listAgentCredentials(strings.TrimSpace(r.FormValue("agent")), strings.TrimSpace(r.FormValue("operator"))))
+}
+
+func handleAgentCredentialRevoke(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	if r.Method == http.MethodGet {
+		writeJSON(w, map[string]interface{}{
+			"result":         true,
+			"formMethod":     "post",
+			"operatorDriven": true,
+			"agentsList":     storage.getAgents(),
+		})
+		return
+	}
+	writeJSON(w, storage.revokeAgentCredential(
+		strings.TrimSpace(r.FormValue("agent")),
+		strings.TrimSpace(r.FormValue("operator")),
+		strings.TrimSpace(r.FormValue("credential")),
+	))
+}
+
+func handleAgentChallenge(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	writeJSON(w, storage.agentChallenge(strings.TrimSpace(r.FormValue("agent"))))
+}
+
+func handleAgentAuthenticate(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	writeJSON(w, storage.authenticateAgent(
+		strings.TrimSpace(r.FormValue("agent")),
+		strings.TrimSpace(r.FormValue("secret")),
+		strings.TrimSpace(r.FormValue("nonce")),
+		r.FormValue("signature"),
+	))
+}
+
+func handleAgentTokenVerify(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	writeJSON(w, storage.verifyAgentToken(requestAgentToken(r)))
+}
+
+// requestAgentToken gives the token of the form, or of the Authorization: Bearer header.
+func requestAgentToken(r *http.Request) string {
+	token := strings.TrimSpace(r.FormValue("token"))
+	if auth := r.Header.Get("Authorization"); token == "" && strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return token
+}
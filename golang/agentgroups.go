@@ -0,0 +1,541 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/antchfx/xmlquery"
+)
+
+// An agent group is a named set of agents kept in agents.db. A static group lists its agents;
+// a query group keeps a tag expression, a branch (with or without its subtree) and attribute
+// conditions in the syntax of /aac/agents/search and holds the agents matching them at the moment.
+//
+// A user may run a function for the agents of a branch and of all the branches below it when a
+// position the user holds or is delegated in that branch grants the function through its own
+// funcsets; each position is taken on its own, never the union of them. /aac/emp/function/check
+// and /aac/function/info take a group in place of an agent and expand it to the members the user
+// may target with the function; the members out of reach are reported as denied.
+
+var agentGroupKinds = []string{"static", "query"}
+
+// agentGroupQueryFields are the fields of a query group that /aac/agentgroup/update sets when given.
+var agentGroupQueryFields = []string{"tags", "branch", "subtree"}
+
+func agentGroupOfJSON(jg jsonAgentGroup) agentGroup {
+	return agentGroup{id: jg.ID, descr: jg.Descr, kind: jg.Kind, tags: jg.Tags, branch: jg.Branch, subtree: jg.Subtree,
+		attrs: jg.Attrs, members: jg.Agents, createdAt: time.Now().Unix()}
+}
+
+func (g agentGroup) json() jsonAgentGroup {
+	return jsonAgentGroup{ID: g.id, Descr: g.descr, Kind: g.kind, Tags: g.tags, Branch: g.branch, Subtree: g.subtree, Attrs: g.attrs, Agents: g.members}
+}
+
+func (g agentGroup) dict() map[string]interface{} {
+	ret := map[string]interface{}{"group": g.id, "descr": g.descr, "kind": g.kind, "created_at": g.createdAt}
+	if g.kind == "query" {
+		attrs := g.attrs
+		if attrs == nil {
+			attrs = []string{}
+		}
+		ret["tags"], ret["branch"], ret["subtree"], ret["attrs"] = g.tags, g.branch, g.subtree, attrs
+	}
+	return ret
+}
+
+// agentGroupProblem tells what is wrong with the group, with no regard to the agents registered.
+func agentGroupProblem(g agentGroup) error {
+	if g.id == "" {
+		return fmt.Errorf("group has no id")
+	}
+	if _, err := safeXPathValue(g.id); err != nil {
+		return err
+	}
+	if !hasKey(mapSet(agentGroupKinds...), g.kind) {
+		return fmt.Errorf("group %v is of unknown kind %q, expected one of %v", g.id, g.kind, agentGroupKinds)
+	}
+	if g.kind == "static" {
+		if g.tags != "" || g.branch != "" || len(g.attrs) > 0 {
+			return fmt.Errorf("static group %v cannot have tags, branch or attribute conditions", g.id)
+		}
+		return nil
+	}
+	if len(g.members) > 0 {
+		return fmt.Errorf("query group %v cannot list agents", g.id)
+	}
+	if _, err := parseTagExpr(g.tags); err != nil {
+		return fmt.Errorf("group %v: tag expression %q: %v", g.id, g.tags, err)
+	}
+	for _, a := range g.attrs {
+		if _, err := parseAttrCond(a); err != nil {
+			return fmt.Errorf("group %v: %v", g.id, err)
+		}
+	}
+	return nil
+}
+
+// checkAgentGroup adds to agentGroupProblem the branch of a query group and the agents of a static one.
+func (dk *configDataKeeper) checkAgentGroup(g agentGroup) *internError {
+	if err := agentGroupProblem(g); err != nil {
+		return newInternError("WRONG-FORMAT", err.Error(), map[string]interface{}{"bad_value": g.id})
+	}
+	if g.branch != "" && dk.data().branch(g.branch) == nil {
+		return newInternError("BRANCH-UNKNOWN", fmt.Sprintf("Branch %v is unknown", g.branch), map[string]interface{}{"bad_value": g.branch})
+	}
+	for _, agentID := range g.members {
+		if dk.agentsKeeper.getAgentDict(agentID, false) == nil {
+			return newInternError("AGENT-UNKNOWN", fmt.Sprintf("Agent %v is never registered", agentID), map[string]interface{}{"bad_value": agentID})
+		}
+	}
+	return nil
+}
+
+func (dk *configDataKeeper) agentGroupByID(groupID string) (agentGroup, *internError) {
+	if groupID == "" {
+		return agentGroup{}, newInternError("WRONG-FORMAT", "Required argument not given: group", nil)
+	}
+	groups, err := dk.agentsKeeper.groups(groupID)
+	if err != nil {
+		return agentGroup{}, newInternError("DATABASE-ERROR", fmt.Sprintf("Group %v not read: %v", groupID, err), nil)
+	}
+	if len(groups) == 0 {
+		return agentGroup{}, newInternError("GROUP-UNKNOWN", fmt.Sprintf("Agent group %v is unknown", groupID), map[string]interface{}{"bad_value": groupID})
+	}
+	return groups[0], nil
+}
+
+// groupMembers gives the agents of the group; a query group whose branch is gone has none.
+func (dk *configDataKeeper) groupMembers(g agentGroup) ([]string, *internError) {
+	if g.kind == "static" {
+		if g.members == nil {
+			return []string{}, nil
+		}
+		return g.members, nil
+	}
+	q := agentQuery{}
+	q.tags, _ = parseTagExpr(g.tags)
+	for _, a := range g.attrs {
+		c, _ := parseAttrCond(a)
+		q.attrs = append(q.attrs, c)
+	}
+	if g.branch != "" {
+		q.branches, _ = dk.branchScope(g.branch, g.subtree)
+		if q.branches == nil {
+			q.branches = []string{}
+		}
+	}
+	ids, err := dk.agentsKeeper.agentIDsMatching(q)
+	if err != nil {
+		return nil, newInternError("DATABASE-ERROR", fmt.Sprintf("Agents of group %v not read: %v", g.id, err), nil)
+	}
+	return ids, nil
+}
+
+// catalogueFunction gives the definition of the function in the catalogue; ids as test:states do not
+// pass safeXPathValue, so the function is looked up by id as it is.
+func (dk *configDataKeeper) catalogueFunction(funcID string) *xmlquery.Node {
+	if fn, ok := dk.store.function(funcID); ok {
+		return fn.Def
+	}
+	return nil
+}
+
+// functionScope gives the branches whose agents the user may target with the function: those of
+// every position held or delegated whose own funcsets hold the function, with their subtrees.
+func (dk *configDataKeeper) functionScope(userid, funcID string) map[string]struct{} {
+	ret := map[string]struct{}{}
+	if dk.catalogueFunction(funcID) == nil {
+		return ret
+	}
+	view := dk.data()
+	holders := map[string]struct{}{}
+	for _, fs := range view.funcsetList {
+		if contains(fs.Functions, funcID) {
+			holders[fs.ID] = struct{}{}
+		}
+	}
+	positions := append(dk._userPositions(userid), dk._delegatedPositions(userid, time.Now().Unix())...)
+	for _, p := range positions {
+		if len(intersectMaps(dk._positionFuncSets(p), holders)) == 0 {
+			continue
+		}
+		for _, br := range view.subtree(p.Branch) {
+			ret[br] = struct{}{}
+		}
+	}
+	return ret
+}
+
+// splitByScope parts the agents into the ones in the branches of the scope and the others.
+func (dk *configDataKeeper) splitByScope(agentIDs []string, scope map[string]struct{}) ([]string, []string) {
+	allowed, denied := []string{}, []string{}
+	for _, agentID := range agentIDs {
+		ag := dk.agentsKeeper.getAgentDict(agentID, false)
+		if branch, _ := ag["branch"].(string); ag != nil && hasKey(scope, branch) {
+			allowed = append(allowed, agentID)
+		} else {
+			denied = append(denied, agentID)
+		}
+	}
+	return allowed, denied
+}
+
+func (dk *configDataKeeper) createAgentGroup(g agentGroup) map[string]interface{} {
+	if g.id == "" {
+		return newInternError("WRONG-FORMAT", "Required argument not given: group", nil).dict4api
+	}
+	if g.kind == "" {
+		g.kind = "static"
+	}
+	if ex := dk.checkAgentGroup(g); ex != nil {
+		return ex.dict4api
+	}
+	if _, ex := dk.agentGroupByID(g.id); ex == nil {
+		return newInternError("ALREADY-EXISTS", fmt.Sprintf("Agent group %v already exists", g.id), map[string]interface{}{"bad_value": g.id}).dict4api
+	}
+	g.createdAt = time.Now().Unix()
+	if err := dk.agentsKeeper.saveGroup(g); err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Agent group %v not created: %v", g.id, err), nil).dict4api
+	}
+	logDataKeeper.Info("agent group created", "group", g.id, "kind", g.kind)
+	return dk.agentGroupDetails(g.id, "", "")
+}
+
+// updateAgentGroup sets the fields of set (descr, and tags, branch, subtree of a query group), the attribute
+// conditions of a query group when attrs is not nil, and adds and removes the comma separated agents of a static group.
+func (dk *configDataKeeper) updateAgentGroup(groupID string, set map[string]string, attrs []string, addAgents, removeAgents string) map[string]interface{} {
+	g, ex := dk.agentGroupByID(groupID)
+	if ex != nil {
+		return ex.dict4api
+	}
+	add, remove := splitTags(addAgents), splitTags(removeAgents)
+	if g.kind == "query" && len(add)+len(remove) > 0 {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Agents of query group %v cannot be listed", groupID), nil).dict4api
+	}
+	if v, ok := set["descr"]; ok {
+		g.descr = v
+	}
+	if v, ok := set["tags"]; ok {
+		g.tags = v
+	}
+	if v, ok := set["branch"]; ok {
+		g.branch = v
+	}
+	if v, ok := set["subtree"]; ok {
+		g.subtree = boolFromParam(v, false)
+	}
+	if attrs != nil {
+		g.attrs = []string{}
+		for _, a := range attrs {
+			if a = strings.TrimSpace(a); a != "" {
+				g.attrs = append(g.attrs, a)
+			}
+		}
+	}
+	members := mapSet(g.members...)
+	for _, agentID := range remove {
+		delete(members, agentID)
+	}
+	for _, agentID := range add {
+		members[agentID] = struct{}{}
+	}
+	g.members = sortedSet(members)
+	if ex := dk.checkAgentGroup(g); ex != nil {
+		return ex.dict4api
+	}
+	if err := dk.agentsKeeper.saveGroup(g); err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Agent group %v not updated: %v", groupID, err), nil).dict4api
+	}
+	logDataKeeper.Info("agent group updated", "group", groupID)
+	return dk.agentGroupDetails(groupID, "", "")
+}
+
+func (dk *configDataKeeper) deleteAgentGroup(groupID string) map[string]interface{} {
+	if groupID == "" {
+		return newInternError("WRONG-FORMAT", "Required argument not given: group", nil).dict4api
+	}
+	deleted, err := dk.agentsKeeper.deleteGroup(groupID)
+	if err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Agent group %v not deleted: %v", groupID, err), nil).dict4api
+	}
+	if !deleted {
+		return newInternError("GROUP-UNKNOWN", fmt.Sprintf("Agent group %v is unknown", groupID), map[string]interface{}{"bad_value": groupID}).dict4api
+	}
+	logDataKeeper.Info("agent group deleted", "group", groupID)
+	return map[string]interface{}{"result": true, "group": groupID}
+}
+
+// agentGroupDetails gives the group with its agents; with the user and the function also the agents
+// the user may and may not target with the function.
+func (dk *configDataKeeper) agentGroupDetails(groupID, userid, funcID string) map[string]interface{} {
+	g, ex := dk.agentGroupByID(groupID)
+	if ex != nil {
+		return ex.dict4api
+	}
+	members, ex := dk.groupMembers(g)
+	if ex != nil {
+		return ex.dict4api
+	}
+	ret := g.dict()
+	ret["result"], ret["agents"] = true, members
+	if userid != "" {
+		if dk._getPerson(userid) == nil {
+			return newInternError("USER-UNKNOWN", fmt.Sprintf("User %v is unknown", userid), map[string]interface{}{"bad_value": userid}).dict4api
+		}
+		if funcID == "" {
+			return newInternError("WRONG-FORMAT", "Required argument not given: funcId", nil).dict4api
+		}
+		ret["user"], ret["funcId"] = userid, funcID
+		ret["allowed"], ret["denied"] = dk.splitByScope(members, dk.functionScope(userid, funcID))
+	}
+	return ret
+}
+
+func (dk *configDataKeeper) agentGroupsList() map[string]interface{} {
+	groups, err := dk.agentsKeeper.groups()
+	if err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Agent groups not read: %v", err), nil).dict4api
+	}
+	rep := make([]interface{}, 0, len(groups))
+	for _, g := range groups {
+		entry := g.dict()
+		if members, ex := dk.groupMembers(g); ex == nil {
+			entry["size"] = len(members)
+		}
+		rep = append(rep, entry)
+	}
+	return map[string]interface{}{"result": true, "groups": rep}
+}
+
+func (dk *configDataKeeper) agentGroupIDs() []string {
+	groups, _ := dk.agentsKeeper.groups()
+	ret := make([]string, 0, len(groups))
+	for _, g := range groups {
+		ret = append(ret, g.id)
+	}
+	return ret
+}
+
+// functionTargets gives the agents the user may target with the function: the agent, or the members
+// of the group in reach, the agents denied, and whether any position of the user grants the function.
+func (dk *configDataKeeper) functionTargets(userid, funcID, agentID, groupID string) ([]string, []string, bool, *internError) {
+	if (agentID == "") == (groupID == "") {
+		return nil, nil, false, newInternError("WRONG-FORMAT", "Either agent or group is to be given", nil)
+	}
+	if dk._getPerson(userid) == nil {
+		return nil, nil, false, newInternError("USER-UNKNOWN", fmt.Sprintf("User %v is unknown", userid), map[string]interface{}{"bad_value": userid})
+	}
+	agents := []string{agentID}
+	if groupID != "" {
+		g, ex := dk.agentGroupByID(groupID)
+		if ex != nil {
+			return nil, nil, false, ex
+		}
+		if agents, ex = dk.groupMembers(g); ex != nil {
+			return nil, nil, false, ex
+		}
+	} else if dk.agentsKeeper.getAgentDict(agentID, false) == nil {
+		return nil, nil, false, newInternError("AGENT-UNKNOWN", fmt.Sprintf("Agent %v is never registered", agentID), map[string]interface{}{"bad_value": agentID})
+	}
+	scope := dk.functionScope(userid, funcID)
+	allowed, denied := dk.splitByScope(agents, scope)
+	return allowed, denied, len(scope) > 0, nil
+}
+
+// checkEmpFunction tells whether the user may run the function for the agent or for the members of the group.
+func (dk *configDataKeeper) checkEmpFunction(userid, funcID, agentID, groupID string) map[string]interface{} {
+	if userid == "" || funcID == "" {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Not all required parameters are given: user is %v, funcId is %v", userid, funcID), nil).dict4api
+	}
+	allowed, denied, funcAllowed, ex := dk.functionTargets(userid, funcID, agentID, groupID)
+	if ex != nil {
+		return ex.dict4api
+	}
+	ret := map[string]interface{}{"result": true, "user": userid, "funcId": funcID, "function_allowed": funcAllowed,
+		"allowed": funcAllowed && len(allowed) > 0, "agents": allowed, "denied": denied}
+	if groupID != "" {
+		ret["group"] = groupID
+	} else {
+		ret["agent"] = agentID
+	}
+	return ret
+}
+
+// groupFunctionDef gives the definition of the function with the agents of the group the user may target
+// listed under every iterable input: <iterate group="..."><value>agent</value>...</iterate>.
+func (dk *configDataKeeper) groupFunctionDef(funcID, groupID, userid, header string) map[string]interface{} {
+	if userid == "" {
+		return newInternError("WRONG-FORMAT", "Required argument not given: user", nil).dict4api
+	}
+	fn := dk.catalogueFunction(funcID)
+	if fn == nil {
+		return newInternError("FUNCTION-UNKNOWN", fmt.Sprintf("Function '%v' is unknown", funcID), nil).dict4api
+	}
+	allowed, denied, funcAllowed, ex := dk.functionTargets(userid, funcID, "", groupID)
+	if ex != nil {
+		return ex.dict4api
+	}
+	if !funcAllowed {
+		return newInternError("NOT-ALLOWED", fmt.Sprintf("Function %v is not allowed to user %v", funcID, userid), map[string]interface{}{"bad_value": funcID}).dict4api
+	}
+	fn, err := parseFunctionDefinition(outputXMLDocument(fn))
+	if err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Function %v has a broken definition: %v", funcID, err), nil).dict4api
+	}
+	inputs := queryAll(fn, "in/*[@iterable='yes']")
+	if len(inputs) == 0 {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Function %v has no iterable input to take a group", funcID), map[string]interface{}{"bad_value": funcID}).dict4api
+	}
+	for _, in := range inputs {
+		// the definition is cut out of the catalogue, so the indentation step is taken from the input and its parent
+		own, _ := lineIndent(in.PrevSibling)
+		outer, _ := lineIndent(in.Parent.PrevSibling)
+		step := strings.TrimPrefix(own, outer)
+		if step == "" || step == own {
+			step = "  "
+		}
+		it := &xmlquery.Node{Type: xmlquery.ElementNode, Data: "iterate"}
+		it.SetAttr("group", groupID)
+		for _, agentID := range allowed {
+			value := &xmlquery.Node{Type: xmlquery.ElementNode, Data: "value"}
+			xmlquery.AddChild(value, &xmlquery.Node{Type: xmlquery.TextNode, Data: agentID})
+			xmlquery.AddChild(it, &xmlquery.Node{Type: xmlquery.TextNode, Data: "\n" + own + step + step})
+			xmlquery.AddChild(it, value)
+		}
+		if len(allowed) > 0 {
+			xmlquery.AddChild(it, &xmlquery.Node{Type: xmlquery.TextNode, Data: "\n" + own + step})
+		}
+		xmlquery.AddChild(in, &xmlquery.Node{Type: xmlquery.TextNode, Data: "\n" + own + step})
+		xmlquery.AddChild(in, it)
+		xmlquery.AddChild(in, &xmlquery.Node{Type: xmlquery.TextNode, Data: "\n" + own})
+	}
+	return map[string]interface{}{"result": true, "definition": header + outputXMLDocument(fn), "group": groupID, "targets": allowed, "denied": denied}
+}
+
+func agentGroupFromForm(r *http.Request) agentGroup {
+	g := agentGroup{
+		id:      strings.TrimSpace(r.FormValue("group")),
+		descr:   strings.TrimSpace(r.FormValue("descr")),
+		kind:    strings.TrimSpace(r.FormValue("kind")),
+		tags:    strings.TrimSpace(r.FormValue("tags")),
+		branch:  strings.TrimSpace(r.FormValue("branch")),
+		subtree: boolFromParam(r.FormValue("subtree"), false),
+		members: splitTags(r.FormValue("agents")),
+	}
+	for _, a := range r.Form["attr"] {
+		if a = strings.TrimSpace(a); a != "" {
+			g.attrs = append(g.attrs, a)
+		}
+	}
+	return g
+}
+
+func handleAgentGroupCreate(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	if r.Method == http.MethodGet {
+		writeJSON(w, map[string]interface{}{
+			"result":     true,
+			"formMethod": "post",
+			"branchList": storageBranches(),
+			"kindList":   agentGroupKinds,
+			"extratxtinputs": [][3]string{
+				{"group", "Group ID", ""},
+				{"descr", "Description", ""},
+				{"agents", "Agents of a static group (comma separated)", ""},
+				{"tags", "Tag expression of a query group", ""},
+				{"attr", "Attribute condition of a query group", ""},
+			},
+			"cboxes": [][2]string{{"subtree", "Query the branch with its subtree"}},
+		})
+		return
+	}
+	writeJSON(w, storage.createAgentGroup(agentGroupFromForm(r)))
+}
+
+func handleAgentGroupUpdate(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	if r.Method == http.MethodGet {
+		writeJSON(w, map[string]interface{}{
+			"result":     true,
+			"formMethod": "post",
+			"groupList":  storage.agentGroupIDs(),
+			"branchList": storageBranches(),
+			"extratxtinputs": [][3]string{
+				{"descr", "Description", ""},
+				{"agents_add", "Agents to add (comma separated)", ""},
+				{"agents_remove", "Agents to remove (comma separated)", ""},
+				{"tags", "Tag expression of a query group", ""},
+				{"attr", "Attribute condition of a query group", ""},
+			},
+			"cboxes": [][2]string{{"subtree", "Query the branch with its subtree"}},
+		})
+		return
+	}
+	set := map[string]string{}
+	for _, k := range append([]string{"descr"}, agentGroupQueryFields...) {
+		if _, ok := r.Form[k]; ok {
+			set[k] = strings.TrimSpace(r.FormValue(k))
+		}
+	}
+	var attrs []string
+	if _, ok := r.Form["attr"]; ok {
+		attrs = r.Form["attr"]
+	}
+	writeJSON(w, storage.updateAgentGroup(strings.TrimSpace(r.FormValue("group")), set, attrs, r.FormValue("agents_add"), r.FormValue("agents_remove")))
+}
+
+func handleAgentGroupDelete(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	if r.Method == http.MethodGet {
+		writeJSON(w, map[string]interface{}{
+			"result":     true,
+			"formMethod": "post",
+			"groupList":  storage.agentGroupIDs(),
+		})
+		return
+	}
+	writeJSON(w, storage.deleteAgentGroup(strings.TrimSpace(r.FormValue("group"))))
+}
+
+func handleAgentGroupDetails(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet) {
+		return
+	}
+	parseRequestForm(r)
+	writeJSON(w, storage.agentGroupDetails(
+		strings.TrimSpace(r.FormValue("group")),
+		strings.TrimSpace(r.FormValue("user")),
+		strings.TrimSpace(r.FormValue("funcId")),
+	))
+}
+
+func handleAgentGroupsList(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet) {
+		return
+	}
+	writeJSON(w, storage.agentGroupsList())
+}
+
+func handleEmpFunctionCheck(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet) {
+		return
+	}
+	parseRequestForm(r)
+	writeJSON(w, storage.checkEmpFunction(
+		strings.TrimSpace(r.FormValue("user")),
+		strings.TrimSpace(r.FormValue("funcId")),
+		strings.TrimSpace(r.FormValue("agent")),
+		strings.TrimSpace(r.FormValue("group")),
+	))
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"modernc.org/sqlite"
+)
+
+// Agent search runs as one SQL query against agents.db. Tags are selected with an expression
+// over the tag names: AND, OR, NOT and MINUS (a MINUS b is a AND NOT b, as the methods of
+// modifyFuncTagset), parentheses, and tags written next to each other meaning AND, e.g.
+// `atm AND (moscow OR spb) MINUS broken`. Keywords are upper case; a tag with spaces,
+// parentheses or the name of a keyword is written in double quotes.
+//
+// Attributes are selected with conditions name<op>value, op one of = != < <= > >= and ~ (the
+// value contains the text, without regard to case); a number is compared as a number with int
+// and float attributes. An agent without the attribute matches no condition on it.
+//
+// Text is compared without regard to case with ulower, registered below: lower of SQLite
+// folds only ASCII, so that "Москва" would never find "МОСКВА" or even itself lowered in Go.
+
+var agentSearchSorts = map[string]string{
+	"agent":     "a.agent_id",
+	"branch":    "a.branch",
+	"descr":     "a.descr",
+	"location":  "a.location",
+	"last_seen": "COALESCE(s.last_seen, 0)",
+}
+
+var agentSearchSortList = []string{"agent", "branch", "descr", "location", "last_seen"}
+
+const (
+	agentSearchDefaultLimit = 50
+	agentSearchMaxLimit     = 1000
+)
+
+type tagNode struct {
+	op   string // TAG, AND, OR, NOT
+	tag  string
+	kids []*tagNode
+}
+
+type tagParser struct {
+	tokens []string
+	pos    int
+}
+
+func tokenizeTagExpr(expr string) ([]string, error) {
+	tokens := []string{}
+	rs := []rune(expr)
+	for i := 0; i < len(rs); {
+		switch r := rs[i]; {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, string(r))
+			i++
+		case r == '"':
+			j := i + 1
+			for j < len(rs) && rs[j] != '"' {
+				j++
+			}
+			if j == len(rs) {
+				return nil, fmt.Errorf("quote at %d is not closed", i)
+			}
+			// a leading quote tells a quoted tag from a keyword
+			tokens = append(tokens, "\""+string(rs[i+1:j]))
+			i = j + 1
+		default:
+			j := i
+			for j < len(rs) && !unicode.IsSpace(rs[j]) && rs[j] != '(' && rs[j] != ')' && rs[j] != '"' {
+				j++
+			}
+			tokens = append(tokens, string(rs[i:j]))
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// parseTagExpr gives the tree of the expression: OR binds loosest, then AND and MINUS, then NOT.
+func parseTagExpr(expr string) (*tagNode, error) {
+	tokens, err := tokenizeTagExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	p := &tagParser{tokens: tokens}
+	node, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q after the expression", p.tokens[p.pos])
+	}
+	return node, nil
+}
+
+func (p *tagParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *tagParser) or() (*tagNode, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "OR" {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &tagNode{op: "OR", kids: []*tagNode{left, right}}
+	}
+	return left, nil
+}
+
+func (p *tagParser) and() (*tagNode, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch tok := p.peek(); {
+		case tok == "AND" || tok == "MINUS":
+			p.pos++
+			right, err := p.not()
+			if err != nil {
+				return nil, err
+			}
+			if tok == "MINUS" {
+				right = &tagNode{op: "NOT", kids: []*tagNode{right}}
+			}
+			left = &tagNode{op: "AND", kids: []*tagNode{left, right}}
+		case tok != "" && tok != "OR" && tok != ")":
+			right, err := p.not()
+			if err != nil {
+				return nil, err
+			}
+			left = &tagNode{op: "AND", kids: []*tagNode{left, right}}
+		default:
+			return left, nil
+		}
+	}
+}
+
+func (p *tagParser) not() (*tagNode, error) {
+	switch tok := p.peek(); tok {
+	case "":
+		return nil, fmt.Errorf("expression ends where a tag is expected")
+	case "NOT":
+		p.pos++
+		kid, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &tagNode{op: "NOT", kids: []*tagNode{kid}}, nil
+	case "(":
+		p.pos++
+		node, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("parenthesis is not closed")
+		}
+		p.pos++
+		return node, nil
+	case ")", "AND", "OR", "MINUS":
+		return nil, fmt.Errorf("unexpected %q where a tag is expected", tok)
+	default:
+		p.pos++
+		return &tagNode{op: "TAG", tag: strings.TrimPrefix(tok, "\"")}, nil
+	}
+}
+
+// sql gives the condition on the agent row a for the expression, adding its arguments.
+func (n *tagNode) sql(args *[]interface{}) string {
+	switch n.op {
+	case "TAG":
+		*args = append(*args, n.tag)
+		return "a.agent_id IN (SELECT agent_id FROM Tags WHERE tag = ?)"
+	case "NOT":
+		return "NOT (" + n.kids[0].sql(args) + ")"
+	}
+	return "(" + n.kids[0].sql(args) + " " + n.op + " " + n.kids[1].sql(args) + ")"
+}
+
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("ulower", 1, func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		switch v := args[0].(type) {
+		case string:
+			return strings.ToLower(v), nil
+		case []byte:
+			return strings.ToLower(string(v)), nil
+		}
+		return args[0], nil
+	})
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+type attrCond struct {
+	name  string
+	op    string
+	value string
+}
+
+func parseAttrCond(cond string) (attrCond, error) {
+	i := strings.IndexAny(cond, "=!<>~")
+	if i <= 0 {
+		return attrCond{}, fmt.Errorf("condition %q is not name<op>value", cond)
+	}
+	c := attrCond{name: strings.TrimSpace(cond[:i]), op: cond[i : i+1]}
+	if rest := cond[i:]; strings.HasPrefix(rest, "!=") || strings.HasPrefix(rest, "<=") || strings.HasPrefix(rest, ">=") {
+		c.op = rest[:2]
+	} else if c.op == "!" {
+		return attrCond{}, fmt.Errorf("condition %q has no operator", cond)
+	}
+	c.value = strings.TrimSpace(cond[i+len(c.op):])
+	if !agentAttrNameRe.MatchString(c.name) {
+		return attrCond{}, fmt.Errorf("attribute name %q is not valid", c.name)
+	}
+	return c, nil
+}
+
+// sql gives the condition on the agent row a, adding its arguments.
+func (c attrCond) sql(args *[]interface{}) string {
+	*args = append(*args, c.name)
+	cmp := "x.value " + c.op + " ?"
+	if c.op == "~" {
+		cmp = `ulower(x.value) LIKE ? ESCAPE '\'`
+		*args = append(*args, "%"+likeEscaper.Replace(strings.ToLower(c.value))+"%")
+	} else if f, err := strconv.ParseFloat(c.value, 64); err == nil {
+		cmp = "(x.type IN ('int', 'float') AND CAST(x.value AS REAL) " + c.op + " ?) OR (x.type NOT IN ('int', 'float') AND " + cmp + ")"
+		*args = append(*args, f, c.value)
+	} else {
+		*args = append(*args, c.value)
+	}
+	return "EXISTS (SELECT 1 FROM AgentAttributes x WHERE x.agent_id = a.agent_id AND x.name = ? AND (" + cmp + "))"
+}
+
+type agentQuery struct {
+	tags     *tagNode
+	text     string
+	descr    string
+	location string
+	attrs    []attrCond
+	branches []string // nil for all branches
+	status   string
+	sort     string
+	desc     bool
+	limit    int
+	offset   int
+}
+
+// searchFrom gives the FROM and WHERE of the query over the agent rows a and their status s, with the arguments.
+func searchFrom(q agentQuery, onlineSince int64) (string, []interface{}) {
+	conds, args := []string{}, []interface{}{}
+	if q.tags != nil {
+		conds = append(conds, q.tags.sql(&args))
+	}
+	like := func(v string) string { return "%" + likeEscaper.Replace(strings.ToLower(v)) + "%" }
+	if q.text != "" {
+		conds = append(conds, `(ulower(a.descr) LIKE ? ESCAPE '\' OR ulower(a.location) LIKE ? ESCAPE '\')`)
+		args = append(args, like(q.text), like(q.text))
+	}
+	if q.descr != "" {
+		conds = append(conds, `ulower(a.descr) LIKE ? ESCAPE '\'`)
+		args = append(args, like(q.descr))
+	}
+	if q.location != "" {
+		conds = append(conds, `ulower(a.location) LIKE ? ESCAPE '\'`)
+		args = append(args, like(q.location))
+	}
+	for _, c := range q.attrs {
+		conds = append(conds, c.sql(&args))
+	}
+	if q.branches != nil {
+		conds = append(conds, "a.branch IN ("+strings.TrimSuffix(strings.Repeat("?,", len(q.branches)), ",")+")")
+		for _, b := range q.branches {
+			args = append(args, b)
+		}
+	}
+	switch q.status {
+	case "online":
+		conds = append(conds, "s.last_seen >= ?")
+		args = append(args, onlineSince)
+	case "offline":
+		conds = append(conds, "s.last_seen < ?")
+		args = append(args, onlineSince)
+	case "never":
+		conds = append(conds, "s.last_seen IS NULL")
+	}
+
+	from := " FROM Agents a LEFT JOIN AgentStatus s ON s.agent_id = a.agent_id"
+	if len(conds) > 0 {
+		from += " WHERE " + strings.Join(conds, " AND ")
+	}
+	return from, args
+}
+
+func (ak *agentsKeeper) onlineSince() int64 {
+	timeout := ak.onlineTimeout
+	if timeout <= 0 {
+		timeout = defaultAgentOnlineTimeout
+	}
+	return time.Now().Unix() - timeout*60
+}
+
+// agentIDsMatching gives all the agents the query selects, without paging.
+func (ak *agentsKeeper) agentIDsMatching(q agentQuery) ([]string, error) {
+	if ak.db == nil {
+		return nil, fmt.Errorf("database is not initialized")
+	}
+	if q.branches != nil && len(q.branches) == 0 {
+		return []string{}, nil
+	}
+	from, args := searchFrom(q, ak.onlineSince())
+	rows, err := ak.db.Query("SELECT a.agent_id"+from+" ORDER BY a.agent_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
+
+// searchAgents gives a page of the agents matching the query and how many match in all.
+func (ak *agentsKeeper) searchAgents(q agentQuery) ([]map[string]interface{}, int, error) {
+	if ak.db == nil {
+		return nil, 0, fmt.Errorf("database is not initialized")
+	}
+	if q.branches != nil && len(q.branches) == 0 {
+		return []map[string]interface{}{}, 0, nil
+	}
+	onlineSince := ak.onlineSince()
+	from, args := searchFrom(q, onlineSince)
+	var total int
+	if err := ak.db.QueryRow("SELECT COUNT(*)"+from, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	order := agentSearchSorts[q.sort] + " ASC"
+	if q.desc {
+		order = agentSearchSorts[q.sort] + " DESC"
+	}
+	rows, err := ak.db.Query("SELECT a.agent_id, a.branch, a.descr, a.location, COALESCE(s.last_seen, 0)"+from+" ORDER BY "+order+", a.agent_id LIMIT ? OFFSET ?",
+		append(args, q.limit, q.offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	out := []map[string]interface{}{}
+	byID := map[string]map[string]interface{}{}
+	for rows.Next() {
+		var id, branch, descr, location string
+		var lastSeen int64
+		if err := rows.Scan(&id, &branch, &descr, &location, &lastSeen); err != nil {
+			return nil, 0, err
+		}
+		ag := map[string]interface{}{"agent": id, "branch": branch, "descr": descr, "location": location, "tags": []string{}, "attributes": map[string]interface{}{}}
+		if lastSeen > 0 {
+			ag["last_seen"] = lastSeen
+			ag["status"] = "offline"
+			if lastSeen >= onlineSince {
+				ag["status"] = "online"
+			}
+		} else {
+			ag["status"] = "never"
+		}
+		out = append(out, ag)
+		byID[id] = ag
+	}
+	rows.Close()
+	if len(out) == 0 {
+		return out, total, nil
+	}
+
+	ids, idList := make([]interface{}, 0, len(out)), make([]string, 0, len(out))
+	for _, ag := range out {
+		ids, idList = append(ids, ag["agent"]), append(idList, ag["agent"].(string))
+	}
+	for id, attrs := range ak.attributes(idList) {
+		byID[id]["attributes"] = typedAttrMap(attrs)
+	}
+	tagRows, err := ak.db.Query("SELECT agent_id, tag FROM Tags WHERE agent_id IN ("+strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")+") ORDER BY tag", ids...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tagRows.Close()
+	for tagRows.Next() {
+		var id, tag string
+		if err := tagRows.Scan(&id, &tag); err == nil {
+			byID[id]["tags"] = append(byID[id]["tags"].([]string), tag)
+		}
+	}
+	return out, total, nil
+}
+
+// branchScope gives the branch and, with subtree, all the branches below it.
+func (dk *configDataKeeper) branchScope(branchID string, subtree bool) ([]string, *internError) {
+	view := dk.data()
+	if view.branch(branchID) == nil {
+		return nil, newInternError("BRANCH-UNKNOWN", fmt.Sprintf("Branch %v is unknown", branchID), map[string]interface{}{"bad_value": branchID})
+	}
+	if subtree {
+		return view.subtree(branchID), nil
+	}
+	return []string{branchID}, nil
+}
+
+func (dk *configDataKeeper) searchAgents(tags, text, descr, location string, attrs []string, branch string, subtree bool, status, sort, order string, limit, offset int) map[string]interface{} {
+	q := agentQuery{text: text, descr: descr, location: location, status: status, sort: sort, desc: order == "desc", limit: limit, offset: offset}
+	var err error
+	if q.tags, err = parseTagExpr(tags); err != nil {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Tag expression %q: %v", tags, err), map[string]interface{}{"bad_value": tags}).dict4api
+	}
+	for _, a := range attrs {
+		if strings.TrimSpace(a) == "" {
+			continue
+		}
+		c, err := parseAttrCond(a)
+		if err != nil {
+			return newInternError("WRONG-FORMAT", err.Error(), map[string]interface{}{"bad_value": a}).dict4api
+		}
+		q.attrs = append(q.attrs, c)
+	}
+	if branch != "" && branch != "*ALL*" {
+		var ierr *internError
+		if q.branches, ierr = dk.branchScope(branch, subtree); ierr != nil {
+			return ierr.dict4api
+		}
+	}
+	if q.sort == "" {
+		q.sort = "agent"
+	}
+	if _, ok := agentSearchSorts[q.sort]; !ok {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Unknown sort %v, expected one of %v", q.sort, agentSearchSortList), map[string]interface{}{"bad_value": q.sort}).dict4api
+	}
+	if order != "" && order != "asc" && order != "desc" {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Unknown order %v, expected asc or desc", order), map[string]interface{}{"bad_value": order}).dict4api
+	}
+	if q.status == "all" {
+		q.status = ""
+	}
+	if q.status != "" && !hasKey(mapSet(agentStatusFilters...), q.status) {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Unknown status %v, expected one of %v", q.status, agentStatusFilters), map[string]interface{}{"bad_value": q.status}).dict4api
+	}
+	if q.limit <= 0 {
+		q.limit = agentSearchDefaultLimit
+	}
+	if q.limit > agentSearchMaxLimit {
+		q.limit = agentSearchMaxLimit
+	}
+	if q.offset < 0 {
+		q.offset = 0
+	}
+
+	agents, total, dberr := dk.agentsKeeper.searchAgents(q)
+	if dberr != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Agent search failed: %v", dberr), nil).dict4api
+	}
+	return map[string]interface{}{"result": true, "agents": agents, "total": total, "limit": q.limit, "offset": q.offset}
+}
+
+func handleAgentsSearch(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	writeJSON(w, storage.searchAgents(
+		r.FormValue("tags"),
+		strings.TrimSpace(r.FormValue("text")),
+		strings.TrimSpace(r.FormValue("descr")),
+		strings.TrimSpace(r.FormValue("location")),
+		r.Form["attr"],
+		strings.TrimSpace(r.FormValue("branch")),
+		boolFromParam(r.FormValue("subtree"), true),
+		strings.TrimSpace(r.FormValue("status")),
+		strings.TrimSpace(r.FormValue("sort")),
+		strings.ToLower(strings.TrimSpace(r.FormValue("order"))),
+		toInt(r.FormValue("limit"), agentSearchDefaultLimit),
+		toInt(r.FormValue("offset"), 0),
+	))
+}
@@ -3,14 +3,22 @@ package main
 import (
     "database/sql"
     "fmt"
+    "os"
     "sort"
     "strings"
+    "sync"
+    "time"
     _ "modernc.org/sqlite"
 )
 
 type agentsKeeper struct {
     dbFile string
     db     *sql.DB
+
+    tokenTTL      int64 // minutes an agent token is valid, 0 for the default
+    onlineTimeout int64 // minutes since the last heartbeat an agent counts as online, 0 for the default
+    authMu        sync.Mutex
+    challenges    map[string]int64 // agent id + ":" + nonce -> expiry
 }
 
 func newAgentsKeeper(dataFolder string) *agentsKeeper {
@@ -28,7 +36,11 @@ func (ak *agentsKeeper) initData() error {
     }
 
     ak.db = db
-    return ak.createTablesIfNeeded()
+    if err := ak.createTablesIfNeeded(); err != nil {
+        return err
+    }
+    logAgentsKeeper.Info("agents database opened", "file", ak.dbFile)
+    return nil
 }
 
 func (ak *agentsKeeper) createTablesIfNeeded() error {
@@ -53,6 +65,122 @@ func (ak *agentsKeeper) createTablesIfNeeded() error {
             FOREIGN KEY (agent_id) REFERENCES Agents (agent_id)
         )
     `)
+    if err != nil {
+        return err
+    }
+
+    // kind is "secret" (data is the salted hash) or "pubkey" (data is the PEM key);
+    // expires_at is 0 until a rotation gives the credential a grace period.
+    _, err = ak.db.Exec(`
+        CREATE TABLE IF NOT EXISTS AgentCredentials (
+            cred_id INTEGER PRIMARY KEY AUTOINCREMENT,
+            agent_id TEXT,
+            kind TEXT,
+            data TEXT,
+            fingerprint TEXT,
+            created_at INTEGER,
+            expires_at INTEGER,
+            FOREIGN KEY (agent_id) REFERENCES Agents (agent_id)
+        )
+    `)
+    if err != nil {
+        return err
+    }
+
+    _, err = ak.db.Exec(`
+        CREATE TABLE IF NOT EXISTS AgentTokens (
+            token_hash TEXT PRIMARY KEY,
+            agent_id TEXT,
+            cred_id INTEGER,
+            issued_at INTEGER,
+            expires_at INTEGER,
+            FOREIGN KEY (agent_id) REFERENCES Agents (agent_id)
+        )
+    `)
+    if err != nil {
+        return err
+    }
+
+    _, err = ak.db.Exec(`
+        CREATE TABLE IF NOT EXISTS AgentStatus (
+            agent_id TEXT PRIMARY KEY,
+            last_seen INTEGER,
+            version TEXT,
+            ip TEXT,
+            heartbeats INTEGER,
+            FOREIGN KEY (agent_id) REFERENCES Agents (agent_id)
+        )
+    `)
+    if err != nil {
+        return err
+    }
+
+    // One row per changed field; the history outlives the agent, so there is no foreign key.
+    _, err = ak.db.Exec(`
+        CREATE TABLE IF NOT EXISTS AgentHistory (
+            hist_id INTEGER PRIMARY KEY AUTOINCREMENT,
+            agent_id TEXT,
+            at INTEGER,
+            action TEXT,
+            field TEXT,
+            old_value TEXT,
+            new_value TEXT
+        )
+    `)
+    if err != nil {
+        return err
+    }
+    _, err = ak.db.Exec(`CREATE INDEX IF NOT EXISTS AgentHistoryAgent ON AgentHistory (agent_id, hist_id)`)
+    if err != nil {
+        return err
+    }
+
+    // type is one of agentAttrTypes, value its canonical text form
+    _, err = ak.db.Exec(`
+        CREATE TABLE IF NOT EXISTS AgentAttributes (
+            agent_id TEXT,
+            name TEXT,
+            type TEXT,
+            value TEXT,
+            PRIMARY KEY (agent_id, name),
+            FOREIGN KEY (agent_id) REFERENCES Agents (agent_id)
+        )
+    `)
+    if err != nil {
+        return err
+    }
+    _, err = ak.db.Exec(`CREATE INDEX IF NOT EXISTS AgentAttributesValue ON AgentAttributes (name, value)`)
+    if err != nil {
+        return err
+    }
+
+    // kind "static" lists its agents in AgentGroupMembers, kind "query" selects them with tags
+    // (an expression of agents/search), branch (with subtree 1 for its subtree) and attrs (one condition a line)
+    _, err = ak.db.Exec(`
+        CREATE TABLE IF NOT EXISTS AgentGroups (
+            group_id TEXT PRIMARY KEY,
+            descr TEXT,
+            kind TEXT,
+            tags TEXT,
+            branch TEXT,
+            subtree INTEGER,
+            attrs TEXT,
+            created_at INTEGER
+        )
+    `)
+    if err != nil {
+        return err
+    }
+
+    _, err = ak.db.Exec(`
+        CREATE TABLE IF NOT EXISTS AgentGroupMembers (
+            group_id TEXT,
+            agent_id TEXT,
+            PRIMARY KEY (group_id, agent_id),
+            FOREIGN KEY (group_id) REFERENCES AgentGroups (group_id),
+            FOREIGN KEY (agent_id) REFERENCES Agents (agent_id)
+        )
+    `)
     return err
 }
 
@@ -63,6 +191,63 @@ func (ak *agentsKeeper) close() {
     }
 }
 
+func (ak *agentsKeeper) ping() error {
+    if ak.db == nil {
+        return fmt.Errorf("database is not initialized")
+    }
+    var n int
+    return ak.db.QueryRow(`SELECT COUNT(*) FROM Agents`).Scan(&n)
+}
+
+func (ak *agentsKeeper) copyTo(filename string) error {
+    if ak.db == nil {
+        return fmt.Errorf("database is not initialized")
+    }
+    if _, err := os.Stat(filename); err == nil {
+        if err := os.Remove(filename); err != nil {
+            return err
+        }
+    }
+    _, err := ak.db.Exec(`VACUUM INTO ?`, filename)
+    return err
+}
+
+// copyOf opens a copy of another agents database, made at target without touching the original,
+// so that it can be looked at before takeOver makes it the database of the keeper.
+func copyOf(src, target string) (*agentsKeeper, error) {
+    db, err := sql.Open("sqlite", "file:"+src+"?mode=ro")
+    if err != nil {
+        return nil, err
+    }
+    defer db.Close()
+    if _, err := os.Stat(target); err == nil {
+        if err := os.Remove(target); err != nil {
+            return nil, err
+        }
+    }
+    if _, err := db.Exec(`VACUUM INTO ?`, target); err != nil {
+        return nil, err
+    }
+    cp := &agentsKeeper{dbFile: target}
+    if err := cp.initData(); err != nil {
+        cp.close()
+        _ = os.Remove(target)
+        return nil, err
+    }
+    return cp, nil
+}
+
+// takeOver puts the database of the copy in the place of the own one and opens it.
+func (ak *agentsKeeper) takeOver(cp *agentsKeeper) error {
+    cp.close()
+    ak.close()
+    if err := os.Rename(cp.dbFile, ak.dbFile); err != nil {
+        _ = ak.initData()
+        return err
+    }
+    return ak.initData()
+}
+
 func (ak *agentsKeeper) getAllAgentIds() []string {
     if ak.db == nil {
         return []string{}
@@ -156,6 +341,11 @@ func (ak *agentsKeeper) addAgent(agentID, branch, descr, location, extra string,
             return err
         }
     }
+    changes := diffAgentRows(agentRow{}, agentRow{branch: branch, descr: descr, location: location, extra: extra, tags: tags})
+    if err := writeAgentHistory(tx, agentID, "register", time.Now().Unix(), changes); err != nil {
+        _ = tx.Rollback()
+        return err
+    }
     return tx.Commit()
 }
 
@@ -167,9 +357,20 @@ func (ak *agentsKeeper) deleteAgent(agentID string) error {
     if err != nil {
         return err
     }
-    if _, err := tx.Exec(`DELETE FROM Tags WHERE agent_id = ?`, agentID); err != nil {
+    if old, found, err := readAgentRow(tx, agentID); err != nil {
         _ = tx.Rollback()
         return err
+    } else if found {
+        if err := writeAgentHistory(tx, agentID, "unregister", time.Now().Unix(), diffAgentRows(old, agentRow{})); err != nil {
+            _ = tx.Rollback()
+            return err
+        }
+    }
+    for _, q := range []string{`DELETE FROM Tags WHERE agent_id = ?`, `DELETE FROM AgentAttributes WHERE agent_id = ?`, `DELETE FROM AgentGroupMembers WHERE agent_id = ?`, `DELETE FROM AgentCredentials WHERE agent_id = ?`, `DELETE FROM AgentTokens WHERE agent_id = ?`, `DELETE FROM AgentStatus WHERE agent_id = ?`} {
+        if _, err := tx.Exec(q, agentID); err != nil {
+            _ = tx.Rollback()
+            return err
+        }
     }
     res, err := tx.Exec(`DELETE FROM Agents WHERE agent_id = ?`, agentID)
     if err != nil {
@@ -186,6 +387,34 @@ func (ak *agentsKeeper) deleteAgent(agentID string) error {
     return nil
 }
 
+func (ak *agentsKeeper) renameBranch(oldName, newName string) (int64, error) {
+    if ak.db == nil {
+        return 0, fmt.Errorf("database not initialized")
+    }
+    tx, err := ak.db.Begin()
+    if err != nil {
+        return 0, err
+    }
+    if _, err := tx.Exec(`
+        INSERT INTO AgentHistory (agent_id, at, action, field, old_value, new_value)
+        SELECT agent_id, ?, 'branch-rename', 'branch', branch, ? FROM Agents WHERE branch = ?
+    `, time.Now().Unix(), newName, oldName); err != nil {
+        _ = tx.Rollback()
+        return 0, err
+    }
+    res, err := tx.Exec(`UPDATE Agents SET branch = ? WHERE branch = ?`, newName, oldName)
+    if err != nil {
+        _ = tx.Rollback()
+        return 0, err
+    }
+    affected, _ := res.RowsAffected()
+    if _, err := tx.Exec(`UPDATE AgentGroups SET branch = ? WHERE branch = ?`, newName, oldName); err != nil {
+        _ = tx.Rollback()
+        return 0, err
+    }
+    return affected, tx.Commit()
+}
+
 func (ak *agentsKeeper) getAgentsByBranches(branchNames []string) [][2]string {
     if ak.db == nil || len(branchNames) == 0 {
         return [][2]string{}
@@ -213,3 +442,733 @@ func (ak *agentsKeeper) getAgentsByBranches(branchNames []string) [][2]string {
     }
     return out
 }
+
+// importAgents writes the agents and the agent groups over the stored ones in one transaction;
+// with replace the agents and groups not given are removed.
+func (ak *agentsKeeper) importAgents(agents []jsonAgent, groups []jsonAgentGroup, replace bool) error {
+    if ak.db == nil {
+        return fmt.Errorf("database is not initialized")
+    }
+    tx, err := ak.db.Begin()
+    if err != nil {
+        return err
+    }
+    before, err := readAgentRows(tx)
+    if err != nil {
+        _ = tx.Rollback()
+        return err
+    }
+    now := time.Now().Unix()
+    if replace {
+        for _, q := range []string{`DELETE FROM Tags`, `DELETE FROM AgentAttributes`, `DELETE FROM AgentGroupMembers`, `DELETE FROM AgentGroups`, `DELETE FROM Agents`} {
+            if _, err := tx.Exec(q); err != nil {
+                _ = tx.Rollback()
+                return err
+            }
+        }
+    }
+    for _, ag := range agents {
+        if _, err := tx.Exec(`DELETE FROM Tags WHERE agent_id = ?`, ag.ID); err != nil {
+            _ = tx.Rollback()
+            return err
+        }
+        if _, err := tx.Exec(`INSERT OR REPLACE INTO Agents (agent_id, branch, descr, location, extra) VALUES (?, ?, ?, ?, ?)`, ag.ID, ag.Branch, ag.Descr, ag.Location, ag.Extra); err != nil {
+            _ = tx.Rollback()
+            return err
+        }
+        for _, t := range ag.Tags {
+            if t == "" {
+                continue
+            }
+            if _, err := tx.Exec(`INSERT INTO Tags (agent_id, tag) VALUES (?, ?)`, ag.ID, t); err != nil {
+                _ = tx.Rollback()
+                return err
+            }
+        }
+        attrs := make([]agentAttr, 0, len(ag.Attributes))
+        for _, a := range ag.Attributes {
+            attrs = append(attrs, agentAttr{name: a.Name, typ: a.Type, value: a.Value})
+        }
+        if err := writeAgentAttrs(tx, ag.ID, attrs); err != nil {
+            _ = tx.Rollback()
+            return err
+        }
+        changes := diffAgentRows(before[ag.ID], agentRow{branch: ag.Branch, descr: ag.Descr, location: ag.Location, extra: ag.Extra, tags: ag.Tags, attrs: attrs})
+        if err := writeAgentHistory(tx, ag.ID, "import", now, changes); err != nil {
+            _ = tx.Rollback()
+            return err
+        }
+        delete(before, ag.ID)
+    }
+    if replace {
+        for id, old := range before {
+            if err := writeAgentHistory(tx, id, "import", now, diffAgentRows(old, agentRow{})); err != nil {
+                _ = tx.Rollback()
+                return err
+            }
+        }
+    }
+    for _, g := range groups {
+        if err := saveAgentGroup(tx, agentGroupOfJSON(g)); err != nil {
+            _ = tx.Rollback()
+            return err
+        }
+    }
+    for _, q := range []string{`DELETE FROM AgentGroupMembers WHERE agent_id NOT IN (SELECT agent_id FROM Agents)`, `DELETE FROM AgentAttributes WHERE agent_id NOT IN (SELECT agent_id FROM Agents)`, `DELETE FROM AgentCredentials WHERE agent_id NOT IN (SELECT agent_id FROM Agents)`, `DELETE FROM AgentTokens WHERE agent_id NOT IN (SELECT agent_id FROM Agents)`, `DELETE FROM AgentStatus WHERE agent_id NOT IN (SELECT agent_id FROM Agents)`} {
+        if _, err := tx.Exec(q); err != nil {
+            _ = tx.Rollback()
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+type agentCredential struct {
+    id          int64
+    kind        string
+    data        string
+    fingerprint string
+    createdAt   int64
+    expiresAt   int64
+}
+
+// addCredential stores a credential of the agent; the ones it already has stay valid for grace seconds,
+// and are removed at once together with the tokens issued on them when grace is 0.
+func (ak *agentsKeeper) addCredential(agentID, kind, data, fingerprint string, grace int64) (int64, error) {
+    if ak.db == nil {
+        return 0, fmt.Errorf("database is not initialized")
+    }
+    now := time.Now().Unix()
+    tx, err := ak.db.Begin()
+    if err != nil {
+        return 0, err
+    }
+    if grace > 0 {
+        _, err = tx.Exec(`UPDATE AgentCredentials SET expires_at = ? WHERE agent_id = ? AND (expires_at = 0 OR expires_at > ?)`, now+grace, agentID, now+grace)
+    } else {
+        if _, err = tx.Exec(`DELETE FROM AgentTokens WHERE agent_id = ?`, agentID); err == nil {
+            _, err = tx.Exec(`DELETE FROM AgentCredentials WHERE agent_id = ?`, agentID)
+        }
+    }
+    if err != nil {
+        _ = tx.Rollback()
+        return 0, err
+    }
+    res, err := tx.Exec(`INSERT INTO AgentCredentials (agent_id, kind, data, fingerprint, created_at, expires_at) VALUES (?, ?, ?, ?, ?, 0)`, agentID, kind, data, fingerprint, now)
+    if err != nil {
+        _ = tx.Rollback()
+        return 0, err
+    }
+    id, _ := res.LastInsertId()
+    return id, tx.Commit()
+}
+
+// credentials gives the credentials of the agent, with the expired ones only when all is set.
+func (ak *agentsKeeper) credentials(agentID string, all bool) []agentCredential {
+    out := []agentCredential{}
+    if ak.db == nil {
+        return out
+    }
+    rows, err := ak.db.Query(`SELECT cred_id, kind, data, fingerprint, created_at, expires_at FROM AgentCredentials WHERE agent_id = ? ORDER BY cred_id`, agentID)
+    if err != nil {
+        return out
+    }
+    defer rows.Close()
+    now := time.Now().Unix()
+    for rows.Next() {
+        var c agentCredential
+        if err := rows.Scan(&c.id, &c.kind, &c.data, &c.fingerprint, &c.createdAt, &c.expiresAt); err != nil {
+            continue
+        }
+        if all || c.expiresAt == 0 || c.expiresAt > now {
+            out = append(out, c)
+        }
+    }
+    return out
+}
+
+// removeCredential deletes a credential of the agent, or all of them for id 0, with the tokens issued on them.
+func (ak *agentsKeeper) removeCredential(agentID string, credID int64) (int64, error) {
+    if ak.db == nil {
+        return 0, fmt.Errorf("database is not initialized")
+    }
+    tx, err := ak.db.Begin()
+    if err != nil {
+        return 0, err
+    }
+    cond, args := `agent_id = ?`, []interface{}{agentID}
+    if credID != 0 {
+        cond, args = `agent_id = ? AND cred_id = ?`, []interface{}{agentID, credID}
+    }
+    if _, err := tx.Exec(`DELETE FROM AgentTokens WHERE `+cond, args...); err != nil {
+        _ = tx.Rollback()
+        return 0, err
+    }
+    res, err := tx.Exec(`DELETE FROM AgentCredentials WHERE `+cond, args...)
+    if err != nil {
+        _ = tx.Rollback()
+        return 0, err
+    }
+    affected, _ := res.RowsAffected()
+    return affected, tx.Commit()
+}
+
+// storeToken keeps the hash of an issued token and drops the expired tokens and credentials.
+func (ak *agentsKeeper) storeToken(tokenHash, agentID string, credID, issuedAt, expiresAt int64) error {
+    if ak.db == nil {
+        return fmt.Errorf("database is not initialized")
+    }
+    tx, err := ak.db.Begin()
+    if err != nil {
+        return err
+    }
+    for _, q := range []string{`DELETE FROM AgentTokens WHERE expires_at <= ?`, `DELETE FROM AgentCredentials WHERE expires_at <> 0 AND expires_at <= ?`} {
+        if _, err := tx.Exec(q, issuedAt); err != nil {
+            _ = tx.Rollback()
+            return err
+        }
+    }
+    if _, err := tx.Exec(`INSERT INTO AgentTokens (token_hash, agent_id, cred_id, issued_at, expires_at) VALUES (?, ?, ?, ?, ?)`, tokenHash, agentID, credID, issuedAt, expiresAt); err != nil {
+        _ = tx.Rollback()
+        return err
+    }
+    return tx.Commit()
+}
+
+// tokenOwner gives the agent a token was issued to and its expiry, if it is still valid.
+func (ak *agentsKeeper) tokenOwner(tokenHash string) (string, int64, bool) {
+    if ak.db == nil {
+        return "", 0, false
+    }
+    var agentID string
+    var expiresAt int64
+    err := ak.db.QueryRow(`SELECT agent_id, expires_at FROM AgentTokens WHERE token_hash = ?`, tokenHash).Scan(&agentID, &expiresAt)
+    if err != nil || expiresAt <= time.Now().Unix() {
+        return "", 0, false
+    }
+    return agentID, expiresAt, true
+}
+
+type agentStatus struct {
+    lastSeen   int64
+    version    string
+    ip         string
+    heartbeats int64
+}
+
+// heartbeat records that the agent was seen at the time, keeping the version it reported before when none is given.
+func (ak *agentsKeeper) heartbeat(agentID, version, ip string, at int64) error {
+    if ak.db == nil {
+        return fmt.Errorf("database is not initialized")
+    }
+    _, err := ak.db.Exec(`
+        INSERT INTO AgentStatus (agent_id, last_seen, version, ip, heartbeats) VALUES (?, ?, ?, ?, 1)
+        ON CONFLICT (agent_id) DO UPDATE SET
+            last_seen = excluded.last_seen,
+            version = CASE WHEN excluded.version <> '' THEN excluded.version ELSE version END,
+            ip = excluded.ip,
+            heartbeats = heartbeats + 1
+    `, agentID, at, version, ip)
+    return err
+}
+
+// statuses gives what the heartbeats of the agents recorded; agents never seen are left out.
+func (ak *agentsKeeper) statuses(agentIDs []string) map[string]agentStatus {
+    out := map[string]agentStatus{}
+    if ak.db == nil || len(agentIDs) == 0 {
+        return out
+    }
+    wanted := map[string]struct{}{}
+    for _, id := range agentIDs {
+        wanted[id] = struct{}{}
+    }
+    rows, err := ak.db.Query(`SELECT agent_id, last_seen, version, ip, heartbeats FROM AgentStatus`)
+    if err != nil {
+        return out
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var id string
+        var st agentStatus
+        if err := rows.Scan(&id, &st.lastSeen, &st.version, &st.ip, &st.heartbeats); err != nil {
+            continue
+        }
+        if _, ok := wanted[id]; ok {
+            out[id] = st
+        }
+    }
+    return out
+}
+
+// agentRow is what agents.db keeps of an agent besides its credentials and status.
+type agentRow struct {
+    branch   string
+    descr    string
+    location string
+    extra    string
+    tags     []string
+    attrs    []agentAttr
+}
+
+// agentAttr is a typed attribute of an agent, the value in the canonical form of its type.
+type agentAttr struct {
+    name  string
+    typ   string
+    value string
+}
+
+type agentChange struct {
+    field    string
+    oldValue string
+    newValue string
+}
+
+func joinedTags(tags []string) string {
+    set := map[string]struct{}{}
+    for _, t := range tags {
+        if t != "" {
+            set[t] = struct{}{}
+        }
+    }
+    return strings.Join(sortedSet(set), ",")
+}
+
+// diffAgentRows lists the fields that differ, tags compared as a set and given sorted and comma separated.
+func diffAgentRows(was, now agentRow) []agentChange {
+    out := []agentChange{}
+    for _, f := range [][3]string{
+        {"branch", was.branch, now.branch},
+        {"descr", was.descr, now.descr},
+        {"location", was.location, now.location},
+        {"extra", was.extra, now.extra},
+        {"tags", joinedTags(was.tags), joinedTags(now.tags)},
+    } {
+        if f[1] != f[2] {
+            out = append(out, agentChange{field: f[0], oldValue: f[1], newValue: f[2]})
+        }
+    }
+    wasAttrs, nowAttrs := attrValueMap(was.attrs), attrValueMap(now.attrs)
+    names := map[string]struct{}{}
+    for n := range wasAttrs {
+        names[n] = struct{}{}
+    }
+    for n := range nowAttrs {
+        names[n] = struct{}{}
+    }
+    for _, n := range sortedSet(names) {
+        if wasAttrs[n] != nowAttrs[n] {
+            out = append(out, agentChange{field: "attributes." + n, oldValue: wasAttrs[n], newValue: nowAttrs[n]})
+        }
+    }
+    return out
+}
+
+// attrValueMap gives the attributes as name -> value, with the type after a non-string value.
+func attrValueMap(attrs []agentAttr) map[string]string {
+    ret := map[string]string{}
+    for _, a := range attrs {
+        ret[a.name] = a.value
+        if a.typ != "string" {
+            ret[a.name] += " (" + a.typ + ")"
+        }
+    }
+    return ret
+}
+
+func writeAgentAttrs(tx *sql.Tx, agentID string, attrs []agentAttr) error {
+    if _, err := tx.Exec(`DELETE FROM AgentAttributes WHERE agent_id = ?`, agentID); err != nil {
+        return err
+    }
+    for _, a := range attrs {
+        if _, err := tx.Exec(`INSERT INTO AgentAttributes (agent_id, name, type, value) VALUES (?, ?, ?, ?)`, agentID, a.name, a.typ, a.value); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// writeAgentHistory records the changes made by the action; register and unregister are recorded even without any.
+func writeAgentHistory(tx *sql.Tx, agentID, action string, at int64, changes []agentChange) error {
+    if len(changes) == 0 && (action == "register" || action == "unregister") {
+        changes = []agentChange{{}}
+    }
+    for _, c := range changes {
+        if _, err := tx.Exec(`INSERT INTO AgentHistory (agent_id, at, action, field, old_value, new_value) VALUES (?, ?, ?, ?, ?, ?)`,
+            agentID, at, action, c.field, c.oldValue, c.newValue); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func readAgentRow(tx *sql.Tx, agentID string) (agentRow, bool, error) {
+    var row agentRow
+    err := tx.QueryRow(`SELECT branch, descr, location, extra FROM Agents WHERE agent_id = ?`, agentID).Scan(&row.branch, &row.descr, &row.location, &row.extra)
+    if err == sql.ErrNoRows {
+        return row, false, nil
+    }
+    if err != nil {
+        return row, false, err
+    }
+    rows, err := tx.Query(`SELECT tag FROM Tags WHERE agent_id = ?`, agentID)
+    if err != nil {
+        return row, false, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var t string
+        if err := rows.Scan(&t); err == nil {
+            row.tags = append(row.tags, t)
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return row, false, err
+    }
+    attrRows, err := tx.Query(`SELECT name, type, value FROM AgentAttributes WHERE agent_id = ? ORDER BY name`, agentID)
+    if err != nil {
+        return row, false, err
+    }
+    defer attrRows.Close()
+    for attrRows.Next() {
+        var a agentAttr
+        if err := attrRows.Scan(&a.name, &a.typ, &a.value); err == nil {
+            row.attrs = append(row.attrs, a)
+        }
+    }
+    return row, true, attrRows.Err()
+}
+
+func readAgentRows(tx *sql.Tx) (map[string]agentRow, error) {
+    out := map[string]agentRow{}
+    rows, err := tx.Query(`SELECT agent_id, branch, descr, location, extra FROM Agents`)
+    if err != nil {
+        return nil, err
+    }
+    for rows.Next() {
+        var id string
+        var row agentRow
+        if err := rows.Scan(&id, &row.branch, &row.descr, &row.location, &row.extra); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        out[id] = row
+    }
+    rows.Close()
+    tagRows, err := tx.Query(`SELECT agent_id, tag FROM Tags`)
+    if err != nil {
+        return nil, err
+    }
+    for tagRows.Next() {
+        var id, t string
+        if err := tagRows.Scan(&id, &t); err != nil {
+            continue
+        }
+        if row, ok := out[id]; ok {
+            row.tags = append(row.tags, t)
+            out[id] = row
+        }
+    }
+    tagRows.Close()
+    attrRows, err := tx.Query(`SELECT agent_id, name, type, value FROM AgentAttributes ORDER BY name`)
+    if err != nil {
+        return nil, err
+    }
+    defer attrRows.Close()
+    for attrRows.Next() {
+        var id string
+        var a agentAttr
+        if err := attrRows.Scan(&id, &a.name, &a.typ, &a.value); err != nil {
+            continue
+        }
+        if row, ok := out[id]; ok {
+            row.attrs = append(row.attrs, a)
+            out[id] = row
+        }
+    }
+    return out, attrRows.Err()
+}
+
+// agentPatch tells what updateAgent changes: the fields given (nil ones are kept), tags replaced
+// when tags is given, then addTags added and removeTags removed, the attributes of attrs set
+// and those of removeAttrs removed.
+type agentPatch struct {
+    branch      *string
+    descr       *string
+    location    *string
+    extra       *string
+    tags        []string
+    setTags     bool
+    addTags     []string
+    removeTags  []string
+    attrs       []agentAttr
+    removeAttrs []string
+}
+
+var errAgentNotFound = fmt.Errorf("agent not found")
+
+// updateAgent changes the agent in place, keeping its credentials and status, and records the changes
+// in its history as a "move" when the branch changes and an "update" otherwise.
+func (ak *agentsKeeper) updateAgent(agentID string, patch agentPatch) ([]agentChange, error) {
+    if ak.db == nil {
+        return nil, fmt.Errorf("database is not initialized")
+    }
+    tx, err := ak.db.Begin()
+    if err != nil {
+        return nil, err
+    }
+    old, found, err := readAgentRow(tx, agentID)
+    if err != nil || !found {
+        _ = tx.Rollback()
+        if err == nil {
+            err = errAgentNotFound
+        }
+        return nil, err
+    }
+
+    row := old
+    for _, f := range []struct {
+        to   *string
+        from *string
+    }{{&row.branch, patch.branch}, {&row.descr, patch.descr}, {&row.location, patch.location}, {&row.extra, patch.extra}} {
+        if f.from != nil {
+            *f.to = *f.from
+        }
+    }
+    tags := map[string]struct{}{}
+    if !patch.setTags {
+        patch.tags = old.tags
+    }
+    for _, t := range append(append([]string{}, patch.tags...), patch.addTags...) {
+        if t != "" {
+            tags[t] = struct{}{}
+        }
+    }
+    for _, t := range patch.removeTags {
+        delete(tags, t)
+    }
+    row.tags = sortedSet(tags)
+    attrs, names := map[string]agentAttr{}, map[string]struct{}{}
+    for _, a := range append(append([]agentAttr{}, old.attrs...), patch.attrs...) {
+        attrs[a.name], names[a.name] = a, struct{}{}
+    }
+    for _, n := range patch.removeAttrs {
+        delete(names, n)
+    }
+    row.attrs = []agentAttr{}
+    for _, n := range sortedSet(names) {
+        row.attrs = append(row.attrs, attrs[n])
+    }
+
+    changes := diffAgentRows(old, row)
+    if len(changes) == 0 {
+        return changes, tx.Rollback()
+    }
+    action := "update"
+    for _, c := range changes {
+        if c.field == "branch" {
+            action = "move"
+        }
+    }
+    if _, err := tx.Exec(`UPDATE Agents SET branch = ?, descr = ?, location = ?, extra = ? WHERE agent_id = ?`, row.branch, row.descr, row.location, row.extra, agentID); err != nil {
+        _ = tx.Rollback()
+        return nil, err
+    }
+    if joinedTags(old.tags) != joinedTags(row.tags) {
+        if _, err := tx.Exec(`DELETE FROM Tags WHERE agent_id = ?`, agentID); err != nil {
+            _ = tx.Rollback()
+            return nil, err
+        }
+        for _, t := range row.tags {
+            if _, err := tx.Exec(`INSERT INTO Tags (agent_id, tag) VALUES (?, ?)`, agentID, t); err != nil {
+                _ = tx.Rollback()
+                return nil, err
+            }
+        }
+    }
+    for _, c := range changes {
+        if strings.HasPrefix(c.field, "attributes.") {
+            if err := writeAgentAttrs(tx, agentID, row.attrs); err != nil {
+                _ = tx.Rollback()
+                return nil, err
+            }
+            break
+        }
+    }
+    if err := writeAgentHistory(tx, agentID, action, time.Now().Unix(), changes); err != nil {
+        _ = tx.Rollback()
+        return nil, err
+    }
+    return changes, tx.Commit()
+}
+
+// attributes gives the attributes of the agents by agent, each list sorted by name.
+func (ak *agentsKeeper) attributes(agentIDs []string) map[string][]agentAttr {
+    out := map[string][]agentAttr{}
+    if ak.db == nil || len(agentIDs) == 0 {
+        return out
+    }
+    args := make([]interface{}, 0, len(agentIDs))
+    for _, id := range agentIDs {
+        args = append(args, id)
+    }
+    rows, err := ak.db.Query("SELECT agent_id, name, type, value FROM AgentAttributes WHERE agent_id IN ("+strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")+") ORDER BY name", args...)
+    if err != nil {
+        return out
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var id string
+        var a agentAttr
+        if err := rows.Scan(&id, &a.name, &a.typ, &a.value); err == nil {
+            out[id] = append(out[id], a)
+        }
+    }
+    return out
+}
+
+type agentHistoryEntry struct {
+    id     int64
+    at     int64
+    action string
+    change agentChange
+}
+
+// history gives the recorded changes of the agent, the newest first.
+func (ak *agentsKeeper) history(agentID string, limit int) ([]agentHistoryEntry, error) {
+    if ak.db == nil {
+        return nil, fmt.Errorf("database is not initialized")
+    }
+    rows, err := ak.db.Query(`SELECT hist_id, at, action, field, old_value, new_value FROM AgentHistory WHERE agent_id = ? ORDER BY hist_id DESC LIMIT ?`, agentID, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    out := []agentHistoryEntry{}
+    for rows.Next() {
+        var e agentHistoryEntry
+        if err := rows.Scan(&e.id, &e.at, &e.action, &e.change.field, &e.change.oldValue, &e.change.newValue); err != nil {
+            return nil, err
+        }
+        out = append(out, e)
+    }
+    return out, rows.Err()
+}
+
+// agentGroup is a named set of agents, listed (static) or selected by a saved query.
+type agentGroup struct {
+    id        string
+    descr     string
+    kind      string
+    tags      string
+    branch    string
+    subtree   bool
+    attrs     []string
+    createdAt int64
+    members   []string // of a static group
+}
+
+func saveAgentGroup(tx *sql.Tx, g agentGroup) error {
+    if _, err := tx.Exec(`
+        INSERT INTO AgentGroups (group_id, descr, kind, tags, branch, subtree, attrs, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (group_id) DO UPDATE SET
+            descr = excluded.descr, kind = excluded.kind, tags = excluded.tags, branch = excluded.branch,
+            subtree = excluded.subtree, attrs = excluded.attrs
+    `, g.id, g.descr, g.kind, g.tags, g.branch, g.subtree, strings.Join(g.attrs, "\n"), g.createdAt); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(`DELETE FROM AgentGroupMembers WHERE group_id = ?`, g.id); err != nil {
+        return err
+    }
+    for _, m := range g.members {
+        if _, err := tx.Exec(`INSERT OR IGNORE INTO AgentGroupMembers (group_id, agent_id) VALUES (?, ?)`, g.id, m); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// saveGroup creates the group or writes it over the stored one, members included.
+func (ak *agentsKeeper) saveGroup(g agentGroup) error {
+    if ak.db == nil {
+        return fmt.Errorf("database is not initialized")
+    }
+    tx, err := ak.db.Begin()
+    if err != nil {
+        return err
+    }
+    if err := saveAgentGroup(tx, g); err != nil {
+        _ = tx.Rollback()
+        return err
+    }
+    return tx.Commit()
+}
+
+func (ak *agentsKeeper) deleteGroup(groupID string) (bool, error) {
+    if ak.db == nil {
+        return false, fmt.Errorf("database is not initialized")
+    }
+    tx, err := ak.db.Begin()
+    if err != nil {
+        return false, err
+    }
+    if _, err := tx.Exec(`DELETE FROM AgentGroupMembers WHERE group_id = ?`, groupID); err != nil {
+        _ = tx.Rollback()
+        return false, err
+    }
+    res, err := tx.Exec(`DELETE FROM AgentGroups WHERE group_id = ?`, groupID)
+    if err != nil {
+        _ = tx.Rollback()
+        return false, err
+    }
+    affected, _ := res.RowsAffected()
+    return affected > 0, tx.Commit()
+}
+
+// groups gives the groups sorted by id, all of them when groupIDs is empty.
+func (ak *agentsKeeper) groups(groupIDs ...string) ([]agentGroup, error) {
+    if ak.db == nil {
+        return nil, fmt.Errorf("database is not initialized")
+    }
+    q, args := `SELECT group_id, descr, kind, tags, branch, subtree, attrs, created_at FROM AgentGroups`, []interface{}{}
+    if len(groupIDs) > 0 {
+        q += " WHERE group_id IN (" + strings.TrimSuffix(strings.Repeat("?,", len(groupIDs)), ",") + ")"
+        for _, id := range groupIDs {
+            args = append(args, id)
+        }
+    }
+    rows, err := ak.db.Query(q+" ORDER BY group_id", args...)
+    if err != nil {
+        return nil, err
+    }
+    out := []agentGroup{}
+    byID := map[string]int{}
+    for rows.Next() {
+        var g agentGroup
+        var attrs string
+        if err := rows.Scan(&g.id, &g.descr, &g.kind, &g.tags, &g.branch, &g.subtree, &attrs, &g.createdAt); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        if attrs != "" {
+            g.attrs = strings.Split(attrs, "\n")
+        }
+        byID[g.id] = len(out)
+        out = append(out, g)
+    }
+    rows.Close()
+    members, err := ak.db.Query(`SELECT group_id, agent_id FROM AgentGroupMembers ORDER BY agent_id`)
+    if err != nil {
+        return nil, err
+    }
+    defer members.Close()
+    for members.Next() {
+        var gid, aid string
+        if err := members.Scan(&gid, &aid); err != nil {
+            continue
+        }
+        if i, ok := byID[gid]; ok {
+            out[i].members = append(out[i].members, aid)
+        }
+    }
+    return out, members.Err()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registered agents report they are alive with /aac/agent/heartbeat; agents.db keeps the time
+// of the last heartbeat, the version the agent reported and the address it came from. An agent
+// is online while its last heartbeat is younger than agent_online_timeout of general.yaml,
+// offline after that, and "never" until its first heartbeat. An agent that has credentials
+// must send a token of its own with the heartbeat.
+
+var agentStatusFilters = []string{"all", "online", "offline", "never"}
+
+const defaultAgentOnlineTimeout = 5 // minutes
+
+var (
+	trustedProxies   []*net.IPNet
+	trustedProxiesMu sync.RWMutex
+)
+
+// setTrustedProxies takes the addresses and CIDR networks of trusted_proxies of the run location.
+func setTrustedProxies(items []string) {
+	nets := make([]*net.IPNet, 0, len(items))
+	for _, item := range items {
+		cidr := item
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logAac.Warn("trusted proxy ignored", "proxy", item, "error", err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	trustedProxiesMu.Lock()
+	trustedProxies = nets
+	trustedProxiesMu.Unlock()
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	trustedProxiesMu.RLock()
+	defer trustedProxiesMu.RUnlock()
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestIP gives the address of the client. X-Forwarded-For and X-Real-Ip are believed only
+// when the peer is a trusted proxy: then the client is the nearest address of X-Forwarded-For
+// that is not a trusted proxy itself, as a client can put anything in front of the list.
+func requestIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		peer = host
+	}
+	if !isTrustedProxy(peer) {
+		return peer
+	}
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		hops := strings.Split(fwd, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			if hop := strings.TrimSpace(hops[i]); hop != "" && (i == 0 || !isTrustedProxy(hop)) {
+				return hop
+			}
+		}
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-Ip")); realIP != "" {
+		return realIP
+	}
+	return peer
+}
+
+func (ak *agentsKeeper) statusName(st agentStatus, seen bool, now int64) string {
+	timeout := ak.onlineTimeout
+	if timeout <= 0 {
+		timeout = defaultAgentOnlineTimeout
+	}
+	switch {
+	case !seen:
+		return "never"
+	case now-st.lastSeen <= timeout*60:
+		return "online"
+	}
+	return "offline"
+}
+
+func (dk *configDataKeeper) agentHeartbeat(agentID, token, version, ip string) map[string]interface{} {
+	if agentID == "" {
+		return newInternError("WRONG-FORMAT", "Required argument not given: agent", nil).dict4api
+	}
+	if dk.agentsKeeper.getAgentDict(agentID, false) == nil {
+		return newInternError("AGENT-UNKNOWN", fmt.Sprintf("Agent %v is never registered", agentID), map[string]interface{}{"bad_value": agentID}).dict4api
+	}
+	if len(dk.agentsKeeper.credentials(agentID, false)) > 0 {
+		if owner, _, ok := dk.agentsKeeper.tokenOwner(hashAgentToken(token)); !ok || owner != agentID {
+			return newInternError("WRONG-SECRET", fmt.Sprintf("Agent %v has credentials, the heartbeat needs a token of it", agentID), nil).dict4api
+		}
+	}
+	now := time.Now().Unix()
+	if err := dk.agentsKeeper.heartbeat(agentID, version, ip, now); err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Heartbeat not recorded: %v", err), nil).dict4api
+	}
+	return map[string]interface{}{"result": true, "agent": agentID, "last_seen": now}
+}
+
+// listAgentsStatus is the agents list of the branch with the status of every agent, only those in the status asked for.
+func (dk *configDataKeeper) listAgentsStatus(branchID, status string) map[string]interface{} {
+	if status == "" {
+		status = "all"
+	}
+	if !hasKey(mapSet(agentStatusFilters...), status) {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Unknown status %v, expected one of %v", status, agentStatusFilters), map[string]interface{}{"bad_value": status}).dict4api
+	}
+	agents, err := dk._agentsOfBranch(branchID)
+	if err != nil {
+		return err.dict4api
+	}
+	ids := make([]string, 0, len(agents))
+	for _, ag := range agents {
+		ids = append(ids, ag[0])
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i][0] < agents[j][0] })
+
+	statuses := dk.agentsKeeper.statuses(ids)
+	now := time.Now().Unix()
+	counts := map[string]int{"online": 0, "offline": 0, "never": 0}
+	rep := make([]interface{}, 0, len(agents))
+	for _, ag := range agents {
+		st, seen := statuses[ag[0]]
+		name := dk.agentsKeeper.statusName(st, seen, now)
+		counts[name]++
+		if status != "all" && status != name {
+			continue
+		}
+		entry := map[string]interface{}{"agent": ag[0], "branch": ag[1], "status": name}
+		if seen {
+			entry["last_seen"] = st.lastSeen
+			entry["version"] = st.version
+			entry["ip"] = st.ip
+			entry["heartbeats"] = st.heartbeats
+		}
+		rep = append(rep, entry)
+	}
+	return map[string]interface{}{"result": true, "report": rep, "counts": counts}
+}
+
+func handleAgentHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	writeJSON(w, storage.agentHeartbeat(strings.TrimSpace(r.FormValue("agent")), requestAgentToken(r), strings.TrimSpace(r.FormValue("version")), requestIP(r)))
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/antchfx/xmlquery"
+)
+
+// An agent is changed in place with /aac/agent/update: only the fields given are set, and
+// tags can be replaced or have some added and removed. agents.db keeps the history of every
+// agent in AgentHistory, one row per changed field, for registration, updates, moves (also
+// of a renamed branch), imports and unregistration; /aac/agent/history gives it.
+//
+// /aac/agent/movedown only moves an agent below its branch. /aac/agent/move takes it to any
+// branch, up or to a sibling too, when the operator is accountable for both the branch the
+// agent is in and the one it goes to.
+
+var agentUpdateFields = []string{"descr", "location", "tags", "extraxml"}
+
+const (
+	agentHistoryDefaultLimit = 100
+	agentHistoryMaxLimit     = 1000
+)
+
+func splitTags(tags string) []string {
+	ret := []string{}
+	for _, t := range strings.Split(tags, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+func agentChangesDict(changes []agentChange) []interface{} {
+	ret := make([]interface{}, 0, len(changes))
+	for _, c := range changes {
+		ret = append(ret, map[string]interface{}{"field": c.field, "old": c.oldValue, "new": c.newValue})
+	}
+	return ret
+}
+
+// updateAgent sets the fields of set (descr, location, tags, extraxml) and adds and removes the comma separated tags.
+func (dk *configDataKeeper) updateAgent(agentID string, set map[string]string, addTags, removeTags string) map[string]interface{} {
+	if agentID == "" {
+		return newInternError("WRONG-FORMAT", "Required argument not given: agent", nil).dict4api
+	}
+	for k := range set {
+		if !hasKey(mapSet(agentUpdateFields...), k) {
+			return newInternError("WRONG-FORMAT", fmt.Sprintf("Field %v cannot be updated, expected one of %v", k, agentUpdateFields), map[string]interface{}{"bad_value": k}).dict4api
+		}
+	}
+	patch := agentPatch{addTags: splitTags(addTags), removeTags: splitTags(removeTags)}
+	for _, t := range patch.addTags {
+		if hasKey(mapSet(patch.removeTags...), t) {
+			return newInternError("WRONG-FORMAT", fmt.Sprintf("Tag %v is both added and removed", t), map[string]interface{}{"bad_value": t}).dict4api
+		}
+	}
+	if v, ok := set["descr"]; ok {
+		patch.descr = &v
+	}
+	if v, ok := set["location"]; ok {
+		patch.location = &v
+	}
+	if v, ok := set["extraxml"]; ok {
+		if _, err := xmlquery.Parse(strings.NewReader("<extra>" + v + "</extra>")); err != nil {
+			return newInternError("WRONG-FORMAT", fmt.Sprintf("extraxml field does not fit into XML format, details: %v", err), nil).dict4api
+		}
+		patch.extra = &v
+	}
+	if v, ok := set["tags"]; ok {
+		patch.tags, patch.setTags = splitTags(v), true
+	}
+
+	changes, err := dk.agentsKeeper.updateAgent(agentID, patch)
+	if err == errAgentNotFound {
+		return newInternError("AGENT-UNKNOWN", fmt.Sprintf("Agent %v is never registered", agentID), map[string]interface{}{"bad_value": agentID}).dict4api
+	}
+	if err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Agent %v not updated: %v", agentID, err), nil).dict4api
+	}
+	if len(changes) > 0 {
+		logDataKeeper.Info("agent updated", "agent", agentID, "changes", len(changes))
+	}
+	return map[string]interface{}{"result": true, "agent": agentID, "changes": agentChangesDict(changes)}
+}
+
+// agentHistory gives the history of the agent, the newest change first; it stays after the agent is unregistered.
+func (dk *configDataKeeper) agentHistory(agentID string, limit int) map[string]interface{} {
+	if agentID == "" {
+		return newInternError("WRONG-FORMAT", "Required argument not given: agent", nil).dict4api
+	}
+	if limit <= 0 {
+		limit = agentHistoryDefaultLimit
+	}
+	if limit > agentHistoryMaxLimit {
+		limit = agentHistoryMaxLimit
+	}
+	entries, err := dk.agentsKeeper.history(agentID, limit)
+	if err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("History of agent %v not read: %v", agentID, err), nil).dict4api
+	}
+	registered := dk.agentsKeeper.getAgentDict(agentID, false) != nil
+	if len(entries) == 0 && !registered {
+		return newInternError("AGENT-UNKNOWN", fmt.Sprintf("Agent %v is never registered", agentID), map[string]interface{}{"bad_value": agentID}).dict4api
+	}
+	rep := make([]interface{}, 0, len(entries))
+	for _, e := range entries {
+		entry := map[string]interface{}{"id": e.id, "at": e.at, "action": e.action}
+		if e.change.field != "" {
+			entry["field"] = e.change.field
+			entry["old"] = e.change.oldValue
+			entry["new"] = e.change.newValue
+		}
+		rep = append(rep, entry)
+	}
+	return map[string]interface{}{"result": true, "agent": agentID, "registered": registered, "history": rep}
+}
+
+// moveAgent moves the agent to the branch in any direction, on the authority of the operator over both branches.
+func (dk *configDataKeeper) moveAgent(agentID, branchID, operator string, dryRun bool) map[string]interface{} {
+	if agentID == "" || branchID == "" || operator == "" {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Not all required parameters are given: agent is %v, branch is %v, operator is %v", agentID, branchID, operator), nil).dict4api
+	}
+	current := dk.agentsKeeper.getAgentDict(agentID, false)
+	if current == nil {
+		return newInternError("AGENT-UNKNOWN", fmt.Sprintf("Agent %v is never registered", agentID), map[string]interface{}{"bad_value": agentID}).dict4api
+	}
+	from := fmt.Sprintf("%v", current["branch"])
+	view := dk.data()
+	if view.branch(branchID) == nil {
+		return newInternError("BRANCH-UNKNOWN", fmt.Sprintf("Branch %v is unknown", branchID), map[string]interface{}{"bad_value": branchID}).dict4api
+	}
+	if view.branch(from) == nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Branch %v referenced from agent %v does not longer exist", from, agentID), nil).dict4api
+	}
+	if _, ex := dk._get_branch_relOp(operator, from); ex != nil {
+		return ex.dict4api
+	}
+	if _, ex := dk._get_branch_relOp(operator, branchID); ex != nil {
+		return ex.dict4api
+	}
+
+	direction := "lateral"
+	switch {
+	case from == branchID:
+		direction = "none"
+	case view.within(branchID, from):
+		direction = "down"
+	case view.within(from, branchID):
+		direction = "up"
+	}
+	attrs := dk.agentsKeeper.attributes([]string{agentID})[agentID]
+	sch := dk.agentSchemaOf(branchID)
+	if violations := sch.violations(attrs); len(violations) > 0 {
+		return newInternError("NOT-ALLOWED", fmt.Sprintf("Attributes of agent %v break the schema of branch %v", agentID, branchID), map[string]interface{}{"schema_problems": violations}).dict4api
+	}
+	ret := map[string]interface{}{"result": true, "agent": agentID, "from": from, "to": branchID, "direction": direction, "schema_problems": sch.problems(attrs)}
+	if dryRun || direction == "none" {
+		if dryRun {
+			ret["dry_run"] = true
+		}
+		return ret
+	}
+
+	if _, err := dk.agentsKeeper.updateAgent(agentID, agentPatch{branch: &branchID}); err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Agent %v not moved to %v: %v", agentID, branchID, err), nil).dict4api
+	}
+	logDataKeeper.Info("agent moved", "agent", agentID, "from", from, "to", branchID, "direction", direction, "operator", operator)
+	return ret
+}
+
+func handleAgentUpdate(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	agent := strings.TrimSpace(r.FormValue("agent"))
+	if r.Method == http.MethodGet {
+		ini := map[string]string{}
+		if ag := storage.agentDetailsJson(agent); agent != "" && ag["result"] == true {
+			if details, ok := ag["details"].(map[string]interface{}); ok {
+				for _, k := range []string{"descr", "location", "tags", "extra"} {
+					ini[k], _ = details[k].(string)
+				}
+			}
+		}
+		writeJSON(w, map[string]interface{}{
+			"result":          true,
+			"formMethod":      "post",
+			"agentsList":      storage.getAgents(),
+			"agentInit":       agent,
+			"agentAutoSubmit": agent == "",
+			"extratxtinputs": [][3]string{
+				{"descr", "Description", ini["descr"]},
+				{"location", "Location", ini["location"]},
+				{"tags", "Tags (comma separated)", ini["tags"]},
+				{"tags_add", "Tags to add (comma separated)", ""},
+				{"tags_remove", "Tags to remove (comma separated)", ""},
+				{"extraxml", "Optional info in free XML format", ini["extra"]},
+			},
+		})
+		return
+	}
+	set := map[string]string{}
+	for _, k := range agentUpdateFields {
+		if _, ok := r.Form[k]; ok {
+			set[k] = r.FormValue(k)
+		}
+	}
+	writeJSON(w, storage.updateAgent(agent, set, r.FormValue("tags_add"), r.FormValue("tags_remove")))
+}
+
+func handleAgentHistory(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet) {
+		return
+	}
+	parseRequestForm(r)
+	writeJSON(w, storage.agentHistory(strings.TrimSpace(r.FormValue("agent")), toInt(r.FormValue("limit"), agentHistoryDefaultLimit)))
+}
+
+func handleAgentMove(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	if r.Method == http.MethodGet {
+		writeJSON(w, map[string]interface{}{
+			"result":         true,
+			"formMethod":     "post",
+			"operatorDriven": true,
+			"agentsList":     storage.getAgents(),
+			"branchList":     storageBranches(),
+			"cboxes":         [][2]string{{"dry_run", "Only check, do not move"}},
+		})
+		return
+	}
+	writeJSON(w, storage.moveAgent(
+		strings.TrimSpace(r.FormValue("agent")),
+		strings.TrimSpace(r.FormValue("branch")),
+		strings.TrimSpace(r.FormValue("operator")),
+		boolFromParam(r.FormValue("dry_run"), false),
+	))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A batch is applied to a sandbox copy of universe.xml operation by operation. When all of
+// them succeed and no new integrity issues appear, the copy replaces the tree and is saved
+// once; otherwise nothing is changed. Operations are named after their endpoints and take the
+// same fields. Operations on agents.db are not offered since they cannot be rolled back.
+
+type batchOperation struct {
+	Op   string                 `json:"op"`
+	Args map[string]interface{} `json:"args"`
+}
+
+type batchRequest struct {
+	Operations []batchOperation `json:"operations"`
+	DryRun     bool             `json:"dry_run"`
+}
+
+var batchOperations = map[string]func(dk *configDataKeeper, a url.Values) map[string]interface{}{
+	"branch/subbranch/add": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.addBranchSub(a.Get("branch"), a.Get("subbranch"))
+	},
+	"branch/delete": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.deleteBranch(a.Get("branch"))
+	},
+	"branch/move": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.moveBranch(a.Get("branch"), a.Get("parent"), false)
+	},
+	"branch/fswhitelist/set": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.setBranchFsWhiteList(a.Get("branch"), boolFromParam(a.Get("propparent"), false), a["white"])
+	},
+	"branch/role/create": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.createBranchRole(a.Get("branch"), a.Get("role"), a["duties"])
+	},
+	"branch/role/delete": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.deleteBranchRole(a.Get("branch"), a.Get("role"), a.Get("mode"), false)
+	},
+	"funcset/create": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.funcsetCreate(a.Get("branch"), a.Get("funcset"), a.Get("readablename"))
+	},
+	"funcset/delete": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.funcsetDelete(a.Get("funcset"), a.Get("mode"), false)
+	},
+	"funcset/function/add": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.funcsetFuncAdd(a.Get("funcset"), a.Get("funcId"))
+	},
+	"funcset/function/remove": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.funcsetFuncRemove(a.Get("funcset"), a.Get("funcId"))
+	},
+	"role/funcset/add": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.roleFuncsetAdd(a.Get("branch"), a.Get("role"), a.Get("funcset"))
+	},
+	"role/funcset/remove": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.roleFuncsetRemove(a.Get("branch"), a.Get("role"), a.Get("funcset"))
+	},
+	"hr/branch/position/create": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.createBranchPosition(a.Get("branch"), a.Get("role"))
+	},
+	"hr/branch/position/delete": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.deleteBranchPosition(a.Get("branch"), a.Get("role"))
+	},
+	"user/create": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.createUser(a.Get("username"), a.Get("secret"), a.Get("operator"), a.Get("pswlifetime"), a.Get("readablename"), a.Get("sessionmax"))
+	},
+	"user/delete": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.deleteUser(a.Get("username"), a.Get("operator"))
+	},
+	"hr/hire": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.hireEmployee(a.Get("username"), a.Get("branch"), a.Get("position"), a.Get("operator"))
+	},
+	"hr/fire": func(dk *configDataKeeper, a url.Values) map[string]interface{} {
+		return dk.fireEmployee(a.Get("username"), a.Get("operator"), a.Get("branch"), a.Get("position"))
+	},
+}
+
+// batchArgs turns JSON arguments into form values; lists are kept for the multi-valued fields.
+func batchArgs(args map[string]interface{}) url.Values {
+	ret := url.Values{}
+	for k, v := range args {
+		switch val := v.(type) {
+		case []interface{}:
+			for _, item := range val {
+				ret.Add(k, strings.TrimSpace(fmt.Sprintf("%v", item)))
+			}
+		case nil:
+		default:
+			ret.Set(k, strings.TrimSpace(fmt.Sprintf("%v", val)))
+		}
+	}
+	return ret
+}
+
+func (dk *configDataKeeper) runBatch(ops []batchOperation, dryRun bool) map[string]interface{} {
+	if len(ops) == 0 {
+		return newInternError("WRONG-FORMAT", "No operations given", nil).dict4api
+	}
+	for i, op := range ops {
+		if _, ok := batchOperations[op.Op]; !ok {
+			return newInternError("WRONG-FORMAT", fmt.Sprintf("Operation #%d: unknown operation %v", i, op.Op), map[string]interface{}{"bad_value": op.Op, "operationList": batchOperationNames()}).dict4api
+		}
+	}
+
+	sb := dk.newSandbox()
+	results := make([]interface{}, 0, len(ops))
+	for i, op := range ops {
+		res := batchOperations[op.Op](sb, batchArgs(op.Args))
+		results = append(results, map[string]interface{}{"op": op.Op, "outcome": res})
+		if ok, _ := res["result"].(bool); !ok {
+			return newInternError("BATCH-FAILED", fmt.Sprintf("Operation #%d %v failed, nothing applied", i, op.Op), map[string]interface{}{"failed_at": i, "results": results}).dict4api
+		}
+	}
+
+	if introduced := dk.introducedIssues(sb); len(introduced) > 0 {
+		return newInternError("BATCH-FAILED", fmt.Sprintf("Operations would introduce %d integrity issue(s), nothing applied", len(introduced)), map[string]interface{}{"integrity": introduced, "results": results}).dict4api
+	}
+
+	if dryRun {
+		return map[string]interface{}{"result": true, "dry_run": true, "results": results}
+	}
+
+	if ex := dk._stored(dk.store.replaceWith(sb.store), false); ex != nil {
+		return ex.dict4api
+	}
+	logDataKeeper.Info("batch applied", "operations", len(ops))
+	return map[string]interface{}{"result": true, "results": results}
+}
+
+func batchOperationNames() []string {
+	keys := map[string]struct{}{}
+	for k := range batchOperations {
+		keys[k] = struct{}{}
+	}
+	return sortedSet(keys)
+}
+
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, map[string]interface{}{
+			"result":        true,
+			"formMethod":    "post",
+			"operationList": batchOperationNames(),
+		})
+		return
+	}
+
+	var req batchRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 8<<20))
+		if err == nil {
+			err = json.Unmarshal(body, &req)
+		}
+		if err != nil {
+			writeJSON(w, newInternError("WRONG-FORMAT", fmt.Sprintf("Batch is not valid JSON: %v", err), nil).dict4api)
+			return
+		}
+	} else {
+		parseRequestForm(r)
+		if err := json.Unmarshal([]byte(r.FormValue("operations")), &req.Operations); err != nil {
+			writeJSON(w, newInternError("WRONG-FORMAT", fmt.Sprintf("Field operations is not a valid JSON list: %v", err), nil).dict4api)
+			return
+		}
+		req.DryRun = boolFromParam(r.FormValue("dry_run"), false)
+	}
+	writeJSON(w, storage.runBatch(req.Operations, req.DryRun))
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const cliUsage = `Usage: aac [command] [flags]
+
+Commands:
+  serve       run the HTTP server (default when no command is given)
+  validate    load DATA and report problems found in it
+  export      write a copy of the DATA files into a directory, or the
+              data as one JSON file with -format json
+  import      replace the DATA files with the ones from a directory, agents.db
+              too when the directory has one, refusing data with integrity
+              issues the current one has not; or merge or replace the data
+              from a JSON file with -format json
+  user add    create a person in universe.xml
+  hire        employ a person at a branch position
+
+Offline commands work on the DATA directory directly; do not run them
+against a directory a running server is writing to.
+
+Run "aac <command> -h" for the flags of a command. Every path flag can
+also be given by an environment variable, shown in the flag help.
+`
+
+type cliOptions struct {
+	configPath string
+	dataDir    string
+	staticDir  string
+	listen     string
+	tlsCert    string
+	tlsKey     string
+	runAt      string
+}
+
+func envOr(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+func addStorageFlags(fs *flag.FlagSet, opts *cliOptions) {
+	fs.StringVar(&opts.configPath, "config", envOr("AAC_CONFIG", ""), "path to general.yaml (env AAC_CONFIG)")
+	fs.StringVar(&opts.dataDir, "data", envOr("AAC_DATA", ""), "DATA directory with universe.xml, catalogues.xml and agents.db (env AAC_DATA)")
+}
+
+// resolvePaths fills what was not given explicitly with the locations the server has always guessed.
+func (opts *cliOptions) resolvePaths() {
+	if opts.configPath == "" {
+		p, err := firstExisting(filepath.Join("..", "config", "general.yaml"), filepath.Join("config", "general.yaml"))
+		if err != nil {
+			p, _ = filepath.Abs("../config/general.yaml")
+		}
+		opts.configPath = p
+	}
+	if opts.dataDir == "" {
+		opts.dataDir, _ = firstExisting(filepath.Join("..", "DATA"), "DATA", filepath.Join("aac", "DATA"), filepath.Join("..", "aac", "DATA"))
+	}
+	if opts.staticDir == "" {
+		opts.staticDir, _ = firstExisting(filepath.Join("..", "aac", "static"), filepath.Join("aac", "static"), filepath.Join("static"))
+	}
+}
+
+func main() {
+	os.Exit(runCLI(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func runCLI(args []string, stdout, stderr io.Writer) int {
+	cmd := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	if cmd == "user" {
+		if len(args) == 0 || args[0] != "add" {
+			fmt.Fprint(stderr, cliUsage)
+			return 2
+		}
+		cmd, args = "user add", args[1:]
+	}
+
+	switch cmd {
+	case "serve":
+		return cmdServe(args, stderr)
+	case "validate":
+		return cmdValidate(args, stdout, stderr)
+	case "export":
+		return cmdExport(args, stdout, stderr)
+	case "import":
+		return cmdImport(args, stdout, stderr)
+	case "user add":
+		return cmdUserAdd(args, stdout, stderr)
+	case "hire":
+		return cmdHire(args, stdout, stderr)
+	case "help":
+		fmt.Fprint(stdout, cliUsage)
+		return 0
+	}
+	fmt.Fprintf(stderr, "unknown command %q\n\n%s", cmd, cliUsage)
+	return 2
+}
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+func cmdServe(args []string, stderr io.Writer) int {
+	opts := cliOptions{}
+	fs := newFlagSet("serve", stderr)
+	addStorageFlags(fs, &opts)
+	fs.StringVar(&opts.staticDir, "static", envOr("AAC_STATIC", ""), "directory with static pages (env AAC_STATIC)")
+	fs.StringVar(&opts.listen, "listen", envOr("AAC_LISTEN", ""), "listen address, e.g. :5001; default is the port of the run location (env AAC_LISTEN)")
+	fs.StringVar(&opts.tlsCert, "tls-cert", envOr("AAC_TLS_CERT", ""), "TLS certificate file, enables HTTPS together with -tls-key (env AAC_TLS_CERT)")
+	fs.StringVar(&opts.tlsKey, "tls-key", envOr("AAC_TLS_KEY", ""), "TLS private key file (env AAC_TLS_KEY)")
+	fs.StringVar(&opts.runAt, "runat", envOr("AAC_RUNAT", ""), "run location from general.yaml (env AAC_RUNAT)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if (opts.tlsCert == "") != (opts.tlsKey == "") {
+		fmt.Fprintln(stderr, "both -tls-cert and -tls-key are required for TLS")
+		return 2
+	}
+	opts.resolvePaths()
+	return serve(opts)
+}
+
+// openOffline loads the DATA directory for the commands working without the server.
+func openOffline(opts *cliOptions, stderr io.Writer) (*configDataKeeper, error) {
+	setupConsoleLogging(stderr, slog.LevelWarn)
+	opts.resolvePaths()
+	if opts.dataDir == "" {
+		return nil, fmt.Errorf("DATA directory not found, give it with -data")
+	}
+	sessMax, historyKeep := int64(60), 0
+	var storageCfg storageConfig
+	if cfg, err := loadAppConfig(opts.configPath); err == nil {
+		sessMax, historyKeep = cfg.SessionMaxDefault, cfg.HistoryKeep
+		storageCfg = cfg.Storage
+	} else {
+		fmt.Fprintf(stderr, "warning: config %s not read (%v), default session length is %d and data is kept in XML files\n", opts.configPath, err, sessMax)
+	}
+	dk := newConfigDataKeeper(opts.dataDir, sessMax)
+	dk.historyKeep = historyKeep
+	store, err := openStore(storageCfg, opts.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	dk.store = store
+	if err := dk.load(); err != nil {
+		dk.close()
+		return nil, err
+	}
+	return dk, nil
+}
+
+func printResult(stdout io.Writer, ret map[string]interface{}) int {
+	b, err := json.MarshalIndent(ret, "", "  ")
+	if err != nil {
+		fmt.Fprintf(stdout, "%v\n", ret)
+	} else {
+		fmt.Fprintln(stdout, string(b))
+	}
+	if ok, _ := ret["result"].(bool); ok {
+		return 0
+	}
+	return 1
+}
+
+func cmdValidate(args []string, stdout, stderr io.Writer) int {
+	opts := cliOptions{}
+	fs := newFlagSet("validate", stderr)
+	addStorageFlags(fs, &opts)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	dk, err := openOffline(&opts, stderr)
+	if err != nil {
+		return printResult(stdout, newInternError("DATABASE-ERROR", err.Error(), nil).dict4api)
+	}
+	defer dk.close()
+	return printResult(stdout, dk.validate())
+}
+
+func cmdExport(args []string, stdout, stderr io.Writer) int {
+	opts := cliOptions{}
+	fs := newFlagSet("export", stderr)
+	addStorageFlags(fs, &opts)
+	out := fs.String("out", "", "directory to write the copy to, or the JSON file; required unless -format json, which then writes to stdout")
+	format := fs.String("format", "xml", "xml for a copy of the files, json for the JSON representation")
+	secrets := fs.Bool("secrets", false, "include the secrets of persons in the JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *format != "xml" && *format != "json" {
+		fmt.Fprintf(stderr, "unknown format %q\n", *format)
+		return 2
+	}
+	if *out == "" && *format == "xml" {
+		fmt.Fprintln(stderr, "-out is required")
+		return 2
+	}
+	dk, err := openOffline(&opts, stderr)
+	if err != nil {
+		return printResult(stdout, newInternError("DATABASE-ERROR", err.Error(), nil).dict4api)
+	}
+	defer dk.close()
+	if *format == "xml" {
+		return printResult(stdout, dk.exportFiles(*out))
+	}
+	b, err := json.MarshalIndent(dk.exportJSON(*secrets), "", "  ")
+	if err != nil {
+		return printResult(stdout, newInternError("WRONG-FORMAT", err.Error(), nil).dict4api)
+	}
+	if *out == "" {
+		fmt.Fprintln(stdout, string(b))
+		return 0
+	}
+	if err := os.WriteFile(*out, append(b, '\n'), 0o600); err != nil {
+		return printResult(stdout, newInternError("DATABASE-ERROR", err.Error(), nil).dict4api)
+	}
+	return printResult(stdout, map[string]interface{}{"result": true, "file": *out})
+}
+
+func cmdImport(args []string, stdout, stderr io.Writer) int {
+	opts := cliOptions{}
+	fs := newFlagSet("import", stderr)
+	addStorageFlags(fs, &opts)
+	from := fs.String("from", "", "directory holding universe.xml, catalogues.xml and optionally agents.db, or the JSON file, to import (required)")
+	format := fs.String("format", "xml", "xml for a directory of files, json for the JSON representation")
+	mode := fs.String("mode", "merge", "JSON import mode: "+strings.Join(jsonImportModes, " or "))
+	dryRun := fs.Bool("dry-run", false, "only check the JSON import, change nothing")
+	secrets := fs.Bool("secrets", false, "take the secrets of persons from the JSON, which is refused otherwise")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *from == "" {
+		fmt.Fprintln(stderr, "-from is required")
+		return 2
+	}
+	if *format != "xml" && *format != "json" {
+		fmt.Fprintf(stderr, "unknown format %q\n", *format)
+		return 2
+	}
+	var data jsonUniverse
+	if *format == "json" {
+		raw, err := os.ReadFile(*from)
+		if err == nil {
+			err = json.Unmarshal(raw, &data)
+		}
+		if err != nil {
+			return printResult(stdout, newInternError("WRONG-FORMAT", err.Error(), nil).dict4api)
+		}
+	}
+	dk, err := openOffline(&opts, stderr)
+	if err != nil {
+		return printResult(stdout, newInternError("DATABASE-ERROR", err.Error(), nil).dict4api)
+	}
+	defer dk.close()
+	if *format == "json" {
+		return printResult(stdout, dk.importJSON(&data, *mode, *dryRun, *secrets))
+	}
+	return printResult(stdout, dk.importFiles(*from))
+}
+
+func cmdUserAdd(args []string, stdout, stderr io.Writer) int {
+	opts := cliOptions{}
+	fs := newFlagSet("user add", stderr)
+	addStorageFlags(fs, &opts)
+	username := fs.String("username", "", "id of the person to create (required)")
+	secret := fs.String("secret", "", "secret as the clients send it (required)")
+	operator := fs.String("operator", "", "existing person recorded as creator (required)")
+	pswLifeTime := fs.String("pswlifetime", "", "secret lifetime in days, empty for no expiration")
+	readableName := fs.String("readablename", "", "human readable name")
+	sessionMax := fs.String("sessionmax", "", "session length in minutes, default from general.yaml")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	dk, err := openOffline(&opts, stderr)
+	if err != nil {
+		return printResult(stdout, newInternError("DATABASE-ERROR", err.Error(), nil).dict4api)
+	}
+	defer dk.close()
+	return printResult(stdout, dk.createUser(*username, *secret, *operator, *pswLifeTime, *readableName, *sessionMax))
+}
+
+func cmdHire(args []string, stdout, stderr io.Writer) int {
+	opts := cliOptions{}
+	fs := newFlagSet("hire", stderr)
+	addStorageFlags(fs, &opts)
+	username := fs.String("username", "", "person to employ (required)")
+	branch := fs.String("branch", "", "branch id (required)")
+	position := fs.String("position", "", "vacant position in the branch (required)")
+	operator := fs.String("operator", "", "operator the branch is accountable to (required)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	dk, err := openOffline(&opts, stderr)
+	if err != nil {
+		return printResult(stdout, newInternError("DATABASE-ERROR", err.Error(), nil).dict4api)
+	}
+	defer dk.close()
+	return printResult(stdout, dk.hireEmployee(*username, *branch, *position, *operator))
+}
@@ -25,6 +25,7 @@ var reasonCode = map[string]int{
     "PROP-UNKNOWN": 404,
     "BRANCH-UNKNOWN": 404,
     "AGENT-UNKNOWN": 404,
+    "GROUP-UNKNOWN": 404,
     "NOT-IN-SET": 404,
     "NOT-ALLOWED": 405,
     "DATABASE-ERROR": 500,
@@ -32,6 +33,9 @@ var reasonCode = map[string]int{
     "OP-UNAUTHORIZED": 401,
     "OPERATOR-UNKNOWN": 401,
     "FORBIDDEN-FOR-OP": 403,
+    "STILL-REFERENCED": 409,
+    "BATCH-FAILED": 409,
+    "SERVICE-UNAVAILABLE": 503,
 }
 
 var safeIDRe = regexp.MustCompile(`^[\p{L}\p{N}_\-.@+ ]{0,256}$`)
@@ -52,6 +56,9 @@ func httpCodeFor(payload map[string]interface{}) int {
 
 func writeJSON(w http.ResponseWriter, payload map[string]interface{}) {
     code := httpCodeFor(payload)
+    if rec, ok := w.(*responseRecorder); ok {
+        rec.notePayload(payload)
+    }
     w.Header().Set("Content-Type", "application/json; charset=utf-8")
     w.WriteHeader(code)
     enc := json.NewEncoder(w)
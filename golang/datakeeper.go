@@ -1,7 +1,6 @@
 package main
 
 import (
-    "bytes"
     "encoding/xml"
     "fmt"
     "os"
@@ -9,6 +8,7 @@ import (
     "sort"
     "strconv"
     "strings"
+    "sync"
     "time"
 
     "github.com/antchfx/xmlquery"
@@ -34,12 +34,26 @@ func newInternError(reason, warnmessage string, extras map[string]interface{}) *
 }
 
 type configDataKeeper struct {
+    mu           sync.RWMutex
     filename     string
     cFilename    string
     dfltSessMax  int64
-    xmlstorage   *xmlquery.Node
-    xmlcats      *xmlquery.Node
+    store        dataStore
     agentsKeeper *agentsKeeper
+    sandbox      bool
+
+    // the view of the data is built for the generation of the store it was taken from.
+    viewMu  sync.Mutex
+    view    *dataView
+    viewOf  dataStore
+    viewGen uint64
+
+    // operator is who the change being made is recorded for in the history.
+    operator        string
+    lastRevision    int
+    lastSignificant map[string]string
+    // historyKeep is how many revisions the history keeps, 0 for all of them.
+    historyKeep int
 }
 
 func newConfigDataKeeper(dataCatalogue string, defaultSessMax int64) *configDataKeeper {
@@ -48,23 +62,41 @@ func newConfigDataKeeper(dataCatalogue string, defaultSessMax int64) *configData
         cFilename:    filepath.Join(dataCatalogue, "catalogues.xml"),
         dfltSessMax:  defaultSessMax,
         agentsKeeper: newAgentsKeeper(dataCatalogue),
+        store:        &xmlStore{dir: dataCatalogue},
+    }
+}
+
+func (dk *configDataKeeper) close() {
+    dk.agentsKeeper.close()
+    if err := dk.store.close(); err != nil {
+        logDataKeeper.Error("closing data store failed", "store", dk.store.describe(), "error", err)
     }
 }
 
 func (dk *configDataKeeper) load() error {
-    uxml, err := loadXMLFile(dk.filename)
-    if err != nil {
+    if err := dk.store.reload(); err != nil {
         return err
     }
-    dk.xmlstorage = uxml
+    logDataKeeper.Info("data for config data keeper loaded", "universe", dk.filename, "catalogues", dk.cFilename, "store", dk.store.describe())
+    return dk.agentsKeeper.initData()
+}
 
-    cxml, err := loadXMLFile(dk.cFilename)
-    if err != nil {
+// reload drops what the store holds and reads it anew; the XML store swaps in the files only
+// when both parsed fine, so that requests see either the old or the new data but never a mix.
+func (dk *configDataKeeper) reload() error {
+    dk.mu.Lock()
+    defer dk.mu.Unlock()
+    if err := dk.store.reload(); err != nil {
         return err
     }
-    dk.xmlcats = cxml
+    dk.syncHistory("reload")
+    logDataKeeper.Info("data reloaded", "universe", dk.filename, "catalogues", dk.cFilename, "store", dk.store.describe())
+    return nil
+}
 
-    return dk.agentsKeeper.initData()
+func (dk *configDataKeeper) flush() {
+    dk._save(false)
+    dk._save(true)
 }
 
 func loadXMLFile(filename string) (*xmlquery.Node, error) {
@@ -72,8 +104,7 @@ func loadXMLFile(filename string) (*xmlquery.Node, error) {
     if err != nil {
         return nil, err
     }
-    raw = bytes.TrimPrefix(raw, []byte{0xEF, 0xBB, 0xBF})
-    return xmlquery.Parse(bytes.NewReader(raw))
+    return parseXMLDocument(raw)
 }
 
 func writeXMLToFile(filename string, node *xmlquery.Node) error {
@@ -83,7 +114,7 @@ func writeXMLToFile(filename string, node *xmlquery.Node) error {
 
     tempFilename := filename + ".temp.xml"
     backupFilename := filename + ".bk.xml"
-    payload := []byte(node.OutputXML(true))
+    payload := []byte(outputXMLDocument(node))
 
     if err := os.WriteFile(tempFilename, payload, 0o644); err != nil {
         return err
@@ -98,12 +129,124 @@ func writeXMLToFile(filename string, node *xmlquery.Node) error {
     return os.Rename(tempFilename, filename)
 }
 
-func (dk *configDataKeeper) _save(catalogues bool) {
+func (dk *configDataKeeper) _save(catalogues bool) error {
+    if dk.sandbox {
+        return nil
+    }
+    filename := dk.filename
     if catalogues {
-        _ = writeXMLToFile(dk.cFilename, dk.xmlcats)
+        filename = dk.cFilename
+    }
+    doc := filepath.Base(filename)
+    started := time.Now()
+    err := dk.store.save(doc)
+    mXMLSaveLatency.observe(time.Since(started).Seconds(), doc)
+    if err != nil {
+        mXMLSaveFailures.inc(doc)
+        logDataKeeper.Error("saving data failed", "file", filename, "error", err)
+        return err
+    }
+    logDataKeeper.Info("data saved", "file", filename, "store", dk.store.describe(), "duration_ms", float64(time.Since(started).Microseconds())/1000)
+    if uxml, cxml, err := renderDocuments(dk.store); err == nil {
+        node := uxml
+        if catalogues {
+            node = cxml
+        }
+        dk._recordRevision(doc, node, dk.operator)
     } else {
-        _ = writeXMLToFile(dk.filename, dk.xmlstorage)
+        logDataKeeper.Error("revision not recorded", "file", filename, "error", err)
+    }
+    return nil
+}
+
+// _stored saves the document after a write to the store, or gives the error of the write.
+func (dk *configDataKeeper) _stored(err error, catalogues bool) *internError {
+    if err != nil {
+        logDataKeeper.Error("changing data failed", "store", dk.store.describe(), "error", err)
+        return newInternError("DATABASE-ERROR", err.Error(), nil)
+    }
+    dk._save(catalogues)
+    return nil
+}
+
+func (dk *configDataKeeper) exportFiles(outDir string) map[string]interface{} {
+    if err := os.MkdirAll(outDir, 0o755); err != nil {
+        return newInternError("WRONG-DATA", fmt.Sprintf("Cannot create %v: %v", outDir, err), nil).dict4api
+    }
+    uxml, cxml, err := renderDocuments(dk.store)
+    if err != nil {
+        return newInternError("DATABASE-ERROR", err.Error(), nil).dict4api
+    }
+    written := []string{}
+    for _, f := range []struct {
+        name string
+        node *xmlquery.Node
+    }{{"universe.xml", uxml}, {"catalogues.xml", cxml}} {
+        target := filepath.Join(outDir, f.name)
+        if err := writeXMLToFile(target, f.node); err != nil {
+            return newInternError("DATABASE-ERROR", fmt.Sprintf("Cannot write %v: %v", target, err), map[string]interface{}{"written": written}).dict4api
+        }
+        written = append(written, target)
+    }
+    target := filepath.Join(outDir, "agents.db")
+    if err := dk.agentsKeeper.copyTo(target); err != nil {
+        return newInternError("DATABASE-ERROR", fmt.Sprintf("Cannot write %v: %v", target, err), map[string]interface{}{"written": written}).dict4api
+    }
+    written = append(written, target)
+    return map[string]interface{}{"result": true, "written": written}
+}
+
+// importFiles takes universe.xml and catalogues.xml from another directory, and agents.db when it is
+// there; nothing is replaced unless both files parse, have the expected root elements and the
+// data they make has no integrity issues the current data has not.
+func (dk *configDataKeeper) importFiles(fromDir string) map[string]interface{} {
+    uxml, err := loadXMLFile(filepath.Join(fromDir, "universe.xml"))
+    if err != nil {
+        return newInternError("WRONG-DATA", fmt.Sprintf("universe.xml is not readable: %v", err), nil).dict4api
+    }
+    if queryOne(uxml, "/universe/branches/branch") == nil || queryOne(uxml, "/universe/registers/people_register") == nil {
+        return newInternError("WRONG-DATA", "universe.xml has no root branch or people register", nil).dict4api
+    }
+    cxml, err := loadXMLFile(filepath.Join(fromDir, "catalogues.xml"))
+    if err != nil {
+        return newInternError("WRONG-DATA", fmt.Sprintf("catalogues.xml is not readable: %v", err), nil).dict4api
+    }
+    if queryOne(cxml, "/catalogues/functions_catalogue") == nil {
+        return newInternError("WRONG-DATA", "catalogues.xml has no functions catalogue", nil).dict4api
+    }
+
+    sb := dk.newSandbox()
+    sb.store = newMemoryStore(uxml, cxml)
+    imported := []string{dk.filename, dk.cFilename}
+    var agents *agentsKeeper
+    if _, err := os.Stat(filepath.Join(fromDir, "agents.db")); err == nil {
+        if agents, err = copyOf(filepath.Join(fromDir, "agents.db"), dk.agentsKeeper.dbFile+".import"); err != nil {
+            return newInternError("WRONG-DATA", fmt.Sprintf("agents.db is not readable: %v", err), nil).dict4api
+        }
+        defer func() {
+            agents.close()
+            _ = os.Remove(agents.dbFile)
+        }()
+        sb.agentsKeeper = agents
+        imported = append(imported, dk.agentsKeeper.dbFile)
+    }
+    if introduced := dk.introducedIssues(sb); len(introduced) > 0 {
+        return newInternError("WRONG-DATA", fmt.Sprintf("Import would introduce %d integrity issue(s), nothing changed", len(introduced)), map[string]interface{}{"integrity": introduced}).dict4api
     }
+
+    if err := dk.store.replaceWith(sb.store); err != nil {
+        return newInternError("DATABASE-ERROR", err.Error(), nil).dict4api
+    }
+    if agents != nil {
+        if err := dk.agentsKeeper.takeOver(agents); err != nil {
+            if rerr := dk.store.reload(); rerr != nil {
+                logDataKeeper.Error("data not reloaded", "error", rerr)
+            }
+            return newInternError("DATABASE-ERROR", fmt.Sprintf("agents.db not replaced, nothing changed: %v", err), nil).dict4api
+        }
+    }
+    dk.flush()
+    return map[string]interface{}{"result": true, "imported": imported}
 }
 
 func queryOne(top *xmlquery.Node, expr string) *xmlquery.Node {
@@ -158,15 +301,20 @@ func sortedSet(set map[string]struct{}) []string {
 
 func addChildElement(parent *xmlquery.Node, name string, attrs map[string]string, text string) *xmlquery.Node {
     child := &xmlquery.Node{Type: xmlquery.ElementNode, Data: name}
-    for key, val := range attrs {
-        if val != "" {
+    keys := make([]string, 0, len(attrs))
+    for key := range attrs {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+        if val := attrs[key]; val != "" {
             child.SetAttr(key, val)
         }
     }
     if text != "" {
         xmlquery.AddChild(child, &xmlquery.Node{Type: xmlquery.TextNode, Data: text})
     }
-    xmlquery.AddChild(parent, child)
+    appendChildLaidOut(parent, child)
     return child
 }
 
@@ -203,22 +351,20 @@ func extractValue(n *xmlquery.Node, expr string) string {
     return strings.TrimSpace(target.InnerText())
 }
 
-func (dk *configDataKeeper) _getUserNode(userid string) *xmlquery.Node {
-    safeID, err := safeXPathValue(userid)
-    if err != nil {
+func (dk *configDataKeeper) _getPerson(userid string) *personRecord {
+    if _, err := safeXPathValue(userid); err != nil {
         return nil
     }
-    expr := fmt.Sprintf("/universe/registers/people_register/person[@id='%s']", safeID)
-    return queryOne(dk.xmlstorage, expr)
+    return dk.data().person(userid)
 }
 
-func (dk *configDataKeeper) _procFailure(unode *xmlquery.Node, failures int64, warntext string) {
-    if unode == nil {
+func (dk *configDataKeeper) _procFailure(person *personRecord, failures int64, warntext string) {
+    if person == nil {
         return
     }
-    unode.SetAttr("failures", strconv.FormatInt(failures, 10))
-    unode.SetAttr("last_error", strconv.FormatInt(time.Now().Unix(), 10))
-    dk._save(false)
+    attrs := person.Attrs.with("failures", strconv.FormatInt(failures, 10)).with("last_error", strconv.FormatInt(time.Now().Unix(), 10))
+    logDataKeeper.Warn(warntext, "user", person.id(), "failures", failures)
+    dk._stored(dk.store.putPerson(personRecord{Attrs: attrs, Changes: person.Changes}), false)
 }
 
 func (dk *configDataKeeper) _reviewFunc4thePage(fi string) map[string]string {
@@ -261,6 +407,8 @@ func (dk *configDataKeeper) _add_app_details(ret map[string]interface{}, appName
         ret["branches"] = dk.userBranches(userid)
         ret["positions"] = dk.userPositions(userid)
         ret["func_groups"] = dk._userFuncSets(userid)
+        ret["employments"] = dk.userEmployments(userid)
+        ret["delegations"] = dk.userActiveDelegations(userid)
 
         funcs := []interface{}{}
         for _, fi := range dk.__empFunctionIds(userid) {
@@ -273,11 +421,22 @@ func (dk *configDataKeeper) _add_app_details(ret map[string]interface{}, appName
         }
         ret["functions"] = funcs
 
-        if branches, ok := ret["branches"].([]string); ok && len(branches) > 0 {
-            ret["agents"] = dk.listAgents(branches[0], true, false)["report"]
-        } else {
-            ret["agents"] = []interface{}{}
+        agents := []interface{}{}
+        seenAgents := map[string]struct{}{}
+        if branches, ok := ret["branches"].([]string); ok {
+            for _, br := range branches {
+                report, _ := dk.listAgents(br, true, false)["report"].([]interface{})
+                for _, ag := range report {
+                    key := fmt.Sprintf("%v", ag)
+                    if _, seen := seenAgents[key]; seen {
+                        continue
+                    }
+                    seenAgents[key] = struct{}{}
+                    agents = append(agents, ag)
+                }
+            }
         }
+        ret["agents"] = agents
 
         return ret
     }
@@ -303,6 +462,8 @@ func (dk *configDataKeeper) _add_app_details(ret map[string]interface{}, appName
             }
         }
         ret["funcsets"] = reports
+        ret["employments"] = dk.userEmployments(userid)
+        ret["delegations"] = dk.userActiveDelegations(userid)
     }
 
     return ret
@@ -313,30 +474,23 @@ func (dk *configDataKeeper) get_user_reg_details(userid, appName string) map[str
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Not all required parameters are given: user id %v", userid), nil).dict4api
     }
 
-    unode := dk._getUserNode(userid)
-    if unode == nil {
+    person := dk._getPerson(userid)
+    if person == nil {
         return newInternError("USER-UNKNOWN", fmt.Sprintf("User '%s' is unknown", userid), nil).dict4api
     }
 
-    sessMax := dk.dfltSessMax
-    if raw := unode.SelectAttr("sessionMax"); raw != "" {
-        if parsed, err := strconv.ParseInt(raw, 10, 64); err == nil {
-            sessMax = parsed
-        }
-    }
-
     ret := map[string]interface{}{
         "result":            true,
-        "secret_changed":    parseIntAttr(unode, "pswChangedAt", 0),
-        "secret_expiration": parseIntAttr(unode, "expireAt", 0),
-        "readable_name":     unode.SelectAttr("readableName"),
-        "session_max":       sessMax,
-        "created":           []string{unode.SelectAttr("createdBy"), unode.SelectAttr("createdAt")},
+        "secret_changed":    person.Attrs.getInt("pswChangedAt", 0),
+        "secret_expiration": person.Attrs.getInt("expireAt", 0),
+        "readable_name":     person.Attrs.get("readableName"),
+        "session_max":       person.Attrs.getInt("sessionMax", dk.dfltSessMax),
+        "created":           []string{person.Attrs.get("createdBy"), person.Attrs.get("createdAt")},
         "change_history":     []interface{}{},
     }
 
-    for _, ch := range queryAll(unode, "changed") {
-        ret["change_history"] = append(ret["change_history"].([]interface{}), []string{ch.SelectAttr("by"), ch.SelectAttr("at")})
+    for _, ch := range person.Changes {
+        ret["change_history"] = append(ret["change_history"].([]interface{}), []string{ch.get("by"), ch.get("at")})
     }
 
     if appName != "" {
@@ -356,23 +510,23 @@ func (dk *configDataKeeper) authorize(userid, secret, appName string) map[string
         return ret
     }
 
-    unode := dk._getUserNode(userid)
-    if unode == nil {
+    person := dk._getPerson(userid)
+    if person == nil {
         return ret
     }
 
-    failures := parseIntAttr(unode, "failures", 0)
-    if unode.SelectAttr("secret") != secret {
+    failures := person.Attrs.getInt("failures", 0)
+    if person.Attrs.get("secret") != secret {
         failures++
-        dk._procFailure(unode, failures, fmt.Sprintf("User '%s' made %d password mistake(s)", userid, failures))
+        dk._procFailure(person, failures, fmt.Sprintf("User '%s' made %d password mistake(s)", userid, failures))
         return map[string]interface{}{"result": false, "reason": "WRONG-SECRET", "failures": failures}
     }
 
-    expireTime := parseIntAttr(unode, "expireAt", 0)
+    expireTime := person.Attrs.getInt("expireAt", 0)
     now := time.Now().Unix()
     if expireTime > 0 && now > expireTime {
         failures++
-        dk._procFailure(unode, failures, fmt.Sprintf("Password of '%s' expired at %s, failures counter is %d", time.Unix(expireTime, 0).Format(time.RFC1123), failures))
+        dk._procFailure(person, failures, fmt.Sprintf("Password of '%s' expired at %s, failures counter is %d", time.Unix(expireTime, 0).Format(time.RFC1123), failures))
         return map[string]interface{}{
             "result":            false,
             "reason":            "SECRET-EXPIRED",
@@ -381,18 +535,25 @@ func (dk *configDataKeeper) authorize(userid, secret, appName string) map[string
         }
     }
 
-    unode.SetAttr("failures", "0")
-    unode.SetAttr("last_auth_success", strconv.FormatInt(now, 10))
-    dk._save(false)
+    attrs := person.Attrs.with("failures", "0").with("last_auth_success", strconv.FormatInt(now, 10))
+    if ex := dk._stored(dk.store.putPerson(personRecord{Attrs: attrs, Changes: person.Changes}), false); ex != nil {
+        return ex.dict4api
+    }
+    logDataKeeper.Info("user authentificated", "user", userid)
+
+    dk._scheduleExpiryWarning(dk._getPerson(userid))
+    if person := dk._getPerson(userid); expireTime > 0 && person.Attrs.get("expiryWarnedFor") == person.Attrs.get("expireAt") {
+        ret["secret_expires_soon"] = true
+    }
 
     return ret
 }
 
 func (dk *configDataKeeper) getFuncsets() []string {
     values := make([]string, 0)
-    for _, node := range queryAll(dk.xmlstorage, "//branch/deffuncsets/funcset") {
-        if v := node.SelectAttr("id"); v != "" {
-            values = append(values, v)
+    for _, fs := range dk.data().funcsetList {
+        if fs.ID != "" {
+            values = append(values, fs.ID)
         }
     }
     return uniqueStrings(values)
@@ -403,8 +564,7 @@ func (dk *configDataKeeper) funcsetCreate(branchID, funcsetID, readableName stri
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Required argument not given: funcset is %v", funcsetID), nil).dict4api
     }
 
-    branchNode, err := dk._getBranchNodeS(branchID, "deffuncsets", false)
-    if err != nil {
+    if _, err := dk._getBranch(branchID); err != nil {
         return err.dict4api
     }
 
@@ -417,20 +577,17 @@ func (dk *configDataKeeper) funcsetCreate(branchID, funcsetID, readableName stri
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Required argument not given: funcset is %v", funcsetID), nil).dict4api
     }
 
-    if len(queryAll(dk.xmlstorage, fmt.Sprintf("//branch/deffuncsets/funcset[@id='%s']", safeID))) > 0 {
+    if dk.data().funcset(safeID) != nil {
         return newInternError("ALREADY-EXISTS", fmt.Sprintf("Funcset %v already defined somewhere", safeID), map[string]interface{}{"bad_value": safeID}).dict4api
     }
 
-    fsNode := addChildElement(branchNode, "funcset", map[string]string{"id": safeID}, "")
-    if readableName != "" {
-        fsNode.SetAttr("name", readableName)
+    if ex := dk._stored(dk.store.putFuncset(funcsetRecord{ID: safeID, Branch: branchID, Name: readableName}), false); ex != nil {
+        return ex.dict4api
     }
-
-    dk._save(false)
     return map[string]interface{}{"result": true}
 }
 
-func (dk *configDataKeeper) _getFsNode(funcsetID string, expectFunc bool, funcID string) (*xmlquery.Node, *internError) {
+func (dk *configDataKeeper) _getFuncset(funcsetID string, expectFunc bool, funcID string) (*funcsetRecord, *internError) {
     if funcsetID == "" {
         return nil, newInternError("WRONG-FORMAT", "Required funcset id is not given", nil)
     }
@@ -444,32 +601,106 @@ func (dk *configDataKeeper) _getFsNode(funcsetID string, expectFunc bool, funcID
         return nil, newInternError("WRONG-FORMAT", fmt.Sprintf("Required funcset id is unsafe %v", funcsetID), nil)
     }
 
-    fsNodes := queryAll(dk.xmlstorage, fmt.Sprintf("//branch/deffuncsets/funcset[@id='%s']", safeFs))
-    if len(fsNodes) == 0 {
+    fs := dk.data().funcset(safeFs)
+    if fs == nil {
         return nil, newInternError("FUNCSET-UNKNOWN", fmt.Sprintf("Funcset %v is unknown", safeFs), map[string]interface{}{"bad_value": safeFs})
     }
-    return fsNodes[0], nil
+    return fs, nil
 }
 
-func (dk *configDataKeeper) funcsetDelete(funcsetID string) map[string]interface{} {
-    fsNode, err := dk._getFsNode(funcsetID, false, "")
-    if err != nil {
+// Deletions of funcsets, roles and functions take a mode: "restrict" (the default) refuses
+// while anything refers to the object, "cascade" removes the references too. With dryRun
+// the deletion is tried out on a sandbox and reports whose permissions would change.
+
+func checkDeleteMode(mode string) (string, *internError) {
+    switch mode {
+    case "", "restrict":
+        return "restrict", nil
+    case "cascade":
+        return "cascade", nil
+    }
+    return "", newInternError("WRONG-FORMAT", fmt.Sprintf("Unknown delete mode %v, expected restrict or cascade", mode), map[string]interface{}{"bad_value": mode})
+}
+
+func referenceReport(kind, where, id string) map[string]interface{} {
+    return map[string]interface{}{"kind": kind, "where": where, "id": id}
+}
+
+func stillReferenced(what string, refs []interface{}) map[string]interface{} {
+    return newInternError("STILL-REFERENCED", fmt.Sprintf("%v is still referenced %d time(s), use mode=cascade to remove the references too", what, len(refs)), map[string]interface{}{"references": refs}).dict4api
+}
+
+func (dk *configDataKeeper) funcsetDelete(funcsetID, mode string, dryRun bool) map[string]interface{} {
+    if dryRun {
+        return dk.tryOut(func(sb *configDataKeeper) map[string]interface{} { return sb.funcsetDelete(funcsetID, mode, false) })
+    }
+
+    mode, ex := checkDeleteMode(mode)
+    if ex != nil {
+        return ex.dict4api
+    }
+
+    if _, err := dk._getFuncset(funcsetID, false, ""); err != nil {
         return err.dict4api
     }
-    fsNode.RemoveFromTree()
-    dk._save(false)
-    return map[string]interface{}{"result": true}
+
+    view := dk.data()
+    refRoles := make([]roleRecord, 0)
+    refBranches := make([]branchRecord, 0)
+    refs := make([]interface{}, 0)
+    for _, br := range view.branchList {
+        for _, role := range view.roles(br.ID) {
+            for _, fs := range role.Funcsets {
+                if fs == funcsetID {
+                    refs = append(refs, referenceReport("role", br.ID, role.Name))
+                }
+            }
+            if contains(role.Funcsets, funcsetID) {
+                refRoles = append(refRoles, roleRecord{Branch: role.Branch, Name: role.Name, Funcsets: withoutAll(role.Funcsets, funcsetID)})
+            }
+        }
+        if br.Whitelist == nil {
+            continue
+        }
+        for _, fs := range br.Whitelist.Funcsets {
+            if fs == funcsetID {
+                refs = append(refs, referenceReport("whitelist", br.ID, funcsetID))
+            }
+        }
+        if contains(br.Whitelist.Funcsets, funcsetID) {
+            refBranches = append(refBranches, branchRecord{ID: br.ID, Parent: br.Parent, Whitelist: &whitelistRecord{PropagateParent: br.Whitelist.PropagateParent, Funcsets: withoutAll(br.Whitelist.Funcsets, funcsetID)}})
+        }
+    }
+
+    if len(refs) > 0 && mode == "restrict" {
+        return stillReferenced(fmt.Sprintf("Funcset %v", funcsetID), refs)
+    }
+    err := dk.store.deleteFuncset(funcsetID)
+    for _, r := range refRoles {
+        if err == nil {
+            err = dk.store.putRole(r)
+        }
+    }
+    for _, b := range refBranches {
+        if err == nil {
+            err = dk.store.putBranch(b)
+        }
+    }
+    if ex := dk._stored(err, false); ex != nil {
+        return ex.dict4api
+    }
+    return map[string]interface{}{"result": true, "mode": mode, "references_removed": refs}
 }
 
 func (dk *configDataKeeper) getFuncsetDetails(funcsetID string) map[string]interface{} {
-    fsNode, err := dk._getFsNode(funcsetID, false, "")
+    fs, err := dk._getFuncset(funcsetID, false, "")
     if err != nil {
         return err.dict4api
     }
 
     funcIDs := make([]string, 0)
-    for _, node := range queryAll(fsNode, "func") {
-        if v := node.SelectAttr("id"); v != "" {
+    for _, v := range fs.Functions {
+        if v != "" {
             funcIDs = append(funcIDs, v)
         }
     }
@@ -477,13 +708,13 @@ func (dk *configDataKeeper) getFuncsetDetails(funcsetID string) map[string]inter
     return map[string]interface{}{
         "result":    true,
         "functions": funcIDs,
-        "name":      fsNode.SelectAttr("name"),
+        "name":      fs.Name,
         "id":        funcsetID,
     }
 }
 
 func (dk *configDataKeeper) funcsetFuncAdd(funcsetID, funcID string) map[string]interface{} {
-    fsNode, err := dk._getFsNode(funcsetID, true, funcID)
+    fs, err := dk._getFuncset(funcsetID, true, funcID)
     if err != nil {
         return err.dict4api
     }
@@ -493,17 +724,24 @@ func (dk *configDataKeeper) funcsetFuncAdd(funcsetID, funcID string) map[string]
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Required function name is unsafe %v", funcID), nil).dict4api
     }
 
-    if len(queryAll(fsNode, fmt.Sprintf("func[@id='%s']", safeFuncID))) > 0 {
+    if contains(fs.Functions, safeFuncID) {
         return newInternError("ALREADY-EXISTS", fmt.Sprintf("Function %v already in %v", safeFuncID, funcsetID), map[string]interface{}{"bad_value": safeFuncID}).dict4api
     }
 
-    addChildElement(fsNode, "func", map[string]string{"id": safeFuncID}, "")
-    dk._save(false)
+    if !dk._functionDefined(safeFuncID) {
+        return newInternError("FUNCTION-UNKNOWN", fmt.Sprintf("Function %v is not described in catalogues", safeFuncID), map[string]interface{}{"bad_value": safeFuncID}).dict4api
+    }
+
+    changed := *fs
+    changed.Functions = append(append([]string{}, fs.Functions...), safeFuncID)
+    if ex := dk._stored(dk.store.putFuncset(changed), false); ex != nil {
+        return ex.dict4api
+    }
     return map[string]interface{}{"result": true}
 }
 
 func (dk *configDataKeeper) funcsetFuncRemove(funcsetID, funcID string) map[string]interface{} {
-    fsNode, err := dk._getFsNode(funcsetID, true, funcID)
+    fs, err := dk._getFuncset(funcsetID, true, funcID)
     if err != nil {
         return err.dict4api
     }
@@ -513,58 +751,50 @@ func (dk *configDataKeeper) funcsetFuncRemove(funcsetID, funcID string) map[stri
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Required function name is unsafe %v", funcID), nil).dict4api
     }
 
-    fnNodes := queryAll(fsNode, fmt.Sprintf("func[@id='%s']", safeFuncID))
-    if len(fnNodes) == 0 {
+    if !contains(fs.Functions, safeFuncID) {
         return newInternError("NOT-IN-SET", fmt.Sprintf("Function %v is not in %v", safeFuncID, funcsetID), map[string]interface{}{"bad_value": safeFuncID}).dict4api
     }
-    fnNodes[0].RemoveFromTree()
-    dk._save(false)
+    changed := *fs
+    changed.Functions = withoutFirst(fs.Functions, safeFuncID)
+    if ex := dk._stored(dk.store.putFuncset(changed), false); ex != nil {
+        return ex.dict4api
+    }
     return map[string]interface{}{"result": true}
 }
 
 func (dk *configDataKeeper) userBranches(userid string) []string {
-    safeID, err := safeXPathValue(userid)
-    if err != nil {
+    if _, err := safeXPathValue(userid); err != nil {
         return []string{}
     }
 
     branches := make([]string, 0)
-    for _, br := range queryAll(dk.xmlstorage, fmt.Sprintf("//branch[employees/employee[@person='%s']]", safeID)) {
-        if v := br.SelectAttr("id"); v != "" {
-            branches = append(branches, v)
+    for _, p := range dk.data().userPositions(userid) {
+        if p.Branch != "" {
+            branches = append(branches, p.Branch)
         }
     }
     return uniqueStrings(branches)
 }
 
 func (dk *configDataKeeper) userPositions(userid string) []string {
-    safeID, err := safeXPathValue(userid)
-    if err != nil {
+    if _, err := safeXPathValue(userid); err != nil {
         return []string{}
     }
 
     pos := make([]string, 0)
-    for _, employee := range queryAll(dk.xmlstorage, fmt.Sprintf("//employee[@person='%s']", safeID)) {
-        if p := employee.SelectAttr("pos"); p != "" {
-            pos = append(pos, p)
+    for _, p := range dk.data().userPositions(userid) {
+        if p.pos() != "" {
+            pos = append(pos, p.pos())
         }
     }
     return uniqueStrings(pos)
 }
 
 func (dk *configDataKeeper) listBranches() []string {
-    vals := make([]string, 0)
-    for _, branch := range queryAll(dk.xmlstorage, "//branch/@id") {
-        if branch.Type == xmlquery.AttributeNode {
-            vals = append(vals, branch.InnerText())
-            continue
-        }
-        vals = append(vals, branch.Data)
-    }
     ids := make([]string, 0)
-    for _, node := range queryAll(dk.xmlstorage, "//branch") {
-        if id := node.SelectAttr("id"); id != "" {
-            ids = append(ids, id)
+    for _, br := range dk.data().branchList {
+        if br.ID != "" {
+            ids = append(ids, br.ID)
         }
     }
     return uniqueStrings(ids)
@@ -575,32 +805,21 @@ func (dk *configDataKeeper) listRoles4Branch(branchID string) []string {
         return []string{}
     }
 
-    branchNode, err := dk._getBranchNodeS(branchID, "", false)
-    if err != nil {
+    if _, err := dk._getBranch(branchID); err != nil {
         return []string{}
     }
 
-    ret := make([]string, 0)
-    for _, node := range queryAll(branchNode, "roles/role/@name") {
-        if node.Type == xmlquery.AttributeNode {
-            ret = append(ret, node.InnerText())
-            continue
-        }
-        ret = append(ret, strings.TrimSpace(node.Data))
-    }
-
     ids := make([]string, 0)
-    for _, node := range queryAll(branchNode, "roles/role") {
-        if n := node.SelectAttr("name"); n != "" {
-            ids = append(ids, n)
+    for _, role := range dk.data().roles(branchID) {
+        if role.Name != "" {
+            ids = append(ids, role.Name)
         }
     }
     return uniqueStrings(ids)
 }
 
-func (dk *configDataKeeper) _getRoleNode(branchID, roleName string) (*xmlquery.Node, *internError) {
-    rolesNode, err := dk._getBranchNodeS(branchID, "roles", false)
-    if err != nil {
+func (dk *configDataKeeper) _getRole(branchID, roleName string) (*roleRecord, *internError) {
+    if _, err := dk._getBranch(branchID); err != nil {
         return nil, err
     }
 
@@ -609,61 +828,59 @@ func (dk *configDataKeeper) _getRoleNode(branchID, roleName string) (*xmlquery.N
         return nil, newInternError("WRONG-FORMAT", fmt.Sprintf("Required argument not given: role is %v", roleName), nil)
     }
 
-    roleNodes := queryAll(rolesNode, fmt.Sprintf("role[@name='%s']", safeRole))
-    if len(roleNodes) == 0 {
+    role := dk.data().role(branchID, safeRole)
+    if role == nil {
         return nil, newInternError("ROLE-UNKNOWN", fmt.Sprintf("Role %v not defined in branch %v", roleName, branchID), nil)
     }
-    return roleNodes[0], nil
+    return role, nil
 }
 
 func (dk *configDataKeeper) listRoleFuncsets(branchID, roleName string) map[string]interface{} {
-    roleNode, err := dk._getRoleNode(branchID, roleName)
+    role, err := dk._getRole(branchID, roleName)
     if err != nil {
         return err.dict4api
     }
 
-    funcsets := make([]string, 0)
-    for _, fs := range queryAll(roleNode, "funcset/@id") {
-        if fs.Type == xmlquery.AttributeNode {
-            funcsets = append(funcsets, fs.InnerText())
-            continue
-        }
-        if id := fs.SelectAttr("id"); id != "" {
-            funcsets = append(funcsets, id)
-        }
-    }
-
-    return map[string]interface{}{"result": true, "funcsets": uniqueStrings(funcsets)}
+    return map[string]interface{}{"result": true, "funcsets": uniqueStrings(role.Funcsets)}
 }
 
 func (dk *configDataKeeper) roleFuncsetAdd(branchID, roleName, funcsetID string) map[string]interface{} {
-    roleNode, err := dk._getRoleNode(branchID, roleName)
+    role, err := dk._getRole(branchID, roleName)
     if err != nil {
         return err.dict4api
     }
 
-    if len(queryAll(roleNode, fmt.Sprintf("funcset[@id='%s']", funcsetID))) > 0 {
+    if _, ex := dk._getFuncset(funcsetID, false, ""); ex != nil {
+        return ex.dict4api
+    }
+
+    if contains(role.Funcsets, funcsetID) {
         return newInternError("ALREADY-EXISTS", fmt.Sprintf("Funcset %v already in role %v of %v", funcsetID, roleName, branchID), nil).dict4api
     }
 
-    addChildElement(roleNode, "funcset", map[string]string{"id": funcsetID}, "")
-    dk._save(false)
+    changed := *role
+    changed.Funcsets = append(append([]string{}, role.Funcsets...), funcsetID)
+    if ex := dk._stored(dk.store.putRole(changed), false); ex != nil {
+        return ex.dict4api
+    }
     return map[string]interface{}{"result": true}
 }
 
 func (dk *configDataKeeper) roleFuncsetRemove(branchID, roleName, funcsetID string) map[string]interface{} {
-    roleNode, err := dk._getRoleNode(branchID, roleName)
+    role, err := dk._getRole(branchID, roleName)
     if err != nil {
         return err.dict4api
     }
 
-    fsNodes := queryAll(roleNode, fmt.Sprintf("funcset[@id='%s']", funcsetID))
-    if len(fsNodes) == 0 {
+    if !contains(role.Funcsets, funcsetID) {
         return newInternError("NOT-IN-SET", fmt.Sprintf("Funcset %v is not in role %v of %v", funcsetID, roleName, branchID), nil).dict4api
     }
 
-    fsNodes[0].RemoveFromTree()
-    dk._save(false)
+    changed := *role
+    changed.Funcsets = withoutFirst(role.Funcsets, funcsetID)
+    if ex := dk._stored(dk.store.putRole(changed), false); ex != nil {
+        return ex.dict4api
+    }
     return map[string]interface{}{"result": true}
 }
 
@@ -673,12 +890,13 @@ func (dk *configDataKeeper) reviewBranches(pos string) []interface{} {
         safePos = ""
     }
 
+    view := dk.data()
     ret := make([]interface{}, 0)
-    for _, br := range queryAll(dk.xmlstorage, "//branch") {
+    for _, br := range view.branchList {
         if safePos != "" {
             hasPos := false
-            for _, emp := range queryAll(br, "employees/employee") {
-                if emp.SelectAttr("pos") == safePos {
+            for _, emp := range view.positions(br.ID) {
+                if emp.pos() == safePos {
                     hasPos = true
                     break
                 }
@@ -689,15 +907,12 @@ func (dk *configDataKeeper) reviewBranches(pos string) []interface{} {
         }
 
         vacancies := make([]string, 0)
-        for _, emp := range queryAll(br, "employees/employee") {
-            if emp.SelectAttr("person") != "" {
+        for _, emp := range view.positions(br.ID) {
+            if emp.person() != "" {
                 continue
             }
 
-            p := emp.SelectAttr("pos")
-            if safePos != "" && br.SelectAttr("pos") != "" && br.SelectAttr("pos") != safePos {
-                continue
-            }
+            p := emp.pos()
             if safePos != "" && p != safePos {
                 continue
             }
@@ -707,7 +922,7 @@ func (dk *configDataKeeper) reviewBranches(pos string) []interface{} {
         }
 
         ret = append(ret, map[string]interface{}{
-            "id":        br.SelectAttr("id"),
+            "id":        br.ID,
             "vacancies": uniqueStrings(vacancies),
         })
     }
@@ -720,12 +935,13 @@ func (dk *configDataKeeper) getBranches(pos string) []interface{} {
         safePos = ""
     }
 
+    view := dk.data()
     ret := make([]interface{}, 0)
-    for _, br := range queryAll(dk.xmlstorage, "//branch") {
+    for _, br := range view.branchList {
         if safePos != "" {
             hasPos := false
-            for _, emp := range queryAll(br, "employees/employee") {
-                if emp.SelectAttr("pos") == safePos {
+            for _, emp := range view.positions(br.ID) {
+                if emp.pos() == safePos {
                     hasPos = true
                     break
                 }
@@ -736,49 +952,36 @@ func (dk *configDataKeeper) getBranches(pos string) []interface{} {
         }
 
         value := 0
-        for _, emp := range queryAll(br, "employees/employee") {
-            if emp.SelectAttr("person") != "" {
+        for _, emp := range view.positions(br.ID) {
+            if emp.person() != "" {
                 continue
             }
-            if safePos != "" {
-                if br.SelectAttr("pos") != "" && br.SelectAttr("pos") != safePos {
-                    continue
-                }
-                if emp.SelectAttr("pos") != safePos {
-                    continue
-                }
+            if safePos != "" && emp.pos() != safePos {
+                continue
             }
             value++
         }
 
         ret = append(ret, map[string]interface{}{
-            "id":    br.SelectAttr("id"),
-            "value": fmt.Sprintf("%s - %d vacancies", br.SelectAttr("id"), value),
+            "id":    br.ID,
+            "value": fmt.Sprintf("%s - %d vacancies", br.ID, value),
         })
     }
     return ret
 }
 
 func (dk *configDataKeeper) getBranchSubs(branchID string) map[string]interface{} {
-    var root *xmlquery.Node
     if branchID == "" {
-        root = dk.xmlstorage
-    } else {
-        br, err := dk._getBranchNodeS(branchID, "", false)
-        if err != nil {
-            return err.dict4api
-        }
-        root = br
+        return map[string]interface{}{"result": true, "branches": dk.listBranches()}
+    }
+    if _, err := dk._getBranch(branchID); err != nil {
+        return err.dict4api
     }
 
     ids := make([]string, 0)
-    for _, node := range queryAll(root, "descendant::branch/@id") {
-        if node.Type == xmlquery.AttributeNode {
-            ids = append(ids, node.InnerText())
-            continue
-        }
-        if v := node.SelectAttr("id"); v != "" {
-            ids = append(ids, v)
+    for _, id := range dk.data().subtree(branchID)[1:] {
+        if id != "" {
+            ids = append(ids, id)
         }
     }
 
@@ -786,8 +989,7 @@ func (dk *configDataKeeper) getBranchSubs(branchID string) map[string]interface{
 }
 
 func (dk *configDataKeeper) addBranchSub(branchID, subID string) map[string]interface{} {
-    branchesNode, err := dk._getBranchNodeS(branchID, "branches", false)
-    if err != nil {
+    if _, err := dk._getBranch(branchID); err != nil {
         return err.dict4api
     }
 
@@ -800,91 +1002,223 @@ func (dk *configDataKeeper) addBranchSub(branchID, subID string) map[string]inte
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Required argument not given: subbranch is %v", subID), nil).dict4api
     }
 
-    if len(queryAll(branchesNode, fmt.Sprintf("branch[@id='%s']", safeSub))) > 0 {
+    view := dk.data()
+    if contains(view.children[branchID], safeSub) {
         return newInternError("ALREADY-EXISTS", fmt.Sprintf("Branch %v already has subbranch %v", branchID, safeSub), map[string]interface{}{"bad_value": safeSub}).dict4api
     }
 
-    brNode := addChildElement(branchesNode, "branch", map[string]string{"id": safeSub}, "")
-    addChildElement(brNode, "func_white_list", map[string]string{"propagateParent": "no"}, "")
-    addChildElement(brNode, "employees", nil, "")
-    addChildElement(brNode, "roles", nil, "")
-    addChildElement(brNode, "deffuncsets", nil, "")
-    addChildElement(brNode, "branches", nil, "")
+    if view.branch(safeSub) != nil {
+        return newInternError("ALREADY-EXISTS", fmt.Sprintf("Branch %v already exists elsewhere in the tree", safeSub), map[string]interface{}{"bad_value": safeSub}).dict4api
+    }
 
-    dk._save(false)
+    sub := branchRecord{ID: safeSub, Parent: branchID, Whitelist: &whitelistRecord{PropagateParent: "no"}}
+    if ex := dk._stored(dk.store.putBranch(sub), false); ex != nil {
+        return ex.dict4api
+    }
     return map[string]interface{}{"result": true}
 }
 
 func (dk *configDataKeeper) deleteBranch(branchID string) map[string]interface{} {
-    branchNode, err := dk._getBranchNodeS(branchID, "", false)
+    br, err := dk._getBranch(branchID)
     if err != nil {
         return err.dict4api
     }
 
-    if len(queryAll(branchNode, "ancestor::branch")) == 0 {
+    if br.Parent == "" {
         return newInternError("NOT-ALLOWED", fmt.Sprintf("Deletion of a root branch %v is not allowed", branchID), map[string]interface{}{"bad_value": branchID}).dict4api
     }
 
-    if employed := queryAll(branchNode, "descendant::employee[@person]"); len(employed) > 0 {
-        employedUsers := make([]string, 0)
-        for _, emp := range employed {
-            p := emp.SelectAttr("person")
-            if p != "" {
+    view := dk.data()
+    subtree := view.subtree(branchID)
+    employed := false
+    employedUsers := make([]string, 0)
+    for _, id := range subtree {
+        for _, emp := range view.positions(id) {
+            if !emp.Attrs.has("person") {
+                continue
+            }
+            employed = true
+            if p := emp.person(); p != "" {
                 employedUsers = append(employedUsers, p)
             }
         }
+    }
+    if employed {
         return newInternError("USER-EMPLOYED", fmt.Sprintf("Branch %v still has employees: %v", branchID, employedUsers), map[string]interface{}{"fire_them": uniqueStrings(employedUsers)}).dict4api
     }
 
-    branchNode.RemoveFromTree()
-    dk._save(false)
+    if agents := dk.agentsKeeper.getAgentsByBranches(subtree); len(agents) > 0 {
+        agentIDs := make([]string, 0, len(agents))
+        for _, row := range agents {
+            agentIDs = append(agentIDs, row[0])
+        }
+        return newInternError("NOT-ALLOWED", fmt.Sprintf("Branch %v still has agents: %v", branchID, agentIDs), map[string]interface{}{"move_them": agentIDs}).dict4api
+    }
+
+    if ex := dk._stored(dk.store.deleteBranch(branchID), false); ex != nil {
+        return ex.dict4api
+    }
     return map[string]interface{}{"result": true}
 }
 
-func (dk *configDataKeeper) getBranchFsWhiteList(branchID string) map[string]interface{} {
-    wlNode, err := dk._getBranchNodeS(branchID, "func_white_list", false)
+// moveBranch re-parents a subtree and reports whose permissions the whitelist inheritance changes;
+// with dryRun the move is only tried out on a sandbox copy.
+func (dk *configDataKeeper) moveBranch(branchID, parentID string, dryRun bool) map[string]interface{} {
+    if dryRun {
+        ret := dk.newSandbox().moveBranch(branchID, parentID, false)
+        ret["dry_run"] = true
+        return ret
+    }
+
+    br, err := dk._getBranch(branchID)
     if err != nil {
         return err.dict4api
     }
+    if _, err := dk._getBranch(parentID); err != nil {
+        return err.dict4api
+    }
 
-    funcsets := make([]string, 0)
-    for _, fs := range queryAll(wlNode, "funcset/@id") {
-        if fs.Type == xmlquery.AttributeNode {
-            funcsets = append(funcsets, fs.InnerText())
-            continue
+    oldParent := br.Parent
+    if oldParent == "" {
+        return newInternError("NOT-ALLOWED", fmt.Sprintf("Moving of a root branch %v is not allowed", branchID), map[string]interface{}{"bad_value": branchID}).dict4api
+    }
+    if oldParent == parentID {
+        return newInternError("NOT-ALLOWED", fmt.Sprintf("Branch %v is already a subbranch of %v", branchID, parentID), map[string]interface{}{"bad_value": parentID}).dict4api
+    }
+    if dk.data().within(parentID, branchID) {
+        return newInternError("NOT-ALLOWED", fmt.Sprintf("Branch %v cannot be moved under itself or its subbranch %v", branchID, parentID), map[string]interface{}{"bad_value": parentID}).dict4api
+    }
+
+    usersBefore, branchesBefore := dk.userPermissions(), dk.branchPermissions()
+    if ex := dk._stored(dk.store.putBranch(branchRecord{ID: branchID, Parent: parentID, Whitelist: br.Whitelist}), false); ex != nil {
+        return ex.dict4api
+    }
+
+    return map[string]interface{}{
+        "result":     true,
+        "branch":     branchID,
+        "old_parent": oldParent,
+        "new_parent": parentID,
+        "users":      diffPermissions(usersBefore, dk.userPermissions(), "user"),
+        "branches":   diffPermissions(branchesBefore, dk.branchPermissions(), "branch"),
+    }
+}
+
+// renameBranch changes a branch id together with everything referring to it:
+// delegations, scheduled actions and agents in agents.db.
+func (dk *configDataKeeper) renameBranch(branchID, newID string, dryRun bool) map[string]interface{} {
+    if _, err := dk._getBranch(branchID); err != nil {
+        return err.dict4api
+    }
+    if newID == "" {
+        return newInternError("WRONG-FORMAT", fmt.Sprintf("Required argument not given: new id is %v", newID), nil).dict4api
+    }
+    safeNew, err2 := safeXPathValue(newID)
+    if err2 != nil {
+        return newInternError("WRONG-FORMAT", fmt.Sprintf("New branch id %v is unsafe", newID), nil).dict4api
+    }
+    if dk.data().branch(safeNew) != nil {
+        return newInternError("ALREADY-EXISTS", fmt.Sprintf("Branch %v already exists", newID), map[string]interface{}{"bad_value": newID}).dict4api
+    }
+
+    type reference struct {
+        register string
+        entry    attrPairs
+    }
+    refs := make([]reference, 0)
+    for _, register := range registerNames {
+        for _, e := range dk.store.registerEntries(register) {
+            if e.get("branch") == branchID {
+                refs = append(refs, reference{register, e})
+            }
         }
-        if v := fs.SelectAttr("id"); v != "" {
-            funcsets = append(funcsets, v)
+    }
+    agents := make([]string, 0)
+    for _, row := range dk.agentsKeeper.getAgentsByBranches([]string{branchID}) {
+        agents = append(agents, row[0])
+    }
+
+    ret := map[string]interface{}{"result": true, "branch": branchID, "new_id": newID, "agents": agents, "references": len(refs)}
+    if dryRun {
+        ret["dry_run"] = true
+        return ret
+    }
+
+    // universe.xml is saved first: agents.db is changed only when it is, and the data is set back when agents.db fails
+    setID := func(from, to string) error {
+        err := dk.store.renameBranch(from, to)
+        for _, r := range refs {
+            if err == nil {
+                err = dk.store.putRegisterEntry(r.register, r.entry.with("branch", to))
+            }
         }
+        return err
+    }
+    err := setID(branchID, newID)
+    if err == nil {
+        err = dk._save(false)
+    }
+    if err != nil {
+        dk.store.reload()
+        return newInternError("DATABASE-ERROR", fmt.Sprintf("Branch %v not renamed to %v: %v", branchID, newID, err), nil).dict4api
+    }
+    if _, err := dk.agentsKeeper.renameBranch(branchID, newID); err != nil {
+        setID(newID, branchID)
+        dk._save(false)
+        return newInternError("DATABASE-ERROR", fmt.Sprintf("Agents of branch %v not moved to %v, branch not renamed: %v", branchID, newID, err), nil).dict4api
+    }
+    logDataKeeper.Info("branch renamed", "branch", branchID, "new_id", newID, "agents", len(agents), "references", len(refs))
+
+    return ret
+}
+
+// _getWhitelist gives the branch with its whitelist, which every branch but a top-level one is expected to have.
+func (dk *configDataKeeper) _getWhitelist(branchID string) (*branchRecord, *internError) {
+    br, err := dk._getBranch(branchID)
+    if err != nil {
+        return nil, err
+    }
+    if br.Whitelist == nil {
+        return nil, newInternError("DATABASE-ERROR", fmt.Sprintf("Inconsistent server data: branch %v description has no sub-path func_white_list", branchID), map[string]interface{}{"inconsistence": "func_white_list"})
+    }
+    return br, nil
+}
+
+func (dk *configDataKeeper) getBranchFsWhiteList(branchID string) map[string]interface{} {
+    br, err := dk._getWhitelist(branchID)
+    if err != nil {
+        return err.dict4api
     }
 
     return map[string]interface{}{
         "result":             true,
-        "funcsets":           uniqueStrings(funcsets),
-        "propagate_parent_flag": strings.ToLower(wlNode.SelectAttr("propagateParent")) == "yes",
+        "funcsets":           uniqueStrings(br.Whitelist.Funcsets),
+        "propagate_parent_flag": strings.ToLower(br.Whitelist.PropagateParent) == "yes",
     }
 }
 
 func (dk *configDataKeeper) setBranchFsWhiteList(branchID string, propParentFlag bool, newwlist []string) map[string]interface{} {
-    wlNode, err := dk._getBranchNodeS(branchID, "func_white_list", false)
+    br, err := dk._getWhitelist(branchID)
     if err != nil {
         return err.dict4api
     }
 
-    wlNode.SetAttr("propagateParent", boolToYesNo(propParentFlag))
-    for _, old := range queryAll(wlNode, "funcset") {
-        old.RemoveFromTree()
+    if undefined := dk._undefinedFuncsets(newwlist); len(undefined) > 0 {
+        return newInternError("FUNCSET-UNKNOWN", fmt.Sprintf("Funcsets %v are defined nowhere", undefined), map[string]interface{}{"bad_value": undefined}).dict4api
     }
 
+    wl := &whitelistRecord{PropagateParent: boolToYesNo(propParentFlag), Funcsets: []string{}}
     for _, fs := range newwlist {
         fs = strings.TrimSpace(fs)
         if fs == "" {
             continue
         }
-        addChildElement(wlNode, "funcset", map[string]string{"id": fs}, "")
+        wl.Funcsets = append(wl.Funcsets, fs)
     }
 
-    dk._save(false)
+    if ex := dk._stored(dk.store.putBranch(branchRecord{ID: br.ID, Parent: br.Parent, Whitelist: wl}), false); ex != nil {
+        return ex.dict4api
+    }
     return map[string]interface{}{"result": true}
 }
 
@@ -895,7 +1229,7 @@ func boolToYesNo(v bool) string {
     return "no"
 }
 
-func (dk *configDataKeeper) _getBranchNodeS(branchID string, subpath string, autocreate bool) (*xmlquery.Node, *internError) {
+func (dk *configDataKeeper) _getBranch(branchID string) (*branchRecord, *internError) {
     if branchID == "" {
         return nil, newInternError("WRONG-FORMAT", fmt.Sprintf("Required argument not given: branch is %v", branchID), nil)
     }
@@ -905,32 +1239,18 @@ func (dk *configDataKeeper) _getBranchNodeS(branchID string, subpath string, aut
         return nil, newInternError("WRONG-FORMAT", fmt.Sprintf("Required argument not given: branch is %v", branchID), nil)
     }
 
-    brs := queryAll(dk.xmlstorage, fmt.Sprintf("//branch[@id='%s']", safeBranch))
-    if len(brs) == 0 {
+    br := dk.data().branch(safeBranch)
+    if br == nil {
         return nil, newInternError("BRANCH-UNKNOWN", fmt.Sprintf("Branch %v is unknown", safeBranch), map[string]interface{}{"bad_value": safeBranch})
     }
-
-    if subpath == "" {
-        return brs[0], nil
-    }
-
-    subs := queryAll(brs[0], subpath)
-    if len(subs) == 0 {
-        if !autocreate {
-            return nil, newInternError("DATABASE-ERROR", fmt.Sprintf("Inconsistent server data: branch %v description has no sub-path %v", safeBranch, subpath), map[string]interface{}{"inconsistence": subpath})
-        }
-        return addChildElement(brs[0], subpath, nil, ""), nil
-    }
-    return subs[0], nil
+    return br, nil
 }
 
 func (dk *configDataKeeper) listUsers() map[string]interface{} {
     users := make([]string, 0)
-    for _, p := range queryAll(dk.xmlstorage, "/universe/registers/people_register/person/@id") {
-        if p.Type == xmlquery.AttributeNode {
-            users = append(users, p.InnerText())
-        } else {
-            users = append(users, p.SelectAttr("id"))
+    for _, p := range dk.data().personList {
+        if p.Attrs.has("id") {
+            users = append(users, p.id())
         }
     }
     return map[string]interface{}{
@@ -939,27 +1259,31 @@ func (dk *configDataKeeper) listUsers() map[string]interface{} {
     }
 }
 
-func (dk *configDataKeeper) reviewPositions(branchID string) []interface{} {
-    if branchID == "" {
-        branchID = ""
-    }
+// _branchesOrAll gives the records of the branch, or of all the branches for none.
+func (dk *configDataKeeper) _branchesOrAll(branchID string) []branchRecord {
     safeBranch, err := safeXPathValue(branchID)
     if err != nil {
         safeBranch = ""
     }
 
-    selector := "//branch"
-    if safeBranch != "" {
-        selector = fmt.Sprintf("//branch[@id='%s']", safeBranch)
+    ret := make([]branchRecord, 0)
+    for _, br := range dk.data().branchList {
+        if safeBranch == "" || br.ID == safeBranch {
+            ret = append(ret, br)
+        }
     }
+    return ret
+}
 
+func (dk *configDataKeeper) reviewPositions(branchID string) []interface{} {
+    view := dk.data()
     ret := make([]interface{}, 0)
-    for _, branch := range queryAll(dk.xmlstorage, selector) {
-        for _, e := range queryAll(branch, "employees/employee") {
+    for _, branch := range dk._branchesOrAll(branchID) {
+        for _, e := range view.positions(branch.ID) {
             ret = append(ret, map[string]interface{}{
-                "pos":   e.SelectAttr("pos"),
-                "branch": branch.SelectAttr("id"),
-                "vacant": e.SelectAttr("person") == "",
+                "pos":   e.pos(),
+                "branch": branch.ID,
+                "vacant": e.person() == "",
             })
         }
     }
@@ -967,30 +1291,17 @@ func (dk *configDataKeeper) reviewPositions(branchID string) []interface{} {
 }
 
 func (dk *configDataKeeper) getPositions(branchID string) []interface{} {
-    if branchID == "" {
-        branchID = ""
-    }
-    safeBranch, err := safeXPathValue(branchID)
-    if err != nil {
-        safeBranch = ""
-    }
-
-    selector := "//branch"
-    if safeBranch != "" {
-        selector = fmt.Sprintf("//branch[@id='%s']", safeBranch)
-    }
-
+    view := dk.data()
     ret := make([]interface{}, 0)
-    for _, branch := range queryAll(dk.xmlstorage, selector) {
-        for _, e := range queryAll(branch, "employees/employee") {
-            person := e.SelectAttr("person")
+    for _, branch := range dk._branchesOrAll(branchID) {
+        for _, e := range view.positions(branch.ID) {
             state := "VACANT"
-            if person != "" {
+            if e.person() != "" {
                 state = "OCCUPIED"
             }
             ret = append(ret, map[string]interface{}{
-                "id":    e.SelectAttr("pos"),
-                "value": fmt.Sprintf("%s at %s %s", e.SelectAttr("pos"), branch.SelectAttr("id"), state),
+                "id":    e.pos(),
+                "value": fmt.Sprintf("%s at %s %s", e.pos(), branch.ID, state),
             })
         }
     }
@@ -1006,13 +1317,14 @@ func (dk *configDataKeeper) get_branches_with_positions(branchID string, perRole
         branchID = safeBranch
     }
 
-    var roots []*xmlquery.Node
+    view := dk.data()
+    var roots []string
     if branchID == "*ALL*" {
-        roots = queryAll(dk.xmlstorage, "//branch")
-    } else {
-        if b := queryOne(dk.xmlstorage, fmt.Sprintf("//branch[@id='%s']", branchID)); b != nil {
-            roots = queryAll(b, "descendant-or-self::branch")
+        for _, br := range view.branchList {
+            roots = append(roots, br.ID)
         }
+    } else {
+        roots = view.subtree(branchID)
     }
 	if len(roots) == 0 {
 		return map[string]interface{}{
@@ -1026,8 +1338,8 @@ func (dk *configDataKeeper) get_branches_with_positions(branchID string, perRole
     report := make([]interface{}, 0)
     for _, br := range roots {
         countAll := 0
-        for _, e := range queryAll(br, "employees/employee") {
-            if onlyVacant && e.SelectAttr("person") != "" {
+        for _, e := range view.positions(br) {
+            if onlyVacant && e.person() != "" {
                 continue
             }
             countAll++
@@ -1035,30 +1347,30 @@ func (dk *configDataKeeper) get_branches_with_positions(branchID string, perRole
 
         if !perRole {
             report = append(report, map[string]interface{}{
-                "branch": br.SelectAttr("id"),
+                "branch": br,
                 "count":  countAll,
             })
             continue
         }
 
         positions := make([]string, 0)
-        for _, e := range queryAll(br, "employees/employee") {
-            if onlyVacant && e.SelectAttr("person") != "" {
+        for _, e := range view.positions(br) {
+            if onlyVacant && e.person() != "" {
                 continue
             }
-            positions = append(positions, e.SelectAttr("pos"))
+            positions = append(positions, e.pos())
         }
 
         for _, p := range uniqueStrings(positions) {
             cnt := 0
-            for _, e := range queryAll(br, fmt.Sprintf("employees/employee[@pos='%s']", p)) {
-                if onlyVacant && e.SelectAttr("person") != "" {
+            for _, e := range view.positions(br) {
+                if e.pos() != p || (onlyVacant && e.person() != "") {
                     continue
                 }
                 cnt++
             }
             report = append(report, map[string]interface{}{
-                "branch": br.SelectAttr("id"),
+                "branch": br,
                 "role":   p,
                 "count":  cnt,
             })
@@ -1073,41 +1385,6 @@ func (dk *configDataKeeper) get_branches_with_positions(branchID string, perRole
     }
 }
 
-func (dk *configDataKeeper) _collectBranchFuncsets(branchNode *xmlquery.Node) map[string]struct{} {
-    if branchNode == nil {
-        return map[string]struct{}{}
-    }
-
-    ret := map[string]struct{}{}
-    for _, fs := range queryAll(branchNode, "deffuncsets/funcset") {
-        if fsid := fs.SelectAttr("id"); fsid != "" {
-            ret[fsid] = struct{}{}
-        }
-    }
-
-    wlNodes := queryAll(branchNode, "func_white_list")
-    anc := queryAll(branchNode, "ancestor::branch")
-    if len(wlNodes) == 0 || len(anc) == 0 {
-        return ret
-    }
-
-    parent := anc[len(anc)-1]
-    parentFuncsets := dk._collectBranchFuncsets(parent)
-
-    if strings.ToLower(wlNodes[0].SelectAttr("propagateParent")) == "yes" {
-        return mergeSets(ret, parentFuncsets)
-    }
-
-    wl := map[string]struct{}{}
-    for _, fs := range queryAll(wlNodes[0], "funcset") {
-        if id := fs.SelectAttr("id"); id != "" {
-            wl[id] = struct{}{}
-        }
-    }
-
-    return mergeSets(ret, intersectMaps(parentFuncsets, wl))
-}
-
 func mergeSets(a, b map[string]struct{}) map[string]struct{} {
     ret := map[string]struct{}{}
     for k := range a {
@@ -1129,45 +1406,38 @@ func intersectMaps(a, b map[string]struct{}) map[string]struct{} {
     return ret
 }
 
-func (dk *configDataKeeper) _findRoleNode(pos string, branchNode *xmlquery.Node) *xmlquery.Node {
-    if branchNode == nil {
-        return nil
-    }
-
-    safePos, err := safeXPathValue(pos)
-    if err != nil {
-        return nil
-    }
-
-    candidates := queryAll(branchNode, fmt.Sprintf("ancestor-or-self::branch/roles/role[@name='%s']", safePos))
-    if len(candidates) == 0 {
-        return nil
-    }
-    return candidates[len(candidates)-1]
-}
-
 func (dk *configDataKeeper) listEnabledRoles4Branch(branchID string) []string {
-    branchNode, err := dk._getBranchNodeS(branchID, "", false)
-    if err != nil {
+    if _, err := dk._getBranch(branchID); err != nil {
         return []string{}
     }
 
+    view := dk.data()
     set := map[string]struct{}{}
-    for _, role := range queryAll(branchNode, "ancestor-or-self::branch/roles/role/@name") {
-        if role.Type == xmlquery.AttributeNode {
-            set[strings.TrimSpace(role.InnerText())] = struct{}{}
-        } else {
-            if n := role.SelectAttr("name"); n != "" {
-                set[n] = struct{}{}
-            }
+    for _, br := range view.lineage(branchID) {
+        for _, role := range view.roles(br) {
+            set[strings.TrimSpace(role.Name)] = struct{}{}
         }
     }
     return sortedSet(set)
 }
 
+// _positionCounts gives how many positions of the name the branch has, and how many of them are vacant.
+func (dk *configDataKeeper) _positionCounts(branchID, pos string) (int, int) {
+    total, vacant := 0, 0
+    for _, e := range dk.data().positions(branchID) {
+        if e.pos() != pos {
+            continue
+        }
+        total++
+        if !e.Attrs.has("person") {
+            vacant++
+        }
+    }
+    return total, vacant
+}
+
 func (dk *configDataKeeper) createBranchPosition(branchID, roleName string) map[string]interface{} {
-    empsNode, err := dk._getBranchNodeS(branchID, "employees", false)
-    if err != nil {
+    if _, err := dk._getBranch(branchID); err != nil {
         return err.dict4api
     }
 
@@ -1176,17 +1446,10 @@ func (dk *configDataKeeper) createBranchPosition(branchID, roleName string) map[
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Required argument not given: role is %v", roleName), nil).dict4api
     }
 
-    empNode := addChildElement(empsNode, "employee", map[string]string{"pos": safeRole}, "")
-    _ = empNode
-    total := len(queryAll(empsNode, fmt.Sprintf("employee[@pos='%s']", safeRole)))
-    vacant := 0
-    for _, e := range queryAll(empsNode, fmt.Sprintf("employee[@pos='%s' and not(@person)]", safeRole)) {
-        if e.SelectAttr("person") == "" {
-            vacant++
-        }
+    if ex := dk._stored(dk.store.addPosition(positionRecord{Branch: branchID, Attrs: attrPairs{"pos", safeRole}}), false); ex != nil {
+        return ex.dict4api
     }
-
-    dk._save(false)
+    total, vacant := dk._positionCounts(branchID, safeRole)
     return map[string]interface{}{
         "result": true,
         "branch": branchID,
@@ -1197,8 +1460,7 @@ func (dk *configDataKeeper) createBranchPosition(branchID, roleName string) map[
 }
 
 func (dk *configDataKeeper) deleteBranchPosition(branchID, roleName string) map[string]interface{} {
-    empsNode, err := dk._getBranchNodeS(branchID, "employees", false)
-    if err != nil {
+    if _, err := dk._getBranch(branchID); err != nil {
         return err.dict4api
     }
 
@@ -1207,21 +1469,20 @@ func (dk *configDataKeeper) deleteBranchPosition(branchID, roleName string) map[
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Required argument not given: role is %v", roleName), nil).dict4api
     }
 
-    candidates := queryAll(empsNode, fmt.Sprintf("employee[@pos='%s' and not(@person)]", safeRole))
+    candidates := make([]positionRecord, 0)
+    for _, e := range dk.data().positions(branchID) {
+        if e.pos() == safeRole && !e.Attrs.has("person") {
+            candidates = append(candidates, e)
+        }
+    }
     if len(candidates) == 0 {
         return newInternError("NOT-IN-SET", fmt.Sprintf("Branch %v has no vacant %v positions", branchID, roleName), nil).dict4api
     }
-    candidates[len(candidates)-1].RemoveFromTree()
-
-    total := len(queryAll(empsNode, fmt.Sprintf("employee[@pos='%s']", safeRole)))
-    vacant := 0
-    for _, e := range queryAll(empsNode, fmt.Sprintf("employee[@pos='%s' and not(@person)]", safeRole)) {
-        if e.SelectAttr("person") == "" {
-            vacant++
-        }
+    if ex := dk._stored(dk.store.deletePosition(branchID, candidates[len(candidates)-1].Seq), false); ex != nil {
+        return ex.dict4api
     }
 
-    dk._save(false)
+    total, vacant := dk._positionCounts(branchID, safeRole)
     return map[string]interface{}{
         "result": true,
         "branch": branchID,
@@ -1238,79 +1499,76 @@ func (dk *configDataKeeper) getBranchVacantPositions(branchID string) []string {
     }
 
     ret := make(map[string]struct{})
-    for _, e := range queryAll(dk.xmlstorage, fmt.Sprintf("//branch[@id='%s']/employees/employee[not(@person)]/@pos", safeBranch)) {
-        if e.Type == xmlquery.AttributeNode {
-            ret[strings.TrimSpace(e.InnerText())] = struct{}{}
-            continue
-        }
-        if p := e.SelectAttr("pos"); p != "" {
-            ret[p] = struct{}{}
+    for _, e := range dk.data().positions(safeBranch) {
+        if !e.Attrs.has("person") && e.Attrs.has("pos") {
+            ret[strings.TrimSpace(e.pos())] = struct{}{}
         }
     }
 
     return sortedSet(ret)
 }
 
-func (dk *configDataKeeper) _userFuncSets(userid string) []string {
-    safeID, err := safeXPathValue(userid)
-    if err != nil {
-        return []string{}
-    }
-
-    empNodes := queryAll(dk.xmlstorage, fmt.Sprintf("//branch/employees/employee[@person='%s']", safeID))
-    if len(empNodes) == 0 {
-        return []string{}
+func (dk *configDataKeeper) _userPositions(userid string) []positionRecord {
+    if _, err := safeXPathValue(userid); err != nil {
+        return nil
     }
+    return dk.data().userPositions(userid)
+}
 
-    branchNode := empNodes[0].Parent.Parent
-    whitelist := dk._collectBranchFuncsets(branchNode)
-    pos := empNodes[0].SelectAttr("pos")
+// _positionFuncSets gives funcsets of one position: those of its role allowed by the branch whitelist.
+func (dk *configDataKeeper) _positionFuncSets(p positionRecord) map[string]struct{} {
+    return dk.data().positionFuncsets(p)
+}
 
-    roleNode := dk._findRoleNode(pos, branchNode)
-    if roleNode == nil {
-        return []string{}
+// _userFuncSets is the union of funcsets over all positions held by the user
+// and the positions delegated to him at the moment.
+func (dk *configDataKeeper) _userFuncSets(userid string) []string {
+    ret := map[string]struct{}{}
+    for _, p := range dk._userPositions(userid) {
+        ret = mergeSets(ret, dk._positionFuncSets(p))
     }
-
-    roleSets := map[string]struct{}{}
-    for _, fs := range queryAll(roleNode, "funcset/@id") {
-        if fs.Type == xmlquery.AttributeNode {
-            roleSets[strings.TrimSpace(fs.InnerText())] = struct{}{}
-            continue
-        }
-        if id := fs.SelectAttr("id"); id != "" {
-            roleSets[id] = struct{}{}
-        }
+    for _, p := range dk._delegatedPositions(userid, time.Now().Unix()) {
+        ret = mergeSets(ret, dk._positionFuncSets(p))
     }
+    return sortedSet(ret)
+}
 
-    return sortedSet(intersectMaps(whitelist, roleSets))
+func (dk *configDataKeeper) userEmployments(userid string) []interface{} {
+    ret := make([]interface{}, 0)
+    for _, p := range dk._userPositions(userid) {
+        ret = append(ret, map[string]interface{}{
+            "branch":   p.Branch,
+            "pos":      p.pos(),
+            "funcsets": sortedSet(dk._positionFuncSets(p)),
+        })
+    }
+    return ret
 }
 
 func (dk *configDataKeeper) getBranchEnabledFuncsets(branchID string) []string {
-    branchNode, err := dk._getBranchNodeS(branchID, "", false)
-    if err != nil {
+    if _, err := dk._getBranch(branchID); err != nil {
         return []string{}
     }
-    return sortedSet(dk._collectBranchFuncsets(branchNode))
+    return sortedSet(dk.data().collectFuncsets(branchID))
 }
 
 func (dk *configDataKeeper) listBranchRoles(branchID string, withInherited, withBranchIds bool) map[string]interface{} {
-    branchNode, err := dk._getBranchNodeS(branchID, "", false)
-    if err != nil {
+    if _, err := dk._getBranch(branchID); err != nil {
         return err.dict4api
     }
 
-    rolesSet := map[string]struct{}{}
-    axis := "self"
+    view := dk.data()
+    branches := []string{branchID}
     if withInherited {
-        axis = "ancestor-or-self"
+        branches = view.lineage(branchID)
     }
 
-    for _, role := range queryAll(branchNode, fmt.Sprintf("%s::branch/roles/role", axis)) {
-        if role == nil {
-            continue
-        }
-        if name := role.SelectAttr("name"); name != "" {
-            rolesSet[name] = struct{}{}
+    rolesSet := map[string]struct{}{}
+    for _, br := range branches {
+        for _, role := range view.roles(br) {
+            if role.Name != "" {
+                rolesSet[role.Name] = struct{}{}
+            }
         }
     }
 
@@ -1320,10 +1578,9 @@ func (dk *configDataKeeper) listBranchRoles(branchID string, withInherited, with
 
     rolesInBranches := make([]interface{}, 0)
     for _, roleName := range sortedSet(rolesSet) {
-        roleNode := dk._findRoleNode(roleName, branchNode)
         parentBranch := ""
-        if roleNode != nil && roleNode.Parent != nil && roleNode.Parent.Parent != nil {
-            parentBranch = roleNode.Parent.Parent.SelectAttr("id")
+        if role := view.findRole(roleName, branchID); role != nil {
+            parentBranch = role.Branch
         }
         rolesInBranches = append(rolesInBranches, []interface{}{roleName, parentBranch})
     }
@@ -1335,8 +1592,7 @@ func (dk *configDataKeeper) listBranchRoles(branchID string, withInherited, with
 }
 
 func (dk *configDataKeeper) createBranchRole(branchID, roleName string, duties []string) map[string]interface{} {
-    rolesNode, err := dk._getBranchNodeS(branchID, "roles", false)
-    if err != nil {
+    if _, err := dk._getBranch(branchID); err != nil {
         return err.dict4api
     }
 
@@ -1345,25 +1601,40 @@ func (dk *configDataKeeper) createBranchRole(branchID, roleName string, duties [
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Required argument not given: role is %v", roleName), nil).dict4api
     }
 
-    if len(queryAll(rolesNode, fmt.Sprintf("role[@name='%s']", safeRole))) > 0 {
+    if dk.data().role(branchID, safeRole) != nil {
         return newInternError("ALREADY-EXISTS", fmt.Sprintf("Role %v already defined in branch %v", roleName, branchID), map[string]interface{}{"bad_value": safeRole}).dict4api
     }
 
-    roleNode := addChildElement(rolesNode, "role", map[string]string{"name": safeRole}, "")
+    if undefined := dk._undefinedFuncsets(duties); len(undefined) > 0 {
+        return newInternError("FUNCSET-UNKNOWN", fmt.Sprintf("Funcsets %v are defined nowhere", undefined), map[string]interface{}{"bad_value": undefined}).dict4api
+    }
+
+    role := roleRecord{Branch: branchID, Name: safeRole, Funcsets: []string{}}
     for _, d := range duties {
         d = strings.TrimSpace(d)
         if d == "" {
             continue
         }
-        addChildElement(roleNode, "funcset", map[string]string{"id": d}, "")
+        role.Funcsets = append(role.Funcsets, d)
     }
 
-    dk._save(false)
+    if ex := dk._stored(dk.store.putRole(role), false); ex != nil {
+        return ex.dict4api
+    }
     return map[string]interface{}{"result": true}
 }
 
-func (dk *configDataKeeper) deleteBranchRole(branchID, roleName string) map[string]interface{} {
-    rolesNode, err := dk._getBranchNodeS(branchID, "roles", false)
+func (dk *configDataKeeper) deleteBranchRole(branchID, roleName, mode string, dryRun bool) map[string]interface{} {
+    if dryRun {
+        return dk.tryOut(func(sb *configDataKeeper) map[string]interface{} { return sb.deleteBranchRole(branchID, roleName, mode, false) })
+    }
+
+    mode, ex := checkDeleteMode(mode)
+    if ex != nil {
+        return ex.dict4api
+    }
+
+    br, err := dk._getBranch(branchID)
     if err != nil {
         return err.dict4api
     }
@@ -1373,38 +1644,80 @@ func (dk *configDataKeeper) deleteBranchRole(branchID, roleName string) map[stri
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Required argument not given: role is %v", roleName), nil).dict4api
     }
 
-    roleNodes := queryAll(rolesNode, fmt.Sprintf("role[@name='%s']", safeRole))
-    if len(roleNodes) == 0 {
+    view := dk.data()
+    if view.role(branchID, safeRole) == nil {
         return newInternError("ROLE-UNKNOWN", fmt.Sprintf("Role %v has no direct definition in branch %v", roleName, branchID), map[string]interface{}{"bad_value": safeRole}).dict4api
     }
 
-    roleNodes[0].RemoveFromTree()
-    dk._save(false)
-    return map[string]interface{}{"result": true}
+    // positions resolving to this role with no same-named role above to fall back to
+    fallback := br.Parent != "" && view.findRole(roleName, br.Parent) != nil
+    refPositions := make([]positionRecord, 0)
+    refs := make([]interface{}, 0)
+    employed := make([]string, 0)
+    if !fallback {
+        for _, id := range view.subtree(branchID) {
+            for _, emp := range view.positions(id) {
+                if role := view.findRole(roleName, id); emp.pos() != roleName || role == nil || role.Branch != branchID {
+                    continue
+                }
+                refPositions = append(refPositions, emp)
+                refs = append(refs, map[string]interface{}{"kind": "position", "where": id, "id": roleName, "person": emp.person()})
+                if p := emp.person(); p != "" {
+                    employed = append(employed, p)
+                }
+            }
+        }
+    }
+
+    if len(refs) > 0 && mode == "restrict" {
+        return stillReferenced(fmt.Sprintf("Role %v of %v", roleName, branchID), refs)
+    }
+    if len(employed) > 0 {
+        return newInternError("USER-EMPLOYED", fmt.Sprintf("Positions of role %v are still held by %v", roleName, employed), map[string]interface{}{"fire_them": uniqueStrings(employed), "references": refs}).dict4api
+    }
+    // the positions go last first, so that the numbers of the ones still to go stay
+    var werr error
+    for i := len(refPositions) - 1; i >= 0 && werr == nil; i-- {
+        werr = dk.store.deletePosition(refPositions[i].Branch, refPositions[i].Seq)
+    }
+    if werr == nil {
+        werr = dk.store.deleteRole(branchID, safeRole)
+    }
+    if ex := dk._stored(werr, false); ex != nil {
+        return ex.dict4api
+    }
+    return map[string]interface{}{"result": true, "mode": mode, "references_removed": refs}
 }
 
-func (dk *configDataKeeper) _get_operatorS_node(operatorID string) (*xmlquery.Node, *internError) {
+func (dk *configDataKeeper) _get_operator(operatorID string) (*personRecord, *internError) {
     if operatorID == "" {
         return nil, newInternError("OP-UNAUTHORIZED", "Operator not authorized or authorization expired", nil)
     }
-    opNode := dk._getUserNode(operatorID)
-    if opNode == nil {
+    op := dk._getPerson(operatorID)
+    if op == nil {
         return nil, newInternError("OP-UNKNOWN", fmt.Sprintf("Operator %v is unknown to the system", operatorID), nil)
     }
-    return opNode, nil
+    return op, nil
 }
 
-func (dk *configDataKeeper) _get_operatorS_branch(operatorID string) (*xmlquery.Node, *internError) {
+// _get_operatorS_branches gives all branches the operator holds a position in; operator authority
+// spreads over each of them with their subsidiaries.
+func (dk *configDataKeeper) _get_operatorS_branches(operatorID string) ([]string, *internError) {
     _, err := safeXPathValue(operatorID)
     if err != nil {
         return nil, newInternError("WRONG-FORMAT", fmt.Sprintf("Operator identifier %v is unsafe", operatorID), nil)
     }
 
-    opBranches := queryAll(dk.xmlstorage, fmt.Sprintf("//branch[employees/employee[@person='%s']]", operatorID))
+    opBranches := make([]string, 0)
+    for _, p := range dk.data().userPositions(operatorID) {
+        if !contains(opBranches, p.Branch) {
+            opBranches = append(opBranches, p.Branch)
+        }
+    }
     if len(opBranches) == 0 {
         return nil, newInternError("FORBIDDEN-FOR-OP", fmt.Sprintf("Operator %v is nowhere employed", operatorID), nil)
     }
-    return opBranches[0], nil
+    return opBranches, nil
 }
 
 func (dk *configDataKeeper) createUser(userid, secret, operator, pswLifeTime, readableName, sessionMax string) map[string]interface{} {
@@ -1412,33 +1725,30 @@ func (dk *configDataKeeper) createUser(userid, secret, operator, pswLifeTime, re
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Not all required parameters are given: user id:%v, secret:%v, operator:%v", userid, secret, operator), nil).dict4api
     }
 
-    if dk._getUserNode(userid) != nil {
+    if dk._getPerson(userid) != nil {
         return newInternError("ALREADY-EXISTS", fmt.Sprintf("User '%s' already exists", userid), nil).dict4api
     }
 
-    if _, ex := dk._get_operatorS_node(operator); ex != nil {
+    if _, ex := dk._get_operator(operator); ex != nil {
         return ex.dict4api
     }
 
-    pnodes := queryAll(dk.xmlstorage, "/universe/registers/people_register")
-    if len(pnodes) == 0 {
-        return newInternError("DATABASE-ERROR", "No people register found", nil).dict4api
-    }
-
     pswTime := time.Now().Unix()
-    unode := addChildElement(pnodes[0], "person", map[string]string{"id": userid, "secret": secret, "pswChangedAt": strconv.FormatInt(pswTime, 10), "failures": "0", "readableName": readableName, "sessionMax": strconv.FormatInt(toInt(sessionMax, int(dk.dfltSessMax)), 10), "createdBy": operator, "createdAt": strconv.FormatInt(pswTime, 10)}, "")
+    attrs := mergeAttrs(nil, orderedPairs(map[string]string{"id": userid, "secret": secret, "pswChangedAt": strconv.FormatInt(pswTime, 10), "failures": "0", "readableName": readableName, "sessionMax": strconv.FormatInt(toInt(sessionMax, int(dk.dfltSessMax)), 10), "createdBy": operator, "createdAt": strconv.FormatInt(pswTime, 10)}), true)
 
     ret := map[string]interface{}{"result": true, "secret_changed": pswTime}
     if pswLifeTime != "" {
         ttl, err := strconv.ParseFloat(pswLifeTime, 64)
         if err == nil {
             expTime := pswTime + int64(ttl*86400)
-            unode.SetAttr("expireAt", strconv.FormatInt(expTime, 10))
+            attrs = attrs.with("expireAt", strconv.FormatInt(expTime, 10))
             ret["secret_expiration"] = expTime
         }
     }
 
-    dk._save(false)
+    if ex := dk._stored(dk.store.putPerson(personRecord{Attrs: attrs}), false); ex != nil {
+        return ex.dict4api
+    }
     return ret
 }
 
@@ -1447,43 +1757,45 @@ func (dk *configDataKeeper) changeUser(userid, secret, operator, pswLifeTime, re
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Not all required parameters are given: user id:%v, secret:%v, operator:%v", userid, secret, operator), nil).dict4api
     }
 
-    unode := dk._getUserNode(userid)
-    if unode == nil {
+    person := dk._getPerson(userid)
+    if person == nil {
         return newInternError("USER-UNKNOWN", fmt.Sprintf("User %v is unknown", userid), nil).dict4api
     }
 
-    if _, ex := dk._get_operatorS_node(operator); ex != nil {
+    if _, ex := dk._get_operator(operator); ex != nil {
         return ex.dict4api
     }
 
     pswTime := time.Now().Unix()
-    unode.SetAttr("secret", secret)
-    unode.SetAttr("pswChangedAt", strconv.FormatInt(pswTime, 10))
-    unode.SetAttr("readableName", readableName)
-    unode.SetAttr("sessionMax", strconv.FormatInt(toInt(sessionMax, int(dk.dfltSessMax)), 10))
-    unode.SetAttr("failures", "0")
+    attrs := person.Attrs.with("secret", secret)
+    attrs = attrs.with("pswChangedAt", strconv.FormatInt(pswTime, 10))
+    attrs = attrs.with("readableName", readableName)
+    attrs = attrs.with("sessionMax", strconv.FormatInt(toInt(sessionMax, int(dk.dfltSessMax)), 10))
+    attrs = attrs.with("failures", "0")
 
     ret := map[string]interface{}{"result": true, "secret_changed": pswTime}
     if pswLifeTime != "" {
         ttl, err := strconv.ParseFloat(pswLifeTime, 64)
         if err == nil {
             expTime := pswTime + int64(ttl*86400)
-            unode.SetAttr("expireAt", strconv.FormatInt(expTime, 10))
+            attrs = attrs.with("expireAt", strconv.FormatInt(expTime, 10))
             ret["secret_expiration"] = expTime
         }
-    } else if unode.SelectAttr("expireAt") != "" {
-        unode.RemoveAttr("expireAt")
+    } else if attrs.get("expireAt") != "" {
+        attrs = attrs.without("expireAt")
     }
 
-    changedNode := addChildElement(unode, "changed", map[string]string{"by": operator, "at": strconv.FormatInt(pswTime, 10)}, "")
-    _ = changedNode
+    changed := attrPairs(orderedPairs(map[string]string{"by": operator, "at": strconv.FormatInt(pswTime, 10)}))
+    changes := append(append([]attrPairs{}, person.Changes...), changed)
 
-    dk._save(false)
+    if ex := dk._stored(dk.store.putPerson(personRecord{Attrs: mergeAttrs(nil, attrs, true), Changes: changes}), false); ex != nil {
+        return ex.dict4api
+    }
     return ret
 }
 
 func (dk *configDataKeeper) deleteUser(userid, operator string) map[string]interface{} {
-    if _, ex := dk._get_operatorS_node(operator); ex != nil {
+    if _, ex := dk._get_operator(operator); ex != nil {
         return ex.dict4api
     }
 
@@ -1491,8 +1803,7 @@ func (dk *configDataKeeper) deleteUser(userid, operator string) map[string]inter
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Not all required parameters are given: user id is %v", userid), nil).dict4api
     }
 
-    unode := dk._getUserNode(userid)
-    if unode == nil {
+    if dk._getPerson(userid) == nil {
         return newInternError("USER-UNKNOWN", fmt.Sprintf("User %v is unknown", userid), nil).dict4api
     }
 
@@ -1500,15 +1811,16 @@ func (dk *configDataKeeper) deleteUser(userid, operator string) map[string]inter
         return newInternError("USER-EMPLOYED", fmt.Sprintf("User '%v' is employed, fire him first", userid), nil).dict4api
     }
 
-    if unode.Parent != nil {
-        unode.RemoveFromTree()
+    if ex := dk._stored(dk.store.deletePerson(userid), false); ex != nil {
+        return ex.dict4api
     }
-    dk._save(false)
     return map[string]interface{}{"result": true}
 }
 
-func (dk *configDataKeeper) _get_empNode_relOp(operatorID, userid string) (*xmlquery.Node, *internError) {
-    opBranch, ex := dk._get_operatorS_branch(operatorID)
+// _get_positions_relOp gives positions of the user accountable to the operator,
+// optionally narrowed down to a branch and/or a position name.
+func (dk *configDataKeeper) _get_positions_relOp(operatorID, userid, branchID, pos string) ([]positionRecord, *internError) {
+    opBranches, ex := dk._get_operatorS_branches(operatorID)
     if ex != nil {
         return nil, ex
     }
@@ -1518,19 +1830,41 @@ func (dk *configDataKeeper) _get_empNode_relOp(operatorID, userid string) (*xmlq
         return nil, newInternError("WRONG-FORMAT", fmt.Sprintf("User %v is unsafe", userid), nil)
     }
 
-    empNodes := queryAll(opBranch, fmt.Sprintf("descendant-or-self::employee[@person='%s']", uid))
-    if len(empNodes) == 0 {
+    view := dk.data()
+    seen := map[string]struct{}{}
+    positions := make([]positionRecord, 0)
+    for _, opBranch := range opBranches {
+        for _, br := range view.subtree(opBranch) {
+            for _, emp := range view.positions(br) {
+                key := fmt.Sprintf("%v#%d", emp.Branch, emp.Seq)
+                if emp.person() != uid || hasKey(seen, key) {
+                    continue
+                }
+                if branchID != "" && emp.Branch != branchID {
+                    continue
+                }
+                if pos != "" && emp.pos() != pos {
+                    continue
+                }
+                seen[key] = struct{}{}
+                positions = append(positions, emp)
+            }
+        }
+    }
+    if len(positions) == 0 {
         return nil, newInternError("FORBIDDEN-FOR-OP", fmt.Sprintf("User %v is not accountable to operator %v", userid, operatorID), nil)
     }
-    return empNodes[0], nil
+    return positions, nil
 }
 
-func (dk *configDataKeeper) fireEmployee(userid, operator string) map[string]interface{} {
+// fireEmployee releases one position of the user; branch and pos may be omitted
+// when they leave no doubt which position is meant.
+func (dk *configDataKeeper) fireEmployee(userid, operator, branchID, pos string) map[string]interface{} {
     if userid == "" {
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Not all required parameters are given: user id is %v", userid), nil).dict4api
     }
 
-    if dk._getUserNode(userid) == nil {
+    if dk._getPerson(userid) == nil {
         return newInternError("USER-UNKNOWN", fmt.Sprintf("User %v is unknown", userid), nil).dict4api
     }
 
@@ -1539,24 +1873,38 @@ func (dk *configDataKeeper) fireEmployee(userid, operator string) map[string]int
         return newInternError("ALREADY-UNEMPLOYED", fmt.Sprintf("User '%v' already unemployed", userid), nil).dict4api
     }
 
-    empNode, ex := dk._get_empNode_relOp(operator, userid)
+    if branchID != "" || pos != "" {
+        matching := false
+        for _, emp := range dk._userPositions(userid) {
+            if (branchID == "" || emp.Branch == branchID) && (pos == "" || emp.pos() == pos) {
+                matching = true
+                break
+            }
+        }
+        if !matching {
+            return newInternError("NOT-IN-SET", fmt.Sprintf("User '%v' holds no position %v at %v", userid, pos, branchID), map[string]interface{}{"employments": dk.userEmployments(userid)}).dict4api
+        }
+    }
+
+    positions, ex := dk._get_positions_relOp(operator, userid, branchID, pos)
     if ex != nil {
         return ex.dict4api
     }
+    if len(positions) > 1 {
+        return newInternError("WRONG-FORMAT", fmt.Sprintf("User '%v' holds %d positions, specify branch and position to fire from", userid, len(positions)), map[string]interface{}{"employments": dk.userEmployments(userid)}).dict4api
+    }
+    emp := positions[0]
 
-    branch := ""
-    if empNode.Parent != nil && empNode.Parent.Parent != nil {
-        branch = empNode.Parent.Parent.SelectAttr("id")
+    fired := positionRecord{Branch: emp.Branch, Seq: emp.Seq, Attrs: emp.Attrs.without("person")}
+    if ex := dk._stored(dk.store.setPosition(fired), false); ex != nil {
+        return ex.dict4api
     }
-    pos := empNode.SelectAttr("pos")
-    empNode.RemoveAttr("person")
-    dk._save(false)
 
-    return map[string]interface{}{"result": true, "branch": branch, "pos": pos}
+    return map[string]interface{}{"result": true, "branch": emp.Branch, "pos": emp.pos(), "remaining": dk.userEmployments(userid)}
 }
 
-func (dk *configDataKeeper) _get_brNode_relOp(operatorID, branchID string) (*xmlquery.Node, *internError) {
-    opBranch, ex := dk._get_operatorS_branch(operatorID)
+func (dk *configDataKeeper) _get_branch_relOp(operatorID, branchID string) (*branchRecord, *internError) {
+    opBranches, ex := dk._get_operatorS_branches(operatorID)
     if ex != nil {
         return nil, ex
     }
@@ -1566,11 +1914,27 @@ func (dk *configDataKeeper) _get_brNode_relOp(operatorID, branchID string) (*xml
         return nil, newInternError("WRONG-FORMAT", fmt.Sprintf("Branch %v is unsafe", branchID), nil)
     }
 
-    brNodes := queryAll(opBranch, fmt.Sprintf("descendant-or-self::branch[@id='%s']", safeBranch))
-    if len(brNodes) == 0 {
-        return nil, newInternError("FORBIDDEN-FOR-OP", fmt.Sprintf("Branch %v is not accountable to operator %v", branchID, operatorID), nil)
+    view := dk.data()
+    for _, opBranch := range opBranches {
+        if view.within(safeBranch, opBranch) {
+            return view.branch(safeBranch), nil
+        }
+    }
+    return nil, newInternError("FORBIDDEN-FOR-OP", fmt.Sprintf("Branch %v is not accountable to operator %v", branchID, operatorID), nil)
+}
+
+// _check_rootOp lets through only an operator accountable for the root branch, as operations
+// over the whole data (secrets export, restore, reload) need.
+func (dk *configDataKeeper) _check_rootOp(operatorID string) *internError {
+    if _, ex := dk._get_operator(operatorID); ex != nil {
+        return ex
     }
-    return brNodes[0], nil
+    roots := dk.data().roots()
+    if len(roots) == 0 {
+        return newInternError("DATABASE-ERROR", "Universe has no root branch", nil)
+    }
+    _, ex := dk._get_branch_relOp(operatorID, roots[0])
+    return ex
 }
 
 func (dk *configDataKeeper) hireEmployee(userid, branchID, pos, operator string) map[string]interface{} {
@@ -1578,14 +1942,10 @@ func (dk *configDataKeeper) hireEmployee(userid, branchID, pos, operator string)
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Not all required parameters are given: user id is %v, branch is %v, pos is %v", userid, branchID, pos), nil).dict4api
     }
 
-    if dk._getUserNode(userid) == nil {
+    if dk._getPerson(userid) == nil {
         return newInternError("USER-UNKNOWN", fmt.Sprintf("User %v is unknown", userid), nil).dict4api
     }
 
-    if branches := dk.userBranches(userid); len(branches) != 0 {
-        return newInternError("ALREADY-EMPLOYED", fmt.Sprintf("User '%v' already employed at %v", userid, branches), nil).dict4api
-    }
-
     safeBranch, err := safeXPathValue(branchID)
     if err != nil {
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Branch %v is unsafe", branchID), nil).dict4api
@@ -1596,24 +1956,43 @@ func (dk *configDataKeeper) hireEmployee(userid, branchID, pos, operator string)
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Position %v is unsafe", pos), nil).dict4api
     }
 
-    branchNodes := queryAll(dk.xmlstorage, fmt.Sprintf("//branch[@id='%s']", safeBranch))
-    if len(branchNodes) == 0 {
+    view := dk.data()
+    if view.branch(safeBranch) == nil {
         return newInternError("BRANCH-UNKNOWN", fmt.Sprintf("Branch '%v' does not exist", branchID), nil).dict4api
     }
 
-    empNodes := queryAll(branchNodes[0], fmt.Sprintf("employees/employee[@pos='%s' and not(@person)]", safePos))
-    if len(empNodes) == 0 {
+    safeUser, err := safeXPathValue(userid)
+    if err != nil {
+        return newInternError("WRONG-FORMAT", fmt.Sprintf("User %v is unsafe", userid), nil).dict4api
+    }
+
+    vacant := make([]positionRecord, 0)
+    for _, emp := range view.positions(safeBranch) {
+        if emp.pos() != safePos {
+            continue
+        }
+        if emp.person() == safeUser && emp.Attrs.has("person") {
+            return newInternError("ALREADY-EMPLOYED", fmt.Sprintf("User '%v' already holds position '%v' in '%v'", userid, pos, branchID), nil).dict4api
+        }
+        if !emp.Attrs.has("person") {
+            vacant = append(vacant, emp)
+        }
+    }
+
+    if len(vacant) == 0 {
         return newInternError("NO-VACANT-POSITIONS", fmt.Sprintf("No vacant positions for '%v' in '%v'", pos, branchID), nil).dict4api
     }
 
-    if _, ex := dk._get_brNode_relOp(operator, branchID); ex != nil {
+    if _, ex := dk._get_branch_relOp(operator, branchID); ex != nil {
         return ex.dict4api
     }
 
-    empNodes[0].SetAttr("person", userid)
-    dk._save(false)
+    hired := positionRecord{Branch: vacant[0].Branch, Seq: vacant[0].Seq, Attrs: vacant[0].Attrs.with("person", userid)}
+    if ex := dk._stored(dk.store.setPosition(hired), false); ex != nil {
+        return ex.dict4api
+    }
 
-    return map[string]interface{}{"result": true}
+    return map[string]interface{}{"result": true, "employments": dk.userEmployments(userid)}
 }
 
 func (dk *configDataKeeper) empSubbranchesList(userid string, allLevels, excludeOwn bool) map[string]interface{} {
@@ -1622,29 +2001,24 @@ func (dk *configDataKeeper) empSubbranchesList(userid string, allLevels, exclude
         return newInternError("WRONG-FORMAT", fmt.Sprintf("User %v is unsafe", userid), nil).dict4api
     }
 
-    if dk._getUserNode(safeID) == nil {
+    if dk._getPerson(safeID) == nil {
         return map[string]interface{}{"result": false, "reason": "USER-UNKNOWN"}
     }
 
+    view := dk.data()
     branchesNodeSet := map[string]struct{}{}
-    for _, branch := range queryAll(dk.xmlstorage, fmt.Sprintf("//branch[employees/employee[@person='%s']]", safeID)) {
-        if !excludeOwn {
-            if id := branch.SelectAttr("id"); id != "" {
-                branchesNodeSet[id] = struct{}{}
-            }
+    for _, p := range view.userPositions(safeID) {
+        if !excludeOwn && p.Branch != "" {
+            branchesNodeSet[p.Branch] = struct{}{}
         }
 
+        subs := view.children[p.Branch]
         if allLevels {
-            for _, sub := range queryAll(branch, "descendant::branch") {
-                if id := sub.SelectAttr("id"); id != "" {
-                    branchesNodeSet[id] = struct{}{}
-                }
-            }
-        } else {
-            for _, sub := range queryAll(branch, "branches/branch") {
-                if id := sub.SelectAttr("id"); id != "" {
-                    branchesNodeSet[id] = struct{}{}
-                }
+            subs = view.subtree(p.Branch)[1:]
+        }
+        for _, id := range subs {
+            if id != "" {
+                branchesNodeSet[id] = struct{}{}
             }
         }
     }
@@ -1653,7 +2027,7 @@ func (dk *configDataKeeper) empSubbranchesList(userid string, allLevels, exclude
 }
 
 func (dk *configDataKeeper) empFuncsetsList(userid string) map[string]interface{} {
-    if dk._getUserNode(userid) == nil {
+    if dk._getPerson(userid) == nil {
         return map[string]interface{}{"result": false, "reason": "USER-UNKNOWN"}
     }
 
@@ -1663,32 +2037,28 @@ func (dk *configDataKeeper) empFuncsetsList(userid string) map[string]interface{
 func (dk *configDataKeeper) __empFunctionIds(userid string) []string {
     funcsAllowed := map[string]struct{}{}
     for _, fsID := range dk._userFuncSets(userid) {
-        // Query universe.xml (dk.xmlstorage) for functions in funcset
-        for _, fnode := range queryAll(dk.xmlstorage, fmt.Sprintf("//funcset[@id='%s']/func/@id", fsID)) {
-            if fnode.Type == xmlquery.AttributeNode {
-                funcsAllowed[strings.TrimSpace(fnode.InnerText())] = struct{}{}
+        for _, fs := range dk.data().funcsetList {
+            if fs.ID != fsID {
+                continue
+            }
+            for _, fn := range fs.Functions {
+                funcsAllowed[strings.TrimSpace(fn)] = struct{}{}
             }
         }
     }
 
-    // Get all known functions from catalogues.xml
-    known := map[string]struct{}{}
-    for _, row := range queryAll(dk.xmlcats, "/catalogues/functions_catalogue/function") {
-        if id := row.SelectAttr("id"); id != "" {
-            known[id] = struct{}{}
-        }
-    }
-
-    // Return intersection
+    // only the functions described in the catalogue
     funcs := make([]string, 0)
-    for f := range intersectMaps(funcsAllowed, known) {
-        funcs = append(funcs, f)
+    for f := range funcsAllowed {
+        if f != "" && dk._functionDefined(f) {
+            funcs = append(funcs, f)
+        }
     }
     return funcs
 }
 
 func (dk *configDataKeeper) empFunctionsList(userid, prop string) map[string]interface{} {
-    if dk._getUserNode(userid) == nil {
+    if dk._getPerson(userid) == nil {
         return map[string]interface{}{"result": false, "reason": "USER-UNKNOWN"}
     }
 
@@ -1718,7 +2088,7 @@ func (dk *configDataKeeper) empFunctionsList(userid, prop string) map[string]int
 }
 
 func (dk *configDataKeeper) empFunctionsReview(userid, props string) map[string]interface{} {
-    if dk._getUserNode(userid) == nil {
+    if dk._getPerson(userid) == nil {
         return map[string]interface{}{"result": false, "reason": "USER-UNKNOWN"}
     }
 
@@ -1740,27 +2110,22 @@ func (dk *configDataKeeper) branchEmployeesList(branchID string, includeSubBranc
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Branch %v is unsafe", branchID), nil).dict4api
     }
 
-    br := queryOne(dk.xmlstorage, fmt.Sprintf("//branch[@id='%s']", safeBranch))
-    if br == nil {
+    view := dk.data()
+    if view.branch(safeBranch) == nil {
         return newInternError("BRANCH-UNKNOWN", fmt.Sprintf("Branch '%v' is unknown", branchID), nil).dict4api
     }
 
-    expr := "employees/employee/@person"
+    branches := []string{safeBranch}
     if includeSubBranches {
-        expr = "descendant::employees/employee/@person"
+        branches = view.subtree(safeBranch)
     }
 
     names := make([]interface{}, 0)
-    for _, emp := range queryAll(br, expr) {
-        if emp.Type == xmlquery.AttributeNode {
-            v := strings.TrimSpace(emp.InnerText())
-            if v != "" {
+    for _, br := range branches {
+        for _, emp := range view.positions(br) {
+            if v := strings.TrimSpace(emp.person()); v != "" {
                 names = append(names, v)
             }
-            continue
-        }
-        if v := emp.SelectAttr("person"); v != "" {
-            names = append(names, v)
         }
     }
 
@@ -1787,8 +2152,8 @@ func (dk *configDataKeeper) listFunctions(prop string) map[string]interface{} {
     }
 
     values := make([]string, 0)
-    for _, fn := range queryAll(dk.xmlcats, "/catalogues/functions_catalogue/function") {
-        raw := extractValue(fn, cfg.path)
+    for _, fn := range dk.store.functions() {
+        raw := extractValue(fn.Def, cfg.path)
         if raw == "" {
             continue
         }
@@ -1814,24 +2179,12 @@ func (dk *configDataKeeper) reviewFunctions(props string, functionID string) map
         }
     }
 
-    funcNodes := queryAll(dk.xmlcats, "/catalogues/functions_catalogue/function")
-    if functionID != "" {
-        safeID, err := safeXPathValue(functionID)
-        if err != nil {
-            return newInternError("WRONG-FORMAT", fmt.Sprintf("Function id %v is unsafe", functionID), nil).dict4api
-        }
-        funcNodes = queryAll(dk.xmlcats, fmt.Sprintf("/catalogues/functions_catalogue/function[@id='%s']", safeID))
-        if len(funcNodes) == 0 {
-            return newInternError("FUNCTION-UNKNOWN", fmt.Sprintf("Function %v is not described in catalogue", functionID), nil).dict4api
-        }
-    }
-
     if functionID == "" {
         result := make([]interface{}, 0)
-        for _, fn := range funcNodes {
+        for _, fn := range dk.store.functions() {
             entry := map[string]interface{}{}
             for _, p := range propl {
-                if val := _fpHow[p].transform(extractValue(fn, _fpHow[p].path)); val != "" {
+                if val := _fpHow[p].transform(extractValue(fn.Def, _fpHow[p].path)); val != "" {
                     entry[p] = val
                 }
             }
@@ -1840,10 +2193,18 @@ func (dk *configDataKeeper) reviewFunctions(props string, functionID string) map
         return map[string]interface{}{"result": true, "functions": result}
     }
 
-    fn := funcNodes[0]
+    safeID, err := safeXPathValue(functionID)
+    if err != nil {
+        return newInternError("WRONG-FORMAT", fmt.Sprintf("Function id %v is unsafe", functionID), nil).dict4api
+    }
+    fn, ok := dk.store.function(safeID)
+    if !ok {
+        return newInternError("FUNCTION-UNKNOWN", fmt.Sprintf("Function %v is not described in catalogue", functionID), nil).dict4api
+    }
+
     entry := map[string]interface{}{}
     for _, p := range propl {
-        if val := _fpHow[p].transform(extractValue(fn, _fpHow[p].path)); val != "" {
+        if val := _fpHow[p].transform(extractValue(fn.Def, _fpHow[p].path)); val != "" {
             entry[p] = val
         }
     }
@@ -1851,7 +2212,7 @@ func (dk *configDataKeeper) reviewFunctions(props string, functionID string) map
     return map[string]interface{}{
         "result":     true,
         "props":      entry,
-        "function_id": fn.SelectAttr("id"),
+        "function_id": fn.ID,
     }
 }
 
@@ -1861,12 +2222,12 @@ func (dk *configDataKeeper) getFunctionDef(funcID, pureXML string, header string
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Function %v is unsafe", funcID), nil).dict4api
     }
 
-    fnNodes := queryAll(dk.xmlcats, fmt.Sprintf("/catalogues/functions_catalogue/function[@id='%s']", safeID))
-    if len(fnNodes) == 0 {
+    fn, ok := dk.store.function(safeID)
+    if !ok {
         return newInternError("FUNCTION-UNKNOWN", fmt.Sprintf("Function '%v' is unknown", funcID), nil).dict4api
     }
 
-    definition := header + fnNodes[0].OutputXML(true)
+    definition := header + fn.Def.OutputXML(true)
     _ = pureXML
     return map[string]interface{}{"result": true, "definition": definition}
 }
@@ -1893,23 +2254,17 @@ func (dk *configDataKeeper) postFunctionDef(funcDescrText string) map[string]int
     }
     fnNode.SetAttr("id", safeID)
 
-    funcsCat := queryOne(dk.xmlcats, "/catalogues/functions_catalogue")
-    if funcsCat == nil {
-        return newInternError("DATABASE-ERROR", "Functions catalogue is missing", nil).dict4api
+    old, replaced := dk.store.function(safeID)
+    oldTxt := ""
+    if replaced {
+        oldTxt = old.Def.OutputXML(true)
     }
-
-    existing := queryAll(funcsCat, fmt.Sprintf("function[@id='%s']", safeID))
-    if len(existing) == 0 {
-        xmlquery.AddChild(funcsCat, fnNode)
-        dk._save(true)
+    if ex := dk._stored(dk.store.putFunction(fnNode), true); ex != nil {
+        return ex.dict4api
+    }
+    if !replaced {
         return map[string]interface{}{"result": true, "function_id": safeID, "status": "APPENDED"}
     }
-
-    oldNode := existing[0]
-    oldTxt := oldNode.OutputXML(true)
-    oldNode.RemoveFromTree()
-    xmlquery.AddChild(funcsCat, fnNode)
-    dk._save(true)
     return map[string]interface{}{"result": true, "function_id": safeID, "status": "REPLACED", "old_definition": oldTxt}
 }
 
@@ -1920,7 +2275,16 @@ func repr(err error) string {
     return fmt.Sprintf("%#v", err)
 }
 
-func (dk *configDataKeeper) deleteFunctionDef(funcID string) map[string]interface{} {
+func (dk *configDataKeeper) deleteFunctionDef(funcID, mode string, dryRun bool) map[string]interface{} {
+    if dryRun {
+        return dk.tryOut(func(sb *configDataKeeper) map[string]interface{} { return sb.deleteFunctionDef(funcID, mode, false) })
+    }
+
+    mode, ex := checkDeleteMode(mode)
+    if ex != nil {
+        return ex.dict4api
+    }
+
     if funcID == "" {
         return map[string]interface{}{"result": false, "reason": "WRONG-FORMAT"}
     }
@@ -1930,20 +2294,43 @@ func (dk *configDataKeeper) deleteFunctionDef(funcID string) map[string]interfac
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Function %v is unsafe", funcID), nil).dict4api
     }
 
-    funcsCat := queryOne(dk.xmlcats, "/catalogues/functions_catalogue")
-    if funcsCat == nil {
-        return newInternError("DATABASE-ERROR", "Functions catalogue is missing", nil).dict4api
+    fn, ok := dk.store.function(safeID)
+    if !ok {
+        return newInternError("FUNCTION-UNKNOWN", fmt.Sprintf("Function '%v' is unknown", safeID), nil).dict4api
     }
 
-    nodes := queryAll(funcsCat, fmt.Sprintf("function[@id='%s']", safeID))
-    if len(nodes) == 0 {
-        return newInternError("FUNCTION-UNKNOWN", fmt.Sprintf("Function '%v' is unknown", safeID), nil).dict4api
+    refFuncsets := make([]funcsetRecord, 0)
+    refs := make([]interface{}, 0)
+    for _, fs := range dk.data().funcsetList {
+        for _, f := range fs.Functions {
+            if f == funcID {
+                refs = append(refs, referenceReport("funcset", fs.Branch, fs.ID))
+            }
+        }
+        if contains(fs.Functions, funcID) {
+            refFuncsets = append(refFuncsets, fs)
+        }
+    }
+    if len(refs) > 0 && mode == "restrict" {
+        return stillReferenced(fmt.Sprintf("Function %v", funcID), refs)
     }
 
-    oldTxt := nodes[0].OutputXML(true)
-    nodes[0].RemoveFromTree()
-    dk._save(true)
-    return map[string]interface{}{"result": true, "function_id": safeID, "status": "DELETED", "old_definition": oldTxt}
+    oldTxt := fn.Def.OutputXML(true)
+    if ex := dk._stored(dk.store.deleteFunction(safeID), true); ex != nil {
+        return ex.dict4api
+    }
+    if len(refFuncsets) > 0 {
+        var werr error
+        for _, fs := range refFuncsets {
+            if werr == nil {
+                werr = dk.store.putFuncset(funcsetRecord{ID: fs.ID, Branch: fs.Branch, Name: fs.Name, Functions: withoutAll(fs.Functions, funcID)})
+            }
+        }
+        if ex := dk._stored(werr, false); ex != nil {
+            return ex.dict4api
+        }
+    }
+    return map[string]interface{}{"result": true, "function_id": safeID, "status": "DELETED", "old_definition": oldTxt, "mode": mode, "references_removed": refs}
 }
 
 func (dk *configDataKeeper) modifyFuncTagset(funcID, method string, tagset []string, readOnly bool) map[string]interface{} {
@@ -1956,13 +2343,13 @@ func (dk *configDataKeeper) modifyFuncTagset(funcID, method string, tagset []str
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Function %v is unsafe", funcID), nil).dict4api
     }
 
-    funcNodes := queryAll(dk.xmlcats, fmt.Sprintf("/catalogues/functions_catalogue/function[@id='%s']", safeID))
-    if len(funcNodes) == 0 {
+    fn, ok := dk.store.function(safeID)
+    if !ok {
         return newInternError("FUNCTION-UNKNOWN", fmt.Sprintf("Function %v is unknown", safeID), nil).dict4api
     }
 
     oldTagSet := map[string]struct{}{}
-    for _, t := range strings.Split(funcNodes[0].SelectAttr("tags"), ",") {
+    for _, t := range strings.Split(fn.Def.SelectAttr("tags"), ",") {
         t = strings.TrimSpace(t)
         if t != "" {
             oldTagSet[t] = struct{}{}
@@ -2000,8 +2387,11 @@ func (dk *configDataKeeper) modifyFuncTagset(funcID, method string, tagset []str
 
     retTs := strings.Join(sortedSet(nextSet), ",")
     if !readOnly {
-        funcNodes[0].SetAttr("tags", retTs)
-        dk._save(true)
+        def := cloneXMLTree(fn.Def)
+        def.SetAttr("tags", retTs)
+        if ex := dk._stored(dk.store.putFunction(def), true); ex != nil {
+            return ex.dict4api
+        }
     }
 
     return map[string]interface{}{"result": true, "tagset": retTs}
@@ -2022,18 +2412,7 @@ func (dk *configDataKeeper) getSubBranchesOfAgent(agentID string) []string {
         return []string{}
     }
 
-    ret := make([]string, 0)
-    for _, b := range queryAll(dk.xmlstorage, fmt.Sprintf("//branch[@id='%s']/descendant-or-self::branch/@id", safeBranch)) {
-        if b.Type == xmlquery.AttributeNode {
-            ret = append(ret, strings.TrimSpace(b.InnerText()))
-            continue
-        }
-        if id := b.SelectAttr("id"); id != "" {
-            ret = append(ret, id)
-        }
-    }
-
-    return uniqueStrings(ret)
+    return uniqueStrings(dk.data().subtree(safeBranch))
 }
 
 func (dk *configDataKeeper) registerAgentInBranch(branchID, agentID string, move bool, descr, location, tags, extraxml string) map[string]interface{} {
@@ -2041,12 +2420,13 @@ func (dk *configDataKeeper) registerAgentInBranch(branchID, agentID string, move
         return newInternError("WRONG-FORMAT", fmt.Sprintf("Required argument not given: branch is %v, agent is %v", branchID, agentID), nil).dict4api
     }
 
+    view := dk.data()
     if branchID == "*ROOT*" {
-        rootBranch := queryOne(dk.xmlstorage, "/universe/branches/branch[1]")
-        if rootBranch == nil {
+        roots := view.roots()
+        if len(roots) == 0 {
             return newInternError("DATABASE-ERROR", "Root branch is not defined", nil).dict4api
         }
-        branchID = rootBranch.SelectAttr("id")
+        branchID = roots[0]
     }
 
     safeBranch, err := safeXPathValue(branchID)
@@ -2074,31 +2454,41 @@ func (dk *configDataKeeper) registerAgentInBranch(branchID, agentID string, move
             return newInternError("DATABASE-ERROR", fmt.Sprintf("Branch for agent %v is unsafe", currBranchName), nil).dict4api
         }
 
-        currBranchNode := queryOne(dk.xmlstorage, fmt.Sprintf("//branch[@id='%s']", safeCurrBranch))
-        if currBranchNode == nil {
+        if view.branch(safeCurrBranch) == nil {
             return newInternError("DATABASE-ERROR", fmt.Sprintf("Branch %v referenced from agent %v does not longer exist", currBranchName, agentID), nil).dict4api
         }
 
-        if len(queryAll(currBranchNode, fmt.Sprintf("descendant-or-self::branch[@id='%s']", safeBranch))) == 0 {
+        if !view.within(safeBranch, safeCurrBranch) {
             return newInternError("NOT-IN-SET", fmt.Sprintf("Branch %v is not a subsidiary of a branch %v containing agent %v", branchID, currBranchName, agentID), map[string]interface{}{"bad_value": branchID}).dict4api
         }
+    }
+
+    tagsTrim := splitTags(tags)
 
-        dk.unregisterAgent(agentID)
+    // a new agent has no attributes yet, a moved one keeps its own, which the schema of the branch must allow
+    var attrs []agentAttr
+    if move {
+        attrs = dk.agentsKeeper.attributes([]string{agentID})[agentID]
+    }
+    sch := dk.agentSchemaOf(safeBranch)
+    if violations := sch.violations(attrs); len(violations) > 0 {
+        return newInternError("NOT-ALLOWED", fmt.Sprintf("Attributes of agent %v break the schema of branch %v", agentID, branchID), map[string]interface{}{"schema_problems": violations}).dict4api
     }
 
-    tagsTrim := []string{}
-    for _, t := range strings.Split(tags, ",") {
-        t = strings.TrimSpace(t)
-        if t != "" {
-            tagsTrim = append(tagsTrim, t)
+    if move {
+        // the agent is changed in place, so that it keeps its credentials, status and history
+        patch := agentPatch{branch: &safeBranch, descr: &descr, location: &location, extra: &extraxml, tags: tagsTrim, setTags: true}
+        if _, err := dk.agentsKeeper.updateAgent(agentID, patch); err != nil {
+            return newInternError("DATABASE-ERROR", err.Error(), nil).dict4api
         }
+        return map[string]interface{}{"result": true, "schema_problems": sch.problems(attrs)}
     }
 
     if err := dk.agentsKeeper.addAgent(agentID, safeBranch, descr, location, extraxml, tagsTrim); err != nil {
         return newInternError("DATABASE-ERROR", err.Error(), nil).dict4api
     }
 
-    return map[string]interface{}{"result": true}
+    return map[string]interface{}{"result": true, "schema_problems": sch.problems(attrs)}
 }
 
 func (dk *configDataKeeper) unregisterAgent(agentID string) map[string]interface{} {
@@ -2117,12 +2507,19 @@ func (dk *configDataKeeper) agentDetailsXml(agentID string) map[string]interface
     tags := agdict["tags"].([]string)
     sort.Strings(tags)
 
+    type attribute struct {
+        Name  string `xml:"name,attr"`
+        Type  string `xml:"type,attr"`
+        Value string `xml:",chardata"`
+    }
+
     type aginfo struct {
-        XMLName  xml.Name `xml:"aginfo"`
-        Descr    string   `xml:"descr"`
-        Location string   `xml:"location"`
-        Extra    string   `xml:"extra"`
-        Tags     []string `xml:"tag"`
+        XMLName    xml.Name    `xml:"aginfo"`
+        Descr      string      `xml:"descr"`
+        Location   string      `xml:"location"`
+        Extra      string      `xml:"extra"`
+        Tags       []string    `xml:"tag"`
+        Attributes []attribute `xml:"attributes>attribute"`
     }
 
     payload := aginfo{
@@ -2131,6 +2528,9 @@ func (dk *configDataKeeper) agentDetailsXml(agentID string) map[string]interface
         Extra:    fmt.Sprintf("%v", agdict["extra"]),
         Tags:     tags,
     }
+    for _, a := range dk.agentsKeeper.attributes([]string{agentID})[agentID] {
+        payload.Attributes = append(payload.Attributes, attribute{Name: a.name, Type: a.typ, Value: a.value})
+    }
 
     b, err := xml.MarshalIndent(payload, "", "  ")
     if err != nil {
@@ -2155,47 +2555,41 @@ func (dk *configDataKeeper) agentDetailsJson(agentID string) map[string]interfac
     return map[string]interface{}{
         "result": true,
         "details": map[string]interface{}{
-            "descr":    agdict["descr"],
-            "location": agdict["location"],
-            "tags":     strings.Join(tags, ","),
-            "extra":    agdict["extra"],
+            "descr":      agdict["descr"],
+            "location":   agdict["location"],
+            "tags":       strings.Join(tags, ","),
+            "extra":      agdict["extra"],
+            "attributes": typedAttrMap(dk.agentsKeeper.attributes([]string{agentID})[agentID]),
         },
     }
 }
 
-func (dk *configDataKeeper) listAgents(branchID string, withSubs bool, withLoc bool) map[string]interface{} {
+// _agentsOfBranch gives the agents of the branch and the branches below it as (agent, branch) pairs.
+func (dk *configDataKeeper) _agentsOfBranch(branchID string) ([][2]string, *internError) {
     if branchID != "*ALL*" {
         safeBranch, err := safeXPathValue(branchID)
         if err != nil {
-            return newInternError("WRONG-FORMAT", fmt.Sprintf("Branch %v is unsafe", branchID), nil).dict4api
+            return nil, newInternError("WRONG-FORMAT", fmt.Sprintf("Branch %v is unsafe", branchID), nil)
         }
         branchID = safeBranch
     }
 
     var branches []string
     if branchID == "*ALL*" {
-        for _, b := range queryAll(dk.xmlstorage, "/universe/branches/branch") {
-            if id := b.SelectAttr("id"); id != "" {
-                branches = append(branches, id)
-            }
-        }
+        branches = dk.data().roots()
     } else {
-        for _, b := range queryAll(dk.xmlstorage, fmt.Sprintf("//branch[@id='%s']/descendant-or-self::branch/@id", branchID)) {
-            if b.Type == xmlquery.AttributeNode {
-                branches = append(branches, strings.TrimSpace(b.InnerText()))
-                continue
-            }
-            if id := b.SelectAttr("id"); id != "" {
-                branches = append(branches, id)
-            }
-        }
+        branches = dk.data().subtree(branchID)
     }
 
-    if len(branches) == 0 {
-        return map[string]interface{}{"result": true, "report": []interface{}{}}
+    return dk.agentsKeeper.getAgentsByBranches(branches), nil
+}
+
+func (dk *configDataKeeper) listAgents(branchID string, withSubs bool, withLoc bool) map[string]interface{} {
+    agents, err := dk._agentsOfBranch(branchID)
+    if err != nil {
+        return err.dict4api
     }
 
-    agents := dk.agentsKeeper.getAgentsByBranches(branches)
     if withLoc {
         rep := make([]interface{}, 0, len(agents))
         for _, ag := range agents {
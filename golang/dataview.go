@@ -0,0 +1,230 @@
+package main
+
+import "strings"
+
+// dataView indexes what the store holds for the lookups of the keeper: the tree of branches
+// with their funcsets, roles, positions and agent schemas, and the persons. It is built anew once the
+// generation of the store changes, so that a write is seen by the next read. Its records are
+// shared by the readers and must not be changed; a write starts from a copy.
+type dataView struct {
+	branchList   []branchRecord
+	branchByID   map[string]*branchRecord
+	children     map[string][]string
+	funcsetList  []funcsetRecord
+	funcsetByID  map[string]*funcsetRecord
+	rolesOf      map[string][]roleRecord
+	positionList []positionRecord
+	positionsOf  map[string][]positionRecord
+	personList   []personRecord
+	personByID   map[string]*personRecord
+	schemaOf     map[string]*agentSchemaRecord
+}
+
+func newDataView(s dataStore) *dataView {
+	v := &dataView{
+		branchList:   s.branches(),
+		branchByID:   map[string]*branchRecord{},
+		children:     map[string][]string{},
+		funcsetList:  s.funcsets(),
+		funcsetByID:  map[string]*funcsetRecord{},
+		rolesOf:      map[string][]roleRecord{},
+		positionList: s.positions(),
+		positionsOf:  map[string][]positionRecord{},
+		personList:   s.persons(),
+		personByID:   map[string]*personRecord{},
+		schemaOf:     map[string]*agentSchemaRecord{},
+	}
+	// the first of the records with an id is the one found, as the first XPath match was
+	for i, b := range v.branchList {
+		if _, dup := v.branchByID[b.ID]; !dup {
+			v.branchByID[b.ID] = &v.branchList[i]
+			v.children[b.Parent] = append(v.children[b.Parent], b.ID)
+		}
+	}
+	for i, fs := range v.funcsetList {
+		if _, dup := v.funcsetByID[fs.ID]; !dup {
+			v.funcsetByID[fs.ID] = &v.funcsetList[i]
+		}
+	}
+	for _, r := range s.roles() {
+		v.rolesOf[r.Branch] = append(v.rolesOf[r.Branch], r)
+	}
+	for _, p := range v.positionList {
+		v.positionsOf[p.Branch] = append(v.positionsOf[p.Branch], p)
+	}
+	for _, sch := range s.agentSchemas() {
+		sch := sch
+		v.schemaOf[sch.Branch] = &sch
+	}
+	for i, p := range v.personList {
+		if _, dup := v.personByID[p.id()]; !dup {
+			v.personByID[p.id()] = &v.personList[i]
+		}
+	}
+	return v
+}
+
+// data gives the view of the current data, built when the store changed since the last one.
+func (dk *configDataKeeper) data() *dataView {
+	dk.viewMu.Lock()
+	defer dk.viewMu.Unlock()
+	if dk.view == nil || dk.viewOf != dk.store || dk.viewGen != dk.store.generation() {
+		dk.view, dk.viewOf, dk.viewGen = newDataView(dk.store), dk.store, dk.store.generation()
+	}
+	return dk.view
+}
+
+func (v *dataView) branch(id string) *branchRecord {
+	return v.branchByID[id]
+}
+
+// roots gives the top-level branches, the first of which is the root of the universe.
+func (v *dataView) roots() []string {
+	return v.children[""]
+}
+
+// lineage gives the branch and the branches above it, the nearest first.
+func (v *dataView) lineage(id string) []string {
+	ret := make([]string, 0)
+	seen := map[string]struct{}{}
+	for b := v.branch(id); b != nil && !hasKey(seen, b.ID); b = v.branch(b.Parent) {
+		seen[b.ID] = struct{}{}
+		ret = append(ret, b.ID)
+		if b.Parent == "" {
+			break
+		}
+	}
+	return ret
+}
+
+// subtree gives the branch and all the branches below it, in the order of the tree.
+func (v *dataView) subtree(id string) []string {
+	ret := make([]string, 0)
+	if v.branch(id) == nil {
+		return ret
+	}
+	seen := map[string]struct{}{}
+	var walk func(id string)
+	walk = func(id string) {
+		if hasKey(seen, id) {
+			return
+		}
+		seen[id] = struct{}{}
+		ret = append(ret, id)
+		for _, c := range v.children[id] {
+			walk(c)
+		}
+	}
+	walk(id)
+	return ret
+}
+
+// within tells whether the branch is top or below it.
+func (v *dataView) within(id, top string) bool {
+	for _, b := range v.lineage(id) {
+		if b == top {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *dataView) funcset(id string) *funcsetRecord {
+	return v.funcsetByID[id]
+}
+
+func (v *dataView) funcsetsOf(branch string) []funcsetRecord {
+	ret := make([]funcsetRecord, 0)
+	for _, fs := range v.funcsetList {
+		if fs.Branch == branch {
+			ret = append(ret, fs)
+		}
+	}
+	return ret
+}
+
+func (v *dataView) roles(branch string) []roleRecord {
+	return v.rolesOf[branch]
+}
+
+func (v *dataView) role(branch, name string) *roleRecord {
+	for i, r := range v.rolesOf[branch] {
+		if r.Name == name {
+			return &v.rolesOf[branch][i]
+		}
+	}
+	return nil
+}
+
+// findRole gives the role a position of the branch has: the one defined in the branch or
+// the nearest one above it.
+func (v *dataView) findRole(pos, branch string) *roleRecord {
+	if _, err := safeXPathValue(pos); err != nil {
+		return nil
+	}
+	for _, b := range v.lineage(branch) {
+		if r := v.role(b, pos); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// collectFuncsets gives the funcsets enabled in the branch: its own ones, and those of its
+// parent that its whitelist lets through.
+func (v *dataView) collectFuncsets(branch string) map[string]struct{} {
+	b := v.branch(branch)
+	if b == nil {
+		return map[string]struct{}{}
+	}
+
+	ret := map[string]struct{}{}
+	for _, fs := range v.funcsetsOf(branch) {
+		if fs.ID != "" {
+			ret[fs.ID] = struct{}{}
+		}
+	}
+
+	if b.Whitelist == nil || b.Parent == "" || v.branch(b.Parent) == nil {
+		return ret
+	}
+
+	parentFuncsets := v.collectFuncsets(b.Parent)
+
+	if strings.ToLower(b.Whitelist.PropagateParent) == "yes" {
+		return mergeSets(ret, parentFuncsets)
+	}
+
+	return mergeSets(ret, intersectMaps(parentFuncsets, mapSet(b.Whitelist.Funcsets...)))
+}
+
+// positionFuncsets gives the funcsets of one position: those of its role allowed by the branch whitelist.
+func (v *dataView) positionFuncsets(p positionRecord) map[string]struct{} {
+	role := v.findRole(p.pos(), p.Branch)
+	if role == nil {
+		return map[string]struct{}{}
+	}
+	return intersectMaps(v.collectFuncsets(p.Branch), mapSet(role.Funcsets...))
+}
+
+func (v *dataView) positions(branch string) []positionRecord {
+	return v.positionsOf[branch]
+}
+
+// userPositions gives the positions the user holds, in the order of the tree.
+func (v *dataView) userPositions(userid string) []positionRecord {
+	ret := make([]positionRecord, 0)
+	if userid == "" {
+		return ret
+	}
+	for _, p := range v.positionList {
+		if p.person() == userid {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+func (v *dataView) person(id string) *personRecord {
+	return v.personByID[id]
+}
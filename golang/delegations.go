@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Delegations are kept in /universe/registers/delegations as
+//
+//	<delegation id=".." delegator=".." delegate=".." branch=".." pos=".." start="unix" end="unix" createdBy=".." createdAt="unix"/>
+//
+// While the window is open the delegate gets the funcsets of the delegator's position,
+// provided the delegator still holds it. Expired records are dropped by the scheduler.
+
+// parseTimeParam accepts unix seconds, RFC 3339, "2006-01-02T15:04" or "2006-01-02" (local time).
+func parseTimeParam(value string, fallback int64) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return fallback, nil
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return n, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Unix(), nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("time %q is neither unix seconds nor a date", value)
+}
+
+func (dk *configDataKeeper) _delegations() []attrPairs {
+	return dk.store.registerEntries("delegations")
+}
+
+func delegationActive(dlg attrPairs, now int64) bool {
+	return dlg.getInt("start", 0) <= now && now < dlg.getInt("end", 0)
+}
+
+// _delegatorPosition gives the position a delegation refers to, if the delegator still holds it.
+func (dk *configDataKeeper) _delegatorPosition(dlg attrPairs) *positionRecord {
+	for _, p := range dk._userPositions(dlg.get("delegator")) {
+		if p.Branch == dlg.get("branch") && p.pos() == dlg.get("pos") {
+			return &p
+		}
+	}
+	return nil
+}
+
+// _delegatedPositions gives positions whose rights are delegated to the user at the moment.
+func (dk *configDataKeeper) _delegatedPositions(userid string, now int64) []positionRecord {
+	ret := make([]positionRecord, 0)
+	for _, dlg := range dk._delegations() {
+		if dlg.get("delegate") != userid || !delegationActive(dlg, now) {
+			continue
+		}
+		if p := dk._delegatorPosition(dlg); p != nil {
+			ret = append(ret, *p)
+		}
+	}
+	return ret
+}
+
+func (dk *configDataKeeper) delegationDetails(dlg attrPairs, now int64) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        dlg.get("id"),
+		"delegator": dlg.get("delegator"),
+		"delegate":  dlg.get("delegate"),
+		"branch":    dlg.get("branch"),
+		"pos":       dlg.get("pos"),
+		"start":     dlg.getInt("start", 0),
+		"end":       dlg.getInt("end", 0),
+		"createdBy": dlg.get("createdBy"),
+		"active":    delegationActive(dlg, now) && dk._delegatorPosition(dlg) != nil,
+	}
+}
+
+// userActiveDelegations reports the delegations currently giving rights to the user, with the funcsets they add.
+func (dk *configDataKeeper) userActiveDelegations(userid string) []interface{} {
+	now := time.Now().Unix()
+	ret := make([]interface{}, 0)
+	for _, dlg := range dk._delegations() {
+		if dlg.get("delegate") != userid || !delegationActive(dlg, now) {
+			continue
+		}
+		p := dk._delegatorPosition(dlg)
+		if p == nil {
+			continue
+		}
+		det := dk.delegationDetails(dlg, now)
+		det["funcsets"] = sortedSet(dk._positionFuncSets(*p))
+		ret = append(ret, det)
+	}
+	return ret
+}
+
+// listDelegations gives delegations where the user is delegator or delegate, all of them for an empty user.
+func (dk *configDataKeeper) listDelegations(userid string) map[string]interface{} {
+	now := time.Now().Unix()
+	report := make([]interface{}, 0)
+	for _, dlg := range dk._delegations() {
+		if userid != "" && dlg.get("delegator") != userid && dlg.get("delegate") != userid {
+			continue
+		}
+		report = append(report, dk.delegationDetails(dlg, now))
+	}
+	return map[string]interface{}{"result": true, "delegations": report}
+}
+
+func (dk *configDataKeeper) createDelegation(delegator, delegate, branchID, pos, start, end, operator string) map[string]interface{} {
+	if delegator == "" || delegate == "" || branchID == "" || pos == "" || end == "" {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Not all required parameters are given: delegator:%v, delegate:%v, branch:%v, pos:%v, end:%v", delegator, delegate, branchID, pos, end), nil).dict4api
+	}
+	if delegator == delegate {
+		return newInternError("WRONG-DATA", fmt.Sprintf("User '%v' cannot delegate to himself", delegator), nil).dict4api
+	}
+
+	now := time.Now().Unix()
+	startAt, err := parseTimeParam(start, now)
+	if err != nil {
+		return newInternError("WRONG-FORMAT", err.Error(), map[string]interface{}{"bad_value": start}).dict4api
+	}
+	endAt, err := parseTimeParam(end, 0)
+	if err != nil {
+		return newInternError("WRONG-FORMAT", err.Error(), map[string]interface{}{"bad_value": end}).dict4api
+	}
+	if endAt <= startAt || endAt <= now {
+		return newInternError("WRONG-DATA", fmt.Sprintf("Delegation period %d..%d is empty or already over", startAt, endAt), nil).dict4api
+	}
+
+	if dk._getPerson(delegator) == nil {
+		return newInternError("USER-UNKNOWN", fmt.Sprintf("User %v is unknown", delegator), nil).dict4api
+	}
+	if dk._getPerson(delegate) == nil {
+		return newInternError("USER-UNKNOWN", fmt.Sprintf("User %v is unknown", delegate), nil).dict4api
+	}
+
+	held := false
+	for _, p := range dk._userPositions(delegator) {
+		if p.Branch == branchID && p.pos() == pos {
+			held = true
+			break
+		}
+	}
+	if !held {
+		return newInternError("NOT-IN-SET", fmt.Sprintf("User '%v' holds no position %v at %v", delegator, pos, branchID), map[string]interface{}{"employments": dk.userEmployments(delegator)}).dict4api
+	}
+
+	if _, ex := dk._get_operator(operator); ex != nil {
+		return ex.dict4api
+	}
+	if operator != delegator {
+		if _, ex := dk._get_branch_relOp(operator, branchID); ex != nil {
+			return ex.dict4api
+		}
+	}
+
+	for _, dlg := range dk._delegations() {
+		if dlg.get("delegator") == delegator && dlg.get("delegate") == delegate &&
+			dlg.get("branch") == branchID && dlg.get("pos") == pos &&
+			dlg.getInt("start", 0) < endAt && startAt < dlg.getInt("end", 0) {
+			return newInternError("ALREADY-EXISTS", fmt.Sprintf("Delegation %v overlaps the requested period", dlg.get("id")), map[string]interface{}{"delegation": dk.delegationDetails(dlg, now)}).dict4api
+		}
+	}
+
+	dlg := mergeAttrs(nil, orderedPairs(map[string]string{
+		"id":        "dlg-" + newRequestID(),
+		"delegator": delegator,
+		"delegate":  delegate,
+		"branch":    branchID,
+		"pos":       pos,
+		"start":     strconv.FormatInt(startAt, 10),
+		"end":       strconv.FormatInt(endAt, 10),
+		"createdBy": operator,
+		"createdAt": strconv.FormatInt(now, 10),
+	}), true)
+	if ex := dk._stored(dk.store.putRegisterEntry("delegations", dlg), false); ex != nil {
+		return ex.dict4api
+	}
+	logDataKeeper.Info("delegation created", "id", dlg.get("id"), "delegator", delegator, "delegate", delegate, "branch", branchID, "pos", pos, "start", startAt, "end", endAt)
+
+	return map[string]interface{}{"result": true, "delegation": dk.delegationDetails(dlg, now)}
+}
+
+func (dk *configDataKeeper) revokeDelegation(dlgID, operator string) map[string]interface{} {
+	if dlgID == "" {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Not all required parameters are given: delegation id is %v", dlgID), nil).dict4api
+	}
+	safeID, err := safeXPathValue(dlgID)
+	if err != nil {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Delegation id %v is unsafe", dlgID), nil).dict4api
+	}
+	var dlg attrPairs
+	for _, e := range dk._delegations() {
+		if e.get("id") == safeID {
+			dlg = e
+			break
+		}
+	}
+	if dlg == nil {
+		return newInternError("NOT-IN-SET", fmt.Sprintf("Delegation %v is unknown", dlgID), nil).dict4api
+	}
+
+	if _, ex := dk._get_operator(operator); ex != nil {
+		return ex.dict4api
+	}
+	if operator != dlg.get("delegator") && operator != dlg.get("delegate") {
+		if _, ex := dk._get_branch_relOp(operator, dlg.get("branch")); ex != nil {
+			return ex.dict4api
+		}
+	}
+
+	det := dk.delegationDetails(dlg, time.Now().Unix())
+	if ex := dk._stored(dk.store.deleteRegisterEntry("delegations", safeID), false); ex != nil {
+		return ex.dict4api
+	}
+	logDataKeeper.Info("delegation revoked", "id", dlgID, "operator", operator)
+
+	return map[string]interface{}{"result": true, "delegation": det}
+}
+
+// expireDelegations drops the delegations whose period is over and reports their ids.
+func (dk *configDataKeeper) expireDelegations(now int64) []string {
+	expired := make([]string, 0)
+	var err error
+	for _, dlg := range dk._delegations() {
+		if dlg.getInt("end", 0) > now || err != nil {
+			continue
+		}
+		if err = dk.store.deleteRegisterEntry("delegations", dlg.get("id")); err == nil {
+			expired = append(expired, dlg.get("id"))
+		}
+	}
+	if err != nil {
+		logDataKeeper.Error("expired delegations not dropped", "store", dk.store.describe(), "error", err)
+	}
+	if len(expired) > 0 {
+		dk._save(false)
+		logDataKeeper.Info("delegations expired", "ids", expired)
+	}
+	return expired
+}
+
+func handleDelegationCreate(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	delegator := strings.TrimSpace(r.FormValue("delegator"))
+	delegate := strings.TrimSpace(r.FormValue("delegate"))
+	branch := strings.TrimSpace(r.FormValue("branch"))
+	position := strings.TrimSpace(r.FormValue("position"))
+	operator := strings.TrimSpace(r.FormValue("operator"))
+	if r.Method == http.MethodGet || delegator == "" || delegate == "" {
+		writeJSON(w, map[string]interface{}{
+			"result":      true,
+			"formMethod":  "post",
+			"userList":    storageUsers(),
+			"employments": storage.userEmployments(delegator),
+			"init": map[string]interface{}{
+				"delegator": delegator,
+				"delegate":  delegate,
+				"b":         branch,
+				"p":         position,
+			},
+			"operList": storageUsers(),
+		})
+		return
+	}
+	writeJSON(w, storage.createDelegation(delegator, delegate, branch, position, r.FormValue("start"), r.FormValue("end"), operator))
+}
+
+func handleDelegationRevoke(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	id := strings.TrimSpace(r.FormValue("id"))
+	operator := strings.TrimSpace(r.FormValue("operator"))
+	if r.Method == http.MethodGet || id == "" {
+		writeJSON(w, map[string]interface{}{
+			"result":      true,
+			"formMethod":  "post",
+			"delegations": storage.listDelegations("")["delegations"],
+			"operList":    storageUsers(),
+		})
+		return
+	}
+	writeJSON(w, storage.revokeDelegation(id, operator))
+}
+
+func handleDelegationsList(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet) {
+		return
+	}
+	parseRequestForm(r)
+	writeJSON(w, storage.listDelegations(strings.TrimSpace(r.FormValue("username"))))
+}
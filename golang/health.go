@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Long operations that swap or rewrite the data (reloads, migrations) register themselves here,
+// so that /readyz reports the service as not ready until they are finished.
+var (
+	maintenanceMu    sync.Mutex
+	maintenanceTasks = map[string]int{}
+)
+
+func beginMaintenance(what string) func() {
+	maintenanceMu.Lock()
+	maintenanceTasks[what]++
+	maintenanceMu.Unlock()
+	logAac.Info("maintenance started", "task", what)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			maintenanceMu.Lock()
+			maintenanceTasks[what]--
+			if maintenanceTasks[what] <= 0 {
+				delete(maintenanceTasks, what)
+			}
+			maintenanceMu.Unlock()
+			logAac.Info("maintenance finished", "task", what)
+		})
+	}
+}
+
+func maintenanceInProgress() []string {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	ret := make([]string, 0, len(maintenanceTasks))
+	for k := range maintenanceTasks {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (dk *configDataKeeper) dataFolder() string {
+	return filepath.Dir(dk.filename)
+}
+
+func checkDirWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".aac-health-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, werr := f.Write([]byte("ok"))
+	cerr := f.Close()
+	rerr := os.Remove(name)
+	if werr != nil {
+		return werr
+	}
+	if cerr != nil {
+		return cerr
+	}
+	return rerr
+}
+
+// storageChecks runs the self-checks of all the storages and reports "ok" or the failure text for each of them.
+// The probes are not routed behind the data lock, which would hold them for the whole request;
+// the lock is taken here, shared, only while the trees are looked at.
+func (dk *configDataKeeper) storageChecks() (map[string]interface{}, bool) {
+	checks := map[string]interface{}{}
+	healthy := true
+	fail := func(name string, err error) {
+		checks[name] = err.Error()
+		healthy = false
+	}
+
+	dk.mu.RLock()
+	universeLoaded := dk.store.check(filepath.Base(dk.filename)) == nil
+	cataloguesLoaded := dk.store.check(filepath.Base(dk.cFilename)) == nil
+	dk.mu.RUnlock()
+
+	if !universeLoaded {
+		fail("universe", fmt.Errorf("%s is not loaded", dk.filename))
+	} else {
+		checks["universe"] = "ok"
+	}
+
+	if !cataloguesLoaded {
+		fail("catalogues", fmt.Errorf("%s is not loaded", dk.cFilename))
+	} else {
+		checks["catalogues"] = "ok"
+	}
+
+	if err := checkDirWritable(dk.dataFolder()); err != nil {
+		fail("data_dir", err)
+	} else {
+		checks["data_dir"] = "ok"
+	}
+
+	if err := dk.agentsKeeper.ping(); err != nil {
+		fail("agents_db", err)
+	} else {
+		checks["agents_db"] = "ok"
+	}
+
+	return checks, healthy
+}
+
+// validate reports the results of all storage self-checks and of the integrity check.
+func (dk *configDataKeeper) validate() map[string]interface{} {
+	checks, healthy := dk.storageChecks()
+	integrity := dk.checkIntegrity()
+	ret := map[string]interface{}{"result": healthy, "checks": checks, "integrity": integrity}
+	if !healthy {
+		ret["reason"] = "DATABASE-ERROR"
+	} else if consistent, _ := integrity["consistent"].(bool); !consistent {
+		ret["result"] = false
+		ret["reason"] = "WRONG-DATA"
+	}
+	return ret
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodHead) {
+		return
+	}
+	if storage == nil {
+		writeJSON(w, map[string]interface{}{"result": false, "reason": "SERVICE-UNAVAILABLE", "warning": "Storage is not initialized"})
+		return
+	}
+	checks, healthy := storage.storageChecks()
+	if !healthy {
+		writeJSON(w, map[string]interface{}{"result": false, "reason": "SERVICE-UNAVAILABLE", "checks": checks})
+		return
+	}
+	writeJSON(w, map[string]interface{}{"result": true, "checks": checks})
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodHead) {
+		return
+	}
+	if storage == nil {
+		writeJSON(w, map[string]interface{}{"result": false, "reason": "SERVICE-UNAVAILABLE", "warning": "Storage is not initialized"})
+		return
+	}
+	if busy := maintenanceInProgress(); len(busy) > 0 {
+		writeJSON(w, map[string]interface{}{"result": false, "reason": "SERVICE-UNAVAILABLE", "warning": fmt.Sprintf("Maintenance in progress: %v", busy), "maintenance": busy})
+		return
+	}
+	checks, healthy := storage.storageChecks()
+	if !healthy {
+		writeJSON(w, map[string]interface{}{"result": false, "reason": "SERVICE-UNAVAILABLE", "checks": checks})
+		return
+	}
+	writeJSON(w, map[string]interface{}{"result": true, "checks": checks})
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/antchfx/xmlquery"
+)
+
+// Every save of universe.xml or catalogues.xml that changes more than the login bookkeeping
+// is kept as a numbered revision in DATA/history: a full copy of the file and a line in
+// revisions.jsonl telling who made it and when. Numbers are shared by both files, so the
+// state at revision N is the latest copy of each file numbered N or less. With history_keep in
+// general.yaml only that many of the latest revisions are kept.
+
+const historyDirName = "history"
+const historyIndexName = "revisions.jsonl"
+
+// historyVolatileAttrs are updated on every login attempt and do not make a revision.
+var historyVolatileAttrs = mapSet("failures", "last_error", "last_auth_success")
+
+type revisionRecord struct {
+	Rev      int    `json:"rev"`
+	File     string `json:"file"`
+	Operator string `json:"operator"`
+	At       int64  `json:"at"`
+	Snapshot string `json:"snapshot"`
+}
+
+func (dk *configDataKeeper) _historyDir() string {
+	return filepath.Join(filepath.Dir(dk.filename), historyDirName)
+}
+
+func (dk *configDataKeeper) _readRevisions() ([]revisionRecord, error) {
+	f, err := os.Open(filepath.Join(dk._historyDir(), historyIndexName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret := make([]revisionRecord, 0)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var rec revisionRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return nil, fmt.Errorf("%v: %v", historyIndexName, err)
+		}
+		ret = append(ret, rec)
+	}
+	return ret, sc.Err()
+}
+
+// significantHash fingerprints the file as a revision sees it, without the login bookkeeping.
+// It walks the tree once, with no copy and no serialisation, since it runs on every save.
+func significantHash(node *xmlquery.Node) string {
+	h := sha256.New()
+	var walk func(n *xmlquery.Node)
+	walk = func(n *xmlquery.Node) {
+		fmt.Fprintf(h, "<%d %s:%s", n.Type, n.Prefix, n.Data)
+		for _, a := range n.Attr {
+			if _, skip := historyVolatileAttrs[a.Name.Local]; !skip {
+				fmt.Fprintf(h, " %s:%s=%q", a.Name.Space, a.Name.Local, a.Value)
+			}
+		}
+		h.Write([]byte{'>'})
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		h.Write([]byte{'/'})
+	}
+	walk(node)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// _recordRevision stores the node as a new revision of the file unless nothing significant changed since the last one.
+func (dk *configDataKeeper) _recordRevision(file string, node *xmlquery.Node, operator string) {
+	if dk.sandbox || node == nil {
+		return
+	}
+	sig := significantHash(node)
+	if dk.lastSignificant == nil {
+		dk.lastSignificant = map[string]string{}
+		revs, err := dk._readRevisions()
+		if err != nil {
+			logDataKeeper.Error("reading revisions failed", "error", err)
+		}
+		for _, rec := range revs {
+			dk.lastRevision = rec.Rev
+			if snap, err := loadXMLFile(filepath.Join(dk._historyDir(), rec.Snapshot)); err == nil {
+				dk.lastSignificant[rec.File] = significantHash(snap)
+			}
+		}
+	}
+	if last, ok := dk.lastSignificant[file]; ok && last == sig {
+		return
+	}
+
+	rec := revisionRecord{Rev: dk.lastRevision + 1, File: file, Operator: operator, At: time.Now().Unix()}
+	rec.Snapshot = fmt.Sprintf("%06d-%s", rec.Rev, file)
+	if err := os.MkdirAll(dk._historyDir(), 0o755); err != nil {
+		logDataKeeper.Error("creating history directory failed", "error", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(dk._historyDir(), rec.Snapshot), []byte(outputXMLDocument(node)), 0o644); err != nil {
+		logDataKeeper.Error("writing revision failed", "file", rec.Snapshot, "error", err)
+		return
+	}
+	line, _ := json.Marshal(rec)
+	f, err := os.OpenFile(filepath.Join(dk._historyDir(), historyIndexName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		logDataKeeper.Error("writing revision index failed", "error", err)
+		return
+	}
+	dk.lastRevision = rec.Rev
+	dk.lastSignificant[file] = sig
+	logDataKeeper.Info("revision recorded", "rev", rec.Rev, "file", file, "operator", operator)
+	dk._pruneRevisions()
+}
+
+// _pruneRevisions drops the revisions older than the last historyKeep ones, with their copies.
+// The copy of each file in effect at the oldest revision kept stays, as the states of the kept
+// revisions are made of it.
+func (dk *configDataKeeper) _pruneRevisions() {
+	if dk.historyKeep <= 0 {
+		return
+	}
+	revs, err := dk._readRevisions()
+	if err != nil {
+		logDataKeeper.Error("reading revisions failed", "error", err)
+		return
+	}
+	cut := len(revs) - dk.historyKeep
+	if cut <= 0 {
+		return
+	}
+	inEffect := map[string]int{}
+	for i, rec := range revs[:cut] {
+		inEffect[rec.File] = i
+	}
+	kept, dropped := make([]revisionRecord, 0, dk.historyKeep+len(inEffect)), make([]revisionRecord, 0, cut)
+	for i, rec := range revs {
+		if i >= cut || inEffect[rec.File] == i {
+			kept = append(kept, rec)
+		} else {
+			dropped = append(dropped, rec)
+		}
+	}
+	if len(dropped) == 0 {
+		return
+	}
+
+	var b strings.Builder
+	for _, rec := range kept {
+		line, _ := json.Marshal(rec)
+		b.Write(append(line, '\n'))
+	}
+	index := filepath.Join(dk._historyDir(), historyIndexName)
+	if err := os.WriteFile(index+".temp", []byte(b.String()), 0o644); err != nil {
+		logDataKeeper.Error("writing revision index failed", "error", err)
+		return
+	}
+	if err := os.Rename(index+".temp", index); err != nil {
+		logDataKeeper.Error("writing revision index failed", "error", err)
+		return
+	}
+	for _, rec := range dropped {
+		if err := os.Remove(filepath.Join(dk._historyDir(), rec.Snapshot)); err != nil && !os.IsNotExist(err) {
+			logDataKeeper.Warn("pruned revision copy not removed", "file", rec.Snapshot, "error", err)
+		}
+	}
+	logDataKeeper.Info("revisions pruned", "dropped", len(dropped), "kept", len(kept))
+}
+
+// syncHistory records the files as loaded from disk when they differ from the last revisions,
+// e.g. on the first start or after an offline import.
+func (dk *configDataKeeper) syncHistory(operator string) {
+	uxml, cxml, err := renderDocuments(dk.store)
+	if err != nil {
+		logDataKeeper.Error("history not synced", "store", dk.store.describe(), "error", err)
+		return
+	}
+	dk._recordRevision(filepath.Base(dk.filename), uxml, operator)
+	dk._recordRevision(filepath.Base(dk.cFilename), cxml, operator)
+}
+
+func (dk *configDataKeeper) listRevisions(file string, limit int) map[string]interface{} {
+	revs, err := dk._readRevisions()
+	if err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Cannot read revisions: %v", err), nil).dict4api
+	}
+	ret := make([]interface{}, 0)
+	for i := len(revs) - 1; i >= 0 && (limit <= 0 || len(ret) < limit); i-- {
+		if file != "" && revs[i].File != file {
+			continue
+		}
+		ret = append(ret, map[string]interface{}{"rev": revs[i].Rev, "file": revs[i].File, "operator": revs[i].Operator, "at": revs[i].At})
+	}
+	return map[string]interface{}{"result": true, "revisions": ret}
+}
+
+// revisionState loads universe.xml and catalogues.xml as they were at the revision.
+func (dk *configDataKeeper) revisionState(rev int) (*xmlquery.Node, *xmlquery.Node, error) {
+	revs, err := dk._readRevisions()
+	if err != nil {
+		return nil, nil, err
+	}
+	// A file with no copy up to the revision had not been changed yet, so its first copy stands for it.
+	found := false
+	snapshots := map[string]string{}
+	for _, rec := range revs {
+		if _, ok := snapshots[rec.File]; rec.Rev > rev && ok {
+			continue
+		}
+		found = found || rec.Rev == rev
+		snapshots[rec.File] = rec.Snapshot
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("no revision %d", rev)
+	}
+	load := func(file string) (*xmlquery.Node, error) {
+		snap, ok := snapshots[file]
+		if !ok {
+			return nil, fmt.Errorf("no copy of %v at revision %d", file, rev)
+		}
+		return loadXMLFile(filepath.Join(dk._historyDir(), snap))
+	}
+	uxml, err := load(filepath.Base(dk.filename))
+	if err != nil {
+		return nil, nil, err
+	}
+	cxml, err := load(filepath.Base(dk.cFilename))
+	if err != nil {
+		return nil, nil, err
+	}
+	return uxml, cxml, nil
+}
+
+// historyEntities sums a state up as entity kind -> id -> property -> value for diffing.
+func historyEntities(uxml, cxml *xmlquery.Node) map[string]map[string]map[string]string {
+	ret := map[string]map[string]map[string]string{
+		"branches": {}, "roles": {}, "funcsets": {}, "persons": {}, "functions": {},
+	}
+	idsOf := func(nodes []*xmlquery.Node, attr string) string {
+		ids := make([]string, 0, len(nodes))
+		for _, n := range nodes {
+			ids = append(ids, n.SelectAttr(attr))
+		}
+		sort.Strings(ids)
+		return strings.Join(ids, ", ")
+	}
+
+	employments := map[string][]string{}
+	for _, br := range queryAll(uxml, "//branch") {
+		brID := br.SelectAttr("id")
+		props := map[string]string{"whitelist": idsOf(queryAll(br, "func_white_list/funcset"), "id")}
+		if p := parentBranchNode(br); p != nil {
+			props["parent"] = p.SelectAttr("id")
+		}
+		if wl := queryAll(br, "func_white_list"); len(wl) > 0 {
+			props["propagateParent"] = wl[0].SelectAttr("propagateParent")
+		}
+		positions := make([]string, 0)
+		for _, emp := range queryAll(br, "employees/employee") {
+			positions = append(positions, emp.SelectAttr("pos")+"="+emp.SelectAttr("person"))
+			if p := emp.SelectAttr("person"); p != "" {
+				employments[p] = append(employments[p], brID+"/"+emp.SelectAttr("pos"))
+			}
+		}
+		sort.Strings(positions)
+		props["positions"] = strings.Join(positions, ", ")
+		ret["branches"][brID] = props
+
+		for _, role := range queryAll(br, "roles/role") {
+			ret["roles"][brID+"/"+role.SelectAttr("name")] = map[string]string{"funcsets": idsOf(queryAll(role, "funcset"), "id")}
+		}
+		for _, fs := range queryAll(br, "deffuncsets/funcset") {
+			ret["funcsets"][fs.SelectAttr("id")] = map[string]string{
+				"branch":    brID,
+				"name":      fs.SelectAttr("name"),
+				"functions": idsOf(queryAll(fs, "func"), "id"),
+			}
+		}
+	}
+
+	for _, p := range queryAll(uxml, "/universe/registers/people_register/person") {
+		props := map[string]string{}
+		for _, a := range p.Attr {
+			if _, skip := historyVolatileAttrs[a.Name.Local]; skip || a.Name.Local == "id" {
+				continue
+			}
+			props[a.Name.Local] = a.Value
+		}
+		if s, ok := props["secret"]; ok {
+			props["secret"] = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(s)))[:15]
+		}
+		emps := employments[p.SelectAttr("id")]
+		sort.Strings(emps)
+		props["employments"] = strings.Join(emps, ", ")
+		ret["persons"][p.SelectAttr("id")] = props
+	}
+
+	for _, fn := range queryAll(cxml, "/catalogues/functions_catalogue/function") {
+		ret["functions"][fn.SelectAttr("id")] = map[string]string{"definition": strings.TrimSpace(fn.OutputXML(true))}
+	}
+	return ret
+}
+
+// diffEntities tells which ids were added or removed and which properties of the others changed.
+func diffEntities(before, after map[string]map[string]string) map[string]interface{} {
+	added, removed := make([]string, 0), make([]string, 0)
+	changed := make([]interface{}, 0)
+	ids := map[string]struct{}{}
+	for id := range before {
+		ids[id] = struct{}{}
+	}
+	for id := range after {
+		ids[id] = struct{}{}
+	}
+	for _, id := range sortedSet(ids) {
+		b, inBefore := before[id]
+		a, inAfter := after[id]
+		switch {
+		case !inBefore:
+			added = append(added, id)
+		case !inAfter:
+			removed = append(removed, id)
+		default:
+			props := map[string]struct{}{}
+			for k := range a {
+				props[k] = struct{}{}
+			}
+			for k := range b {
+				props[k] = struct{}{}
+			}
+			fields := map[string]interface{}{}
+			for _, k := range sortedSet(props) {
+				if a[k] != b[k] {
+					fields[k] = map[string]interface{}{"from": b[k], "to": a[k]}
+				}
+			}
+			if len(fields) > 0 {
+				changed = append(changed, map[string]interface{}{"id": id, "fields": fields})
+			}
+		}
+	}
+	return map[string]interface{}{"added": added, "removed": removed, "changed": changed}
+}
+
+// diffRevisions compares two revisions; to = 0 stands for the current data.
+func (dk *configDataKeeper) diffRevisions(from, to int) map[string]interface{} {
+	fromU, fromC, err := dk.revisionState(from)
+	if err != nil {
+		return newInternError("WRONG-DATA", fmt.Sprintf("Cannot load revision %d: %v", from, err), map[string]interface{}{"bad_value": from}).dict4api
+	}
+	toU, toC, err := renderDocuments(dk.store)
+	if err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Cannot read the current data: %v", err), nil).dict4api
+	}
+	if to > 0 {
+		if toU, toC, err = dk.revisionState(to); err != nil {
+			return newInternError("WRONG-DATA", fmt.Sprintf("Cannot load revision %d: %v", to, err), map[string]interface{}{"bad_value": to}).dict4api
+		}
+	}
+	before, after := historyEntities(fromU, fromC), historyEntities(toU, toC)
+	ret := map[string]interface{}{"result": true, "from": from, "to": to}
+	for kind := range before {
+		ret[kind] = diffEntities(before[kind], after[kind])
+	}
+	return ret
+}
+
+// restoreRevision makes the data what it was at the revision; the restore is recorded as a new revision.
+// It replaces the whole data, so the operator must be accountable for the root branch.
+// agents.db is not versioned and stays as it is.
+func (dk *configDataKeeper) restoreRevision(rev int, operator string) map[string]interface{} {
+	if ex := dk._check_rootOp(operator); ex != nil {
+		return ex.dict4api
+	}
+	uxml, cxml, err := dk.revisionState(rev)
+	if err != nil {
+		return newInternError("WRONG-DATA", fmt.Sprintf("Cannot load revision %d: %v", rev, err), map[string]interface{}{"bad_value": rev}).dict4api
+	}
+	if err := dk.store.replaceWith(newMemoryStore(uxml, cxml)); err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Revision %d not restored: %v", rev, err), nil).dict4api
+	}
+	saved := dk.operator
+	dk.operator = fmt.Sprintf("%v (restore of %d)", operator, rev)
+	dk.flush()
+	dk.operator = saved
+	logDataKeeper.Info("revision restored", "rev", rev, "operator", operator)
+	return map[string]interface{}{"result": true, "restored": rev, "rev": dk.lastRevision, "integrity": dk.checkIntegrity()}
+}
+
+// requestOperator is who a modifying request is recorded for in the history.
+func requestOperator(r *http.Request) string {
+	if op := strings.TrimSpace(r.Header.Get("X-Aac-Operator")); op != "" {
+		return op
+	}
+	return strings.TrimSpace(r.FormValue("operator"))
+}
+
+func handleHistoryList(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet) {
+		return
+	}
+	parseRequestForm(r)
+	writeJSON(w, storage.listRevisions(strings.TrimSpace(r.FormValue("file")), toInt(r.FormValue("limit"), 100)))
+}
+
+func handleHistoryDiff(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet) {
+		return
+	}
+	parseRequestForm(r)
+	from := toInt(r.FormValue("from"), 0)
+	if from <= 0 {
+		writeJSON(w, newInternError("WRONG-FORMAT", "Field from (revision number) is required", nil).dict4api)
+		return
+	}
+	writeJSON(w, storage.diffRevisions(from, toInt(r.FormValue("to"), 0)))
+}
+
+func handleHistoryRestore(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	if r.Method == http.MethodGet {
+		writeJSON(w, map[string]interface{}{
+			"result":         true,
+			"formMethod":     "post",
+			"operatorDriven": true,
+			"revisions":      storage.listRevisions("", 20)["revisions"],
+		})
+		return
+	}
+	rev := toInt(r.FormValue("rev"), 0)
+	operator := strings.TrimSpace(r.FormValue("operator"))
+	if rev <= 0 || operator == "" {
+		writeJSON(w, newInternError("WRONG-FORMAT", "Fields rev and operator are required", nil).dict4api)
+		return
+	}
+	writeJSON(w, storage.restoreRevision(rev, operator))
+}
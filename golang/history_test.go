@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHistoryPruning(t *testing.T) {
+	dk, dir := sampleKeeper(t)
+	dk.historyKeep = 3
+	dk.syncHistory("test")
+	for i := 0; i < 4; i++ {
+		if res := dk.addBranchSub("root", fmt.Sprintf("b%d", i)); res["result"] != true {
+			t.Fatalf("branch b%d not added: %v", i, res["warning"])
+		}
+	}
+
+	revs := make([]int, 0)
+	for _, rec := range dk.listRevisions("", 0)["revisions"].([]interface{}) {
+		revs = append(revs, rec.(map[string]interface{})["rev"].(int))
+	}
+	// 4, 5 and 6 are the last three; 2 and 3 hold catalogues.xml and universe.xml as they were at 4
+	if want := []int{6, 5, 4, 3, 2}; !reflect.DeepEqual(revs, want) {
+		t.Fatalf("revisions kept %v, want %v", revs, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, historyDirName, "000001-universe.xml")); !os.IsNotExist(err) {
+		t.Fatalf("copy of the pruned revision stays: %v", err)
+	}
+	if _, _, err := dk.revisionState(1); err == nil {
+		t.Fatal("state of a pruned revision is given")
+	}
+
+	uxml, cxml, err := dk.revisionState(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queryOne(uxml, "//branch[@id='b1']") == nil || queryOne(uxml, "//branch[@id='b2']") != nil {
+		t.Fatal("state at revision 4 is not the one recorded")
+	}
+	if queryOne(cxml, "//function[@id='test:states']") == nil {
+		t.Fatal("catalogues.xml at revision 4 is lost")
+	}
+}
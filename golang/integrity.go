@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The integrity checker looks for what the lookups by id silently get wrong:
+// ids defined more than once (the first match wins) and references to nothing.
+
+// Ids are compared outside XPath since function ids carry ':' which safeXPathValue refuses.
+
+func (dk *configDataKeeper) _funcsetDefined(funcsetID string) bool {
+	return dk.data().funcset(funcsetID) != nil
+}
+
+func (dk *configDataKeeper) _functionDefined(funcID string) bool {
+	_, ok := dk.store.function(funcID)
+	return ok
+}
+
+// _undefinedFuncsets gives those of the ids no branch defines.
+func (dk *configDataKeeper) _undefinedFuncsets(funcsetIDs []string) []string {
+	ret := make([]string, 0)
+	for _, id := range funcsetIDs {
+		id = strings.TrimSpace(id)
+		if id != "" && !dk._funcsetDefined(id) {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+func integrityIssue(kind, id, where, detail string) map[string]interface{} {
+	return map[string]interface{}{"kind": kind, "id": id, "where": where, "detail": detail}
+}
+
+// duplicatesOf gives the ids met more than once, in sorted order, with their counts.
+func duplicatesOf(ids []string) ([]string, map[string]int) {
+	counts := map[string]int{}
+	for _, id := range ids {
+		counts[id]++
+	}
+	dups := map[string]struct{}{}
+	for id, c := range counts {
+		if c > 1 {
+			dups[id] = struct{}{}
+		}
+	}
+	return sortedSet(dups), counts
+}
+
+// checkIntegrity reports duplicate ids and dangling references of universe.xml, catalogues.xml and agents.db.
+func (dk *configDataKeeper) checkIntegrity() map[string]interface{} {
+	issues := make([]interface{}, 0)
+	add := func(kind, id, where, detail string) {
+		issues = append(issues, integrityIssue(kind, id, where, detail))
+	}
+
+	view := dk.data()
+	ids := make([]string, 0, len(view.branchList))
+	for _, br := range view.branchList {
+		ids = append(ids, br.ID)
+	}
+	branchIDs := mapSet(ids...)
+	dups, counts := duplicatesOf(ids)
+	for _, id := range dups {
+		add("duplicate-branch", id, "", fmt.Sprintf("branch id defined %d times, only the first one is reachable", counts[id]))
+	}
+
+	ids = ids[:0]
+	for _, fs := range view.funcsetList {
+		ids = append(ids, fs.ID)
+	}
+	dups, counts = duplicatesOf(ids)
+	for _, id := range dups {
+		add("duplicate-funcset", id, "", fmt.Sprintf("funcset defined %d times, only the first one is used", counts[id]))
+	}
+
+	ids = ids[:0]
+	for _, p := range view.personList {
+		ids = append(ids, p.id())
+	}
+	persons := mapSet(ids...)
+	dups, counts = duplicatesOf(ids)
+	for _, id := range dups {
+		add("duplicate-person", id, "", fmt.Sprintf("person registered %d times", counts[id]))
+	}
+
+	ids = ids[:0]
+	for _, fn := range dk.store.functions() {
+		ids = append(ids, fn.ID)
+	}
+	dups, counts = duplicatesOf(ids)
+	for _, id := range dups {
+		add("duplicate-function", id, "", fmt.Sprintf("function described %d times", counts[id]))
+	}
+
+	checked := map[string]struct{}{}
+	for _, br := range view.branchList {
+		if hasKey(checked, br.ID) {
+			continue
+		}
+		checked[br.ID] = struct{}{}
+		for _, role := range view.roles(br.ID) {
+			for _, id := range role.Funcsets {
+				if !dk._funcsetDefined(id) {
+					add("dangling-role-funcset", id, br.ID, fmt.Sprintf("role %v refers to an undefined funcset", role.Name))
+				}
+			}
+		}
+		if br.Whitelist != nil {
+			for _, id := range br.Whitelist.Funcsets {
+				if !dk._funcsetDefined(id) {
+					add("dangling-whitelist-funcset", id, br.ID, "whitelist refers to an undefined funcset")
+				}
+			}
+		}
+		for _, fs := range view.funcsetsOf(br.ID) {
+			for _, id := range fs.Functions {
+				if !dk._functionDefined(id) {
+					add("dangling-function", id, br.ID, fmt.Sprintf("funcset %v refers to a function not described in catalogues", fs.ID))
+				}
+			}
+		}
+		for _, emp := range view.positions(br.ID) {
+			if p := emp.person(); p != "" {
+				if _, ok := persons[p]; !ok {
+					add("dangling-employee", p, br.ID, fmt.Sprintf("position %v is held by an unregistered person", emp.pos()))
+				}
+			}
+			if view.findRole(emp.pos(), br.ID) == nil {
+				add("undefined-role", emp.pos(), br.ID, "position has no role defined in the branch or above")
+			}
+		}
+	}
+
+	for _, agentID := range dk.agentsKeeper.getAllAgentIds() {
+		branch, _ := dk.agentsKeeper.getBranchName(agentID)
+		if _, ok := branchIDs[branch]; !ok {
+			add("dangling-agent", agentID, branch, "agent is registered in a branch that does not exist")
+		}
+	}
+
+	for _, dlg := range dk.store.registerEntries("delegations") {
+		if _, ok := branchIDs[dlg.get("branch")]; !ok {
+			add("dangling-delegation", dlg.get("id"), dlg.get("branch"), "delegation refers to a branch that does not exist")
+		}
+		for _, who := range []string{dlg.get("delegator"), dlg.get("delegate")} {
+			if _, ok := persons[who]; !ok {
+				add("dangling-delegation", dlg.get("id"), dlg.get("branch"), fmt.Sprintf("delegation refers to unregistered person %v", who))
+			}
+		}
+	}
+
+	for _, act := range dk.store.registerEntries("schedule") {
+		if br := act.get("branch"); br != "" {
+			if _, ok := branchIDs[br]; !ok {
+				add("dangling-scheduled-action", act.get("id"), br, "scheduled action refers to a branch that does not exist")
+			}
+		}
+		if _, ok := persons[act.get("username")]; !ok {
+			add("dangling-scheduled-action", act.get("id"), act.get("branch"), fmt.Sprintf("scheduled action refers to unregistered person %v", act.get("username")))
+		}
+	}
+
+	kinds := map[string]int{}
+	for _, is := range issues {
+		kinds[is.(map[string]interface{})["kind"].(string)]++
+	}
+	return map[string]interface{}{"result": true, "consistent": len(issues) == 0, "counts": kinds, "issues": issues}
+}
+
+func integrityIssueKey(issue interface{}) string {
+	m := issue.(map[string]interface{})
+	return fmt.Sprintf("%v|%v|%v|%v", m["kind"], m["id"], m["where"], m["detail"])
+}
+
+// introducedIssues gives the integrity issues of the changed copy the data has not, leaving out the skipped kinds.
+func (dk *configDataKeeper) introducedIssues(changed *configDataKeeper, skip ...string) []interface{} {
+	known := map[string]struct{}{}
+	before, _ := dk.checkIntegrity()["issues"].([]interface{})
+	for _, is := range before {
+		known[integrityIssueKey(is)] = struct{}{}
+	}
+	skipped := mapSet(skip...)
+	introduced := make([]interface{}, 0)
+	after, _ := changed.checkIntegrity()["issues"].([]interface{})
+	for _, is := range after {
+		if hasKey(skipped, fmt.Sprintf("%v", is.(map[string]interface{})["kind"])) {
+			continue
+		}
+		if _, ok := known[integrityIssueKey(is)]; !ok {
+			introduced = append(introduced, is)
+		}
+	}
+	return introduced
+}
+
+func handleAdminIntegrity(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet) {
+		return
+	}
+	writeJSON(w, storage.checkIntegrity())
+}
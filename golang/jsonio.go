@@ -0,0 +1,842 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/antchfx/xmlquery"
+)
+
+// The JSON representation of the data ("aac-json", version 1) holds the whole of universe.xml,
+// the function definitions of catalogues.xml and the agents of agents.db:
+//
+//	branches     in document order, parents before children; each with parent, whitelist,
+//	             funcsets, roles, employees, properties and the schema of agent attributes
+//	persons      attributes of every person (the secret only when exported with secrets)
+//	             and the changes recorded for it
+//	functions    the catalogue definition as XML, with its readable properties alongside
+//	agents       agent records with their tags and typed attributes
+//	delegations  and schedule: the attributes of the register entries
+//
+// Import in merge mode adds what is new and updates what the file lists, keeping everything
+// else; a list missing from a branch leaves that part of the branch as it is. Replace mode
+// makes the data exactly what the file holds. Either way the import is tried on a copy first
+// and refused if the file is malformed or the result has integrity issues the current data has not.
+
+const jsonFormatName = "aac-json"
+const jsonFormatVersion = 1
+
+var jsonImportModes = []string{"merge", "replace"}
+
+type jsonWhitelist struct {
+	PropagateParent string   `json:"propagateParent,omitempty"`
+	Funcsets        []string `json:"funcsets"`
+}
+
+type jsonFuncset struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name,omitempty"`
+	Functions []string `json:"functions"`
+}
+
+type jsonRole struct {
+	Name     string   `json:"name"`
+	Funcsets []string `json:"funcsets"`
+}
+
+type jsonEmployee struct {
+	Position   string            `json:"position"`
+	Person     string            `json:"person,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+type jsonProperty struct {
+	Name     string   `json:"name"`
+	Variants []string `json:"variants"`
+}
+
+type jsonBranch struct {
+	ID         string         `json:"id"`
+	Parent     string         `json:"parent,omitempty"`
+	Whitelist  *jsonWhitelist `json:"whitelist,omitempty"`
+	Funcsets   []jsonFuncset  `json:"funcsets"`
+	Roles      []jsonRole     `json:"roles"`
+	Employees  []jsonEmployee `json:"employees"`
+	Properties []jsonProperty `json:"properties"`
+
+	AgentSchema *jsonAgentSchema `json:"agentSchema,omitempty"`
+}
+
+type jsonAgentSchema struct {
+	Strict     bool                `json:"strict,omitempty"`
+	Attributes []jsonAgentAttrDecl `json:"attributes"`
+}
+
+type jsonAgentAttrDecl struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required,omitempty"`
+}
+
+type jsonPerson struct {
+	ID         string              `json:"id"`
+	Attributes map[string]string   `json:"attributes"`
+	Changes    []map[string]string `json:"changes"`
+}
+
+type jsonFunction struct {
+	ID         string            `json:"id"`
+	Properties map[string]string `json:"properties,omitempty"`
+	Definition string            `json:"definition"`
+}
+
+type jsonAgent struct {
+	ID       string   `json:"id"`
+	Branch   string   `json:"branch"`
+	Descr    string   `json:"descr"`
+	Location string   `json:"location"`
+	Extra    string   `json:"extra"`
+	Tags     []string `json:"tags"`
+
+	Attributes []jsonAgentAttr `json:"attributes,omitempty"`
+}
+
+type jsonAgentAttr struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type jsonAgentGroup struct {
+	ID      string   `json:"id"`
+	Descr   string   `json:"descr"`
+	Kind    string   `json:"kind"`
+	Tags    string   `json:"tags,omitempty"`
+	Branch  string   `json:"branch,omitempty"`
+	Subtree bool     `json:"subtree,omitempty"`
+	Attrs   []string `json:"attrs,omitempty"`
+	Agents  []string `json:"agents,omitempty"`
+}
+
+type jsonUniverse struct {
+	Format      string              `json:"format"`
+	Version     int                 `json:"version"`
+	ExportedAt  int64               `json:"exportedAt,omitempty"`
+	Secrets     bool                `json:"secrets"`
+	Branches    []jsonBranch        `json:"branches"`
+	Persons     []jsonPerson        `json:"persons"`
+	Functions   []jsonFunction      `json:"functions"`
+	Agents      []jsonAgent         `json:"agents"`
+	AgentGroups []jsonAgentGroup    `json:"agentGroups"`
+	Delegations []map[string]string `json:"delegations"`
+	Schedule    []map[string]string `json:"schedule"`
+}
+
+func (dk *configDataKeeper) exportJSON(withSecrets bool) *jsonUniverse {
+	ret := &jsonUniverse{Format: jsonFormatName, Version: jsonFormatVersion, ExportedAt: time.Now().Unix(), Secrets: withSecrets,
+		Branches: []jsonBranch{}, Persons: []jsonPerson{}, Functions: []jsonFunction{}, Agents: []jsonAgent{}, AgentGroups: []jsonAgentGroup{},
+		Delegations: []map[string]string{}, Schedule: []map[string]string{}}
+
+	view := dk.data()
+	props := map[string][]propertyRecord{}
+	for _, p := range dk.store.properties() {
+		props[p.Branch] = append(props[p.Branch], p)
+	}
+	for _, b := range view.branchList {
+		jb := jsonBranch{ID: b.ID, Parent: b.Parent, Funcsets: []jsonFuncset{}, Roles: []jsonRole{}, Employees: []jsonEmployee{}, Properties: []jsonProperty{}}
+		if b.Whitelist != nil {
+			jb.Whitelist = &jsonWhitelist{PropagateParent: b.Whitelist.PropagateParent, Funcsets: nonNil(b.Whitelist.Funcsets)}
+		}
+		for _, fs := range view.funcsetsOf(b.ID) {
+			jb.Funcsets = append(jb.Funcsets, jsonFuncset{ID: fs.ID, Name: fs.Name, Functions: nonNil(fs.Functions)})
+		}
+		for _, role := range view.roles(b.ID) {
+			jb.Roles = append(jb.Roles, jsonRole{Name: role.Name, Funcsets: nonNil(role.Funcsets)})
+		}
+		for _, p := range view.positions(b.ID) {
+			je := jsonEmployee{Position: p.pos(), Person: p.person()}
+			if extra := p.Attrs.dict("pos", "person"); len(extra) > 0 {
+				je.Attributes = extra
+			}
+			jb.Employees = append(jb.Employees, je)
+		}
+		for _, prop := range props[b.ID] {
+			jb.Properties = append(jb.Properties, jsonProperty{Name: prop.Name, Variants: nonNil(prop.Variants)})
+		}
+		if sch := view.schemaOf[b.ID]; sch != nil {
+			jb.AgentSchema = &jsonAgentSchema{Strict: sch.Strict, Attributes: append([]jsonAgentAttrDecl{}, sch.Attrs...)}
+		}
+		ret.Branches = append(ret.Branches, jb)
+	}
+
+	for _, p := range view.personList {
+		skip := []string{"id"}
+		if !withSecrets {
+			skip = append(skip, "secret")
+		}
+		jp := jsonPerson{ID: p.id(), Attributes: p.Attrs.dict(skip...), Changes: []map[string]string{}}
+		for _, ch := range p.Changes {
+			jp.Changes = append(jp.Changes, ch.dict())
+		}
+		ret.Persons = append(ret.Persons, jp)
+	}
+
+	for _, fn := range dk.store.functions() {
+		jf := jsonFunction{ID: fn.ID, Properties: map[string]string{}, Definition: outputXMLDocument(fn.Def)}
+		for prop, how := range _fpHow {
+			if v := extractValue(fn.Def, how.path); v != "" && prop != "id" {
+				jf.Properties[prop] = how.transform(v)
+			}
+		}
+		ret.Functions = append(ret.Functions, jf)
+	}
+
+	agentIDs := dk.agentsKeeper.getAllAgentIds()
+	attrs := dk.agentsKeeper.attributes(agentIDs)
+	for _, agentID := range agentIDs {
+		ag := dk.agentsKeeper.getAgentDict(agentID, true)
+		if ag == nil {
+			continue
+		}
+		ja := jsonAgent{ID: agentID, Tags: asStringSlice(ag["tags"])}
+		ja.Branch, _ = ag["branch"].(string)
+		ja.Descr, _ = ag["descr"].(string)
+		ja.Location, _ = ag["location"].(string)
+		ja.Extra, _ = ag["extra"].(string)
+		if ja.Tags == nil {
+			ja.Tags = []string{}
+		}
+		for _, a := range attrs[agentID] {
+			ja.Attributes = append(ja.Attributes, jsonAgentAttr{Name: a.name, Type: a.typ, Value: a.value})
+		}
+		ret.Agents = append(ret.Agents, ja)
+	}
+	groups, _ := dk.agentsKeeper.groups()
+	for _, g := range groups {
+		ret.AgentGroups = append(ret.AgentGroups, g.json())
+	}
+
+	for _, dlg := range dk._delegations() {
+		ret.Delegations = append(ret.Delegations, dlg.dict())
+	}
+	for _, act := range dk._scheduled() {
+		ret.Schedule = append(ret.Schedule, act.dict())
+	}
+	return ret
+}
+
+// orderedPairs gives the map as name, value pairs: the leading names in their order, then the rest sorted.
+func orderedPairs(m map[string]string, leading ...string) []string {
+	ret := make([]string, 0, 2*len(m))
+	done := map[string]struct{}{}
+	for _, k := range leading {
+		if v, ok := m[k]; ok {
+			ret = append(ret, k, v)
+			done[k] = struct{}{}
+		}
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if _, ok := done[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ret = append(ret, k, m[k])
+	}
+	return ret
+}
+
+func pairValue(pairs []string, name string) string {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i] == name {
+			return pairs[i+1]
+		}
+	}
+	return ""
+}
+
+// validateJSONImport lists what is wrong with the file before anything is changed.
+func (dk *configDataKeeper) validateJSONImport(data *jsonUniverse, mode string) []string {
+	problems := make([]string, 0)
+	if data.Format != jsonFormatName || data.Version != jsonFormatVersion {
+		return append(problems, fmt.Sprintf("format %q version %d is not %v version %d", data.Format, data.Version, jsonFormatName, jsonFormatVersion))
+	}
+
+	// ids end up in XPath expressions: an unsafe id is refused, unless the data has it already (as Bank1|Office1)
+	present := mapSet(dk.agentsKeeper.getAllAgentIds()...)
+	view := dk.data()
+	known := func(values ...string) {
+		for _, v := range values {
+			present[v] = struct{}{}
+		}
+	}
+	knownAttrs := func(p attrPairs) {
+		for _, name := range []string{"id", "name", "pos", "person"} {
+			if p.has(name) {
+				known(p.get(name))
+			}
+		}
+	}
+	for _, b := range view.branchList {
+		known(b.ID)
+		if b.Whitelist != nil {
+			known(b.Whitelist.Funcsets...)
+		}
+	}
+	for _, fs := range view.funcsetList {
+		known(append([]string{fs.ID, fs.Name}, fs.Functions...)...)
+	}
+	for _, r := range dk.store.roles() {
+		known(append([]string{r.Name}, r.Funcsets...)...)
+	}
+	for _, p := range view.positionList {
+		knownAttrs(p.Attrs)
+	}
+	for _, p := range dk.store.properties() {
+		known(p.Name)
+	}
+	for _, sch := range view.schemaOf {
+		for _, d := range sch.Attrs {
+			known(d.Name)
+		}
+	}
+	for _, p := range view.personList {
+		knownAttrs(p.Attrs)
+	}
+	for _, register := range registerNames {
+		for _, e := range dk.store.registerEntries(register) {
+			knownAttrs(e)
+		}
+	}
+	checkID := func(what, id string) {
+		if _, err := safeXPathValue(id); err != nil && !hasKey(present, id) {
+			problems = append(problems, fmt.Sprintf("%v id %q has unsafe characters", what, id))
+		}
+	}
+
+	existing := map[string]*branchRecord{}
+	if mode == "merge" {
+		for id, b := range view.branchByID {
+			existing[id] = b
+		}
+	}
+	seen := map[string]struct{}{}
+	roots := 0
+	for i, jb := range data.Branches {
+		switch {
+		case jb.ID == "":
+			problems = append(problems, fmt.Sprintf("branch #%d has no id", i))
+			continue
+		case hasKey(seen, jb.ID):
+			problems = append(problems, fmt.Sprintf("branch %v is listed twice", jb.ID))
+		}
+		if jb.Parent == "" {
+			if cur, ok := existing[jb.ID]; ok && cur.Parent != "" {
+				problems = append(problems, fmt.Sprintf("branch %v cannot become a root branch", jb.ID))
+			} else if !ok {
+				roots++
+			}
+		} else if _, ok := seen[jb.Parent]; !ok && existing[jb.Parent] == nil {
+			problems = append(problems, fmt.Sprintf("parent %v of branch %v is neither listed before it nor present", jb.Parent, jb.ID))
+		}
+		seen[jb.ID] = struct{}{}
+		checkID("branch", jb.ID)
+		if jb.Whitelist != nil {
+			for _, fs := range jb.Whitelist.Funcsets {
+				checkID("funcset", fs)
+			}
+		}
+		for _, fs := range jb.Funcsets {
+			checkID("funcset", fs.ID)
+		}
+		for _, role := range jb.Roles {
+			checkID("role", role.Name)
+			for _, fs := range role.Funcsets {
+				checkID("funcset", fs)
+			}
+		}
+		for _, emp := range jb.Employees {
+			checkID("position", emp.Position)
+			checkID("person", emp.Person)
+		}
+		if jb.AgentSchema != nil {
+			names := map[string]struct{}{}
+			for _, d := range jb.AgentSchema.Attributes {
+				if hasKey(names, d.Name) {
+					problems = append(problems, fmt.Sprintf("branch %v declares agent attribute %v twice", jb.ID, d.Name))
+				} else if err := checkAgentAttrDecl(d.Name, d.Type); err != nil {
+					problems = append(problems, fmt.Sprintf("branch %v: %v", jb.ID, err))
+				}
+				names[d.Name] = struct{}{}
+			}
+		}
+	}
+	if roots > 1 || (roots == 1 && mode == "merge") {
+		problems = append(problems, fmt.Sprintf("%d new root branches, the universe has exactly one", roots))
+	}
+	if mode == "replace" && len(data.Branches) == 0 {
+		problems = append(problems, "no branches to replace the universe with")
+	}
+
+	people := map[string]struct{}{}
+	for i, jp := range data.Persons {
+		switch {
+		case jp.ID == "":
+			problems = append(problems, fmt.Sprintf("person #%d has no id", i))
+		case hasKey(people, jp.ID):
+			problems = append(problems, fmt.Sprintf("person %v is listed twice", jp.ID))
+		case jp.Attributes["secret"] == "" && view.person(jp.ID) == nil:
+			problems = append(problems, fmt.Sprintf("person %v has no secret and is not present to keep one from", jp.ID))
+		}
+		people[jp.ID] = struct{}{}
+		checkID("person", jp.ID)
+	}
+
+	funcs := map[string]struct{}{}
+	for i, jf := range data.Functions {
+		if hasKey(funcs, jf.ID) {
+			problems = append(problems, fmt.Sprintf("function %v is listed twice", jf.ID))
+		}
+		funcs[jf.ID] = struct{}{}
+		if fn, err := parseFunctionDefinition(jf.Definition); err != nil {
+			problems = append(problems, fmt.Sprintf("function #%d %v: %v", i, jf.ID, err))
+		} else if fn.SelectAttr("id") != jf.ID || jf.ID == "" {
+			problems = append(problems, fmt.Sprintf("function #%d: definition id %q differs from %q", i, fn.SelectAttr("id"), jf.ID))
+		}
+	}
+
+	agents := map[string]struct{}{}
+	for i, ja := range data.Agents {
+		switch {
+		case ja.ID == "":
+			problems = append(problems, fmt.Sprintf("agent #%d has no id", i))
+		case hasKey(agents, ja.ID):
+			problems = append(problems, fmt.Sprintf("agent %v is listed twice", ja.ID))
+		case !hasKey(seen, ja.Branch) && existing[ja.Branch] == nil:
+			problems = append(problems, fmt.Sprintf("agent %v is in branch %v that will not exist", ja.ID, ja.Branch))
+		}
+		agents[ja.ID] = struct{}{}
+		checkID("agent", ja.ID)
+		names := map[string]struct{}{}
+		for _, a := range ja.Attributes {
+			if hasKey(names, a.Name) {
+				problems = append(problems, fmt.Sprintf("agent %v has attribute %v twice", ja.ID, a.Name))
+			} else if err := checkAgentAttr(a.Name, a.Type, a.Value); err != nil {
+				problems = append(problems, fmt.Sprintf("agent %v: %v", ja.ID, err))
+			}
+			names[a.Name] = struct{}{}
+		}
+	}
+	registered := map[string]struct{}{}
+	if mode == "merge" {
+		registered = mapSet(dk.agentsKeeper.getAllAgentIds()...)
+	}
+	groups := map[string]struct{}{}
+	for i, jg := range data.AgentGroups {
+		if hasKey(groups, jg.ID) {
+			problems = append(problems, fmt.Sprintf("agent group %v is listed twice", jg.ID))
+		}
+		groups[jg.ID] = struct{}{}
+		if err := agentGroupProblem(agentGroupOfJSON(jg)); err != nil {
+			problems = append(problems, fmt.Sprintf("agent group #%d: %v", i, err))
+		}
+		if jg.Branch != "" && !hasKey(seen, jg.Branch) && existing[jg.Branch] == nil {
+			problems = append(problems, fmt.Sprintf("agent group %v queries branch %v that will not exist", jg.ID, jg.Branch))
+		}
+		for _, agentID := range jg.Agents {
+			if !hasKey(agents, agentID) && !hasKey(registered, agentID) {
+				problems = append(problems, fmt.Sprintf("agent group %v lists agent %v that will not exist", jg.ID, agentID))
+			}
+		}
+	}
+	for name, entries := range map[string][]map[string]string{"delegation": data.Delegations, "scheduled action": data.Schedule} {
+		for i, e := range entries {
+			if e["id"] == "" {
+				problems = append(problems, fmt.Sprintf("%v #%d has no id", name, i))
+			}
+			for _, k := range []string{"id", "delegator", "delegate", "branch", "pos"} {
+				checkID(name+" "+k, e[k])
+			}
+		}
+	}
+	return problems
+}
+
+func hasKey(set map[string]struct{}, key string) bool {
+	_, ok := set[key]
+	return ok
+}
+
+// parseFunctionDefinition gives the function element of a definition, detached from its document.
+func parseFunctionDefinition(def string) (*xmlquery.Node, error) {
+	doc, err := parseXMLDocument([]byte(def))
+	if err != nil {
+		return nil, err
+	}
+	fn := firstElement(doc)
+	if fn == nil || fn.Data != "function" {
+		return nil, fmt.Errorf("definition is not a function element")
+	}
+	xmlquery.RemoveFromTree(fn)
+	return fn, nil
+}
+
+// applyJSONImport changes the data of the keeper (a sandbox) to what the file says.
+func (dk *configDataKeeper) applyJSONImport(data *jsonUniverse, mode string) error {
+	replace := mode == "replace"
+
+	listed := map[string]struct{}{}
+	for _, jb := range data.Branches {
+		listed[jb.ID] = struct{}{}
+		view := dk.data()
+		cur := view.branch(jb.ID)
+		isNew := cur == nil
+
+		b := branchRecord{ID: jb.ID, Parent: jb.Parent}
+		switch {
+		case jb.Whitelist != nil:
+			b.Whitelist = &whitelistRecord{PropagateParent: jb.Whitelist.PropagateParent, Funcsets: jb.Whitelist.Funcsets}
+		case isNew:
+			b.Whitelist = &whitelistRecord{PropagateParent: "no"}
+		case !replace:
+			b.Whitelist = cur.Whitelist
+		}
+		if !isNew && jb.Parent == "" {
+			b.Parent = cur.Parent
+		}
+		if err := dk.store.putBranch(b); err != nil {
+			return err
+		}
+
+		// A list missing from the file leaves that part of the branch alone when merging.
+		given := func(list bool) bool { return list || replace || isNew }
+
+		if given(jb.Employees != nil) {
+			matched := map[int]struct{}{}
+			added := make([]attrPairs, 0)
+			for _, je := range jb.Employees {
+				attrs := mergeAttrs(nil, append([]string{"pos", je.Position, "person", je.Person}, orderedPairs(je.Attributes)...), true)
+				found := false
+				for _, p := range view.positions(jb.ID) {
+					if _, used := matched[p.Seq]; !used && p.pos() == je.Position {
+						matched[p.Seq] = struct{}{}
+						if err := dk.store.setPosition(positionRecord{Branch: jb.ID, Seq: p.Seq, Attrs: attrs}); err != nil {
+							return err
+						}
+						found = true
+						break
+					}
+				}
+				if !found {
+					added = append(added, attrs)
+				}
+			}
+			existing := view.positions(jb.ID)
+			for i := len(existing) - 1; i >= 0; i-- {
+				if _, ok := matched[existing[i].Seq]; !ok {
+					if err := dk.store.deletePosition(jb.ID, existing[i].Seq); err != nil {
+						return err
+					}
+				}
+			}
+			for _, attrs := range added {
+				if err := dk.store.addPosition(positionRecord{Branch: jb.ID, Attrs: attrs}); err != nil {
+					return err
+				}
+			}
+		}
+
+		if given(jb.Roles != nil) {
+			names := map[string]struct{}{}
+			for _, jr := range jb.Roles {
+				names[jr.Name] = struct{}{}
+				if err := dk.store.putRole(roleRecord{Branch: jb.ID, Name: jr.Name, Funcsets: jr.Funcsets}); err != nil {
+					return err
+				}
+			}
+			for _, r := range view.roles(jb.ID) {
+				if !hasKey(names, r.Name) {
+					if err := dk.store.deleteRole(jb.ID, r.Name); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if given(jb.Funcsets != nil) {
+			ids := map[string]struct{}{}
+			for _, jf := range jb.Funcsets {
+				ids[jf.ID] = struct{}{}
+				if err := dk.store.putFuncset(funcsetRecord{ID: jf.ID, Branch: jb.ID, Name: jf.Name, Functions: jf.Functions}); err != nil {
+					return err
+				}
+			}
+			for _, fs := range view.funcsetsOf(jb.ID) {
+				if !hasKey(ids, fs.ID) {
+					if err := dk.store.deleteFuncset(fs.ID); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if given(jb.Properties != nil) {
+			names := map[string]struct{}{}
+			for _, jp := range jb.Properties {
+				names[jp.Name] = struct{}{}
+				if err := dk.store.putProperty(propertyRecord{Branch: jb.ID, Name: jp.Name, Variants: jp.Variants}); err != nil {
+					return err
+				}
+			}
+			for _, p := range dk.store.properties() {
+				if p.Branch == jb.ID && !hasKey(names, p.Name) {
+					if err := dk.store.deleteProperty(jb.ID, p.Name); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		switch {
+		case jb.AgentSchema != nil:
+			if err := dk.store.putAgentSchema(agentSchemaRecord{Branch: jb.ID, Strict: jb.AgentSchema.Strict, Attrs: jb.AgentSchema.Attributes}); err != nil {
+				return err
+			}
+		case replace && view.schemaOf[jb.ID] != nil:
+			if err := dk.store.deleteAgentSchema(jb.ID); err != nil {
+				return err
+			}
+		}
+	}
+	if replace {
+		// the branches below one removed go with it
+		gone := map[string]struct{}{}
+		for _, b := range dk.data().branchList {
+			if hasKey(listed, b.ID) {
+				continue
+			}
+			gone[b.ID] = struct{}{}
+			if hasKey(gone, b.Parent) {
+				continue
+			}
+			if err := dk.store.deleteBranch(b.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	persons := map[string]*personRecord{}
+	for _, p := range dk.data().personList {
+		p := p
+		persons[p.id()] = &p
+	}
+	for _, jp := range data.Persons {
+		p := personRecord{Attrs: attrPairs{"id", jp.ID}}
+		if cur := persons[jp.ID]; cur != nil {
+			p = *cur
+		}
+		p.Attrs = mergeAttrs(p.Attrs, append([]string{"id", jp.ID}, orderedPairs(jp.Attributes)...), replace, "secret")
+		if jp.Changes != nil || replace {
+			p.Changes = make([]attrPairs, 0, len(jp.Changes))
+			for _, ch := range jp.Changes {
+				p.Changes = append(p.Changes, mergeAttrs(nil, orderedPairs(ch, "by", "at"), true))
+			}
+		}
+		if err := dk.store.putPerson(p); err != nil {
+			return err
+		}
+		delete(persons, jp.ID)
+	}
+	if replace {
+		for id := range persons {
+			if err := dk.store.deletePerson(id); err != nil {
+				return err
+			}
+		}
+	}
+
+	functions := map[string]struct{}{}
+	for _, fn := range dk.store.functions() {
+		functions[fn.ID] = struct{}{}
+	}
+	for _, jf := range data.Functions {
+		fn, _ := parseFunctionDefinition(jf.Definition)
+		if err := dk.store.putFunction(fn); err != nil {
+			return err
+		}
+		delete(functions, jf.ID)
+	}
+	if replace {
+		for id := range functions {
+			if err := dk.store.deleteFunction(id); err != nil {
+				return err
+			}
+		}
+	}
+
+	for register, entries := range map[string][]map[string]string{"delegations": data.Delegations, "schedule": data.Schedule} {
+		if entries == nil && !replace {
+			continue
+		}
+		unlisted := map[string]struct{}{}
+		for _, e := range dk.store.registerEntries(register) {
+			unlisted[e.get("id")] = struct{}{}
+		}
+		for _, e := range entries {
+			if err := dk.store.putRegisterEntry(register, mergeAttrs(nil, orderedPairs(e, "id"), true)); err != nil {
+				return err
+			}
+			delete(unlisted, e["id"])
+		}
+		if replace {
+			for id := range unlisted {
+				if err := dk.store.deleteRegisterEntry(register, id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// importJSON validates the file, applies it to a copy and, when the copy is sound, makes the copy the data.
+// Secrets of persons are taken only when secrets is set, as they replace passwords.
+func (dk *configDataKeeper) importJSON(data *jsonUniverse, mode string, dryRun, secrets bool) map[string]interface{} {
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Unknown import mode %v, expected one of %v", mode, jsonImportModes), map[string]interface{}{"bad_value": mode}).dict4api
+	}
+	if !secrets {
+		withSecret := make([]string, 0)
+		for _, jp := range data.Persons {
+			if _, ok := jp.Attributes["secret"]; ok {
+				withSecret = append(withSecret, jp.ID)
+			}
+		}
+		if len(withSecret) > 0 {
+			return newInternError("NOT-ALLOWED", fmt.Sprintf("Import refused, %d person(s) carry a secret and secrets are not asked to be imported, nothing changed", len(withSecret)), map[string]interface{}{"persons": withSecret}).dict4api
+		}
+	}
+	if problems := dk.validateJSONImport(data, mode); len(problems) > 0 {
+		return newInternError("WRONG-DATA", fmt.Sprintf("Import refused, %d problem(s) found, nothing changed", len(problems)), map[string]interface{}{"problems": problems}).dict4api
+	}
+
+	sb := dk.newSandbox()
+	if err := sb.applyJSONImport(data, mode); err != nil {
+		return newInternError("WRONG-DATA", fmt.Sprintf("Import refused, nothing changed: %v", err), nil).dict4api
+	}
+
+	// Agents are checked by the validation against the branches to be; agents.db is not changed yet.
+	introduced := dk.introducedIssues(sb, "dangling-agent")
+	if len(introduced) > 0 {
+		return newInternError("WRONG-DATA", fmt.Sprintf("Import would introduce %d integrity issue(s), nothing changed", len(introduced)), map[string]interface{}{"integrity": introduced}).dict4api
+	}
+	// The attributes of the agents are checked against the schemas of the branches to be.
+	violations, schemaProblems := make([]string, 0), map[string]interface{}{}
+	for _, ja := range data.Agents {
+		attrs := make([]agentAttr, 0, len(ja.Attributes))
+		for _, a := range ja.Attributes {
+			attrs = append(attrs, agentAttr{name: a.Name, typ: a.Type, value: a.Value})
+		}
+		sch := sb.agentSchemaOf(ja.Branch)
+		for _, v := range sch.violations(attrs) {
+			violations = append(violations, fmt.Sprintf("agent %v: %v", ja.ID, v))
+		}
+		if problems := sch.problems(attrs); len(problems) > 0 {
+			schemaProblems[ja.ID] = problems
+		}
+	}
+	if len(violations) > 0 {
+		return newInternError("WRONG-DATA", fmt.Sprintf("Import refused, %d agent attribute(s) break the schemas, nothing changed", len(violations)), map[string]interface{}{"problems": violations}).dict4api
+	}
+
+	ret := map[string]interface{}{
+		"result":          true,
+		"mode":            mode,
+		"branches":        len(data.Branches),
+		"persons":         len(data.Persons),
+		"functions":       len(data.Functions),
+		"agents":          len(data.Agents),
+		"groups":          len(data.AgentGroups),
+		"schema_problems": schemaProblems,
+	}
+	if dryRun {
+		ret["dry_run"] = true
+		return ret
+	}
+
+	if err := dk.agentsKeeper.importAgents(data.Agents, data.AgentGroups, mode == "replace"); err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Agents not imported, nothing changed: %v", err), nil).dict4api
+	}
+	if err := dk.store.replaceWith(sb.store); err != nil {
+		logDataKeeper.Error("imported data not taken over", "error", err)
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Imported data not taken over: %v", err), nil).dict4api
+	}
+	dk.flush()
+	logDataKeeper.Info("data imported from JSON", "mode", mode, "branches", len(data.Branches), "persons", len(data.Persons), "functions", len(data.Functions), "agents", len(data.Agents), "groups", len(data.AgentGroups))
+	return ret
+}
+
+// handleExport gives the data without secrets to anyone; with secrets=yes it takes a POST by an
+// operator accountable for the root branch.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	secrets := boolFromParam(r.FormValue("secrets"), false)
+	if secrets {
+		if r.Method != http.MethodPost {
+			writeJSON(w, newInternError("NOT-ALLOWED", "Export with secrets is only given to a POST request", nil).dict4api)
+			return
+		}
+		if ex := storage._check_rootOp(requestOperator(r)); ex != nil {
+			writeJSON(w, ex.dict4api)
+			return
+		}
+		logDataKeeper.Warn("data exported with secrets", "operator", requestOperator(r))
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(storage.exportJSON(secrets))
+}
+
+// handleImport takes a POST by an operator accountable for the root branch: an import may
+// replace the whole data, the passwords of persons included (with secrets=yes).
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	if ex := storage._check_rootOp(requestOperator(r)); ex != nil {
+		writeJSON(w, ex.dict4api)
+		return
+	}
+
+	var raw []byte
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var err error
+		if raw, err = io.ReadAll(io.LimitReader(r.Body, 64<<20)); err != nil {
+			writeJSON(w, newInternError("WRONG-FORMAT", fmt.Sprintf("Cannot read the body: %v", err), nil).dict4api)
+			return
+		}
+	} else {
+		raw = []byte(r.FormValue("data"))
+	}
+	var data jsonUniverse
+	if err := json.Unmarshal(raw, &data); err != nil {
+		writeJSON(w, newInternError("WRONG-FORMAT", fmt.Sprintf("Import is not valid JSON: %v", err), nil).dict4api)
+		return
+	}
+	writeJSON(w, storage.importJSON(&data, strings.TrimSpace(r.FormValue("mode")), boolFromParam(r.FormValue("dry_run"), false), boolFromParam(r.FormValue("secrets"), false)))
+}
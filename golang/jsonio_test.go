@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sampleKeeper opens a keeper on the sample data of the storage tests, written as XML files.
+func sampleKeeper(t *testing.T) (*configDataKeeper, string) {
+	t.Helper()
+	dir := t.TempDir()
+	writeSample(t, dir)
+	dk := newConfigDataKeeper(dir, 60)
+	if err := dk.load(); err != nil {
+		dk.close()
+		t.Fatalf("keeper load: %v", err)
+	}
+	t.Cleanup(dk.close)
+	return dk, dir
+}
+
+func TestImportNeedsRootOperator(t *testing.T) {
+	dk, dir := sampleKeeper(t)
+	saved := storage
+	storage = dk
+	defer func() { storage = saved }()
+
+	data := dk.exportJSON(true)
+	for i := range data.Persons {
+		if data.Persons[i].ID == "Ivanov" {
+			data.Persons[i].Attributes["secret"] = "changed"
+		}
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	universeXML := func() string {
+		u, _, err := renderDocuments(dk.store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.OutputXML(true)
+	}
+	universe := universeXML()
+	file, err := os.ReadFile(filepath.Join(dir, "universe.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	importAs := func(method, query string) map[string]interface{} {
+		req := httptest.NewRequest(method, "/aac/import?"+query, strings.NewReader(string(payload)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handleImport(rec, req)
+		ret := map[string]interface{}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &ret); err != nil {
+			t.Fatalf("%v %v: %v", method, query, err)
+		}
+		return ret
+	}
+
+	for _, refused := range []struct {
+		method, query, reason string
+	}{
+		{http.MethodPost, "mode=merge&secrets=yes", "OP-UNAUTHORIZED"},
+		{http.MethodPost, "mode=replace&secrets=yes&operator=Nobody", "OP-UNKNOWN"},
+		{http.MethodPost, "mode=merge&secrets=yes&operator=Petrov", "FORBIDDEN-FOR-OP"},
+		{http.MethodPost, "mode=replace&secrets=yes&operator=Petrov", "FORBIDDEN-FOR-OP"},
+		{http.MethodPost, "mode=merge&operator=Ivanov", "NOT-ALLOWED"},
+		{http.MethodGet, "mode=merge&secrets=yes&operator=Ivanov", "NOT-ALLOWED"},
+	} {
+		if ret := importAs(refused.method, refused.query); ret["reason"] != refused.reason {
+			t.Errorf("%v %v: got %v, want %v", refused.method, refused.query, ret, refused.reason)
+		}
+		if universeXML() != universe {
+			t.Fatalf("%v %v changed the data", refused.method, refused.query)
+		}
+		if now, _ := os.ReadFile(filepath.Join(dir, "universe.xml")); string(now) != string(file) {
+			t.Fatalf("%v %v changed universe.xml", refused.method, refused.query)
+		}
+	}
+
+	if ret := importAs(http.MethodPost, "mode=merge&secrets=yes&operator=Ivanov"); ret["result"] != true {
+		t.Fatalf("root operator refused: %v", ret)
+	}
+	if got := dk._getPerson("Ivanov").Attrs.get("secret"); got != "changed" {
+		t.Fatalf("secret of Ivanov is %q after the import", got)
+	}
+}
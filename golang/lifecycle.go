@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const shutdownGracePeriod = 30 * time.Second
+
+func setCorsWhitelist(origins []string) {
+	wl := make(map[string]struct{}, len(origins))
+	for _, item := range origins {
+		wl[item] = struct{}{}
+	}
+	corsMu.Lock()
+	corsWhitelist = wl
+	corsMu.Unlock()
+}
+
+// withDataLock lets the data reload swap the XML trees only between requests:
+// reading requests share the lock, modifying ones take it exclusively.
+// A GET that still writes, as /aac/authorize does with the login counters, is routed with routeWriting.
+func withDataLock(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if storage == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			storage.mu.RLock()
+			defer storage.mu.RUnlock()
+		} else {
+			storage.mu.Lock()
+			defer storage.mu.Unlock()
+			storage.operator = requestOperator(r)
+			defer func() { storage.operator = "" }()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routeWriting is for handlers that modify the data whatever the request method is.
+func routeWriting(mux *http.ServeMux, path string, handler http.HandlerFunc) {
+	mux.Handle(path, withCORS(withRequestLog(path, withWriteLock(http.HandlerFunc(handler)))))
+}
+
+func withWriteLock(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if storage == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		storage.mu.Lock()
+		defer storage.mu.Unlock()
+		storage.operator = requestOperator(r)
+		defer func() { storage.operator = "" }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reloadConfig re-reads general.yaml and applies what can be changed on the fly:
+// the CORS whitelist of the current run location, the default session length and the agent token and online timeouts.
+func reloadConfig() error {
+	cfg, err := loadAppConfig(appCfgPath)
+	if err != nil {
+		return err
+	}
+	runLocation, ok := cfg.RunLocations[appRunAt]
+	if !ok {
+		return fmt.Errorf("run location %q is no longer described in %s", appRunAt, appCfgPath)
+	}
+	setCorsWhitelist(runLocation.CorsWhitelist)
+	setTrustedProxies(runLocation.TrustedProxies)
+	storage.mu.Lock()
+	storage.dfltSessMax = cfg.SessionMaxDefault
+	storage.agentsKeeper.tokenTTL = cfg.AgentTokenTTL
+	storage.agentsKeeper.onlineTimeout = cfg.AgentOnlineTimeout
+	storage.historyKeep = cfg.HistoryKeep
+	storage.mu.Unlock()
+	logAac.Info("configuration reloaded", "path", appCfgPath, "run_location", appRunAt, "cors_whitelist", runLocation.CorsWhitelist, "session_max_default", cfg.SessionMaxDefault, "agent_token_ttl", cfg.AgentTokenTTL, "agent_online_timeout", cfg.AgentOnlineTimeout, "history_keep", cfg.HistoryKeep)
+	return nil
+}
+
+func reloadAll(what string) map[string]interface{} {
+	done := beginMaintenance("reload")
+	defer done()
+
+	reloaded := []string{}
+	if what == "all" || what == "config" {
+		if err := reloadConfig(); err != nil {
+			logAac.Error("configuration reload failed", "error", err)
+			return newInternError("WRONG-DATA", fmt.Sprintf("Configuration reload failed: %v", err), map[string]interface{}{"reloaded": reloaded}).dict4api
+		}
+		reloaded = append(reloaded, "config")
+	}
+	if what == "all" || what == "data" {
+		if err := storage.reload(); err != nil {
+			logAac.Error("data reload failed", "error", err)
+			return newInternError("WRONG-DATA", fmt.Sprintf("Data reload failed, previous data kept: %v", err), map[string]interface{}{"reloaded": reloaded}).dict4api
+		}
+		reloaded = append(reloaded, "data")
+	}
+	if len(reloaded) == 0 {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Unknown reload target %v", what), map[string]interface{}{"bad_value": what}).dict4api
+	}
+	return map[string]interface{}{"result": true, "reloaded": reloaded}
+}
+
+// serveUntilStopped runs the server until SIGTERM/SIGINT, re-reading config and data on SIGHUP.
+// On stop it drains open connections, saves the data and closes the agents database.
+func serveUntilStopped(srv *http.Server, tlsCert, tlsKey string) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				logAac.Info("SIGHUP received, reloading")
+				reloadAll("all")
+				continue
+			}
+
+			logAac.Info("stop signal received, draining connections", "signal", sig.String())
+			beginMaintenance("shutdown")
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+			if err := srv.Shutdown(ctx); err != nil {
+				logAac.Error("graceful shutdown incomplete", "error", err)
+			}
+			cancel()
+			return
+		}
+	}()
+
+	var err error
+	if tlsCert != "" || tlsKey != "" {
+		err = srv.ListenAndServeTLS(tlsCert, tlsKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-stopped
+
+	storage.mu.Lock()
+	storage.flush()
+	storage.mu.Unlock()
+	storage.close()
+	logAac.Info("final save done, storages closed")
+	return nil
+}
+
+func handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	if r.Method == http.MethodGet {
+		writeJSON(w, map[string]interface{}{
+			"result":         true,
+			"formMethod":     "post",
+			"operatorDriven": true,
+			"whatList":       []string{"all", "config", "data"},
+		})
+		return
+	}
+	// The handler is not behind the data lock, reloadAll takes it itself.
+	storage.mu.RLock()
+	ex := storage._check_rootOp(requestOperator(r))
+	storage.mu.RUnlock()
+	if ex != nil {
+		writeJSON(w, ex.dict4api)
+		return
+	}
+	what := strings.TrimSpace(r.FormValue("what"))
+	if what == "" {
+		what = "all"
+	}
+	writeJSON(w, reloadAll(what))
+}
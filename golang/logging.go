@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Loggers mirror the names configured for the Python modules in config/logging.yaml.
+var (
+	logAac          = slog.Default().With("logger", "aac")
+	logDataKeeper   = slog.Default().With("logger", "dataKeeper")
+	logAgentsKeeper = slog.Default().With("logger", "agentsKeeper")
+	logTestRunner   = slog.Default().With("logger", "testRunner")
+)
+
+var redactedFormFields = mapSet("secret", "token", "signature", "nonce")
+
+type logFormatterConfig struct {
+	Format  string `yaml:"format"`
+	Datefmt string `yaml:"datefmt"`
+}
+
+type logHandlerConfig struct {
+	Class       string `yaml:"class"`
+	Formatter   string `yaml:"formatter"`
+	Level       string `yaml:"level"`
+	Filename    string `yaml:"filename"`
+	MaxBytes    int64  `yaml:"maxBytes"`
+	BackupCount int    `yaml:"backupCount"`
+}
+
+type loggerConfig struct {
+	Level    string   `yaml:"level"`
+	Handlers []string `yaml:"handlers"`
+}
+
+type loggingConfig struct {
+	Formatters map[string]logFormatterConfig `yaml:"formatters"`
+	Handlers   map[string]logHandlerConfig   `yaml:"handlers"`
+	Loggers    map[string]loggerConfig       `yaml:"loggers"`
+}
+
+func parseLogLevel(name string, fallback slog.Level) slog.Level {
+	switch strings.ToUpper(strings.TrimSpace(name)) {
+	case "DEBUG", "NOTSET":
+		return slog.LevelDebug
+	case "INFO":
+		return slog.LevelInfo
+	case "WARNING", "WARN":
+		return slog.LevelWarn
+	case "ERROR", "CRITICAL", "FATAL":
+		return slog.LevelError
+	}
+	return fallback
+}
+
+// pyDateFormat translates the strftime subset used in logging.yaml into a Go time layout.
+func pyDateFormat(datefmt string) string {
+	if datefmt == "" {
+		return ""
+	}
+	return strings.NewReplacer(
+		"%Y", "2006", "%m", "01", "%d", "02",
+		"%H", "15", "%M", "04", "%S", "05",
+	).Replace(datefmt)
+}
+
+type rotatingFileWriter struct {
+	mu          sync.Mutex
+	filename    string
+	maxBytes    int64
+	backupCount int
+	file        *os.File
+	size        int64
+}
+
+func newRotatingFileWriter(filename string, maxBytes int64, backupCount int) (*rotatingFileWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return nil, err
+	}
+	rw := &rotatingFileWriter{filename: filename, maxBytes: maxBytes, backupCount: backupCount}
+	if err := rw.open(); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+func (rw *rotatingFileWriter) open() error {
+	f, err := os.OpenFile(rw.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	rw.file = f
+	rw.size = st.Size()
+	return nil
+}
+
+func (rw *rotatingFileWriter) rotate() error {
+	if err := rw.file.Close(); err != nil {
+		return err
+	}
+	if rw.backupCount > 0 {
+		for i := rw.backupCount - 1; i > 0; i-- {
+			src := rw.filename + "." + strconv.Itoa(i)
+			if _, err := os.Stat(src); err == nil {
+				_ = os.Rename(src, rw.filename+"."+strconv.Itoa(i+1))
+			}
+		}
+		_ = os.Rename(rw.filename, rw.filename+".1")
+	} else {
+		_ = os.Truncate(rw.filename, 0)
+	}
+	return rw.open()
+}
+
+func (rw *rotatingFileWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.maxBytes > 0 && rw.size > 0 && rw.size+int64(len(p)) > rw.maxBytes {
+		if err := rw.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rw.file.Write(p)
+	rw.size += int64(n)
+	return n, err
+}
+
+func (rw *rotatingFileWriter) Close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.file == nil {
+		return nil
+	}
+	err := rw.file.Close()
+	rw.file = nil
+	return err
+}
+
+// fanoutHandler passes every record to all handlers of a logger, each of them filtering by its own level.
+type fanoutHandler struct {
+	level    slog.Level
+	handlers []slog.Handler
+}
+
+func (h *fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level < h.level {
+		return false
+	}
+	for _, sub := range h.handlers {
+		if sub.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *fanoutHandler) Handle(ctx context.Context, rec slog.Record) error {
+	var firstErr error
+	for _, sub := range h.handlers {
+		if !sub.Enabled(ctx, rec.Level) {
+			continue
+		}
+		if err := sub.Handle(ctx, rec.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (h *fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	subs := make([]slog.Handler, len(h.handlers))
+	for i, sub := range h.handlers {
+		subs[i] = sub.WithAttrs(attrs)
+	}
+	return &fanoutHandler{level: h.level, handlers: subs}
+}
+
+func (h *fanoutHandler) WithGroup(name string) slog.Handler {
+	subs := make([]slog.Handler, len(h.handlers))
+	for i, sub := range h.handlers {
+		subs[i] = sub.WithGroup(name)
+	}
+	return &fanoutHandler{level: h.level, handlers: subs}
+}
+
+var (
+	logClosersMu sync.Mutex
+	logClosers   []io.Closer
+)
+
+// setupLogging configures the named loggers from a Python dictConfig-style YAML file.
+// Relative log file names are resolved against baseDir, the folder containing config/ and LOGS/.
+func setupLogging(path, baseDir string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cfg loggingConfig
+	if err := yaml.Unmarshal(stripBOM(raw), &cfg); err != nil {
+		return err
+	}
+
+	built := map[string]slog.Handler{}
+	closers := []io.Closer{}
+	for name, hc := range cfg.Handlers {
+		var out io.Writer
+		switch {
+		case strings.HasSuffix(hc.Class, "RotatingFileHandler"), strings.HasSuffix(hc.Class, "FileHandler"):
+			filename := hc.Filename
+			if !filepath.IsAbs(filename) {
+				filename = filepath.Join(baseDir, filename)
+			}
+			rw, err := newRotatingFileWriter(filename, hc.MaxBytes, hc.BackupCount)
+			if err != nil {
+				return fmt.Errorf("log handler %s: %w", name, err)
+			}
+			closers = append(closers, rw)
+			out = rw
+		case strings.HasSuffix(hc.Class, "StreamHandler"):
+			out = os.Stderr
+		default:
+			return fmt.Errorf("log handler %s: unsupported class %q", name, hc.Class)
+		}
+
+		layout := pyDateFormat(cfg.Formatters[hc.Formatter].Datefmt)
+		opts := &slog.HandlerOptions{Level: parseLogLevel(hc.Level, slog.LevelDebug)}
+		if layout != "" {
+			opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && a.Key == slog.TimeKey && a.Value.Kind() == slog.KindTime {
+					return slog.String(slog.TimeKey, a.Value.Time().Format(layout))
+				}
+				return a
+			}
+		}
+		built[name] = slog.NewTextHandler(out, opts)
+	}
+
+	makeLogger := func(name string) *slog.Logger {
+		lc, ok := cfg.Loggers[name]
+		if !ok {
+			lc = cfg.Loggers["root"]
+		}
+		subs := make([]slog.Handler, 0, len(lc.Handlers))
+		for _, hname := range lc.Handlers {
+			if h, ok := built[hname]; ok {
+				subs = append(subs, h)
+			}
+		}
+		return slog.New(&fanoutHandler{level: parseLogLevel(lc.Level, slog.LevelInfo), handlers: subs}).With("logger", name)
+	}
+
+	slog.SetDefault(makeLogger("root"))
+	logAac = makeLogger("aac")
+	logDataKeeper = makeLogger("dataKeeper")
+	logAgentsKeeper = makeLogger("agentsKeeper")
+	logTestRunner = makeLogger("testRunner")
+
+	logClosersMu.Lock()
+	old := logClosers
+	logClosers = closers
+	logClosersMu.Unlock()
+	for _, c := range old {
+		_ = c.Close()
+	}
+	return nil
+}
+
+// setupConsoleLogging sends all loggers to one writer, used by the offline commands.
+func setupConsoleLogging(out io.Writer, level slog.Level) {
+	h := slog.NewTextHandler(out, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(h).With("logger", "root"))
+	logAac = slog.New(h).With("logger", "aac")
+	logDataKeeper = slog.New(h).With("logger", "dataKeeper")
+	logAgentsKeeper = slog.New(h).With("logger", "agentsKeeper")
+	logTestRunner = slog.New(h).With("logger", "testRunner")
+}
+
+func closeLogging() {
+	logClosersMu.Lock()
+	defer logClosersMu.Unlock()
+	for _, c := range logClosers {
+		_ = c.Close()
+	}
+	logClosers = nil
+}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func redactForm(values url.Values) map[string]interface{} {
+	out := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if _, ok := redactedFormFields[strings.ToLower(k)]; ok {
+			out[k] = "***"
+			continue
+		}
+		if len(v) == 1 {
+			out[k] = v[0]
+		} else {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// responseRecorder keeps what the request log needs to know about the response;
+// writeJSON fills result and reason when the payload carries them.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	result string
+	reason string
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) notePayload(payload map[string]interface{}) {
+	if payload == nil {
+		return
+	}
+	if v, ok := payload["result"]; ok {
+		rec.result = fmt.Sprintf("%v", v)
+	}
+	if v, ok := payload["reason"].(string); ok {
+		rec.reason = v
+	}
+}
+
+func withRequestLog(routePath string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		reqID := strings.TrimSpace(r.Header.Get("X-Request-Id"))
+		if reqID == "" || !safeIDRe.MatchString(reqID) {
+			reqID = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", reqID)
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		elapsed := time.Since(started)
+		observeRequest(routePath, r.Method, rec.status, elapsed)
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		logAac.Log(r.Context(), level, "request served",
+			"request_id", reqID,
+			"method", r.Method,
+			"route", routePath,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"result", rec.result,
+			"reason", rec.reason,
+			"latency_ms", float64(elapsed.Microseconds())/1000,
+		)
+		if r.Form != nil {
+			logAac.Debug("request form", "request_id", reqID, "form", redactForm(r.Form))
+		}
+	})
+}
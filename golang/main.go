@@ -8,25 +8,34 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type runLocationConfig struct {
-	Port          int      `yaml:"port"`
-	CorsWhitelist []string `yaml:"cors_whitelist"`
+	Port           int      `yaml:"port"`
+	CorsWhitelist  []string `yaml:"cors_whitelist"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
 }
 
 type appConfig struct {
 	DefaultRunLocation string                       `yaml:"default_run_location"`
 	SessionMaxDefault  int64                        `yaml:"session_max_default"`
 	RunLocations       map[string]runLocationConfig `yaml:"run_locations"`
+	Storage            storageConfig                `yaml:"storage"`
+	AgentTokenTTL      int64                        `yaml:"agent_token_ttl"`
+	AgentOnlineTimeout int64                        `yaml:"agent_online_timeout"`
+	HistoryKeep        int                          `yaml:"history_keep"`
 }
 
 var (
 	storage       *configDataKeeper
 	corsWhitelist map[string]struct{}
+	corsMu        sync.RWMutex
+	appCfgPath    string
+	appRunAt      string
 )
 
 func firstExisting(paths ...string) (string, error) {
@@ -63,25 +72,14 @@ func loadAppConfig(path string) (*appConfig, error) {
 	return &cfg, nil
 }
 
-func parseRunAt(argv []string, defaultRunAt string) string {
-	for _, arg := range argv {
-		if strings.HasPrefix(arg, "-runat=") {
-			return strings.TrimPrefix(arg, "-runat=")
-		}
-		if strings.HasPrefix(arg, "--runat=") {
-			return strings.TrimPrefix(arg, "--runat=")
-		}
-	}
-	return defaultRunAt
-}
-
 func withCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if origin := r.Header.Get("Origin"); origin != "" {
-			if corsWhitelist != nil {
-				if _, ok := corsWhitelist[origin]; ok {
-					w.Header().Set("Access-Control-Allow-Origin", origin)
-				}
+			corsMu.RLock()
+			_, ok := corsWhitelist[origin]
+			corsMu.RUnlock()
+			if ok {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
 			}
 		}
 		next.ServeHTTP(w, r)
@@ -190,7 +188,9 @@ func handleAuthorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeJSON(w, storage.authorize(username, secret, appName))
+	ret := storage.authorize(username, secret, appName)
+	observeAuthorize(ret)
+	writeJSON(w, ret)
 }
 
 func handleUserCreate(w http.ResponseWriter, r *http.Request) {
@@ -351,7 +351,9 @@ func handleEmployeeFire(w http.ResponseWriter, r *http.Request) {
 	parseRequestForm(r)
 	username := strings.TrimSpace(r.FormValue("username"))
 	operator := strings.TrimSpace(r.FormValue("operator"))
-	writeJSON(w, storage.fireEmployee(username, operator))
+	branch := strings.TrimSpace(r.FormValue("branch"))
+	position := strings.TrimSpace(r.FormValue("position"))
+	writeJSON(w, storage.fireEmployee(username, operator, branch, position))
 }
 
 func handleEmployeeHire(w http.ResponseWriter, r *http.Request) {
@@ -566,7 +568,12 @@ func handleFunctionInfo(w http.ResponseWriter, r *http.Request) {
 		header = fmt.Sprintf("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<?xml-stylesheet type=\"text/xsl\" href=%q?>\n\n", xsltref)
 	}
 
-	def := storage.getFunctionDef(functionID, "yes", header)
+	def := map[string]interface{}{}
+	if group := strings.TrimSpace(r.FormValue("group")); group != "" {
+		def = storage.groupFunctionDef(functionID, group, strings.TrimSpace(r.FormValue("user")), header)
+	} else {
+		def = storage.getFunctionDef(functionID, "yes", header)
+	}
 	if pure {
 		if result, ok := def["result"].(bool); ok && result {
 			writeXML(w, fmt.Sprintf("%v", def["definition"]), http.StatusOK)
@@ -586,13 +593,14 @@ func handleFunctionDelete(w http.ResponseWriter, r *http.Request) {
 			"result":       true,
 			"funcRequired": true,
 			"funcList":     storageFunctionIDs(),
+			"modeList":     []string{"restrict", "cascade"},
 			"formMethod":   "post",
 		})
 		return
 	}
 	parseRequestForm(r)
 	functionID := strings.TrimSpace(r.FormValue("funcId"))
-	writeJSON(w, storage.deleteFunctionDef(functionID))
+	writeJSON(w, storage.deleteFunctionDef(functionID, strings.TrimSpace(r.FormValue("mode")), boolFromParam(r.FormValue("dry_run"), false)))
 }
 
 func handleFunctionUploadXmlDescr(w http.ResponseWriter, r *http.Request) {
@@ -676,13 +684,14 @@ func handleFuncsetDelete(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, map[string]interface{}{
 			"result":     true,
 			"funcSets":   storageFuncsets(),
+			"modeList":   []string{"restrict", "cascade"},
 			"formMethod": "post",
 		})
 		return
 	}
 	parseRequestForm(r)
 	funcset := strings.TrimSpace(r.FormValue("funcset"))
-	writeJSON(w, storage.funcsetDelete(funcset))
+	writeJSON(w, storage.funcsetDelete(funcset, strings.TrimSpace(r.FormValue("mode")), boolFromParam(r.FormValue("dry_run"), false)))
 }
 
 func handleFuncsetDetails(w http.ResponseWriter, r *http.Request) {
@@ -885,6 +894,45 @@ func handleBranchDelete(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, storage.deleteBranch(branch))
 }
 
+func handleBranchMove(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	branch := strings.TrimSpace(r.FormValue("branch"))
+	parent := strings.TrimSpace(r.FormValue("parent"))
+	if r.Method == http.MethodGet || branch == "" || parent == "" {
+		writeJSON(w, map[string]interface{}{
+			"result":     true,
+			"formMethod": "post",
+			"branchList": storageBranches(),
+			"branchInit": branch,
+			"parentList": storageBranches(),
+		})
+		return
+	}
+	writeJSON(w, storage.moveBranch(branch, parent, boolFromParam(r.FormValue("dry_run"), false)))
+}
+
+func handleBranchRename(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	branch := strings.TrimSpace(r.FormValue("branch"))
+	newID := strings.TrimSpace(r.FormValue("new_id"))
+	if r.Method == http.MethodGet || branch == "" {
+		writeJSON(w, map[string]interface{}{
+			"result":     true,
+			"formMethod": "post",
+			"branchList": storageBranches(),
+			"branchInit": branch,
+		})
+		return
+	}
+	writeJSON(w, storage.renameBranch(branch, newID, boolFromParam(r.FormValue("dry_run"), false)))
+}
+
 func handleBranchWhiteListGet(w http.ResponseWriter, r *http.Request) {
 	if !ensureMethods(w, r.Method, http.MethodGet) {
 		return
@@ -969,7 +1017,7 @@ func handleBranchRoleDelete(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	writeJSON(w, storage.deleteBranchRole(branch, role))
+	writeJSON(w, storage.deleteBranchRole(branch, role, strings.TrimSpace(r.FormValue("mode")), boolFromParam(r.FormValue("dry_run"), false)))
 }
 
 func handleBranchRoleCreate(w http.ResponseWriter, r *http.Request) {
@@ -1150,17 +1198,24 @@ func handleListAgents(w http.ResponseWriter, r *http.Request) {
 	branch := strings.TrimSpace(r.FormValue("branch"))
 	withSubs := boolFromParam(r.FormValue("subsidinaries"), false)
 	withLoc := boolFromParam(r.FormValue("location"), false)
+	status := strings.TrimSpace(r.FormValue("status"))
 	if branch == "" {
 		writeJSON(w, map[string]interface{}{
 			"result":     true,
 			"branchList": append([]string{"*ALL*"}, storageBranches()...),
+			"statusList": agentStatusFilters,
 			"cboxes": [][2]string{
 				{"subsidinaries", "Including subsidinaries"},
 				{"location", "With location branch"},
+				{"with_status", "With online status"},
 			},
 		})
 		return
 	}
+	if status != "" || boolFromParam(r.FormValue("with_status"), false) {
+		writeJSON(w, storage.listAgentsStatus(branch, status))
+		return
+	}
 	writeJSON(w, storage.listAgents(branch, withSubs, withLoc))
 }
 
@@ -1250,47 +1305,65 @@ func handlePositions(w http.ResponseWriter, r *http.Request) {
 }
 
 func route(mux *http.ServeMux, path string, handler http.HandlerFunc) {
-	mux.Handle(path, withCORS(http.HandlerFunc(handler)))
+	mux.Handle(path, withCORS(withRequestLog(path, withDataLock(http.HandlerFunc(handler)))))
 }
 
-func main() {
-	cfgPath, err := firstExisting(filepath.Join("..", "config", "general.yaml"), filepath.Join("config", "general.yaml"))
-	if err != nil {
-		cfgPath, _ = filepath.Abs("../config/general.yaml")
+// routeUnlocked is for handlers that take the data lock themselves.
+func routeUnlocked(mux *http.ServeMux, path string, handler http.HandlerFunc) {
+	mux.Handle(path, withCORS(withRequestLog(path, http.HandlerFunc(handler))))
+}
+
+func serve(opts cliOptions) int {
+	cfgDir := filepath.Dir(opts.configPath)
+	if err := setupLogging(filepath.Join(cfgDir, "logging.yaml"), filepath.Dir(cfgDir)); err != nil {
+		logAac.Warn("logging configuration failure, using defaults", "error", err)
 	}
-	cfg, err := loadAppConfig(cfgPath)
+	defer closeLogging()
+	logAac.Info("aac started")
+
+	cfg, err := loadAppConfig(opts.configPath)
 	if err != nil {
-		fmt.Printf("failed to read config %s: %v\n", cfgPath, err)
-		return
+		logAac.Error("failed to read config", "path", opts.configPath, "error", err)
+		return 1
 	}
 
-	runAt := parseRunAt(os.Args[1:], cfg.DefaultRunLocation)
+	runAt := opts.runAt
+	if runAt == "" {
+		runAt = cfg.DefaultRunLocation
+	}
 	runLocation, ok := cfg.RunLocations[runAt]
 	if !ok {
 		runAt = cfg.DefaultRunLocation
 		runLocation = cfg.RunLocations[runAt]
 	}
 
-	corsWhitelist = map[string]struct{}{}
-	for _, item := range runLocation.CorsWhitelist {
-		corsWhitelist[item] = struct{}{}
-	}
+	appCfgPath = opts.configPath
+	appRunAt = runAt
+	setCorsWhitelist(runLocation.CorsWhitelist)
+	setTrustedProxies(runLocation.TrustedProxies)
 
-	dataDir, err := firstExisting(filepath.Join("..", "DATA"), "DATA", filepath.Join("aac", "DATA"), filepath.Join("..", "aac", "DATA"))
-	if err != nil {
-		fmt.Printf("failed to locate DATA directory: %v\n", err)
-		return
+	if opts.dataDir == "" {
+		logAac.Error("failed to locate DATA directory")
+		return 1
+	}
+	storage = newConfigDataKeeper(opts.dataDir, cfg.SessionMaxDefault)
+	if storage.store, err = openStore(cfg.Storage, opts.dataDir); err != nil {
+		logAac.Error("failed to open data store", "error", err)
+		return 1
 	}
-	storage = newConfigDataKeeper(dataDir, cfg.SessionMaxDefault)
 	if err := storage.load(); err != nil {
-		fmt.Printf("failed to load data keeper: %v\n", err)
-		return
+		logAac.Error("failed to load data keeper", "error", err)
+		return 1
 	}
+	storage.agentsKeeper.tokenTTL = cfg.AgentTokenTTL
+	storage.agentsKeeper.onlineTimeout = cfg.AgentOnlineTimeout
+	storage.historyKeep = cfg.HistoryKeep
+	storage.syncHistory("startup")
 
-	staticDir, err := firstExisting(filepath.Join("..", "aac", "static"), filepath.Join("aac", "static"), filepath.Join("static"))
-	if err != nil {
-		fmt.Printf("failed to locate static directory: %v\n", err)
-		return
+	staticDir := opts.staticDir
+	if staticDir == "" {
+		logAac.Error("failed to locate static directory")
+		return 1
 	}
 
 	mux := http.NewServeMux()
@@ -1302,9 +1375,12 @@ func main() {
 	route(mux, "/aac", handleAacRoot)
 	route(mux, "/aac/static/index.html", handleRouteRoot)
 	mux.Handle("/aac/static/", withCORS(http.StripPrefix("/aac/static/", fileServer)))
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
 
-	route(mux, "/aac/authentificate", handleAuthorize)
-	route(mux, "/aac/authorize", handleAuthorize)
+	routeWriting(mux, "/aac/authentificate", handleAuthorize)
+	routeWriting(mux, "/aac/authorize", handleAuthorize)
 	route(mux, "/aac/user/create", handleUserCreate)
 	route(mux, "/aac/user/change", handleUserChange)
 	route(mux, "/aac/user/details", handleUserDetails)
@@ -1315,6 +1391,12 @@ func main() {
 	route(mux, "/aac/user/delete", handleUserDelete)
 	route(mux, "/aac/hr/fire", handleEmployeeFire)
 	route(mux, "/aac/hr/hire", handleEmployeeHire)
+	route(mux, "/aac/hr/delegation/create", handleDelegationCreate)
+	route(mux, "/aac/hr/delegation/revoke", handleDelegationRevoke)
+	route(mux, "/aac/hr/delegations/list", handleDelegationsList)
+	route(mux, "/aac/hr/schedule/add", handleScheduleAdd)
+	route(mux, "/aac/hr/schedule/cancel", handleScheduleCancel)
+	route(mux, "/aac/hr/schedule/list", handleScheduleList)
 	route(mux, "/aac/hr/branch/position/create", handleCreateBranchPosition)
 	route(mux, "/aac/hr/branch/position/delete", handleDeleteBranchPosition)
 	route(mux, "/aac/emp/subbranches/list", handleEmpSubBranches)
@@ -1339,26 +1421,72 @@ func main() {
 	route(mux, "/aac/branch/subbranches", handleBranchSubs)
 	route(mux, "/aac/branch/subbranch/add", handleBranchSubAdd)
 	route(mux, "/aac/branch/delete", handleBranchDelete)
+	route(mux, "/aac/branch/move", handleBranchMove)
+	route(mux, "/aac/branch/template/export", handleTemplateExport)
+	route(mux, "/aac/branch/template/instantiate", handleTemplateInstantiate)
+	route(mux, "/aac/impact", handleImpact)
+	route(mux, "/aac/batch", handleBatch)
+	route(mux, "/aac/export", handleExport)
+	route(mux, "/aac/import", handleImport)
+	route(mux, "/aac/admin/history/list", handleHistoryList)
+	route(mux, "/aac/admin/history/diff", handleHistoryDiff)
+	route(mux, "/aac/admin/history/restore", handleHistoryRestore)
+	route(mux, "/aac/branch/rename", handleBranchRename)
 	route(mux, "/aac/branch/fswhitelist/get", handleBranchWhiteListGet)
 	route(mux, "/aac/branch/fswhitelist/set", handleBranchWhiteListSet)
+	route(mux, "/aac/branch/agentschema/get", handleBranchAgentSchemaGet)
+	route(mux, "/aac/branch/agentschema/set", handleBranchAgentSchemaSet)
 	route(mux, "/aac/branch/roles/list", handleBranchRolesList)
 	route(mux, "/aac/branch/role/delete", handleBranchRoleDelete)
 	route(mux, "/aac/branch/role/create", handleBranchRoleCreate)
 	route(mux, "/aac/agent/register", handleAgentRegister)
 	route(mux, "/aac/agent/movedown", handleAgentMoveDown)
+	route(mux, "/aac/agent/move", handleAgentMove)
 	route(mux, "/aac/agent/unregister", handleAgentUnregister)
+	route(mux, "/aac/agent/update", handleAgentUpdate)
+	route(mux, "/aac/agent/history", handleAgentHistory)
+	route(mux, "/aac/agent/attributes/set", handleAgentAttributesSet)
+	route(mux, "/aac/agents/attributes/migrate", handleAgentsAttributesMigrate)
+	route(mux, "/aac/agent/credentials/set", handleAgentCredentialSet)
+	route(mux, "/aac/agent/credentials/list", handleAgentCredentialsList)
+	route(mux, "/aac/agent/credentials/revoke", handleAgentCredentialRevoke)
+	route(mux, "/aac/agent/challenge", handleAgentChallenge)
+	route(mux, "/aac/agent/authenticate", handleAgentAuthenticate)
+	route(mux, "/aac/agent/token/verify", handleAgentTokenVerify)
+	route(mux, "/aac/agent/heartbeat", handleAgentHeartbeat)
 	route(mux, "/aac/agent/details/xml", handleAgentDetailsXML)
 	route(mux, "/aac/agent/details/json", handleAgentDetailsJson)
 	route(mux, "/aac/agents/list", handleListAgents)
+	route(mux, "/aac/agents/search", handleAgentsSearch)
+	route(mux, "/aac/agentgroup/create", handleAgentGroupCreate)
+	route(mux, "/aac/agentgroup/update", handleAgentGroupUpdate)
+	route(mux, "/aac/agentgroup/delete", handleAgentGroupDelete)
+	route(mux, "/aac/agentgroup/details", handleAgentGroupDetails)
+	route(mux, "/aac/agentgroups/list", handleAgentGroupsList)
+	route(mux, "/aac/emp/function/check", handleEmpFunctionCheck)
 	route(mux, "/aac/function/tagset/modify", handleFunctionTagsetModify)
 	route(mux, "/aac/function/tagset/test", handleFunctionTagsetTest)
 	route(mux, "/aac/testrunner/states", handleTestRunnerStates)
 	route(mux, "/aac/branches", handleBranches)
 	route(mux, "/aac/positions", handlePositions)
 
-	addr := fmt.Sprintf(":%d", runLocation.Port)
-	fmt.Printf("AAC Go is running on port %d (run location: %s)\n", runLocation.Port, runAt)
-	if err := http.ListenAndServe(addr, mux); err != nil {
-		fmt.Printf("server failed: %v\n", err)
+	route(mux, "/aac/admin/integrity", handleAdminIntegrity)
+	routeUnlocked(mux, "/aac/admin/reload", handleAdminReload)
+
+	addr := opts.listen
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", runLocation.Port)
+	}
+	srv := &http.Server{Addr: addr, Handler: mux}
+	stopScheduler := make(chan struct{})
+	go runScheduler(stopScheduler, schedulerInterval)
+	defer close(stopScheduler)
+
+	logAac.Info("running", "addr", addr, "tls", opts.tlsCert != "", "run_location", runAt, "cors_whitelist", runLocation.CorsWhitelist)
+	if err := serveUntilStopped(srv, opts.tlsCert, opts.tlsKey); err != nil {
+		logAac.Error("server failed", "error", err)
+		return 1
 	}
+	logAac.Info("aac exited")
+	return 0
 }
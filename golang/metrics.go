@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are kept in-process and rendered in the Prometheus text exposition format,
+// so no client library is needed.
+
+var defaultLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type counterVec struct {
+	mu         sync.Mutex
+	name       string
+	help       string
+	labelNames []string
+	values     map[string]float64
+	labelSets  map[string][]string
+}
+
+func newCounterVec(name, help string, labelNames ...string) *counterVec {
+	return &counterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     map[string]float64{},
+		labelSets:  map[string][]string{},
+	}
+}
+
+func (c *counterVec) add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.labelSets[key]; !ok {
+		c.labelSets[key] = append([]string(nil), labelValues...)
+	}
+	c.values[key] += delta
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) render(sb *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(sb, "%s%s %s\n", c.name, formatLabels(c.labelNames, c.labelSets[key], "", ""), formatFloat(c.values[key]))
+	}
+}
+
+type histogramVec struct {
+	mu         sync.Mutex
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+	counts     map[string][]uint64
+	sums       map[string]float64
+	totals     map[string]uint64
+	labelSets  map[string][]string
+}
+
+func newHistogramVec(name, help string, buckets []float64, labelNames ...string) *histogramVec {
+	return &histogramVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    buckets,
+		counts:     map[string][]uint64{},
+		sums:       map[string]float64{},
+		totals:     map[string]uint64{},
+		labelSets:  map[string][]string{},
+	}
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.labelSets[key]; !ok {
+		h.labelSets[key] = append([]string(nil), labelValues...)
+		h.counts[key] = make([]uint64, len(h.buckets))
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			h.counts[key][i]++
+		}
+	}
+	h.sums[key] += value
+	h.totals[key]++
+}
+
+func (h *histogramVec) render(sb *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.totals))
+	for k := range h.totals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		labels := h.labelSets[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", h.name, formatLabels(h.labelNames, labels, "le", formatFloat(upper)), h.counts[key][i])
+		}
+		fmt.Fprintf(sb, "%s_bucket%s %d\n", h.name, formatLabels(h.labelNames, labels, "le", "+Inf"), h.totals[key])
+		fmt.Fprintf(sb, "%s_sum%s %s\n", h.name, formatLabels(h.labelNames, labels, "", ""), formatFloat(h.sums[key]))
+		fmt.Fprintf(sb, "%s_count%s %d\n", h.name, formatLabels(h.labelNames, labels, "", ""), h.totals[key])
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	parts := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, n, labelValueEscaper.Replace(v)))
+	}
+	if extraName != "" {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, extraName, labelValueEscaper.Replace(extraValue)))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func renderGauge(sb *strings.Builder, name, help string, value float64) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+var (
+	mRequests        = newCounterVec("aac_http_requests_total", "HTTP requests served per route.", "route", "method", "code")
+	mRequestLatency  = newHistogramVec("aac_http_request_duration_seconds", "HTTP request latency per route.", defaultLatencyBuckets, "route")
+	mAuthorize       = newCounterVec("aac_authorize_total", "Authorization attempts by outcome and reason.", "result", "reason")
+	mXMLSaveLatency  = newHistogramVec("aac_xml_save_duration_seconds", "Duration of XML data file saves.", defaultLatencyBuckets, "file")
+	mXMLSaveFailures = newCounterVec("aac_xml_save_failures_total", "Failed XML data file saves.", "file")
+)
+
+func observeRequest(routePath, method string, status int, elapsed time.Duration) {
+	mRequests.inc(routePath, method, strconv.Itoa(status))
+	mRequestLatency.observe(elapsed.Seconds(), routePath)
+}
+
+func observeAuthorize(payload map[string]interface{}) {
+	if ok, _ := payload["result"].(bool); ok {
+		mAuthorize.inc("success", "")
+		return
+	}
+	reason, _ := payload["reason"].(string)
+	mAuthorize.inc("failure", reason)
+}
+
+func countRunningTestTasks() int {
+	tasksMu.Lock()
+	defer tasksMu.Unlock()
+	return len(runningTestTasks)
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet) {
+		return
+	}
+
+	sb := &strings.Builder{}
+	mRequests.render(sb)
+	mRequestLatency.render(sb)
+	mAuthorize.render(sb)
+	mXMLSaveLatency.render(sb)
+	mXMLSaveFailures.render(sb)
+
+	if storage != nil {
+		// /metrics is not behind the data lock, so that scrapes stay out of the request metrics
+		storage.mu.RLock()
+		renderGauge(sb, "aac_tree_branches", "Branches defined in universe.xml.", float64(len(storage.listBranches())))
+		renderGauge(sb, "aac_tree_persons", "Persons in the people register.", float64(len(storageUsers())))
+		renderGauge(sb, "aac_tree_functions", "Functions described in catalogues.xml.", float64(len(storageFunctionIDs())))
+		renderGauge(sb, "aac_tree_agents", "Agents registered in agents.db.", float64(len(storage.getAgents())))
+		storage.mu.RUnlock()
+	}
+	renderGauge(sb, "aac_testrunner_running_tasks", "Test runner tasks still in progress.", float64(countRunningTestTasks()))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(sb.String()))
+}
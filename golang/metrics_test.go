@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// TestScrapeDuringWrites scrapes the metrics and probes while the data is changed and reloaded; run it with -race.
+func TestScrapeDuringWrites(t *testing.T) {
+	dk, _ := sampleKeeper(t)
+	saved := storage
+	storage = dk
+	defer func() { storage = saved }()
+
+	write := withDataLock(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, storage.addBranchSub("root", r.FormValue("branch")))
+	}))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			rec := httptest.NewRecorder()
+			write.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/aac/branch/add?branch=scraped-%d", i), nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("adding a branch: %d %s", rec.Code, rec.Body.String())
+			}
+			if err := storage.reload(); err != nil {
+				t.Errorf("reload: %v", err)
+			}
+		}
+	}()
+
+	scrapes := map[string]http.HandlerFunc{"/metrics": handleMetrics, "/healthz": handleHealthz, "/readyz": handleReadyz}
+	for i := 0; i < 50; i++ {
+		for path, handler := range scrapes {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			if path != "/readyz" && rec.Code != http.StatusOK {
+				t.Fatalf("%v answered %d: %s", path, rec.Code, rec.Body.String())
+			}
+		}
+	}
+	wg.Wait()
+}
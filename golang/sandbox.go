@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/antchfx/xmlquery"
+)
+
+// A sandbox is a copy of the keeper with its data copied into memory that never saves, used to try
+// a change out and see what it would do. agents.db is shared with the original keeper,
+// so the operations run in a sandbox must not write to it.
+
+func cloneXMLTree(n *xmlquery.Node) *xmlquery.Node {
+	if n == nil {
+		return nil
+	}
+	c := &xmlquery.Node{Type: n.Type, Data: n.Data, Prefix: n.Prefix, NamespaceURI: n.NamespaceURI}
+	if n.Attr != nil {
+		c.Attr = append([]xmlquery.Attr(nil), n.Attr...)
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		xmlquery.AddChild(c, cloneXMLTree(child))
+	}
+	return c
+}
+
+func (dk *configDataKeeper) newSandbox() *configDataKeeper {
+	store := newEmptyMemoryStore()
+	if uxml, cxml, err := renderDocuments(dk.store); err == nil {
+		store = newMemoryStore(cloneXMLTree(uxml), cloneXMLTree(cxml))
+	} else {
+		logDataKeeper.Error("data not copied into a sandbox", "store", dk.store.describe(), "error", err)
+	}
+	return &configDataKeeper{
+		filename:     dk.filename,
+		cFilename:    dk.cFilename,
+		dfltSessMax:  dk.dfltSessMax,
+		store:        store,
+		agentsKeeper: dk.agentsKeeper,
+		sandbox:      true,
+	}
+}
+
+// userPermissions gives the effective funcsets of every person in the register.
+func (dk *configDataKeeper) userPermissions() map[string]map[string]struct{} {
+	ret := map[string]map[string]struct{}{}
+	for _, p := range dk.data().personList {
+		if id := p.id(); id != "" {
+			ret[id] = mapSet(dk._userFuncSets(id)...)
+		}
+	}
+	return ret
+}
+
+// branchPermissions gives the funcsets enabled in every branch.
+func (dk *configDataKeeper) branchPermissions() map[string]map[string]struct{} {
+	ret := map[string]map[string]struct{}{}
+	view := dk.data()
+	for _, br := range view.branchList {
+		if id := br.ID; id != "" {
+			ret[id] = view.collectFuncsets(id)
+		}
+	}
+	return ret
+}
+
+// userFunctions gives the effective function ids of every person in the register.
+func (dk *configDataKeeper) userFunctions() map[string]map[string]struct{} {
+	ret := map[string]map[string]struct{}{}
+	for _, p := range dk.data().personList {
+		if id := p.id(); id != "" {
+			ret[id] = mapSet(dk.__empFunctionIds(id)...)
+		}
+	}
+	return ret
+}
+
+// tryOut makes the change on a sandbox and adds to its outcome whose funcsets and functions it changes.
+func (dk *configDataKeeper) tryOut(change func(sb *configDataKeeper) map[string]interface{}) map[string]interface{} {
+	sb := dk.newSandbox()
+	funcsetsBefore, functionsBefore, branchesBefore := sb.userPermissions(), sb.userFunctions(), sb.branchPermissions()
+	ret := change(sb)
+	ret["dry_run"] = true
+	if ok, _ := ret["result"].(bool); ok {
+		ret["users"] = diffPermissions(funcsetsBefore, sb.userPermissions(), "user")
+		ret["functions"] = diffPermissions(functionsBefore, sb.userFunctions(), "user")
+		ret["branches"] = diffPermissions(branchesBefore, sb.branchPermissions(), "branch")
+	}
+	return ret
+}
+
+var impactChanges = []string{"whitelist", "role-funcset-add", "role-funcset-remove"}
+
+// impactAnalysis tells who gains or loses which funcsets and functions if the proposed
+// whitelist or role change were made; nothing is changed.
+func (dk *configDataKeeper) impactAnalysis(change, branchID, roleName, funcsetID string, propParent bool, whitelist []string) map[string]interface{} {
+	switch change {
+	case "whitelist":
+		return dk.tryOut(func(sb *configDataKeeper) map[string]interface{} {
+			return sb.setBranchFsWhiteList(branchID, propParent, whitelist)
+		})
+	case "role-funcset-add":
+		return dk.tryOut(func(sb *configDataKeeper) map[string]interface{} {
+			return sb.roleFuncsetAdd(branchID, roleName, funcsetID)
+		})
+	case "role-funcset-remove":
+		return dk.tryOut(func(sb *configDataKeeper) map[string]interface{} {
+			return sb.roleFuncsetRemove(branchID, roleName, funcsetID)
+		})
+	}
+	return newInternError("WRONG-FORMAT", fmt.Sprintf("Unknown change %v, expected one of %v", change, impactChanges), map[string]interface{}{"bad_value": change}).dict4api
+}
+
+func handleImpact(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	change := strings.TrimSpace(r.FormValue("change"))
+	branch := strings.TrimSpace(r.FormValue("branch"))
+	if change == "" || branch == "" {
+		writeJSON(w, map[string]interface{}{
+			"result":     true,
+			"formMethod": "post",
+			"changeList": impactChanges,
+			"branchList": storageBranches(),
+			"rolesList":  storage.listRoles4Branch(branch),
+			"funcSets":   storageFuncsets(),
+		})
+		return
+	}
+	writeJSON(w, storage.impactAnalysis(change, branch, strings.TrimSpace(r.FormValue("role")), strings.TrimSpace(r.FormValue("funcset")),
+		boolFromParam(r.FormValue("propparent"), false), r.Form["white"]))
+}
+
+// diffPermissions lists the keys whose sets differ, with what was added and removed;
+// keys present on one side only are compared against an empty set.
+func diffPermissions(before, after map[string]map[string]struct{}, keyName string) []interface{} {
+	keys := map[string]struct{}{}
+	for k := range before {
+		keys[k] = struct{}{}
+	}
+	for k := range after {
+		keys[k] = struct{}{}
+	}
+
+	ret := make([]interface{}, 0)
+	for _, k := range sortedSet(keys) {
+		added := make([]string, 0)
+		for fs := range after[k] {
+			if _, ok := before[k][fs]; !ok {
+				added = append(added, fs)
+			}
+		}
+		removed := make([]string, 0)
+		for fs := range before[k] {
+			if _, ok := after[k][fs]; !ok {
+				removed = append(removed, fs)
+			}
+		}
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+		ret = append(ret, map[string]interface{}{
+			keyName:   k,
+			"added":   sortedSet(mapSet(added...)),
+			"removed": sortedSet(mapSet(removed...)),
+		})
+	}
+	return ret
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pending actions are kept in /universe/registers/schedule as
+//
+//	<action id=".." kind="hire|fire|delete|expiry-warning" due="unix" username=".." branch=".." position=".." operator=".." createdAt="unix" failures="n" lastError=".."/>
+//
+// so that they survive restarts. The scheduler loop applies the due ones with the rights
+// of the operator who scheduled them, and drops expired delegations on the same ticks.
+// An action that fails stays with its error and is tried again on the next ticks until it
+// has failed scheduledMaxFailures times; then it waits to be cancelled.
+
+const (
+	schedulerInterval     = time.Minute
+	secretExpiryWarnAhead = 7 * 24 * time.Hour
+	scheduledMaxFailures  = 3
+)
+
+var scheduledKinds = mapSet("hire", "fire", "delete")
+
+func (dk *configDataKeeper) _scheduled() []attrPairs {
+	return dk.store.registerEntries("schedule")
+}
+
+func scheduledActionDetails(act attrPairs) map[string]interface{} {
+	ret := map[string]interface{}{
+		"id":        act.get("id"),
+		"kind":      act.get("kind"),
+		"due":       act.getInt("due", 0),
+		"username":  act.get("username"),
+		"branch":    act.get("branch"),
+		"position":  act.get("position"),
+		"operator":  act.get("operator"),
+		"createdAt": act.getInt("createdAt", 0),
+	}
+	if act.has("failures") {
+		ret["failures"] = act.getInt("failures", 0)
+		ret["lastError"] = act.get("lastError")
+	}
+	return ret
+}
+
+func (dk *configDataKeeper) scheduleAction(kind, userid, branchID, pos, due, operator string) map[string]interface{} {
+	if _, ok := scheduledKinds[kind]; !ok {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Unknown action %v, expected one of %v", kind, sortedSet(scheduledKinds)), map[string]interface{}{"bad_value": kind}).dict4api
+	}
+	if userid == "" || due == "" {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Not all required parameters are given: user id:%v, due:%v", userid, due), nil).dict4api
+	}
+	if kind == "hire" && (branchID == "" || pos == "") {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Not all required parameters are given: branch is %v, pos is %v", branchID, pos), nil).dict4api
+	}
+
+	dueAt, err := parseTimeParam(due, 0)
+	if err != nil {
+		return newInternError("WRONG-FORMAT", err.Error(), map[string]interface{}{"bad_value": due}).dict4api
+	}
+
+	if dk._getPerson(userid) == nil {
+		return newInternError("USER-UNKNOWN", fmt.Sprintf("User %v is unknown", userid), nil).dict4api
+	}
+	if _, ex := dk._get_operator(operator); ex != nil {
+		return ex.dict4api
+	}
+	if branchID != "" {
+		if _, ex := dk._get_branch_relOp(operator, branchID); ex != nil {
+			return ex.dict4api
+		}
+	} else if _, ex := dk._get_positions_relOp(operator, userid, "", ""); ex != nil {
+		return ex.dict4api
+	}
+
+	act := mergeAttrs(nil, orderedPairs(map[string]string{
+		"id":        "act-" + newRequestID(),
+		"kind":      kind,
+		"due":       strconv.FormatInt(dueAt, 10),
+		"username":  userid,
+		"branch":    branchID,
+		"position":  pos,
+		"operator":  operator,
+		"createdAt": strconv.FormatInt(time.Now().Unix(), 10),
+	}), true)
+	if ex := dk._stored(dk.store.putRegisterEntry("schedule", act), false); ex != nil {
+		return ex.dict4api
+	}
+	logDataKeeper.Info("action scheduled", "id", act.get("id"), "kind", kind, "user", userid, "due", dueAt, "operator", operator)
+
+	return map[string]interface{}{"result": true, "action": scheduledActionDetails(act)}
+}
+
+// listScheduledActions gives the pending actions ordered by due time, those concerning the user only when one is given.
+func (dk *configDataKeeper) listScheduledActions(userid string) map[string]interface{} {
+	acts := dk._scheduled()
+	sort.SliceStable(acts, func(i, j int) bool { return acts[i].getInt("due", 0) < acts[j].getInt("due", 0) })
+	report := make([]interface{}, 0)
+	for _, act := range acts {
+		if userid != "" && act.get("username") != userid {
+			continue
+		}
+		report = append(report, scheduledActionDetails(act))
+	}
+	return map[string]interface{}{"result": true, "actions": report}
+}
+
+func (dk *configDataKeeper) cancelScheduledAction(actID, operator string) map[string]interface{} {
+	if actID == "" {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Not all required parameters are given: action id is %v", actID), nil).dict4api
+	}
+	safeID, err := safeXPathValue(actID)
+	if err != nil {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Action id %v is unsafe", actID), nil).dict4api
+	}
+	var act attrPairs
+	for _, e := range dk._scheduled() {
+		if e.get("id") == safeID {
+			act = e
+			break
+		}
+	}
+	if act == nil {
+		return newInternError("NOT-IN-SET", fmt.Sprintf("Scheduled action %v is unknown", actID), nil).dict4api
+	}
+
+	if _, ex := dk._get_operator(operator); ex != nil {
+		return ex.dict4api
+	}
+	if operator != act.get("operator") {
+		if branchID := act.get("branch"); branchID != "" {
+			if _, ex := dk._get_branch_relOp(operator, branchID); ex != nil {
+				return ex.dict4api
+			}
+		} else if _, ex := dk._get_positions_relOp(operator, act.get("username"), "", ""); ex != nil {
+			return ex.dict4api
+		}
+	}
+
+	det := scheduledActionDetails(act)
+	if ex := dk._stored(dk.store.deleteRegisterEntry("schedule", safeID), false); ex != nil {
+		return ex.dict4api
+	}
+	logDataKeeper.Info("scheduled action cancelled", "id", actID, "operator", operator)
+
+	return map[string]interface{}{"result": true, "action": det}
+}
+
+// _scheduleExpiryWarning makes sure a warning is due some days before the secret of the person expires.
+func (dk *configDataKeeper) _scheduleExpiryWarning(person *personRecord) {
+	if person == nil {
+		return
+	}
+	expireAt := person.Attrs.get("expireAt")
+	if expireAt == "" || person.Attrs.get("expiryWarnedFor") == expireAt {
+		return
+	}
+	userid := person.id()
+	for _, act := range dk._scheduled() {
+		if act.get("kind") == "expiry-warning" && act.get("username") == userid && act.get("expireAt") == expireAt {
+			return
+		}
+	}
+	due := person.Attrs.getInt("expireAt", 0) - int64(secretExpiryWarnAhead.Seconds())
+	act := mergeAttrs(nil, orderedPairs(map[string]string{
+		"id":        "act-" + newRequestID(),
+		"kind":      "expiry-warning",
+		"due":       strconv.FormatInt(due, 10),
+		"username":  userid,
+		"expireAt":  expireAt,
+		"createdAt": strconv.FormatInt(time.Now().Unix(), 10),
+	}), true)
+	if err := dk.store.putRegisterEntry("schedule", act); err != nil {
+		logDataKeeper.Error("expiry warning not scheduled", "user", userid, "error", err)
+		return
+	}
+	dk._save(false)
+}
+
+func (dk *configDataKeeper) _applyScheduledAction(act attrPairs) map[string]interface{} {
+	userid := act.get("username")
+	switch act.get("kind") {
+	case "hire":
+		return dk.hireEmployee(userid, act.get("branch"), act.get("position"), act.get("operator"))
+	case "fire":
+		return dk.fireEmployee(userid, act.get("operator"), act.get("branch"), act.get("position"))
+	case "delete":
+		return dk.deleteUser(userid, act.get("operator"))
+	case "expiry-warning":
+		person := dk._getPerson(userid)
+		if person == nil {
+			return newInternError("USER-UNKNOWN", fmt.Sprintf("User %v is unknown", userid), nil).dict4api
+		}
+		if person.Attrs.get("expireAt") != act.get("expireAt") {
+			return map[string]interface{}{"result": true, "warning": "Secret changed since the warning was scheduled"}
+		}
+		warned := personRecord{Attrs: person.Attrs.with("expiryWarnedFor", act.get("expireAt")), Changes: person.Changes}
+		if err := dk.store.putPerson(warned); err != nil {
+			return newInternError("DATABASE-ERROR", err.Error(), nil).dict4api
+		}
+		logDataKeeper.Warn("secret expires soon", "user", userid, "expireAt", act.get("expireAt"))
+		return map[string]interface{}{"result": true}
+	}
+	return newInternError("WRONG-DATA", fmt.Sprintf("Unknown scheduled action kind %v", act.get("kind")), nil).dict4api
+}
+
+// runDueActions applies the actions due by now in the order of their due times and removes the
+// ones applied; a failed one is kept with its error and the count of its failures.
+func (dk *configDataKeeper) runDueActions(now int64) []interface{} {
+	due := make([]attrPairs, 0)
+	for _, act := range dk._scheduled() {
+		if act.getInt("due", 0) <= now && act.getInt("failures", 0) < scheduledMaxFailures {
+			due = append(due, act)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].getInt("due", 0) < due[j].getInt("due", 0) })
+
+	report := make([]interface{}, 0, len(due))
+	for _, act := range due {
+		det := scheduledActionDetails(act)
+		res := dk._applyScheduledAction(act)
+		det["outcome"] = res
+		report = append(report, det)
+		if ok, _ := res["result"].(bool); ok {
+			if err := dk.store.deleteRegisterEntry("schedule", act.get("id")); err != nil {
+				logDataKeeper.Error("scheduled action not removed", "id", det["id"], "error", err)
+			}
+			logDataKeeper.Info("scheduled action applied", "id", det["id"], "kind", det["kind"], "user", det["username"])
+			continue
+		}
+		failures := act.getInt("failures", 0) + 1
+		failed := act.with("failures", strconv.FormatInt(failures, 10)).with("lastError", fmt.Sprintf("%v: %v", res["reason"], res["warning"]))
+		if err := dk.store.putRegisterEntry("schedule", failed); err != nil {
+			logDataKeeper.Error("scheduled action failure not recorded", "id", det["id"], "error", err)
+		}
+		logDataKeeper.Warn("scheduled action failed", "id", det["id"], "kind", det["kind"], "user", det["username"], "reason", res["reason"], "warning", res["warning"], "failures", failures, "retried", failures < scheduledMaxFailures)
+	}
+	if len(due) > 0 {
+		dk._save(false)
+	}
+	return report
+}
+
+func (dk *configDataKeeper) schedulerTick(now int64) {
+	dk.runDueActions(now)
+	dk.expireDelegations(now)
+}
+
+// runScheduler does what is due at start and then on every tick until stop is closed.
+func runScheduler(stop <-chan struct{}, interval time.Duration) {
+	tick := func() {
+		storage.mu.Lock()
+		defer storage.mu.Unlock()
+		storage.operator = "scheduler"
+		defer func() { storage.operator = "" }()
+		storage.schedulerTick(time.Now().Unix())
+	}
+	tick()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			tick()
+		}
+	}
+}
+
+func handleScheduleAdd(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	action := strings.TrimSpace(r.FormValue("action"))
+	username := strings.TrimSpace(r.FormValue("username"))
+	branch := strings.TrimSpace(r.FormValue("branch"))
+	position := strings.TrimSpace(r.FormValue("position"))
+	operator := strings.TrimSpace(r.FormValue("operator"))
+	if r.Method == http.MethodGet || action == "" || username == "" {
+		writeJSON(w, map[string]interface{}{
+			"result":       true,
+			"formMethod":   "post",
+			"actionList":   sortedSet(scheduledKinds),
+			"userList":     storageUsers(),
+			"branchReview": storage.reviewBranches(position),
+			"posReview":    storage.reviewPositions(branch),
+			"operList":     storageUsers(),
+		})
+		return
+	}
+	writeJSON(w, storage.scheduleAction(action, username, branch, position, r.FormValue("due"), operator))
+}
+
+func handleScheduleList(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet) {
+		return
+	}
+	parseRequestForm(r)
+	writeJSON(w, storage.listScheduledActions(strings.TrimSpace(r.FormValue("username"))))
+}
+
+func handleScheduleCancel(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	id := strings.TrimSpace(r.FormValue("id"))
+	operator := strings.TrimSpace(r.FormValue("operator"))
+	if r.Method == http.MethodGet || id == "" {
+		writeJSON(w, map[string]interface{}{
+			"result":     true,
+			"formMethod": "post",
+			"actions":    storage.listScheduledActions("")["actions"],
+			"operList":   storageUsers(),
+		})
+		return
+	}
+	writeJSON(w, storage.cancelScheduledAction(id, operator))
+}
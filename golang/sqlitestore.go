@@ -0,0 +1,1112 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/antchfx/xmlquery"
+)
+
+// sqliteStore keeps every entity in tables of its own: a row per branch, funcset, role,
+// position, property, person, function and register entry, and rows in the order given for
+// what they list. The order of siblings is kept in ord columns. Writes go into a transaction
+// begun by the first of them and committed by save; each write is atomic by a savepoint of its own.
+type sqliteStore struct {
+	mu     sync.Mutex
+	dbFile string
+	// xmlDir holds the XML files the tables are filled from while they are empty.
+	xmlDir string
+	db     *sql.DB
+	tx     *sql.Tx
+	gen    uint64
+}
+
+type sqlQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+var sqliteStoreSchema = []string{
+	`CREATE TABLE IF NOT EXISTS branches (
+		id TEXT PRIMARY KEY,
+		parent TEXT NOT NULL,
+		ord INTEGER NOT NULL,
+		whitelist INTEGER NOT NULL,
+		propagate_parent TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS whitelist_funcsets (
+		branch TEXT NOT NULL,
+		ord INTEGER NOT NULL,
+		funcset TEXT NOT NULL,
+		PRIMARY KEY (branch, ord)
+	)`,
+	`CREATE TABLE IF NOT EXISTS funcsets (
+		id TEXT PRIMARY KEY,
+		branch TEXT NOT NULL,
+		ord INTEGER NOT NULL,
+		name TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS funcset_functions (
+		funcset TEXT NOT NULL,
+		ord INTEGER NOT NULL,
+		function TEXT NOT NULL,
+		PRIMARY KEY (funcset, ord)
+	)`,
+	`CREATE TABLE IF NOT EXISTS roles (
+		branch TEXT NOT NULL,
+		name TEXT NOT NULL,
+		ord INTEGER NOT NULL,
+		PRIMARY KEY (branch, name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS role_funcsets (
+		branch TEXT NOT NULL,
+		role TEXT NOT NULL,
+		ord INTEGER NOT NULL,
+		funcset TEXT NOT NULL,
+		PRIMARY KEY (branch, role, ord)
+	)`,
+	`CREATE TABLE IF NOT EXISTS positions (
+		id INTEGER PRIMARY KEY,
+		branch TEXT NOT NULL,
+		ord INTEGER NOT NULL,
+		pos TEXT NOT NULL,
+		person TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS position_attrs (
+		position INTEGER NOT NULL,
+		ord INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (position, ord)
+	)`,
+	`CREATE TABLE IF NOT EXISTS properties (
+		branch TEXT NOT NULL,
+		name TEXT NOT NULL,
+		ord INTEGER NOT NULL,
+		PRIMARY KEY (branch, name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS property_variants (
+		branch TEXT NOT NULL,
+		property TEXT NOT NULL,
+		ord INTEGER NOT NULL,
+		variant TEXT NOT NULL,
+		PRIMARY KEY (branch, property, ord)
+	)`,
+	`CREATE TABLE IF NOT EXISTS agent_schemas (
+		branch TEXT PRIMARY KEY,
+		strict INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS agent_schema_attrs (
+		branch TEXT NOT NULL,
+		ord INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		type TEXT NOT NULL,
+		required INTEGER NOT NULL,
+		PRIMARY KEY (branch, ord)
+	)`,
+	`CREATE TABLE IF NOT EXISTS persons (
+		id TEXT PRIMARY KEY,
+		ord INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS person_attrs (
+		person TEXT NOT NULL,
+		ord INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (person, ord)
+	)`,
+	`CREATE TABLE IF NOT EXISTS person_changes (
+		person TEXT NOT NULL,
+		change INTEGER NOT NULL,
+		ord INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (person, change, ord)
+	)`,
+	`CREATE TABLE IF NOT EXISTS functions (
+		id TEXT PRIMARY KEY,
+		ord INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		title TEXT NOT NULL,
+		definition TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS register_entries (
+		register TEXT NOT NULL,
+		id TEXT NOT NULL,
+		ord INTEGER NOT NULL,
+		PRIMARY KEY (register, id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS register_attrs (
+		register TEXT NOT NULL,
+		entry TEXT NOT NULL,
+		ord INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (register, entry, ord)
+	)`,
+	`CREATE INDEX IF NOT EXISTS positions_branch ON positions (branch, ord)`,
+	`CREATE INDEX IF NOT EXISTS positions_person ON positions (person)`,
+	`CREATE INDEX IF NOT EXISTS funcsets_branch ON funcsets (branch, ord)`,
+}
+
+// sqliteStoreTables are cleared when the data is replaced, children before their parents.
+var sqliteStoreTables = []string{
+	"register_attrs", "register_entries", "functions", "person_changes", "person_attrs", "persons",
+	"agent_schema_attrs", "agent_schemas", "property_variants", "properties", "position_attrs", "positions",
+	"role_funcsets", "roles", "funcset_functions", "funcsets", "whitelist_funcsets", "branches",
+}
+
+// branchTables are the tables whose rows belong to a branch, with the column naming it.
+var branchTables = [][2]string{
+	{"whitelist_funcsets", "branch"}, {"funcsets", "branch"}, {"roles", "branch"}, {"role_funcsets", "branch"},
+	{"positions", "branch"}, {"properties", "branch"}, {"property_variants", "branch"},
+	{"agent_schemas", "branch"}, {"agent_schema_attrs", "branch"},
+}
+
+func openSQLiteStore(dbFile, xmlDir string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", dbFile)
+	if err != nil {
+		return nil, err
+	}
+	// one connection, so that the reads made while a transaction is open see its writes
+	db.SetMaxOpenConns(1)
+	for _, stmt := range sqliteStoreSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+	return &sqliteStore{dbFile: dbFile, xmlDir: xmlDir, db: db}, nil
+}
+
+func (s *sqliteStore) describe() string {
+	return "sqlite:" + s.dbFile
+}
+
+func (s *sqliteStore) generation() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gen
+}
+
+func (s *sqliteStore) check(doc string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	switch doc {
+	case "universe.xml":
+		if err := s.reader().QueryRow(`SELECT COUNT(*) FROM branches`).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("%v has no branches", s.dbFile)
+		}
+		return nil
+	case "catalogues.xml":
+		return s.reader().QueryRow(`SELECT COUNT(*) FROM functions`).Scan(&n)
+	}
+	return fmt.Errorf("unknown document %v", doc)
+}
+
+// reader gives what the reads go through: the open transaction, if any. It is called with mu held.
+func (s *sqliteStore) reader() sqlQuerier {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+func (s *sqliteStore) rollback() {
+	if s.tx != nil {
+		_ = s.tx.Rollback()
+		s.tx = nil
+	}
+}
+
+// reload drops what was not saved; tables found empty are filled from the XML files.
+func (s *sqliteStore) reload() error {
+	s.mu.Lock()
+	s.rollback()
+	s.gen++
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM branches`).Scan(&n)
+	s.mu.Unlock()
+	if err != nil || n > 0 {
+		return err
+	}
+
+	src := &xmlStore{dir: s.xmlDir}
+	if err := src.reload(); err != nil {
+		return fmt.Errorf("%v has no data and the XML files are not readable: %v", s.dbFile, err)
+	}
+	if err := copyEntities(s, src); err != nil {
+		s.mu.Lock()
+		s.rollback()
+		s.mu.Unlock()
+		return err
+	}
+	if err := s.save("universe.xml"); err != nil {
+		return err
+	}
+	logDataKeeper.Info("data moved into database", "from", s.xmlDir, "db", s.dbFile)
+	return nil
+}
+
+// save commits all the writes made since the last save, whatever document is named.
+func (s *sqliteStore) save(doc string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tx == nil {
+		return nil
+	}
+	err := s.tx.Commit()
+	s.tx = nil
+	return err
+}
+
+func (s *sqliteStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollback()
+	return s.db.Close()
+}
+
+// write runs the change in the transaction, undone as a whole when it fails.
+func (s *sqliteStore) write(change func(q sqlQuerier) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tx == nil {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		s.tx = tx
+	}
+	s.gen++
+	if _, err := s.tx.Exec(`SAVEPOINT change`); err != nil {
+		return err
+	}
+	if err := change(s.tx); err != nil {
+		_, _ = s.tx.Exec(`ROLLBACK TO change`)
+		_, _ = s.tx.Exec(`RELEASE change`)
+		return err
+	}
+	_, err := s.tx.Exec(`RELEASE change`)
+	return err
+}
+
+func (s *sqliteStore) replaceWith(src dataStore) error {
+	if err := s.write(func(q sqlQuerier) error {
+		for _, table := range sqliteStoreTables {
+			if _, err := q.Exec(`DELETE FROM ` + table); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := copyEntities(s, src); err != nil {
+		s.mu.Lock()
+		s.rollback()
+		s.gen++
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// query reads rows, swallowing the errors as the reads of the keeper do.
+func (s *sqliteStore) query(scan func(rows *sql.Rows) error, query string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows, err := s.reader().Query(query, args...)
+	if err != nil {
+		logDataKeeper.Error("reading database failed", "db", s.dbFile, "error", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			logDataKeeper.Error("reading database failed", "db", s.dbFile, "error", err)
+			return
+		}
+	}
+}
+
+// lists reads the values listed in order under each key of a two-column query.
+func (s *sqliteStore) lists(query string, args ...interface{}) map[string][]string {
+	ret := map[string][]string{}
+	s.query(func(rows *sql.Rows) error {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		ret[key] = append(ret[key], value)
+		return nil
+	}, query, args...)
+	return ret
+}
+
+// pairs reads the name, value pairs in order under each key of a three-column query.
+func (s *sqliteStore) pairs(query string, args ...interface{}) map[string]attrPairs {
+	ret := map[string]attrPairs{}
+	s.query(func(rows *sql.Rows) error {
+		var key, name, value string
+		if err := rows.Scan(&key, &name, &value); err != nil {
+			return err
+		}
+		ret[key] = append(ret[key], name, value)
+		return nil
+	}, query, args...)
+	return ret
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+func nextOrd(q sqlQuerier, table, where string, args ...interface{}) (int, error) {
+	var ord int
+	err := q.QueryRow(`SELECT COALESCE(MAX(ord), -1) + 1 FROM `+table+` WHERE `+where, args...).Scan(&ord)
+	return ord, err
+}
+
+// setList makes the values listed under the key those given, in their order.
+func setList(q sqlQuerier, table, keys, column string, values []string, key ...interface{}) error {
+	where := strings.Join(strings.Split(keys, ","), " = ? AND ") + " = ?"
+	if _, err := q.Exec(`DELETE FROM `+table+` WHERE `+where, key...); err != nil {
+		return err
+	}
+	marks := strings.Repeat("?, ", len(key))
+	for i, v := range values {
+		if _, err := q.Exec(`INSERT INTO `+table+` (`+keys+`, ord, `+column+`) VALUES (`+marks+`?, ?)`, append(append([]interface{}{}, key...), i, v)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setPairs makes the attributes kept under the key the pairs given, in their order.
+func setPairs(q sqlQuerier, table, keys string, pairs attrPairs, key ...interface{}) error {
+	where := strings.Join(strings.Split(keys, ","), " = ? AND ") + " = ?"
+	if _, err := q.Exec(`DELETE FROM `+table+` WHERE `+where, key...); err != nil {
+		return err
+	}
+	marks := strings.Repeat("?, ", len(key))
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if _, err := q.Exec(`INSERT INTO `+table+` (`+keys+`, ord, name, value) VALUES (`+marks+`?, ?, ?)`, append(append([]interface{}{}, key...), i/2, pairs[i], pairs[i+1])...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPairs(q sqlQuerier, table, keys string, key ...interface{}) (attrPairs, error) {
+	where := strings.Join(strings.Split(keys, ","), " = ? AND ") + " = ?"
+	rows, err := q.Query(`SELECT name, value FROM `+table+` WHERE `+where+` ORDER BY ord`, key...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := attrPairs{}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		ret = append(ret, name, value)
+	}
+	return ret, rows.Err()
+}
+
+func knownBranch(q sqlQuerier, id string) error {
+	var n int
+	if err := q.QueryRow(`SELECT COUNT(*) FROM branches WHERE id = ?`, id).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("branch %v is unknown", id)
+	}
+	return nil
+}
+
+func deleted(res sql.Result, err error, what string, args ...interface{}) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf(what, args...)
+	}
+	return nil
+}
+
+func (s *sqliteStore) branches() []branchRecord {
+	type row struct {
+		b         branchRecord
+		whitelist bool
+	}
+	byParent := map[string][]row{}
+	s.query(func(rows *sql.Rows) error {
+		var r row
+		var propagate string
+		if err := rows.Scan(&r.b.ID, &r.b.Parent, &r.whitelist, &propagate); err != nil {
+			return err
+		}
+		if r.whitelist {
+			r.b.Whitelist = &whitelistRecord{PropagateParent: propagate}
+		}
+		byParent[r.b.Parent] = append(byParent[r.b.Parent], r)
+		return nil
+	}, `SELECT id, parent, whitelist, propagate_parent FROM branches ORDER BY ord`)
+	whitelists := s.lists(`SELECT branch, funcset FROM whitelist_funcsets ORDER BY branch, ord`)
+
+	ret := make([]branchRecord, 0)
+	var walk func(parent string)
+	walk = func(parent string) {
+		for _, r := range byParent[parent] {
+			if r.b.Whitelist != nil {
+				r.b.Whitelist.Funcsets = nonNil(whitelists[r.b.ID])
+			}
+			ret = append(ret, r.b)
+			walk(r.b.ID)
+		}
+	}
+	walk("")
+	return ret
+}
+
+// branchOrder numbers the branches in the order of the tree, for the entities listed branch by branch.
+func (s *sqliteStore) branchOrder() map[string]int {
+	ret := map[string]int{}
+	for i, b := range s.branches() {
+		ret[b.ID] = i
+	}
+	return ret
+}
+
+func (s *sqliteStore) putBranch(b branchRecord) error {
+	return s.write(func(q sqlQuerier) error {
+		if b.Parent != "" {
+			if err := knownBranch(q, b.Parent); err != nil {
+				return err
+			}
+		}
+		whitelist, propagate := b.Whitelist != nil, ""
+		if whitelist {
+			propagate = b.Whitelist.PropagateParent
+		}
+
+		var parent string
+		err := q.QueryRow(`SELECT parent FROM branches WHERE id = ?`, b.ID).Scan(&parent)
+		switch {
+		case err == sql.ErrNoRows:
+			ord, err := nextOrd(q, "branches", "parent = ?", b.Parent)
+			if err != nil {
+				return err
+			}
+			if _, err := q.Exec(`INSERT INTO branches (id, parent, ord, whitelist, propagate_parent) VALUES (?, ?, ?, ?, ?)`, b.ID, b.Parent, ord, whitelist, propagate); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		default:
+			if parent != b.Parent {
+				for anc := b.Parent; anc != ""; {
+					if anc == b.ID {
+						return fmt.Errorf("branch %v cannot be moved under itself or its subbranch %v", b.ID, b.Parent)
+					}
+					if err := q.QueryRow(`SELECT parent FROM branches WHERE id = ?`, anc).Scan(&anc); err != nil {
+						return err
+					}
+				}
+				ord, err := nextOrd(q, "branches", "parent = ?", b.Parent)
+				if err != nil {
+					return err
+				}
+				if _, err := q.Exec(`UPDATE branches SET parent = ?, ord = ? WHERE id = ?`, b.Parent, ord, b.ID); err != nil {
+					return err
+				}
+			}
+			if _, err := q.Exec(`UPDATE branches SET whitelist = ?, propagate_parent = ? WHERE id = ?`, whitelist, propagate, b.ID); err != nil {
+				return err
+			}
+		}
+		funcsets := []string{}
+		if whitelist {
+			funcsets = b.Whitelist.Funcsets
+		}
+		return setList(q, "whitelist_funcsets", "branch", "funcset", funcsets, b.ID)
+	})
+}
+
+func (s *sqliteStore) renameBranch(id, newID string) error {
+	return s.write(func(q sqlQuerier) error {
+		if err := knownBranch(q, id); err != nil {
+			return err
+		}
+		if knownBranch(q, newID) == nil {
+			return fmt.Errorf("branch %v already exists", newID)
+		}
+		if _, err := q.Exec(`UPDATE branches SET id = ? WHERE id = ?`, newID, id); err != nil {
+			return err
+		}
+		if _, err := q.Exec(`UPDATE branches SET parent = ? WHERE parent = ?`, newID, id); err != nil {
+			return err
+		}
+		for _, t := range branchTables {
+			if _, err := q.Exec(`UPDATE `+t[0]+` SET `+t[1]+` = ? WHERE `+t[1]+` = ?`, newID, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStore) deleteBranch(id string) error {
+	return s.write(func(q sqlQuerier) error {
+		if err := knownBranch(q, id); err != nil {
+			return err
+		}
+		subtree := []string{id}
+		for i := 0; i < len(subtree); i++ {
+			rows, err := q.Query(`SELECT id FROM branches WHERE parent = ?`, subtree[i])
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				var child string
+				if err := rows.Scan(&child); err != nil {
+					rows.Close()
+					return err
+				}
+				subtree = append(subtree, child)
+			}
+			rows.Close()
+		}
+		for _, br := range subtree {
+			for _, stmt := range []string{
+				`DELETE FROM funcset_functions WHERE funcset IN (SELECT id FROM funcsets WHERE branch = ?)`,
+				`DELETE FROM position_attrs WHERE position IN (SELECT id FROM positions WHERE branch = ?)`,
+			} {
+				if _, err := q.Exec(stmt, br); err != nil {
+					return err
+				}
+			}
+			for _, t := range branchTables {
+				if _, err := q.Exec(`DELETE FROM `+t[0]+` WHERE `+t[1]+` = ?`, br); err != nil {
+					return err
+				}
+			}
+			if _, err := q.Exec(`DELETE FROM branches WHERE id = ?`, br); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStore) funcsets() []funcsetRecord {
+	order := s.branchOrder()
+	functions := s.lists(`SELECT funcset, function FROM funcset_functions ORDER BY funcset, ord`)
+	ret := make([]funcsetRecord, 0)
+	s.query(func(rows *sql.Rows) error {
+		var fs funcsetRecord
+		if err := rows.Scan(&fs.ID, &fs.Branch, &fs.Name); err != nil {
+			return err
+		}
+		fs.Functions = nonNil(functions[fs.ID])
+		ret = append(ret, fs)
+		return nil
+	}, `SELECT id, branch, name FROM funcsets ORDER BY ord`)
+	sortByBranch(ret, order, func(fs funcsetRecord) string { return fs.Branch })
+	return ret
+}
+
+// sortByBranch orders the records stably by their branches in the order of the tree.
+func sortByBranch[T any](records []T, order map[string]int, branch func(T) string) {
+	for i := 1; i < len(records); i++ {
+		for j := i; j > 0 && order[branch(records[j])] < order[branch(records[j-1])]; j-- {
+			records[j], records[j-1] = records[j-1], records[j]
+		}
+	}
+}
+
+func (s *sqliteStore) putFuncset(fs funcsetRecord) error {
+	return s.write(func(q sqlQuerier) error {
+		var branch string
+		err := q.QueryRow(`SELECT branch FROM funcsets WHERE id = ?`, fs.ID).Scan(&branch)
+		switch {
+		case err == sql.ErrNoRows || (err == nil && fs.Branch != "" && branch != fs.Branch):
+			if err := knownBranch(q, fs.Branch); err != nil {
+				return err
+			}
+			ord, err := nextOrd(q, "funcsets", "branch = ?", fs.Branch)
+			if err != nil {
+				return err
+			}
+			if _, err := q.Exec(`INSERT OR REPLACE INTO funcsets (id, branch, ord, name) VALUES (?, ?, ?, ?)`, fs.ID, fs.Branch, ord, fs.Name); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		default:
+			if _, err := q.Exec(`UPDATE funcsets SET name = ? WHERE id = ?`, fs.Name, fs.ID); err != nil {
+				return err
+			}
+		}
+		return setList(q, "funcset_functions", "funcset", "function", fs.Functions, fs.ID)
+	})
+}
+
+func (s *sqliteStore) deleteFuncset(id string) error {
+	return s.write(func(q sqlQuerier) error {
+		res, err := q.Exec(`DELETE FROM funcsets WHERE id = ?`, id)
+		if err := deleted(res, err, "funcset %v is unknown", id); err != nil {
+			return err
+		}
+		_, err = q.Exec(`DELETE FROM funcset_functions WHERE funcset = ?`, id)
+		return err
+	})
+}
+
+func (s *sqliteStore) roles() []roleRecord {
+	order := s.branchOrder()
+	funcsets := s.lists(`SELECT branch || '/' || role, funcset FROM role_funcsets ORDER BY branch, role, ord`)
+	ret := make([]roleRecord, 0)
+	s.query(func(rows *sql.Rows) error {
+		var r roleRecord
+		if err := rows.Scan(&r.Branch, &r.Name); err != nil {
+			return err
+		}
+		r.Funcsets = nonNil(funcsets[r.Branch+"/"+r.Name])
+		ret = append(ret, r)
+		return nil
+	}, `SELECT branch, name FROM roles ORDER BY ord`)
+	sortByBranch(ret, order, func(r roleRecord) string { return r.Branch })
+	return ret
+}
+
+func (s *sqliteStore) putRole(r roleRecord) error {
+	return s.write(func(q sqlQuerier) error {
+		if err := knownBranch(q, r.Branch); err != nil {
+			return err
+		}
+		ord, err := nextOrd(q, "roles", "branch = ?", r.Branch)
+		if err != nil {
+			return err
+		}
+		if _, err := q.Exec(`INSERT OR IGNORE INTO roles (branch, name, ord) VALUES (?, ?, ?)`, r.Branch, r.Name, ord); err != nil {
+			return err
+		}
+		return setList(q, "role_funcsets", "branch,role", "funcset", r.Funcsets, r.Branch, r.Name)
+	})
+}
+
+func (s *sqliteStore) deleteRole(branch, name string) error {
+	return s.write(func(q sqlQuerier) error {
+		if err := knownBranch(q, branch); err != nil {
+			return err
+		}
+		res, err := q.Exec(`DELETE FROM roles WHERE branch = ? AND name = ?`, branch, name)
+		if err := deleted(res, err, "role %v is not defined in branch %v", name, branch); err != nil {
+			return err
+		}
+		_, err = q.Exec(`DELETE FROM role_funcsets WHERE branch = ? AND role = ?`, branch, name)
+		return err
+	})
+}
+
+func (s *sqliteStore) positions() []positionRecord {
+	order := s.branchOrder()
+	attrs := s.pairs(`SELECT position, name, value FROM position_attrs ORDER BY position, ord`)
+	ret := make([]positionRecord, 0)
+	seq := map[string]int{}
+	s.query(func(rows *sql.Rows) error {
+		var id string
+		var p positionRecord
+		if err := rows.Scan(&id, &p.Branch); err != nil {
+			return err
+		}
+		p.Seq = seq[p.Branch]
+		seq[p.Branch]++
+		p.Attrs = attrs[id]
+		ret = append(ret, p)
+		return nil
+	}, `SELECT id, branch FROM positions ORDER BY branch, ord`)
+	sortByBranch(ret, order, func(p positionRecord) string { return p.Branch })
+	return ret
+}
+
+// positionID gives the row of the position numbered seq in the branch.
+func positionID(q sqlQuerier, branch string, seq int) (int64, error) {
+	if err := knownBranch(q, branch); err != nil {
+		return 0, err
+	}
+	var id int64
+	err := q.QueryRow(`SELECT id FROM positions WHERE branch = ? ORDER BY ord LIMIT 1 OFFSET ?`, branch, seq).Scan(&id)
+	if err == sql.ErrNoRows || seq < 0 {
+		return 0, fmt.Errorf("branch %v has no position #%d", branch, seq)
+	}
+	return id, err
+}
+
+func (s *sqliteStore) addPosition(p positionRecord) error {
+	return s.write(func(q sqlQuerier) error {
+		if err := knownBranch(q, p.Branch); err != nil {
+			return err
+		}
+		ord, err := nextOrd(q, "positions", "branch = ?", p.Branch)
+		if err != nil {
+			return err
+		}
+		attrs := mergeAttrs(nil, p.Attrs, true)
+		res, err := q.Exec(`INSERT INTO positions (branch, ord, pos, person) VALUES (?, ?, ?, ?)`, p.Branch, ord, attrs.get("pos"), attrs.get("person"))
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		return setPairs(q, "position_attrs", "position", attrs, id)
+	})
+}
+
+func (s *sqliteStore) setPosition(p positionRecord) error {
+	return s.write(func(q sqlQuerier) error {
+		id, err := positionID(q, p.Branch, p.Seq)
+		if err != nil {
+			return err
+		}
+		existing, err := readPairs(q, "position_attrs", "position", id)
+		if err != nil {
+			return err
+		}
+		attrs := mergeAttrs(existing, p.Attrs, true)
+		if _, err := q.Exec(`UPDATE positions SET pos = ?, person = ? WHERE id = ?`, attrs.get("pos"), attrs.get("person"), id); err != nil {
+			return err
+		}
+		return setPairs(q, "position_attrs", "position", attrs, id)
+	})
+}
+
+func (s *sqliteStore) deletePosition(branch string, seq int) error {
+	return s.write(func(q sqlQuerier) error {
+		id, err := positionID(q, branch, seq)
+		if err != nil {
+			return err
+		}
+		if _, err := q.Exec(`DELETE FROM positions WHERE id = ?`, id); err != nil {
+			return err
+		}
+		_, err = q.Exec(`DELETE FROM position_attrs WHERE position = ?`, id)
+		return err
+	})
+}
+
+func (s *sqliteStore) properties() []propertyRecord {
+	order := s.branchOrder()
+	variants := s.lists(`SELECT branch || '/' || property, variant FROM property_variants ORDER BY branch, property, ord`)
+	ret := make([]propertyRecord, 0)
+	s.query(func(rows *sql.Rows) error {
+		var p propertyRecord
+		if err := rows.Scan(&p.Branch, &p.Name); err != nil {
+			return err
+		}
+		p.Variants = nonNil(variants[p.Branch+"/"+p.Name])
+		ret = append(ret, p)
+		return nil
+	}, `SELECT branch, name FROM properties ORDER BY ord`)
+	sortByBranch(ret, order, func(p propertyRecord) string { return p.Branch })
+	return ret
+}
+
+func (s *sqliteStore) putProperty(p propertyRecord) error {
+	return s.write(func(q sqlQuerier) error {
+		if err := knownBranch(q, p.Branch); err != nil {
+			return err
+		}
+		ord, err := nextOrd(q, "properties", "branch = ?", p.Branch)
+		if err != nil {
+			return err
+		}
+		if _, err := q.Exec(`INSERT OR IGNORE INTO properties (branch, name, ord) VALUES (?, ?, ?)`, p.Branch, p.Name, ord); err != nil {
+			return err
+		}
+		return setList(q, "property_variants", "branch,property", "variant", p.Variants, p.Branch, p.Name)
+	})
+}
+
+func (s *sqliteStore) deleteProperty(branch, name string) error {
+	return s.write(func(q sqlQuerier) error {
+		if err := knownBranch(q, branch); err != nil {
+			return err
+		}
+		res, err := q.Exec(`DELETE FROM properties WHERE branch = ? AND name = ?`, branch, name)
+		if err := deleted(res, err, "property %v is not defined in branch %v", name, branch); err != nil {
+			return err
+		}
+		_, err = q.Exec(`DELETE FROM property_variants WHERE branch = ? AND property = ?`, branch, name)
+		return err
+	})
+}
+
+func (s *sqliteStore) agentSchemas() []agentSchemaRecord {
+	order := s.branchOrder()
+	decls := map[string][]jsonAgentAttrDecl{}
+	s.query(func(rows *sql.Rows) error {
+		var branch string
+		var d jsonAgentAttrDecl
+		if err := rows.Scan(&branch, &d.Name, &d.Type, &d.Required); err != nil {
+			return err
+		}
+		decls[branch] = append(decls[branch], d)
+		return nil
+	}, `SELECT branch, name, type, required FROM agent_schema_attrs ORDER BY branch, ord`)
+	ret := make([]agentSchemaRecord, 0)
+	s.query(func(rows *sql.Rows) error {
+		var sch agentSchemaRecord
+		if err := rows.Scan(&sch.Branch, &sch.Strict); err != nil {
+			return err
+		}
+		sch.Attrs = decls[sch.Branch]
+		if sch.Attrs == nil {
+			sch.Attrs = []jsonAgentAttrDecl{}
+		}
+		ret = append(ret, sch)
+		return nil
+	}, `SELECT branch, strict FROM agent_schemas`)
+	sortByBranch(ret, order, func(sch agentSchemaRecord) string { return sch.Branch })
+	return ret
+}
+
+func (s *sqliteStore) putAgentSchema(sch agentSchemaRecord) error {
+	return s.write(func(q sqlQuerier) error {
+		if err := knownBranch(q, sch.Branch); err != nil {
+			return err
+		}
+		if _, err := q.Exec(`INSERT OR REPLACE INTO agent_schemas (branch, strict) VALUES (?, ?)`, sch.Branch, sch.Strict); err != nil {
+			return err
+		}
+		if _, err := q.Exec(`DELETE FROM agent_schema_attrs WHERE branch = ?`, sch.Branch); err != nil {
+			return err
+		}
+		for i, d := range sch.Attrs {
+			if _, err := q.Exec(`INSERT INTO agent_schema_attrs (branch, ord, name, type, required) VALUES (?, ?, ?, ?, ?)`, sch.Branch, i, d.Name, d.Type, d.Required); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStore) deleteAgentSchema(branch string) error {
+	return s.write(func(q sqlQuerier) error {
+		if err := knownBranch(q, branch); err != nil {
+			return err
+		}
+		res, err := q.Exec(`DELETE FROM agent_schemas WHERE branch = ?`, branch)
+		if err := deleted(res, err, "branch %v has no agent schema", branch); err != nil {
+			return err
+		}
+		_, err = q.Exec(`DELETE FROM agent_schema_attrs WHERE branch = ?`, branch)
+		return err
+	})
+}
+
+func (s *sqliteStore) persons() []personRecord {
+	attrs := s.pairs(`SELECT person, name, value FROM person_attrs ORDER BY person, ord`)
+	changes := map[string][]attrPairs{}
+	s.query(func(rows *sql.Rows) error {
+		var person, name, value string
+		var change int
+		if err := rows.Scan(&person, &change, &name, &value); err != nil {
+			return err
+		}
+		for len(changes[person]) <= change {
+			changes[person] = append(changes[person], attrPairs{})
+		}
+		changes[person][change] = append(changes[person][change], name, value)
+		return nil
+	}, `SELECT person, change, name, value FROM person_changes ORDER BY person, change, ord`)
+	ret := make([]personRecord, 0)
+	s.query(func(rows *sql.Rows) error {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		p := personRecord{Attrs: attrs[id], Changes: changes[id]}
+		if p.Changes == nil {
+			p.Changes = []attrPairs{}
+		}
+		ret = append(ret, p)
+		return nil
+	}, `SELECT id FROM persons ORDER BY ord`)
+	return ret
+}
+
+func (s *sqliteStore) putPerson(p personRecord) error {
+	return s.write(func(q sqlQuerier) error {
+		id := p.id()
+		existing, err := readPairs(q, "person_attrs", "person", id)
+		if err != nil {
+			return err
+		}
+		if len(existing) == 0 {
+			ord, err := nextOrd(q, "persons", "1 = 1")
+			if err != nil {
+				return err
+			}
+			if _, err := q.Exec(`INSERT INTO persons (id, ord) VALUES (?, ?)`, id, ord); err != nil {
+				return err
+			}
+		}
+		if err := setPairs(q, "person_attrs", "person", mergeAttrs(existing, p.Attrs, true), id); err != nil {
+			return err
+		}
+		if _, err := q.Exec(`DELETE FROM person_changes WHERE person = ?`, id); err != nil {
+			return err
+		}
+		for i, ch := range p.Changes {
+			ch = mergeAttrs(nil, ch, true)
+			for j := 0; j+1 < len(ch); j += 2 {
+				if _, err := q.Exec(`INSERT INTO person_changes (person, change, ord, name, value) VALUES (?, ?, ?, ?, ?)`, id, i, j/2, ch[j], ch[j+1]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStore) deletePerson(id string) error {
+	return s.write(func(q sqlQuerier) error {
+		res, err := q.Exec(`DELETE FROM persons WHERE id = ?`, id)
+		if err := deleted(res, err, "person %v is unknown", id); err != nil {
+			return err
+		}
+		for _, table := range []string{"person_attrs", "person_changes"} {
+			if _, err := q.Exec(`DELETE FROM `+table+` WHERE person = ?`, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStore) functions() []functionRecord {
+	ret := make([]functionRecord, 0)
+	s.query(func(rows *sql.Rows) error {
+		var id, def string
+		if err := rows.Scan(&id, &def); err != nil {
+			return err
+		}
+		fn, err := parseFunctionDefinition(def)
+		if err != nil {
+			return fmt.Errorf("function %v: %v", id, err)
+		}
+		ret = append(ret, functionRecord{ID: id, Def: fn})
+		return nil
+	}, `SELECT id, definition FROM functions ORDER BY ord`)
+	return ret
+}
+
+func (s *sqliteStore) function(id string) (functionRecord, bool) {
+	var ret functionRecord
+	found := false
+	s.query(func(rows *sql.Rows) error {
+		var def string
+		if err := rows.Scan(&def); err != nil {
+			return err
+		}
+		fn, err := parseFunctionDefinition(def)
+		if err != nil {
+			return fmt.Errorf("function %v: %v", id, err)
+		}
+		ret, found = functionRecord{ID: id, Def: fn}, true
+		return nil
+	}, `SELECT definition FROM functions WHERE id = ?`, id)
+	return ret, found
+}
+
+func (s *sqliteStore) putFunction(def *xmlquery.Node) error {
+	return s.write(func(q sqlQuerier) error {
+		id := def.SelectAttr("id")
+		text := outputXMLDocument(def)
+		res, err := q.Exec(`UPDATE functions SET name = ?, title = ?, definition = ? WHERE id = ?`, def.SelectAttr("name"), def.SelectAttr("title"), text, id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+		ord, err := nextOrd(q, "functions", "1 = 1")
+		if err != nil {
+			return err
+		}
+		_, err = q.Exec(`INSERT INTO functions (id, ord, name, title, definition) VALUES (?, ?, ?, ?, ?)`, id, ord, def.SelectAttr("name"), def.SelectAttr("title"), text)
+		return err
+	})
+}
+
+func (s *sqliteStore) deleteFunction(id string) error {
+	return s.write(func(q sqlQuerier) error {
+		res, err := q.Exec(`DELETE FROM functions WHERE id = ?`, id)
+		return deleted(res, err, "function %v is unknown", id)
+	})
+}
+
+func (s *sqliteStore) registerEntries(register string) []attrPairs {
+	attrs := s.pairs(`SELECT entry, name, value FROM register_attrs WHERE register = ? ORDER BY entry, ord`, register)
+	ret := make([]attrPairs, 0)
+	s.query(func(rows *sql.Rows) error {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ret = append(ret, attrs[id])
+		return nil
+	}, `SELECT id FROM register_entries WHERE register = ? ORDER BY ord`, register)
+	return ret
+}
+
+func (s *sqliteStore) putRegisterEntry(register string, e attrPairs) error {
+	if _, ok := registerTags[register]; !ok {
+		return fmt.Errorf("unknown register %v", register)
+	}
+	return s.write(func(q sqlQuerier) error {
+		id := e.get("id")
+		existing, err := readPairs(q, "register_attrs", "register,entry", register, id)
+		if err != nil {
+			return err
+		}
+		if len(existing) == 0 {
+			ord, err := nextOrd(q, "register_entries", "register = ?", register)
+			if err != nil {
+				return err
+			}
+			if _, err := q.Exec(`INSERT INTO register_entries (register, id, ord) VALUES (?, ?, ?)`, register, id, ord); err != nil {
+				return err
+			}
+		}
+		return setPairs(q, "register_attrs", "register,entry", mergeAttrs(existing, e, true), register, id)
+	})
+}
+
+func (s *sqliteStore) deleteRegisterEntry(register, id string) error {
+	return s.write(func(q sqlQuerier) error {
+		res, err := q.Exec(`DELETE FROM register_entries WHERE register = ? AND id = ?`, register, id)
+		if err := deleted(res, err, "%v has no entry %v", register, id); err != nil {
+			return err
+		}
+		_, err = q.Exec(`DELETE FROM register_attrs WHERE register = ? AND entry = ?`, register, id)
+		return err
+	})
+}
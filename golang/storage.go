@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/antchfx/xmlquery"
+)
+
+// The keeper reads and changes the data through a data store, entity by entity: branches with
+// their funcsets, roles, positions, properties and agent schemas, persons, functions and the
+// entries of the registers. The XML store keeps them in universe.xml and catalogues.xml, edited
+// in place so that what was written by hand stays; the SQLite store keeps them in tables of
+// their own. Both have to pass the checks of storage_test.go.
+//
+// Reads give copies, except the function definitions, which are not to be changed, and swallow
+// errors as the reads of the keeper do. Writes take effect for the reads at once and are made
+// durable by save; the keeper saves after every change. Documents keep the names of the files:
+// "universe.xml" holds everything but the functions, which are in "catalogues.xml".
+
+type dataStore interface {
+	describe() string
+	// generation changes with every write and reload, telling that what was read is outdated.
+	generation() uint64
+	// check tells whether the document is there to be read from.
+	check(doc string) error
+	// reload drops the unsaved changes and reads the data anew.
+	reload() error
+	save(doc string) error
+	close() error
+	// replaceWith makes the data of the store that of src, as a sandbox is taken over.
+	replaceWith(src dataStore) error
+
+	// branches are given parents first, in the order of the tree.
+	branches() []branchRecord
+	// putBranch adds a branch with empty sections under its parent (none for a top-level one),
+	// or moves an existing one under the parent given and sets its whitelist.
+	putBranch(b branchRecord) error
+	// renameBranch changes the branch id in the branch data; the registers are left to the keeper.
+	renameBranch(id, newID string) error
+	// deleteBranch removes the branch with everything defined in it and below it.
+	deleteBranch(id string) error
+
+	funcsets() []funcsetRecord
+	// putFuncset adds a funcset to its branch, or sets the one with the id and moves it to the branch.
+	putFuncset(fs funcsetRecord) error
+	deleteFuncset(id string) error
+
+	roles() []roleRecord
+	putRole(r roleRecord) error
+	deleteRole(branch, name string) error
+
+	// positions of a branch are numbered by Seq in their order.
+	positions() []positionRecord
+	addPosition(p positionRecord) error
+	setPosition(p positionRecord) error
+	deletePosition(branch string, seq int) error
+
+	properties() []propertyRecord
+	putProperty(p propertyRecord) error
+	deleteProperty(branch, name string) error
+
+	agentSchemas() []agentSchemaRecord
+	putAgentSchema(s agentSchemaRecord) error
+	deleteAgentSchema(branch string) error
+
+	persons() []personRecord
+	putPerson(p personRecord) error
+	deletePerson(id string) error
+
+	functions() []functionRecord
+	function(id string) (functionRecord, bool)
+	// putFunction replaces the function with the id of the definition or adds it.
+	putFunction(def *xmlquery.Node) error
+	deleteFunction(id string) error
+
+	// registerEntries gives the entries of one of registerTags, identified by their id attribute.
+	registerEntries(register string) []attrPairs
+	putRegisterEntry(register string, e attrPairs) error
+	deleteRegisterEntry(register, id string) error
+}
+
+// registerNames are the registers of /universe/registers besides the people register; registerTags
+// gives the tag of their entries.
+var registerNames = []string{"delegations", "schedule"}
+
+var registerTags = map[string]string{"delegations": "delegation", "schedule": "action"}
+
+type branchRecord struct {
+	ID     string
+	Parent string
+	// Whitelist is nil for a branch without one, which takes no funcsets of its parent.
+	Whitelist *whitelistRecord
+}
+
+type whitelistRecord struct {
+	PropagateParent string
+	Funcsets        []string
+}
+
+type funcsetRecord struct {
+	ID        string
+	Branch    string
+	Name      string
+	Functions []string
+}
+
+type roleRecord struct {
+	Branch   string
+	Name     string
+	Funcsets []string
+}
+
+type positionRecord struct {
+	Branch string
+	Seq    int
+	Attrs  attrPairs
+}
+
+func (p positionRecord) pos() string    { return p.Attrs.get("pos") }
+func (p positionRecord) person() string { return p.Attrs.get("person") }
+
+type propertyRecord struct {
+	Branch   string
+	Name     string
+	Variants []string
+}
+
+type agentSchemaRecord struct {
+	Branch string
+	Strict bool
+	Attrs  []jsonAgentAttrDecl
+}
+
+type personRecord struct {
+	Attrs   attrPairs
+	Changes []attrPairs
+}
+
+func (p personRecord) id() string { return p.Attrs.get("id") }
+
+type functionRecord struct {
+	ID  string
+	Def *xmlquery.Node
+}
+
+// attrPairs are the attributes of an entity as name, value pairs in their order.
+type attrPairs []string
+
+func (p attrPairs) get(name string) string {
+	return pairValue(p, name)
+}
+
+// getInt gives the attribute as a number, or fallback when it is not there or not a number.
+func (p attrPairs) getInt(name string, fallback int64) int64 {
+	return toInt64(p.get(name), fallback)
+}
+
+func (p attrPairs) has(name string) bool {
+	for i := 0; i+1 < len(p); i += 2 {
+		if p[i] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// with gives a copy with the attribute set, in its place when it is there and last when not.
+func (p attrPairs) with(name, value string) attrPairs {
+	ret := append(attrPairs(nil), p...)
+	for i := 0; i+1 < len(ret); i += 2 {
+		if ret[i] == name {
+			ret[i+1] = value
+			return ret
+		}
+	}
+	return append(ret, name, value)
+}
+
+func (p attrPairs) without(names ...string) attrPairs {
+	dropped := mapSet(names...)
+	ret := attrPairs{}
+	for i := 0; i+1 < len(p); i += 2 {
+		if !hasKey(dropped, p[i]) {
+			ret = append(ret, p[i], p[i+1])
+		}
+	}
+	return ret
+}
+
+func (p attrPairs) dict(skip ...string) map[string]string {
+	skipped := mapSet(skip...)
+	ret := map[string]string{}
+	for i := 0; i+1 < len(p); i += 2 {
+		if !hasKey(skipped, p[i]) {
+			ret[p[i]] = p[i+1]
+		}
+	}
+	return ret
+}
+
+// withoutFirst gives a copy of the list with the first occurrence of the value left out.
+func withoutFirst(list []string, value string) []string {
+	ret := make([]string, 0, len(list))
+	found := false
+	for _, v := range list {
+		if v == value && !found {
+			found = true
+			continue
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+// withoutAll gives a copy of the list with every occurrence of the value left out.
+func withoutAll(list []string, value string) []string {
+	ret := make([]string, 0, len(list))
+	for _, v := range list {
+		if v != value {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeAttrs is syncAttrs on pairs: the given attributes set over the existing ones, which keep
+// their order; with exact the existing ones not given go, except the kept ones. Empty values
+// count as not given.
+func mergeAttrs(existing, given attrPairs, exact bool, keep ...string) attrPairs {
+	values := map[string]string{}
+	for i := 0; i+1 < len(given); i += 2 {
+		if given[i+1] != "" {
+			values[given[i]] = given[i+1]
+		}
+	}
+	kept := mapSet(keep...)
+	ret := attrPairs{}
+	for i := 0; i+1 < len(existing); i += 2 {
+		name := existing[i]
+		if v, ok := values[name]; ok {
+			ret = append(ret, name, v)
+			delete(values, name)
+		} else if (!exact || hasKey(kept, name)) && existing[i+1] != "" {
+			ret = append(ret, name, existing[i+1])
+		}
+	}
+	for i := 0; i+1 < len(given); i += 2 {
+		if v, ok := values[given[i]]; ok {
+			ret = append(ret, given[i], v)
+			delete(values, given[i])
+		}
+	}
+	return ret
+}
+
+type storageConfig struct {
+	Backend string `yaml:"backend"`
+	File    string `yaml:"file"`
+}
+
+var storageBackends = []string{"xml", "sqlite"}
+
+// openStore gives the store general.yaml asks for, to be read with reload; no storage section means the XML files.
+func openStore(cfg storageConfig, dataDir string) (dataStore, error) {
+	switch cfg.Backend {
+	case "", "xml":
+		return &xmlStore{dir: dataDir}, nil
+	case "sqlite":
+		file := cfg.File
+		if file == "" {
+			file = "universe.db"
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dataDir, file)
+		}
+		return openSQLiteStore(file, dataDir)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q, expected one of %v", cfg.Backend, storageBackends)
+}
+
+// copyEntities puts everything src has into dst, which is empty. The ids of branches, funcsets,
+// persons and functions met twice are refused, as the tables of the SQLite store keep them unique.
+func copyEntities(dst, src dataStore) error {
+	seen := map[string]map[string]struct{}{}
+	unique := func(kind, id string) error {
+		if seen[kind] == nil {
+			seen[kind] = map[string]struct{}{}
+		}
+		if hasKey(seen[kind], id) {
+			return fmt.Errorf("%v %q is defined more than once", kind, id)
+		}
+		seen[kind][id] = struct{}{}
+		return nil
+	}
+
+	for _, b := range src.branches() {
+		if err := unique("branch", b.ID); err != nil {
+			return err
+		}
+		if err := dst.putBranch(b); err != nil {
+			return err
+		}
+	}
+	for _, fs := range src.funcsets() {
+		if err := unique("funcset", fs.ID); err != nil {
+			return err
+		}
+		if err := dst.putFuncset(fs); err != nil {
+			return err
+		}
+	}
+	for _, r := range src.roles() {
+		if err := dst.putRole(r); err != nil {
+			return err
+		}
+	}
+	for _, p := range src.positions() {
+		if err := dst.addPosition(p); err != nil {
+			return err
+		}
+	}
+	for _, p := range src.properties() {
+		if err := dst.putProperty(p); err != nil {
+			return err
+		}
+	}
+	for _, s := range src.agentSchemas() {
+		if err := dst.putAgentSchema(s); err != nil {
+			return err
+		}
+	}
+	for _, p := range src.persons() {
+		if err := unique("person", p.id()); err != nil {
+			return err
+		}
+		if err := dst.putPerson(p); err != nil {
+			return err
+		}
+	}
+	for _, fn := range src.functions() {
+		if err := unique("function", fn.ID); err != nil {
+			return err
+		}
+		if err := dst.putFunction(cloneXMLTree(fn.Def)); err != nil {
+			return err
+		}
+	}
+	for _, register := range registerNames {
+		for _, e := range src.registerEntries(register) {
+			if err := dst.putRegisterEntry(register, e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// renderDocuments gives the data of the store as universe.xml and catalogues.xml, for the history,
+// the exports and the sandboxes. The trees of the XML store are its own and must not be changed.
+func renderDocuments(s dataStore) (*xmlquery.Node, *xmlquery.Node, error) {
+	if xs, ok := s.(*xmlStore); ok {
+		return xs.uxml, xs.cxml, nil
+	}
+	m := newEmptyMemoryStore()
+	if err := copyEntities(m, s); err != nil {
+		return nil, nil, err
+	}
+	return m.uxml, m.cxml, nil
+}
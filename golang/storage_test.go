@@ -0,0 +1,341 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Every data store has to pass the same checks before general.yaml may name it.
+
+const sampleUniverse = `<universe>
+  <!-- sample data of the storage tests -->
+  <branches>
+    <branch id="root">
+      <deffuncsets>
+        <funcset id="basic" name="Basic">
+          <func id="test:states"/>
+        </funcset>
+      </deffuncsets>
+      <func_white_list/>
+      <employees>
+        <employee pos="boss" person="Ivanov" head="yes"/>
+      </employees>
+      <roles>
+        <role name="boss">
+          <funcset id="basic"/>
+        </role>
+      </roles>
+      <branches>
+        <branch id="Москва &amp; область">
+          <deffuncsets/>
+          <employees/>
+          <roles/>
+        </branch>
+      </branches>
+    </branch>
+  </branches>
+  <registers>
+    <people_register>
+      <person id="Ivanov" secret="x" readableName="Иван Иванов" failures="0"/>
+      <person id="Petrov" secret="y" failures="0"/>
+    </people_register>
+  </registers>
+</universe>
+`
+
+const sampleCatalogues = `<catalogues>
+  <functions_catalogue>
+    <function id="test:states" name="States" title="States Test">
+      <in>
+        <str entry="AGENT" title="Agent ID" iterable="yes"/>
+      </in>
+      <call method="GET">
+        <url><origin of="AAC"/>/aac/testrunner/states?agent=<insert from="AGENT"/></url>
+      </call>
+    </function>
+  </functions_catalogue>
+</catalogues>
+`
+
+var storeOpeners = []struct {
+	name string
+	open func(dir string) (dataStore, error)
+}{
+	{"xml", func(dir string) (dataStore, error) {
+		return openStore(storageConfig{Backend: "xml"}, dir)
+	}},
+	{"sqlite", func(dir string) (dataStore, error) {
+		return openStore(storageConfig{Backend: "sqlite"}, dir)
+	}},
+}
+
+// writeSample puts the sample files into dir, unless they are there already.
+func writeSample(t *testing.T, dir string) {
+	t.Helper()
+	for doc, text := range map[string]string{"universe.xml": sampleUniverse, "catalogues.xml": sampleCatalogues} {
+		if _, err := os.Stat(filepath.Join(dir, doc)); err == nil {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, doc), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// openStoreT opens the store on the sample files, which the SQLite store is filled from.
+func openStoreT(t *testing.T, open func(string) (dataStore, error), dir string) dataStore {
+	t.Helper()
+	writeSample(t, dir)
+	s, err := open(dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := s.reload(); err != nil {
+		s.close()
+		t.Fatalf("reload: %v", err)
+	}
+	return s
+}
+
+func saveStore(t *testing.T, s dataStore) {
+	t.Helper()
+	for _, doc := range []string{"universe.xml", "catalogues.xml"} {
+		if err := s.save(doc); err != nil {
+			t.Fatalf("saving %v: %v", doc, err)
+		}
+	}
+}
+
+func mustWrite(t *testing.T, what string, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%v: %v", what, err)
+	}
+}
+
+// storeSnapshot is everything the store gives, the functions by their definitions.
+type storeSnapshot struct {
+	Branches     []branchRecord
+	Funcsets     []funcsetRecord
+	Roles        []roleRecord
+	Positions    []positionRecord
+	Properties   []propertyRecord
+	AgentSchemas []agentSchemaRecord
+	Persons      []personRecord
+	Functions    map[string]string
+	Registers    map[string][]attrPairs
+}
+
+func snapshotOf(s dataStore) storeSnapshot {
+	ret := storeSnapshot{Branches: s.branches(), Funcsets: s.funcsets(), Roles: s.roles(), Positions: s.positions(),
+		Properties: s.properties(), AgentSchemas: s.agentSchemas(), Persons: s.persons(),
+		Functions: map[string]string{}, Registers: map[string][]attrPairs{}}
+	for _, fn := range s.functions() {
+		ret.Functions[fn.ID] = fn.Def.OutputXML(true)
+	}
+	for _, register := range registerNames {
+		ret.Registers[register] = s.registerEntries(register)
+	}
+	return ret
+}
+
+func branchIDs(s dataStore) []string {
+	ret := make([]string, 0)
+	for _, b := range s.branches() {
+		ret = append(ret, b.ID+"<"+b.Parent)
+	}
+	return ret
+}
+
+func TestDataStores(t *testing.T) {
+	checks := []struct {
+		name string
+		run  func(t *testing.T, open func(string) (dataStore, error), dir string)
+	}{
+		{"absent data fails to load", func(t *testing.T, open func(string) (dataStore, error), dir string) {
+			s, err := open(dir)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			defer s.close()
+			if s.reload() == nil && s.check("universe.xml") == nil {
+				t.Fatal("a store without data loaded universe.xml")
+			}
+		}},
+		{"sample is read as written", func(t *testing.T, open func(string) (dataStore, error), dir string) {
+			s := openStoreT(t, open, dir)
+			defer s.close()
+			for _, doc := range []string{"universe.xml", "catalogues.xml"} {
+				if err := s.check(doc); err != nil {
+					t.Fatalf("check %v: %v", doc, err)
+				}
+			}
+			if got, want := branchIDs(s), []string{"root<", "Москва & область<root"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("branches %v, want %v", got, want)
+			}
+			if wl := s.branches()[0].Whitelist; wl == nil || len(wl.Funcsets) != 0 {
+				t.Fatalf("whitelist of root %+v, want an empty one", wl)
+			}
+			if s.branches()[1].Whitelist != nil {
+				t.Fatal("a branch without a whitelist got one")
+			}
+			if fs := s.funcsets(); len(fs) != 1 || fs[0].ID != "basic" || fs[0].Name != "Basic" || !reflect.DeepEqual(fs[0].Functions, []string{"test:states"}) {
+				t.Fatalf("funcsets %+v", fs)
+			}
+			if p := s.positions(); len(p) != 1 || !reflect.DeepEqual(p[0].Attrs, attrPairs{"pos", "boss", "person", "Ivanov", "head", "yes"}) {
+				t.Fatalf("positions %+v", p)
+			}
+			if p := s.persons(); len(p) != 2 || !reflect.DeepEqual(p[0].Attrs, attrPairs{"id", "Ivanov", "secret", "x", "readableName", "Иван Иванов", "failures", "0"}) {
+				t.Fatalf("persons %+v", p)
+			}
+			if fn, ok := s.function("test:states"); !ok || fn.Def.SelectAttr("title") != "States Test" {
+				t.Fatal("function test:states is not read")
+			}
+		}},
+		{"writes are read at once and survive reopening", func(t *testing.T, open func(string) (dataStore, error), dir string) {
+			s := openStoreT(t, open, dir)
+			gen := s.generation()
+			mustWrite(t, "branch", s.putBranch(branchRecord{ID: "filial", Parent: "root", Whitelist: &whitelistRecord{PropagateParent: "no", Funcsets: []string{"basic"}}}))
+			if s.generation() == gen {
+				t.Fatal("generation stays after a write")
+			}
+			mustWrite(t, "funcset", s.putFuncset(funcsetRecord{ID: "extra", Branch: "filial", Name: "Extra", Functions: []string{"test:states"}}))
+			mustWrite(t, "role", s.putRole(roleRecord{Branch: "filial", Name: "clerk", Funcsets: []string{"basic", "extra"}}))
+			mustWrite(t, "position", s.addPosition(positionRecord{Branch: "filial", Attrs: attrPairs{"pos", "clerk", "person", "Petrov"}}))
+			mustWrite(t, "position", s.addPosition(positionRecord{Branch: "filial", Attrs: attrPairs{"pos", "clerk"}}))
+			mustWrite(t, "position", s.setPosition(positionRecord{Branch: "filial", Seq: 1, Attrs: attrPairs{"pos", "clerk", "person", "Sidorov"}}))
+			mustWrite(t, "property", s.putProperty(propertyRecord{Branch: "filial", Name: "city", Variants: []string{"Tver", "Pskov"}}))
+			mustWrite(t, "agent schema", s.putAgentSchema(agentSchemaRecord{Branch: "filial", Strict: true, Attrs: []jsonAgentAttrDecl{{Name: "rack", Type: "int", Required: true}}}))
+			mustWrite(t, "person", s.putPerson(personRecord{Attrs: attrPairs{"id", "Sidorov", "secret", "z"}, Changes: []attrPairs{{"by", "Ivanov", "at", "1"}}}))
+			def, err := parseFunctionDefinition(`<function id="test:other" name="Other"><in/></function>`)
+			mustWrite(t, "function", err)
+			mustWrite(t, "function", s.putFunction(def))
+			mustWrite(t, "delegation", s.putRegisterEntry("delegations", attrPairs{"id", "dlg-1", "delegator", "Ivanov", "delegate", "Petrov"}))
+
+			if got, want := s.positions()[2].Attrs, (attrPairs{"pos", "clerk", "person", "Sidorov"}); !reflect.DeepEqual(got, want) {
+				t.Fatalf("position set to %v, want %v", got, want)
+			}
+			if _, ok := s.function("test:other"); !ok {
+				t.Fatal("function added is not read")
+			}
+			written := snapshotOf(s)
+			saveStore(t, s)
+			s.close()
+
+			s = openStoreT(t, open, dir)
+			defer s.close()
+			if got := snapshotOf(s); !reflect.DeepEqual(got, written) {
+				t.Fatalf("reopened data differs from what was saved:\nwant %+v\ngot  %+v", written, got)
+			}
+		}},
+		{"rename, move and delete", func(t *testing.T, open func(string) (dataStore, error), dir string) {
+			s := openStoreT(t, open, dir)
+			defer s.close()
+			mustWrite(t, "branch", s.putBranch(branchRecord{ID: "filial", Parent: "Москва & область"}))
+			mustWrite(t, "role", s.putRole(roleRecord{Branch: "filial", Name: "clerk", Funcsets: []string{"basic"}}))
+			mustWrite(t, "rename", s.renameBranch("Москва & область", "msk"))
+			if err := s.renameBranch("msk", "root"); err == nil {
+				t.Fatal("a branch was renamed to the id of another")
+			}
+			if got, want := branchIDs(s), []string{"root<", "msk<root", "filial<msk"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("branches after rename %v, want %v", got, want)
+			}
+			if err := s.putBranch(branchRecord{ID: "msk", Parent: "filial"}); err == nil {
+				t.Fatal("a branch was moved under its subbranch")
+			}
+			mustWrite(t, "move", s.putBranch(branchRecord{ID: "filial", Parent: "root"}))
+			if got, want := branchIDs(s), []string{"root<", "msk<root", "filial<root"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("branches after move %v, want %v", got, want)
+			}
+			if r := s.roles(); len(r) != 2 || r[1].Branch != "filial" {
+				t.Fatalf("roles after move %+v", r)
+			}
+
+			mustWrite(t, "move back", s.putBranch(branchRecord{ID: "filial", Parent: "msk"}))
+			mustWrite(t, "delete branch", s.deleteBranch("msk"))
+			if got, want := branchIDs(s), []string{"root<"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("branches after delete %v, want %v", got, want)
+			}
+			if r := s.roles(); len(r) != 1 {
+				t.Fatalf("roles of the deleted subtree stay: %+v", r)
+			}
+			mustWrite(t, "delete role", s.deleteRole("root", "boss"))
+			mustWrite(t, "delete position", s.deletePosition("root", 0))
+			mustWrite(t, "delete funcset", s.deleteFuncset("basic"))
+			mustWrite(t, "delete person", s.deletePerson("Petrov"))
+			mustWrite(t, "delete function", s.deleteFunction("test:states"))
+			if len(s.roles())+len(s.positions())+len(s.funcsets())+len(s.functions()) != 0 || len(s.persons()) != 1 {
+				t.Fatalf("deleted entities stay: %+v", snapshotOf(s))
+			}
+			for what, err := range map[string]error{
+				"branch":   s.deleteBranch("msk"),
+				"role":     s.deleteRole("root", "boss"),
+				"position": s.deletePosition("root", 0),
+				"person":   s.deletePerson("Petrov"),
+				"function": s.deleteFunction("test:states"),
+				"entry":    s.deleteRegisterEntry("schedule", "act-1"),
+			} {
+				if err == nil {
+					t.Fatalf("deleting an unknown %v succeeded", what)
+				}
+			}
+		}},
+		{"reload drops what is not saved", func(t *testing.T, open func(string) (dataStore, error), dir string) {
+			s := openStoreT(t, open, dir)
+			defer s.close()
+			before := snapshotOf(s)
+			mustWrite(t, "person", s.deletePerson("Petrov"))
+			mustWrite(t, "entry", s.putRegisterEntry("schedule", attrPairs{"id", "act-1", "kind", "delete"}))
+			if err := s.reload(); err != nil {
+				t.Fatal(err)
+			}
+			if got := snapshotOf(s); !reflect.DeepEqual(got, before) {
+				t.Fatalf("reload kept unsaved changes:\nwant %+v\ngot  %+v", before, got)
+			}
+		}},
+		{"keeper sees the same data after reopening", func(t *testing.T, open func(string) (dataStore, error), dir string) {
+			openKeeper := func() *configDataKeeper {
+				dk := newConfigDataKeeper(dir, 60)
+				dk.store = openStoreT(t, open, dir)
+				if err := dk.load(); err != nil {
+					dk.close()
+					t.Fatalf("keeper load: %v", err)
+				}
+				return dk
+			}
+			dk := openKeeper()
+			for _, res := range []map[string]interface{}{
+				dk.addBranchSub("root", "checked-branch"),
+				dk.createBranchRole("checked-branch", "checked-role", []string{"basic"}),
+				dk.createBranchPosition("checked-branch", "checked-role"),
+			} {
+				if ok, _ := res["result"].(bool); !ok {
+					dk.close()
+					t.Fatalf("keeper refused a change: %v", res["warning"])
+				}
+			}
+			users, branches := dk.userPermissions(), dk.branchPermissions()
+			written := snapshotOf(dk.store)
+			dk.close()
+
+			dk = openKeeper()
+			defer dk.close()
+			if got := snapshotOf(dk.store); !reflect.DeepEqual(got, written) {
+				t.Fatal("reopened data differs from what was saved")
+			}
+			if !reflect.DeepEqual(users, dk.userPermissions()) || !reflect.DeepEqual(branches, dk.branchPermissions()) {
+				t.Fatal("permissions differ after reopening")
+			}
+		}},
+	}
+	for _, store := range storeOpeners {
+		for _, check := range checks {
+			store, check := store, check
+			t.Run(store.name+"/"+check.name, func(t *testing.T) {
+				check.run(t, store.open, t.TempDir())
+			})
+		}
+	}
+}
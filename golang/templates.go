@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A branch template is a subtree exported without its people: the branches with their
+// whitelists, funcsets, roles, properties and vacant positions, in the branch format of the
+// JSON import. Instantiating it under another parent renames the branches and the funcsets
+// the subtree defines (ids and names, both are published globally), so that they stay
+// unique. It refuses when a new id has characters ids may not have, or when a funcset the
+// whitelists or roles refer to does not resolve at the new place.
+
+const templateFormatName = "aac-template"
+
+type branchTemplate struct {
+	Format     string       `json:"format"`
+	Version    int          `json:"version"`
+	ExportedAt int64        `json:"exportedAt,omitempty"`
+	Root       string       `json:"root"`
+	Branches   []jsonBranch `json:"branches"`
+}
+
+// templateNaming tells how the ids of a template become those of its instance: the root gets
+// root, in every other id the template root is replaced by the new one (which suits ids like
+// "Bank1|Office1", with from="|" to="-" as '|' is not allowed in a new id), then from by to,
+// and prefix is put in front.
+type templateNaming struct {
+	Root   string
+	Prefix string
+	From   string
+	To     string
+}
+
+func (tn templateNaming) rename(tplRoot, id string) string {
+	if id == tplRoot && tn.Root != "" {
+		return tn.Root
+	}
+	if tn.Root != "" {
+		id = strings.ReplaceAll(id, tplRoot, tn.Root)
+	}
+	if tn.From != "" {
+		id = strings.ReplaceAll(id, tn.From, tn.To)
+	}
+	return tn.Prefix + id
+}
+
+func (dk *configDataKeeper) exportTemplate(branchID string) (*branchTemplate, *internError) {
+	view := dk.data()
+	if view.branch(branchID) == nil {
+		return nil, newInternError("BRANCH-UNKNOWN", fmt.Sprintf("Branch %v is unknown", branchID), map[string]interface{}{"bad_value": branchID})
+	}
+	subtree := mapSet(view.subtree(branchID)...)
+
+	tpl := &branchTemplate{Format: templateFormatName, Version: jsonFormatVersion, ExportedAt: time.Now().Unix(), Root: branchID, Branches: []jsonBranch{}}
+	for _, jb := range dk.exportJSON(false).Branches {
+		if !hasKey(subtree, jb.ID) {
+			continue
+		}
+		if jb.ID == branchID {
+			jb.Parent = ""
+		}
+		for i := range jb.Employees {
+			jb.Employees[i].Person = ""
+		}
+		tpl.Branches = append(tpl.Branches, jb)
+	}
+	return tpl, nil
+}
+
+// instantiateTemplate creates the branches of the template under parent, renamed as naming says.
+func (dk *configDataKeeper) instantiateTemplate(tpl *branchTemplate, parent string, naming templateNaming, dryRun bool) map[string]interface{} {
+	if tpl.Format != templateFormatName || tpl.Version != jsonFormatVersion {
+		return newInternError("WRONG-FORMAT", fmt.Sprintf("Template format %q version %d is not %v version %d", tpl.Format, tpl.Version, templateFormatName, jsonFormatVersion), nil).dict4api
+	}
+	if len(tpl.Branches) == 0 || tpl.Branches[0].ID != tpl.Root {
+		return newInternError("WRONG-FORMAT", "Template must list its root branch first", nil).dict4api
+	}
+	view := dk.data()
+	if view.branch(parent) == nil {
+		return newInternError("BRANCH-UNKNOWN", fmt.Sprintf("Branch %v is unknown", parent), map[string]interface{}{"bad_value": parent}).dict4api
+	}
+
+	existingFuncsets := map[string]struct{}{}
+	for _, fs := range view.funcsetList {
+		existingFuncsets[fs.ID] = struct{}{}
+	}
+	branchIDs, funcsetIDs := map[string]string{}, map[string]string{}
+	problems := make([]string, 0)
+	takenBranches, takenFuncsets := map[string]struct{}{}, map[string]struct{}{}
+	for _, jb := range tpl.Branches {
+		newID := naming.rename(tpl.Root, jb.ID)
+		branchIDs[jb.ID] = newID
+		if !safeIDRe.MatchString(newID) || newID == "" {
+			problems = append(problems, fmt.Sprintf("branch %v would become %q which is not a valid id", jb.ID, newID))
+		} else if view.branch(newID) != nil || hasKey(takenBranches, newID) {
+			problems = append(problems, fmt.Sprintf("branch %v would become %v which already exists", jb.ID, newID))
+		}
+		takenBranches[newID] = struct{}{}
+		for _, fs := range jb.Funcsets {
+			newFs := naming.rename(tpl.Root, fs.ID)
+			funcsetIDs[fs.ID] = newFs
+			if !safeIDRe.MatchString(newFs) || newFs == "" {
+				problems = append(problems, fmt.Sprintf("funcset %v of branch %v would become %q which is not a valid id", fs.ID, jb.ID, newFs))
+			} else if hasKey(existingFuncsets, newFs) || hasKey(takenFuncsets, newFs) {
+				problems = append(problems, fmt.Sprintf("funcset %v of branch %v would become %v which already exists", fs.ID, jb.ID, newFs))
+			}
+			takenFuncsets[newFs] = struct{}{}
+		}
+	}
+	if len(problems) > 0 {
+		return newInternError("WRONG-DATA", fmt.Sprintf("Template not instantiated, %d problem(s) found; rename with root, prefix or from/to", len(problems)), map[string]interface{}{"problems": problems}).dict4api
+	}
+
+	mapFuncsets := func(ids []string) []string {
+		ret := make([]string, 0, len(ids))
+		for _, id := range ids {
+			if newID, ok := funcsetIDs[id]; ok {
+				id = newID
+			}
+			ret = append(ret, id)
+		}
+		return ret
+	}
+	data := &jsonUniverse{Format: jsonFormatName, Version: jsonFormatVersion}
+	for _, jb := range tpl.Branches {
+		nb := jsonBranch{ID: branchIDs[jb.ID], Parent: parent, Employees: []jsonEmployee{}, Roles: []jsonRole{}, Funcsets: []jsonFuncset{}, Properties: jb.Properties, AgentSchema: jb.AgentSchema}
+		if jb.ID != tpl.Root {
+			mapped, ok := branchIDs[jb.Parent]
+			if !ok {
+				return newInternError("WRONG-FORMAT", fmt.Sprintf("Branch %v of the template is not below its root", jb.ID), map[string]interface{}{"bad_value": jb.ID}).dict4api
+			}
+			nb.Parent = mapped
+		}
+		if jb.Whitelist != nil {
+			nb.Whitelist = &jsonWhitelist{PropagateParent: jb.Whitelist.PropagateParent, Funcsets: mapFuncsets(jb.Whitelist.Funcsets)}
+		}
+		for _, fs := range jb.Funcsets {
+			nb.Funcsets = append(nb.Funcsets, jsonFuncset{ID: funcsetIDs[fs.ID], Name: naming.rename(tpl.Root, fs.Name), Functions: fs.Functions})
+		}
+		for _, role := range jb.Roles {
+			nb.Roles = append(nb.Roles, jsonRole{Name: role.Name, Funcsets: mapFuncsets(role.Funcsets)})
+		}
+		for _, emp := range jb.Employees {
+			nb.Employees = append(nb.Employees, jsonEmployee{Position: emp.Position, Attributes: emp.Attributes})
+		}
+		data.Branches = append(data.Branches, nb)
+	}
+	if problems := dk.validateJSONImport(data, "merge"); len(problems) > 0 {
+		return newInternError("WRONG-DATA", fmt.Sprintf("Template not instantiated, %d problem(s) found", len(problems)), map[string]interface{}{"problems": problems}).dict4api
+	}
+
+	sb := dk.newSandbox()
+	if err := sb.applyJSONImport(data, "merge"); err != nil {
+		return newInternError("DATABASE-ERROR", fmt.Sprintf("Template not instantiated: %v", err), nil).dict4api
+	}
+
+	// A whitelist can only pass on what the parent has, a role only give what its branch has.
+	unresolved := make([]interface{}, 0)
+	for _, nb := range data.Branches {
+		sbView := sb.data()
+		parentSets := sbView.collectFuncsets(nb.Parent)
+		if nb.Whitelist != nil {
+			for _, fs := range nb.Whitelist.Funcsets {
+				if !hasKey(parentSets, fs) {
+					unresolved = append(unresolved, integrityIssue("unresolved-whitelist-funcset", fs, nb.ID, "whitelist names a funcset the parent branch does not have"))
+				}
+			}
+		}
+		ownSets := sbView.collectFuncsets(nb.ID)
+		for _, role := range nb.Roles {
+			for _, fs := range role.Funcsets {
+				if !hasKey(ownSets, fs) {
+					unresolved = append(unresolved, integrityIssue("unresolved-role-funcset", fs, nb.ID, fmt.Sprintf("role %v names a funcset the branch does not have", role.Name)))
+				}
+			}
+		}
+	}
+	unresolved = append(unresolved, dk.introducedIssues(sb)...)
+	if len(unresolved) > 0 {
+		return newInternError("WRONG-DATA", fmt.Sprintf("Template would leave %d reference(s) unresolved under %v, nothing changed", len(unresolved), parent), map[string]interface{}{"unresolved": unresolved}).dict4api
+	}
+
+	renamed := map[string]interface{}{}
+	for old, id := range branchIDs {
+		renamed[old] = id
+	}
+	for old, id := range funcsetIDs {
+		renamed[old] = id
+	}
+	ret := map[string]interface{}{"result": true, "root": branchIDs[tpl.Root], "branches": len(data.Branches), "renamed": renamed}
+	if dryRun {
+		ret["dry_run"] = true
+		return ret
+	}
+	if ex := dk._stored(dk.store.replaceWith(sb.store), false); ex != nil {
+		return ex.dict4api
+	}
+	logDataKeeper.Info("branch template instantiated", "template", tpl.Root, "root", branchIDs[tpl.Root], "parent", parent, "branches", len(data.Branches))
+	return ret
+}
+
+func handleTemplateExport(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet) {
+		return
+	}
+	parseRequestForm(r)
+	tpl, err := storage.exportTemplate(strings.TrimSpace(r.FormValue("branch")))
+	if err != nil {
+		writeJSON(w, err.dict4api)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(tpl)
+}
+
+func handleTemplateInstantiate(w http.ResponseWriter, r *http.Request) {
+	if !ensureMethods(w, r.Method, http.MethodGet, http.MethodPost) {
+		return
+	}
+	parseRequestForm(r)
+	if r.Method == http.MethodGet {
+		writeJSON(w, map[string]interface{}{
+			"result":     true,
+			"formMethod": "post",
+			"branchList": storage.listBranches(),
+		})
+		return
+	}
+
+	var raw []byte
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var err error
+		if raw, err = io.ReadAll(io.LimitReader(r.Body, 16<<20)); err != nil {
+			writeJSON(w, newInternError("WRONG-FORMAT", fmt.Sprintf("Cannot read the body: %v", err), nil).dict4api)
+			return
+		}
+	} else {
+		raw = []byte(r.FormValue("template"))
+	}
+	var tpl branchTemplate
+	if err := json.Unmarshal(raw, &tpl); err != nil {
+		writeJSON(w, newInternError("WRONG-FORMAT", fmt.Sprintf("Template is not valid JSON: %v", err), nil).dict4api)
+		return
+	}
+	naming := templateNaming{
+		Root:   strings.TrimSpace(r.FormValue("root")),
+		Prefix: r.FormValue("prefix"),
+		From:   r.FormValue("from"),
+		To:     r.FormValue("to"),
+	}
+	writeJSON(w, storage.instantiateTemplate(&tpl, strings.TrimSpace(r.FormValue("parent")), naming, boolFromParam(r.FormValue("dry_run"), false)))
+}
@@ -43,6 +43,7 @@ func runTestGeneric(states []string, durations []int, finalDict map[string]inter
 	tasksMu.Lock()
 	runningTestTasks[taskId] = task
 	tasksMu.Unlock()
+	logTestRunner.Info("test task started", "task_id", taskId, "states", states)
 
 	go func() {
 		for i, state := range states {
@@ -67,6 +68,7 @@ func runTestGeneric(states []string, durations []int, finalDict map[string]inter
 		delete(runningTestTasks, taskId)
 		finishedTasks[taskId] = task
 		tasksMu.Unlock()
+		logTestRunner.Info("test task finished", "task_id", taskId)
 	}()
 
 	return taskId
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/antchfx/xmlquery"
+)
+
+// universe.xml and catalogues.xml are edited by hand as much as through the API, so they are
+// written back the way they were read: comments, line breaks and indentation, attribute order,
+// the XML declaration (or its absence) and the byte order mark are kept, and an API edit
+// differs from the file only where it changed something. Elements the API adds are laid out
+// like their siblings.
+
+const utf8BOM = "\uFEFF"
+
+// parseXMLDocument parses a data file keeping what the parser would otherwise lose: the byte order
+// mark becomes a text node in front of the root, and the declaration the parser makes up for a file
+// without one is dropped.
+func parseXMLDocument(raw []byte) (*xmlquery.Node, error) {
+	hasBOM := bytes.HasPrefix(raw, []byte(utf8BOM))
+	raw = bytes.TrimPrefix(raw, []byte(utf8BOM))
+	doc, err := xmlquery.Parse(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(bytes.TrimLeft(raw, " \t\r\n"), []byte("<?xml")) {
+		if decl := doc.FirstChild; decl != nil && decl.Type == xmlquery.DeclarationNode && decl.FirstChild == nil {
+			xmlquery.RemoveFromTree(decl)
+		}
+	}
+	if hasBOM {
+		bom := &xmlquery.Node{Type: xmlquery.TextNode, Data: utf8BOM}
+		if doc.FirstChild == nil {
+			xmlquery.AddChild(doc, bom)
+		} else {
+			insertBefore(doc.FirstChild, bom)
+		}
+	}
+	return doc, nil
+}
+
+// insertBefore puts n into the tree as the previous sibling of ref.
+func insertBefore(ref, n *xmlquery.Node) {
+	n.Parent = ref.Parent
+	n.PrevSibling = ref.PrevSibling
+	n.NextSibling = ref
+	if ref.PrevSibling != nil {
+		ref.PrevSibling.NextSibling = n
+	} else if ref.Parent != nil {
+		ref.Parent.FirstChild = n
+	}
+	ref.PrevSibling = n
+}
+
+// isLayout tells the whitespace between tags from text.
+func isLayout(n *xmlquery.Node) bool {
+	return n != nil && n.Type == xmlquery.TextNode && n.Data != utf8BOM && strings.TrimSpace(n.Data) == ""
+}
+
+// lineIndent gives what follows the last line break of the layout, i.e. the indentation of the next tag.
+func lineIndent(n *xmlquery.Node) (string, bool) {
+	if !isLayout(n) {
+		return "", false
+	}
+	i := strings.LastIndex(n.Data, "\n")
+	if i < 0 {
+		return "", false
+	}
+	return n.Data[i+1:], true
+}
+
+// indentUnit is the indentation step of the document, the one of its root's first child.
+func indentUnit(n *xmlquery.Node) string {
+	for n.Parent != nil {
+		n = n.Parent
+	}
+	for root := n.FirstChild; root != nil; root = root.NextSibling {
+		if root.Type == xmlquery.ElementNode {
+			if unit, ok := lineIndent(root.FirstChild); ok && unit != "" {
+				return unit
+			}
+			break
+		}
+	}
+	return "  "
+}
+
+// appendChildLaidOut adds child as the last child of parent on a line of its own when parent's
+// children are laid out that way, or when parent is empty and sits on a line of its own.
+func appendChildLaidOut(parent, child *xmlquery.Node) {
+	closing, laidOut := lineIndent(parent.LastChild)
+	if !laidOut && parent.FirstChild == nil {
+		if own, ok := lineIndent(parent.PrevSibling); ok {
+			xmlquery.AddChild(parent, &xmlquery.Node{Type: xmlquery.TextNode, Data: "\n" + own})
+			closing, laidOut = own, true
+		}
+	}
+	if !laidOut {
+		xmlquery.AddChild(parent, child)
+		return
+	}
+
+	indent := closing + indentUnit(parent)
+	for n := parent.LastChild; n != nil; n = n.PrevSibling {
+		if n.Type == xmlquery.ElementNode || n.Type == xmlquery.CommentNode {
+			if own, ok := lineIndent(n.PrevSibling); ok {
+				indent = own
+			}
+			break
+		}
+	}
+	trailing := parent.LastChild
+	insertBefore(trailing, &xmlquery.Node{Type: xmlquery.TextNode, Data: "\n" + indent})
+	insertBefore(trailing, child)
+}
+
+var (
+	xmlTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", "]]>", "]]&gt;")
+	xmlAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\n", "&#10;", "\r", "&#13;", "\t", "&#9;")
+)
+
+// outputXMLDocument writes the node and everything below it as it was parsed. Of the layout left
+// around a removed element only the last piece is written, so removals leave no blank lines.
+func outputXMLDocument(n *xmlquery.Node) string {
+	var b strings.Builder
+	writeXMLNode(&b, n)
+	return b.String()
+}
+
+func writeXMLNode(b *strings.Builder, n *xmlquery.Node) {
+	switch n.Type {
+	case xmlquery.DocumentNode:
+		writeXMLChildren(b, n)
+		return
+	case xmlquery.TextNode:
+		if n.Data == utf8BOM {
+			b.WriteString(utf8BOM)
+		} else {
+			b.WriteString(xmlTextEscaper.Replace(n.Data))
+		}
+		return
+	case xmlquery.CharDataNode:
+		b.WriteString("<![CDATA[" + n.Data + "]]>")
+		return
+	case xmlquery.CommentNode:
+		b.WriteString("<!--" + n.Data + "-->")
+		return
+	case xmlquery.NotationNode:
+		b.WriteString("<!" + n.Data + ">")
+		return
+	case xmlquery.DeclarationNode:
+		b.WriteString("<?" + n.Data)
+		for _, a := range n.Attr {
+			b.WriteString(" " + xmlAttrName(a) + `="` + strings.Trim(a.Value, `'`) + `"`)
+		}
+		b.WriteString("?>")
+		return
+	}
+
+	name := n.Data
+	if n.Prefix != "" {
+		name = n.Prefix + ":" + n.Data
+	}
+	b.WriteString("<" + name)
+	for _, a := range n.Attr {
+		b.WriteString(" " + xmlAttrName(a) + `="` + xmlAttrEscaper.Replace(a.Value) + `"`)
+	}
+	if n.FirstChild == nil {
+		b.WriteString("/>")
+		return
+	}
+	b.WriteString(">")
+	writeXMLChildren(b, n)
+	b.WriteString("</" + name + ">")
+}
+
+func writeXMLChildren(b *strings.Builder, n *xmlquery.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if isLayout(c) && isLayout(c.NextSibling) {
+			continue
+		}
+		writeXMLNode(b, c)
+	}
+}
+
+func xmlAttrName(a xmlquery.Attr) string {
+	if a.Name.Space != "" {
+		return a.Name.Space + ":" + a.Name.Local
+	}
+	return a.Name.Local
+}
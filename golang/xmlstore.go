@@ -0,0 +1,803 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/antchfx/xmlquery"
+)
+
+// xmlStore keeps the data in the trees of universe.xml and catalogues.xml and changes them in
+// place, so that a save differs from the file only where the data changed. A store with no
+// directory lives in memory only, as the one of a sandbox does, and saves nothing.
+type xmlStore struct {
+	dir        string
+	uxml, cxml *xmlquery.Node
+	gen        uint64
+}
+
+const (
+	emptyUniverse   = "<universe>\n  <branches/>\n  <registers>\n    <people_register/>\n  </registers>\n</universe>\n"
+	emptyCatalogues = "<catalogues>\n  <functions_catalogue/>\n</catalogues>\n"
+)
+
+func newMemoryStore(uxml, cxml *xmlquery.Node) *xmlStore {
+	return &xmlStore{uxml: uxml, cxml: cxml}
+}
+
+// newEmptyMemoryStore gives a store in memory with no data, to copy entities into.
+func newEmptyMemoryStore() *xmlStore {
+	uxml, _ := parseXMLDocument([]byte(emptyUniverse))
+	cxml, _ := parseXMLDocument([]byte(emptyCatalogues))
+	return newMemoryStore(uxml, cxml)
+}
+
+func (s *xmlStore) describe() string {
+	if s.dir == "" {
+		return "xml:memory"
+	}
+	return "xml:" + s.dir
+}
+
+func (s *xmlStore) generation() uint64 {
+	return s.gen
+}
+
+func (s *xmlStore) check(doc string) error {
+	root := map[string]string{"universe.xml": "/universe", "catalogues.xml": "/catalogues"}[doc]
+	if root == "" {
+		return fmt.Errorf("unknown document %v", doc)
+	}
+	if queryOne(s.tree(doc), root) == nil {
+		return fmt.Errorf("%v is not loaded", doc)
+	}
+	return nil
+}
+
+func (s *xmlStore) tree(doc string) *xmlquery.Node {
+	if doc == "catalogues.xml" {
+		return s.cxml
+	}
+	return s.uxml
+}
+
+// reload re-reads both files and swaps them in only when both parsed fine, so that the
+// data is either the old or the new one but never a mix.
+func (s *xmlStore) reload() error {
+	if s.dir == "" {
+		return nil
+	}
+	uxml, err := loadXMLFile(filepath.Join(s.dir, "universe.xml"))
+	if err != nil {
+		return err
+	}
+	cxml, err := loadXMLFile(filepath.Join(s.dir, "catalogues.xml"))
+	if err != nil {
+		return err
+	}
+	s.uxml, s.cxml = uxml, cxml
+	s.gen++
+	return nil
+}
+
+func (s *xmlStore) save(doc string) error {
+	if s.dir == "" {
+		return nil
+	}
+	return writeXMLToFile(filepath.Join(s.dir, doc), s.tree(doc))
+}
+
+func (s *xmlStore) close() error {
+	return nil
+}
+
+func (s *xmlStore) replaceWith(src dataStore) error {
+	uxml, cxml, err := renderDocuments(src)
+	if err != nil {
+		return err
+	}
+	s.uxml, s.cxml = uxml, cxml
+	s.gen++
+	return nil
+}
+
+// changed marks a write for generation and passes its error on.
+func (s *xmlStore) changed(err error) error {
+	s.gen++
+	return err
+}
+
+func childElements(n *xmlquery.Node, tag string) []*xmlquery.Node {
+	ret := make([]*xmlquery.Node, 0)
+	if n == nil {
+		return ret
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == xmlquery.ElementNode && c.Data == tag {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+func childElement(n *xmlquery.Node, tag string) *xmlquery.Node {
+	if n == nil {
+		return nil
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == xmlquery.ElementNode && c.Data == tag {
+			return c
+		}
+	}
+	return nil
+}
+
+// sectionItems gives the elements of the tag in all the sections of n, as section/tag does.
+func sectionItems(n *xmlquery.Node, section, tag string) []*xmlquery.Node {
+	ret := make([]*xmlquery.Node, 0)
+	for _, sec := range childElements(n, section) {
+		ret = append(ret, childElements(sec, tag)...)
+	}
+	return ret
+}
+
+// section gives the first child element of n with the tag, added when there is none.
+func section(n *xmlquery.Node, tag string) *xmlquery.Node {
+	if sec := childElement(n, tag); sec != nil {
+		return sec
+	}
+	return appendElement(n, tag)
+}
+
+func attrPairsOf(n *xmlquery.Node) attrPairs {
+	ret := make(attrPairs, 0, 2*len(n.Attr))
+	for _, a := range n.Attr {
+		ret = append(ret, a.Name.Local, a.Value)
+	}
+	return ret
+}
+
+// parentBranchNode gives the nearest enclosing branch; the ancestor axis of xmlquery
+// lists the nearest ancestor first, unlike lxml, so it is walked explicitly.
+func parentBranchNode(branchNode *xmlquery.Node) *xmlquery.Node {
+	for p := branchNode.Parent; p != nil; p = p.Parent {
+		if p.Type == xmlquery.ElementNode && p.Data == "branch" {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *xmlStore) universe() *xmlquery.Node {
+	if root := childElement(s.uxml, "universe"); root != nil {
+		return root
+	}
+	return appendElement(s.uxml, "universe")
+}
+
+func (s *xmlStore) branchNodes() []*xmlquery.Node {
+	return queryAll(s.uxml, "//branch")
+}
+
+// branchNode gives the first branch with the id, as the lookups always did.
+func (s *xmlStore) branchNode(id string) *xmlquery.Node {
+	for _, br := range s.branchNodes() {
+		if br.SelectAttr("id") == id {
+			return br
+		}
+	}
+	return nil
+}
+
+func (s *xmlStore) knownBranch(id string) (*xmlquery.Node, error) {
+	if br := s.branchNode(id); br != nil {
+		return br, nil
+	}
+	return nil, fmt.Errorf("branch %v is unknown", id)
+}
+
+func (s *xmlStore) branches() []branchRecord {
+	ret := make([]branchRecord, 0)
+	for _, br := range s.branchNodes() {
+		b := branchRecord{ID: br.SelectAttr("id")}
+		if p := parentBranchNode(br); p != nil {
+			b.Parent = p.SelectAttr("id")
+		}
+		if wl := childElement(br, "func_white_list"); wl != nil {
+			b.Whitelist = &whitelistRecord{PropagateParent: wl.SelectAttr("propagateParent"), Funcsets: attrValues(childElements(wl, "funcset"), "id")}
+		}
+		ret = append(ret, b)
+	}
+	return ret
+}
+
+func (s *xmlStore) putBranch(b branchRecord) error {
+	var parent *xmlquery.Node
+	container := section(s.universe(), "branches")
+	if b.Parent != "" {
+		var err error
+		if parent, err = s.knownBranch(b.Parent); err != nil {
+			return err
+		}
+		container = section(parent, "branches")
+	}
+
+	br := s.branchNode(b.ID)
+	if br == nil {
+		br = appendElement(container, "branch", "id", b.ID)
+		if b.Whitelist != nil {
+			setWhitelist(br, b.Whitelist)
+		}
+		for _, tag := range []string{"employees", "roles", "deffuncsets", "branches"} {
+			appendElement(br, tag)
+		}
+		return s.changed(nil)
+	}
+
+	if parentBranchNode(br) != parent {
+		for anc := parent; anc != nil; anc = parentBranchNode(anc) {
+			if anc == br {
+				return fmt.Errorf("branch %v cannot be moved under itself or its subbranch %v", b.ID, b.Parent)
+			}
+		}
+		xmlquery.RemoveFromTree(br)
+		appendChildLaidOut(container, br)
+	}
+	if b.Whitelist != nil {
+		setWhitelist(br, b.Whitelist)
+	} else if wl := childElement(br, "func_white_list"); wl != nil {
+		xmlquery.RemoveFromTree(wl)
+	}
+	return s.changed(nil)
+}
+
+func setWhitelist(br *xmlquery.Node, wl *whitelistRecord) {
+	n := childElement(br, "func_white_list")
+	if n == nil {
+		n = appendElement(br, "func_white_list")
+	}
+	syncAttrs(n, []string{"propagateParent", wl.PropagateParent}, true)
+	reconcileElements(n, *idList("funcset", wl.Funcsets))
+}
+
+func (s *xmlStore) renameBranch(id, newID string) error {
+	br, err := s.knownBranch(id)
+	if err != nil {
+		return err
+	}
+	if s.branchNode(newID) != nil {
+		return fmt.Errorf("branch %v already exists", newID)
+	}
+	br.SetAttr("id", newID)
+	return s.changed(nil)
+}
+
+func (s *xmlStore) deleteBranch(id string) error {
+	br, err := s.knownBranch(id)
+	if err != nil {
+		return err
+	}
+	xmlquery.RemoveFromTree(br)
+	return s.changed(nil)
+}
+
+func (s *xmlStore) funcsetNodes() []*xmlquery.Node {
+	ret := make([]*xmlquery.Node, 0)
+	for _, br := range s.branchNodes() {
+		ret = append(ret, sectionItems(br, "deffuncsets", "funcset")...)
+	}
+	return ret
+}
+
+func (s *xmlStore) funcsets() []funcsetRecord {
+	ret := make([]funcsetRecord, 0)
+	for _, fs := range s.funcsetNodes() {
+		ret = append(ret, funcsetRecord{
+			ID:        fs.SelectAttr("id"),
+			Branch:    fs.Parent.Parent.SelectAttr("id"),
+			Name:      fs.SelectAttr("name"),
+			Functions: attrValues(childElements(fs, "func"), "id"),
+		})
+	}
+	return ret
+}
+
+func (s *xmlStore) funcsetNode(id string) *xmlquery.Node {
+	for _, fs := range s.funcsetNodes() {
+		if fs.SelectAttr("id") == id {
+			return fs
+		}
+	}
+	return nil
+}
+
+func (s *xmlStore) putFuncset(fs funcsetRecord) error {
+	n := s.funcsetNode(fs.ID)
+	if n == nil || (fs.Branch != "" && n.Parent.Parent.SelectAttr("id") != fs.Branch) {
+		br, err := s.knownBranch(fs.Branch)
+		if err != nil {
+			return err
+		}
+		if n == nil {
+			n = appendElement(section(br, "deffuncsets"), "funcset", "id", fs.ID, "name", fs.Name)
+		} else {
+			xmlquery.RemoveFromTree(n)
+			appendChildLaidOut(section(br, "deffuncsets"), n)
+		}
+	}
+	syncAttrs(n, []string{"id", fs.ID, "name", fs.Name}, true)
+	reconcileElements(n, *idList("func", fs.Functions))
+	return s.changed(nil)
+}
+
+func (s *xmlStore) deleteFuncset(id string) error {
+	n := s.funcsetNode(id)
+	if n == nil {
+		return fmt.Errorf("funcset %v is unknown", id)
+	}
+	xmlquery.RemoveFromTree(n)
+	return s.changed(nil)
+}
+
+func (s *xmlStore) roles() []roleRecord {
+	ret := make([]roleRecord, 0)
+	for _, br := range s.branchNodes() {
+		for _, role := range sectionItems(br, "roles", "role") {
+			ret = append(ret, roleRecord{Branch: br.SelectAttr("id"), Name: role.SelectAttr("name"), Funcsets: attrValues(childElements(role, "funcset"), "id")})
+		}
+	}
+	return ret
+}
+
+func roleNode(br *xmlquery.Node, name string) *xmlquery.Node {
+	for _, role := range sectionItems(br, "roles", "role") {
+		if role.SelectAttr("name") == name {
+			return role
+		}
+	}
+	return nil
+}
+
+func (s *xmlStore) putRole(r roleRecord) error {
+	br, err := s.knownBranch(r.Branch)
+	if err != nil {
+		return err
+	}
+	n := roleNode(br, r.Name)
+	if n == nil {
+		n = appendElement(section(br, "roles"), "role", "name", r.Name)
+	} else {
+		syncAttrs(n, []string{"name", r.Name}, true)
+	}
+	reconcileElements(n, *idList("funcset", r.Funcsets))
+	return s.changed(nil)
+}
+
+func (s *xmlStore) deleteRole(branch, name string) error {
+	br, err := s.knownBranch(branch)
+	if err != nil {
+		return err
+	}
+	n := roleNode(br, name)
+	if n == nil {
+		return fmt.Errorf("role %v is not defined in branch %v", name, branch)
+	}
+	xmlquery.RemoveFromTree(n)
+	return s.changed(nil)
+}
+
+func (s *xmlStore) positions() []positionRecord {
+	ret := make([]positionRecord, 0)
+	for _, br := range s.branchNodes() {
+		for i, emp := range sectionItems(br, "employees", "employee") {
+			ret = append(ret, positionRecord{Branch: br.SelectAttr("id"), Seq: i, Attrs: attrPairsOf(emp)})
+		}
+	}
+	return ret
+}
+
+func (s *xmlStore) positionNode(branch string, seq int) (*xmlquery.Node, error) {
+	br, err := s.knownBranch(branch)
+	if err != nil {
+		return nil, err
+	}
+	emps := sectionItems(br, "employees", "employee")
+	if seq < 0 || seq >= len(emps) {
+		return nil, fmt.Errorf("branch %v has no position #%d", branch, seq)
+	}
+	return emps[seq], nil
+}
+
+func (s *xmlStore) addPosition(p positionRecord) error {
+	br, err := s.knownBranch(p.Branch)
+	if err != nil {
+		return err
+	}
+	appendElement(section(br, "employees"), "employee", p.Attrs...)
+	return s.changed(nil)
+}
+
+func (s *xmlStore) setPosition(p positionRecord) error {
+	n, err := s.positionNode(p.Branch, p.Seq)
+	if err != nil {
+		return err
+	}
+	syncAttrs(n, p.Attrs, true)
+	return s.changed(nil)
+}
+
+func (s *xmlStore) deletePosition(branch string, seq int) error {
+	n, err := s.positionNode(branch, seq)
+	if err != nil {
+		return err
+	}
+	xmlquery.RemoveFromTree(n)
+	return s.changed(nil)
+}
+
+func (s *xmlStore) properties() []propertyRecord {
+	ret := make([]propertyRecord, 0)
+	for _, br := range s.branchNodes() {
+		for _, prop := range sectionItems(br, "defproperties", "property") {
+			p := propertyRecord{Branch: br.SelectAttr("id"), Name: prop.SelectAttr("name"), Variants: []string{}}
+			for _, v := range childElements(prop, "variant") {
+				p.Variants = append(p.Variants, strings.TrimSpace(v.InnerText()))
+			}
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+func propertyNode(br *xmlquery.Node, name string) *xmlquery.Node {
+	for _, prop := range sectionItems(br, "defproperties", "property") {
+		if prop.SelectAttr("name") == name {
+			return prop
+		}
+	}
+	return nil
+}
+
+func (s *xmlStore) putProperty(p propertyRecord) error {
+	br, err := s.knownBranch(p.Branch)
+	if err != nil {
+		return err
+	}
+	n := propertyNode(br, p.Name)
+	if n == nil {
+		n = appendElement(section(br, "defproperties"), "property", "name", p.Name)
+	} else {
+		syncAttrs(n, []string{"name", p.Name}, true)
+	}
+	variants := xmlList{tag: "variant"}
+	for i := range p.Variants {
+		variants.items = append(variants.items, xmlItem{text: &p.Variants[i]})
+	}
+	reconcileElements(n, variants)
+	return s.changed(nil)
+}
+
+func (s *xmlStore) deleteProperty(branch, name string) error {
+	br, err := s.knownBranch(branch)
+	if err != nil {
+		return err
+	}
+	n := propertyNode(br, name)
+	if n == nil {
+		return fmt.Errorf("property %v is not defined in branch %v", name, branch)
+	}
+	xmlquery.RemoveFromTree(n)
+	return s.changed(nil)
+}
+
+func (s *xmlStore) agentSchemas() []agentSchemaRecord {
+	ret := make([]agentSchemaRecord, 0)
+	for _, br := range s.branchNodes() {
+		sch := childElement(br, "agentattrs")
+		if sch == nil {
+			continue
+		}
+		rec := agentSchemaRecord{Branch: br.SelectAttr("id"), Strict: sch.SelectAttr("strict") == "yes", Attrs: []jsonAgentAttrDecl{}}
+		for _, decl := range childElements(sch, "attr") {
+			rec.Attrs = append(rec.Attrs, jsonAgentAttrDecl{Name: decl.SelectAttr("name"), Type: decl.SelectAttr("type"), Required: decl.SelectAttr("required") == "yes"})
+		}
+		ret = append(ret, rec)
+	}
+	return ret
+}
+
+func (s *xmlStore) putAgentSchema(sch agentSchemaRecord) error {
+	br, err := s.knownBranch(sch.Branch)
+	if err != nil {
+		return err
+	}
+	n := section(br, "agentattrs")
+	syncAttrs(n, []string{"strict", boolToYesNo(sch.Strict)}, true)
+	decls := xmlList{tag: "attr", key: "name"}
+	for _, d := range sch.Attrs {
+		decls.items = append(decls.items, xmlItem{attrs: []string{"name", d.Name, "type", d.Type, "required", boolToYesNo(d.Required)}})
+	}
+	reconcileElements(n, decls)
+	return s.changed(nil)
+}
+
+func (s *xmlStore) deleteAgentSchema(branch string) error {
+	br, err := s.knownBranch(branch)
+	if err != nil {
+		return err
+	}
+	n := childElement(br, "agentattrs")
+	if n == nil {
+		return fmt.Errorf("branch %v has no agent schema", branch)
+	}
+	xmlquery.RemoveFromTree(n)
+	return s.changed(nil)
+}
+
+func (s *xmlStore) peopleRegister() *xmlquery.Node {
+	return section(section(s.universe(), "registers"), "people_register")
+}
+
+func (s *xmlStore) personNodes() []*xmlquery.Node {
+	return queryAll(s.uxml, "/universe/registers/people_register/person")
+}
+
+func (s *xmlStore) personNode(id string) *xmlquery.Node {
+	for _, p := range s.personNodes() {
+		if p.SelectAttr("id") == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *xmlStore) persons() []personRecord {
+	ret := make([]personRecord, 0)
+	for _, n := range s.personNodes() {
+		p := personRecord{Attrs: attrPairsOf(n), Changes: []attrPairs{}}
+		for _, ch := range childElements(n, "changed") {
+			p.Changes = append(p.Changes, attrPairsOf(ch))
+		}
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+func (s *xmlStore) putPerson(p personRecord) error {
+	n := s.personNode(p.id())
+	if n == nil {
+		n = appendElement(s.peopleRegister(), "person", p.Attrs...)
+	} else {
+		syncAttrs(n, p.Attrs, true)
+	}
+	changes := xmlList{tag: "changed"}
+	for _, ch := range p.Changes {
+		changes.items = append(changes.items, xmlItem{attrs: ch})
+	}
+	reconcileElements(n, changes)
+	return s.changed(nil)
+}
+
+func (s *xmlStore) deletePerson(id string) error {
+	n := s.personNode(id)
+	if n == nil {
+		return fmt.Errorf("person %v is unknown", id)
+	}
+	xmlquery.RemoveFromTree(n)
+	return s.changed(nil)
+}
+
+func (s *xmlStore) functionNodes() []*xmlquery.Node {
+	return queryAll(s.cxml, "/catalogues/functions_catalogue/function")
+}
+
+func (s *xmlStore) functionNode(id string) *xmlquery.Node {
+	for _, fn := range s.functionNodes() {
+		if fn.SelectAttr("id") == id {
+			return fn
+		}
+	}
+	return nil
+}
+
+func (s *xmlStore) functions() []functionRecord {
+	ret := make([]functionRecord, 0)
+	for _, fn := range s.functionNodes() {
+		ret = append(ret, functionRecord{ID: fn.SelectAttr("id"), Def: fn})
+	}
+	return ret
+}
+
+func (s *xmlStore) function(id string) (functionRecord, bool) {
+	if fn := s.functionNode(id); fn != nil {
+		return functionRecord{ID: id, Def: fn}, true
+	}
+	return functionRecord{}, false
+}
+
+func (s *xmlStore) putFunction(def *xmlquery.Node) error {
+	old := s.functionNode(def.SelectAttr("id"))
+	if old == def {
+		return s.changed(nil)
+	}
+	if def.Parent != nil {
+		xmlquery.RemoveFromTree(def)
+	}
+	if old != nil {
+		insertBefore(old, def)
+		xmlquery.RemoveFromTree(old)
+		return s.changed(nil)
+	}
+	catalogues := childElement(s.cxml, "catalogues")
+	if catalogues == nil {
+		catalogues = appendElement(s.cxml, "catalogues")
+	}
+	appendChildLaidOut(section(catalogues, "functions_catalogue"), def)
+	return s.changed(nil)
+}
+
+func (s *xmlStore) deleteFunction(id string) error {
+	n := s.functionNode(id)
+	if n == nil {
+		return fmt.Errorf("function %v is unknown", id)
+	}
+	xmlquery.RemoveFromTree(n)
+	return s.changed(nil)
+}
+
+func (s *xmlStore) registerNodes(register string) []*xmlquery.Node {
+	return childElements(childElement(childElement(childElement(s.uxml, "universe"), "registers"), register), registerTags[register])
+}
+
+func (s *xmlStore) registerEntries(register string) []attrPairs {
+	ret := make([]attrPairs, 0)
+	for _, n := range s.registerNodes(register) {
+		ret = append(ret, attrPairsOf(n))
+	}
+	return ret
+}
+
+func (s *xmlStore) registerNode(register, id string) *xmlquery.Node {
+	for _, n := range s.registerNodes(register) {
+		if n.SelectAttr("id") == id {
+			return n
+		}
+	}
+	return nil
+}
+
+func (s *xmlStore) putRegisterEntry(register string, e attrPairs) error {
+	tag, ok := registerTags[register]
+	if !ok {
+		return fmt.Errorf("unknown register %v", register)
+	}
+	if n := s.registerNode(register, e.get("id")); n != nil {
+		syncAttrs(n, e, true)
+	} else {
+		appendElement(section(section(s.universe(), "registers"), register), tag, e...)
+	}
+	return s.changed(nil)
+}
+
+func (s *xmlStore) deleteRegisterEntry(register, id string) error {
+	n := s.registerNode(register, id)
+	if n == nil {
+		return fmt.Errorf("%v has no entry %v", register, id)
+	}
+	xmlquery.RemoveFromTree(n)
+	return s.changed(nil)
+}
+
+func attrValues(nodes []*xmlquery.Node, attr string) []string {
+	ret := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		ret = append(ret, n.SelectAttr(attr))
+	}
+	return ret
+}
+
+// appendElement adds an element with the attributes given as name, value pairs in that order; empty values are left out.
+func appendElement(parent *xmlquery.Node, name string, attrs ...string) *xmlquery.Node {
+	el := &xmlquery.Node{Type: xmlquery.ElementNode, Data: name}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if attrs[i+1] != "" {
+			el.SetAttr(attrs[i], attrs[i+1])
+		}
+	}
+	appendChildLaidOut(parent, el)
+	return el
+}
+
+// syncAttrs gives n the attributes of the name, value pairs keeping the order of those it already has;
+// with exact the attributes not given are removed, except the kept ones. Empty values count as not given.
+func syncAttrs(n *xmlquery.Node, pairs []string, exact bool, keep ...string) {
+	given := map[string]struct{}{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			given[pairs[i]] = struct{}{}
+		}
+	}
+	kept := mapSet(keep...)
+	for _, a := range append([]xmlquery.Attr(nil), n.Attr...) {
+		if !exact || hasKey(given, a.Name.Local) || hasKey(kept, a.Name.Local) {
+			continue
+		}
+		n.RemoveAttr(a.Name.Local)
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			n.SetAttr(pairs[i], pairs[i+1])
+		}
+	}
+}
+
+// xmlList describes the wanted elements of one tag below a node. Elements are matched to the
+// existing ones by the key attribute, or by position without a key, so that what is already
+// there is changed in place and the comments and layout around it stay.
+type xmlList struct {
+	tag   string
+	key   string
+	items []xmlItem
+}
+
+type xmlItem struct {
+	attrs []string
+	text  *string
+	below *xmlList
+}
+
+// reconcileElements makes the elements of list.tag below parent those of the list, keeping other children.
+func reconcileElements(parent *xmlquery.Node, list xmlList) {
+	existing := make([]*xmlquery.Node, 0)
+	for c := parent.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == xmlquery.ElementNode && c.Data == list.tag {
+			existing = append(existing, c)
+		}
+	}
+	used := map[*xmlquery.Node]bool{}
+	for i, it := range list.items {
+		var n *xmlquery.Node
+		if list.key == "" {
+			if i < len(existing) {
+				n = existing[i]
+			}
+		} else {
+			for _, e := range existing {
+				if !used[e] && e.SelectAttr(list.key) == pairValue(it.attrs, list.key) {
+					n = e
+					break
+				}
+			}
+		}
+		if n == nil {
+			n = appendElement(parent, list.tag, it.attrs...)
+		} else {
+			syncAttrs(n, it.attrs, true)
+		}
+		used[n] = true
+		if it.text != nil && strings.TrimSpace(n.InnerText()) != *it.text {
+			for c := n.FirstChild; c != nil; c = n.FirstChild {
+				xmlquery.RemoveFromTree(c)
+			}
+			xmlquery.AddChild(n, &xmlquery.Node{Type: xmlquery.TextNode, Data: *it.text})
+		}
+		if it.below != nil {
+			reconcileElements(n, *it.below)
+		}
+	}
+	for _, e := range existing {
+		if !used[e] {
+			xmlquery.RemoveFromTree(e)
+		}
+	}
+}
+
+// idList describes references by id, which are matched by position so that they keep the order given.
+func idList(tag string, ids []string) *xmlList {
+	ret := &xmlList{tag: tag}
+	for _, id := range ids {
+		ret.items = append(ret.items, xmlItem{attrs: []string{"id", id}})
+	}
+	return ret
+}